@@ -23,6 +23,9 @@ func Socket(sockType socket.SocketType) (socket.SockID, error) {
 	return resp.SockID, resp.Err
 }
 
+// Connect opens a connection to dest on a stream socket. On a datagram
+// socket it fixes the peer, Write sends to it, and datagrams from any
+// other address are dropped.
 func Connect(sock socket.SockID, dest string) error {
 	// parse the destination address
 	destAddr, err := socket.ParseSockAddr(dest)
@@ -46,6 +49,43 @@ func Connect(sock socket.SockID, dest string) error {
 	return resp.Err
 }
 
+// Listen marks a stream socket as accepting connections. Up to backlog
+// connections wait to be accepted, 0 uses the default.
+func Listen(sockID socket.SockID, backlog int) error {
+	// Create a listen request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallListen,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+		Backlog:     backlog,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// Accept waits for a connection on a listening socket, and returns
+// a new socket for the connection and the address of the peer
+func Accept(sockID socket.SockID) (socket.SockID, SockAddr, error) {
+	// Create an accept request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallAccept,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return "", SockAddr{}, err
+	}
+
+	return resp.SockID, SockAddr(resp.Addr), resp.Err
+}
+
 func Write(sock socket.SockID, data []byte, flags int) error {
 	// Create a write request object
 	req := socket.SockSyscallRequest{
@@ -64,6 +104,9 @@ func Write(sock socket.SockID, data []byte, flags int) error {
 	return resp.Err
 }
 
+// WriteTo sends data to dest. A stream socket that isn't connected yet
+// connects to dest with TCP Fast Open, sending data in its SYN if the
+// server gave it a cookie before.
 func WriteTo(sockID socket.SockID, data []byte, flags int, dest SockAddr) error {
 	// Create a write request object
 	req := socket.SockSyscallRequest{
@@ -105,6 +148,82 @@ func Read(sock socket.SockID, data *[]byte) error {
 	return resp.Err
 }
 
+// Recv reads from the socket like Read. With MSG_OOB it returns the
+// urgent byte of a TCP connection instead, without waiting for it.
+func Recv(sock socket.SockID, data *[]byte, flags int) error {
+	// Create a read request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallRead,
+		SockID:      sock,
+		SockType:    sock.GetSocketType(),
+		Flags:       flags,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	// copy response to data buffer
+	*data = resp.Data
+
+	return resp.Err
+}
+
+// ReadFrom reads one datagram from a datagram socket, with the address
+// it came from to reply to, and the interface it arrived on. A datagram
+// larger than size is cut off and Truncated is set, 0 takes any size.
+func ReadFrom(sock socket.SockID, size int) (Datagram, error) {
+	// Create a readfrom request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallReadFrom,
+		SockID:      sock,
+		SockType:    sock.GetSocketType(),
+		Size:        size,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return Datagram{}, err
+	}
+
+	dgram := Datagram{
+		Data:      resp.Data,
+		From:      resp.Addr,
+		Iface:     resp.Iface,
+		Truncated: resp.Truncated,
+		Control:   resp.Control,
+	}
+
+	return dgram, resp.Err
+}
+
+// ReadMsg reads from the socket like Read, and also returns the ancillary
+// data for the packet if the socket has IP_RECVTOS or IP_RECVTTL set.
+// control is left untouched when there is no ancillary data.
+func ReadMsg(sock socket.SockID, data *[]byte, control *ControlMessage) error {
+	// Create a read request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallRead,
+		SockID:      sock,
+		SockType:    sock.GetSocketType(),
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	// copy response to data buffer
+	*data = resp.Data
+
+	if resp.Control != nil && control != nil {
+		*control = *resp.Control
+	}
+
+	return resp.Err
+}
+
 func Bind(sockID socket.SockID, addr SockAddr) error {
 	// Create a bind request object
 	req := socket.SockSyscallRequest{
@@ -137,3 +256,133 @@ func Close(sockID socket.SockID) error {
 
 	return resp.Err
 }
+
+// Shutdown closes a connection for reading (SHUT_RD), writing (SHUT_WR)
+// or both (SHUT_RDWR). Closing it for writing sends a FIN, and the peer's
+// data can still be read.
+func Shutdown(sockID socket.SockID, how socket.ShutdownHow) error {
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallShutdown,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+		How:         how,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// SetSockOptInt sets an integer valued socket option
+func SetSockOptInt(sockID socket.SockID, level socket.SockOptLevel, opt socket.SockOptName, value int) error {
+	// Create a setsockopt request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallSetSockOpt,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+		OptLevel:    level,
+		OptName:     opt,
+		OptValue:    value,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// SetSockOptBytes sets a socket option whose value is a byte buffer,
+// such as IP_OPTIONS
+func SetSockOptBytes(sockID socket.SockID, level socket.SockOptLevel, opt socket.SockOptName, value []byte) error {
+	// Create a setsockopt request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallSetSockOpt,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+		OptLevel:    level,
+		OptName:     opt,
+		Data:        value,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// SetTCPCongestionControl selects the congestion control algorithm,
+// "reno" or "cubic", for new TCP connections. Sockets can choose their
+// own with the TCP_CONGESTION option.
+func SetTCPCongestionControl(name string) error {
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallTCPCongestion,
+		Data:        []byte(name),
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// GetTCPCongestionControl returns the congestion control algorithm
+// for new TCP connections
+func GetTCPCongestionControl() (string, error) {
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallTCPCongestion,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return "", err
+	}
+
+	return string(resp.Data), resp.Err
+}
+
+// GetTCPInfo returns the state and stats of a TCP connection, like
+// getsockopt with TCP_INFO
+func GetTCPInfo(sockID socket.SockID) (TCPInfo, error) {
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallGetSockOpt,
+		SockID:      sockID,
+		SockType:    sockID.GetSocketType(),
+		OptLevel:    socket.SockOptLevelTCP,
+		OptName:     socket.SockOptTCPInfo,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return TCPInfo{}, err
+	}
+
+	if resp.TCPInfo == nil {
+		return TCPInfo{}, resp.Err
+	}
+
+	return *resp.TCPInfo, resp.Err
+}
+
+// TCPConnList returns the state and stats of all TCP connections
+// and listeners of the stack, like ss -tai
+func TCPConnList() ([]TCPInfo, error) {
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallTCPConnList,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.TCPConns, resp.Err
+}
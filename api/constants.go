@@ -2,7 +2,9 @@ package api
 
 import (
 	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/netfilter"
 	"github.com/mattcarp12/matnet/netstack/socket"
+	"github.com/mattcarp12/matnet/netstack/transportlayer"
 )
 
 // Socket type constants
@@ -12,9 +14,110 @@ const (
 	SOCK_RAW    = socket.SocketTypeRaw
 )
 
+// Socket option levels
+const (
+	SOL_SOCKET  = socket.SockOptLevelSocket
+	IPPROTO_IP  = socket.SockOptLevelIP
+	IPPROTO_TCP = socket.SockOptLevelTCP
+)
+
+// Socket options
+const (
+	IP_TOS     = socket.SockOptIPTOS
+	IP_TTL     = socket.SockOptIPTTL
+	IP_OPTIONS = socket.SockOptIPOptions
+	IP_RECVTTL = socket.SockOptIPRecvTTL
+	IP_RECVTOS = socket.SockOptIPRecvTOS
+
+	SO_KEEPALIVE = socket.SockOptKeepAlive
+	SO_OOBINLINE = socket.SockOptOOBInline
+	SO_LINGER    = socket.SockOptLinger
+
+	TCP_NODELAY    = socket.SockOptTCPNoDelay
+	TCP_CORK       = socket.SockOptTCPCork
+	TCP_KEEPIDLE   = socket.SockOptTCPKeepIdle
+	TCP_KEEPINTVL  = socket.SockOptTCPKeepIntvl
+	TCP_KEEPCNT    = socket.SockOptTCPKeepCnt
+	TCP_INFO       = socket.SockOptTCPInfo
+	TCP_CONGESTION = socket.SockOptTCPCongestion
+	TCP_FASTOPEN   = socket.SockOptTCPFastOpen
+)
+
+// Flags of Write and Recv
+const (
+	MSG_OOB = socket.MsgOOB
+)
+
+// Shutdown directions
+const (
+	SHUT_RD   = socket.ShutdownRead
+	SHUT_WR   = socket.ShutdownWrite
+	SHUT_RDWR = socket.ShutdownBoth
+)
+
+// ECN codepoints, the low two bits of IP_TOS
+const (
+	IPTOS_ECN_NOT_ECT = netstack.ECNNotECT
+	IPTOS_ECN_ECT1    = netstack.ECNECT1
+	IPTOS_ECN_ECT0    = netstack.ECNECT0
+	IPTOS_ECN_CE      = netstack.ECNCE
+	IPTOS_ECN_MASK    = netstack.ECNMask
+)
+
 /*
 	The user should only need to import the api package,
 	so the following are re-exported.
 */
 
 type SockAddr netstack.SockAddr
+
+type ControlMessage = socket.ControlMessage
+
+// Datagram is a datagram read with ReadFrom, with its sender
+type Datagram = socket.Datagram
+
+// TCPInfo is the state and stats of a TCP connection
+type TCPInfo = transportlayer.TCPStats
+
+// Packet filter types
+type (
+	FilterRule   = netfilter.Rule
+	FilterAction = netfilter.Action
+	Chain        = netstack.Hook
+	PortRange    = netfilter.PortRange
+
+	ConntrackEntry = netfilter.Conn
+	NATRule        = netfilter.NATRule
+)
+
+// Packet filter chains
+const (
+	PREROUTING  = netstack.HookPrerouting
+	INPUT       = netstack.HookInput
+	FORWARD     = netstack.HookForward
+	OUTPUT      = netstack.HookOutput
+	POSTROUTING = netstack.HookPostrouting
+)
+
+// Packet filter actions
+const (
+	ACCEPT = netfilter.ActionAccept
+	DROP   = netfilter.ActionDrop
+	REJECT = netfilter.ActionReject
+	LOG    = netfilter.ActionLog
+)
+
+// NAT rule types
+const (
+	SNAT       = netfilter.NATSource
+	MASQUERADE = netfilter.NATMasquerade
+	DNAT       = netfilter.NATDestination
+)
+
+// Connection states for filter rules
+const (
+	StateNew         = netstack.ConnStateNew
+	StateEstablished = netstack.ConnStateEstablished
+	StateRelated     = netstack.ConnStateRelated
+	StateInvalid     = netstack.ConnStateInvalid
+)
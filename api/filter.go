@@ -0,0 +1,148 @@
+package api
+
+import (
+	"github.com/mattcarp12/matnet/netstack/socket"
+)
+
+// FilterAdd appends a rule to the packet filter and returns its ID.
+// The filter sees IPv4 packets only, ARP is never filtered.
+func FilterAdd(rule FilterRule) (int, error) {
+	// Create a filter request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallFilterAdd,
+		Rule:        &rule,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.RuleID, resp.Err
+}
+
+// FilterDelete removes a rule from the packet filter
+func FilterDelete(ruleID int) error {
+	// Create a filter request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallFilterDelete,
+		RuleID:      ruleID,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// FilterList returns all packet filter rules, with their counters
+func FilterList() ([]FilterRule, error) {
+	// Create a filter request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallFilterList,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Rules, resp.Err
+}
+
+// FilterFlush removes all rules from a chain
+func FilterFlush(chain Chain) error {
+	// Create a filter request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallFilterFlush,
+		Chain:       chain,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// FilterSetPolicy sets the policy of a chain to ACCEPT or DROP
+func FilterSetPolicy(chain Chain, policy FilterAction) error {
+	// Create a filter request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallFilterPolicy,
+		Chain:       chain,
+		Policy:      policy,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// ConntrackList returns the connections tracked by the stack
+func ConntrackList() ([]ConntrackEntry, error) {
+	// Create a conntrack request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallConntrackList,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Conns, resp.Err
+}
+
+// NATAdd appends a NAT rule and returns its ID
+func NATAdd(rule NATRule) (int, error) {
+	// Create a NAT request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallNATAdd,
+		NATRule:     &rule,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.RuleID, resp.Err
+}
+
+// NATDelete removes a NAT rule
+func NATDelete(ruleID int) error {
+	// Create a NAT request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallNATDelete,
+		RuleID:      ruleID,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Err
+}
+
+// NATList returns all NAT rules, with their counters
+func NATList() ([]NATRule, error) {
+	// Create a NAT request object
+	req := socket.SockSyscallRequest{
+		SyscallType: socket.SyscallNATList,
+	}
+
+	resp, err := ipcSendRecv(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.NATRules, resp.Err
+}
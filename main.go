@@ -1,7 +1,9 @@
 package main
 
 import (
+	"github.com/mattcarp12/matnet/netstack"
 	"github.com/mattcarp12/matnet/netstack/linklayer"
+	"github.com/mattcarp12/matnet/netstack/netfilter"
 	"github.com/mattcarp12/matnet/netstack/networklayer"
 	"github.com/mattcarp12/matnet/netstack/socket"
 	"github.com/mattcarp12/matnet/netstack/transportlayer"
@@ -13,14 +15,20 @@ func main() {
 	// Initialize the link layer
 	link, routing_table := linklayer.Init()
 
+	// Initialize the hooks for the packet filter
+	hooks := netstack.NewHooks()
+
 	// Initialize the network layer
-	net := networklayer.Init(link)
+	net := networklayer.Init(link, routing_table, hooks)
 
 	// Initialize the transport layer
 	transport := transportlayer.Init(net)
 
+	// Initialize connection tracking and the packet filter
+	nf := netfilter.Init(hooks)
+
 	// Initialize the socket manager
-	socket_layer := socket.Init(transport, routing_table)
+	socket_layer := socket.Init(transport, routing_table, nf)
 
 	// Initialize the IPC server
 	socket.IpcInit(socket_layer)
@@ -4,4 +4,7 @@ const (
 	DefaultIPAddr  = "10.88.45.69"
 	DefaultGateway = "10.88.45.1"
 	DefaultMACAddr = "DE:AD:BE:EF:DE:AD"
+
+	// Route packets between interfaces
+	DefaultIPForwarding = false
 )
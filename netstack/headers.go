@@ -36,20 +36,22 @@ func Checksum(data []byte) uint16 {
 		length = len(data)
 	)
 
-	// make length multiple of 2
-	if length%2 != 0 {
-		data = append(data, 0)
-		length++
-	}
-
 	// sum the 16-bit words
-	for index < length {
+	for index+1 < length {
 		sum += uint32(data[index])<<8 + uint32(data[index+1])
 		index += 2
 	}
 
-	// add top 16 bits to bottom 16 bits
-	sum = (sum >> 16) + (sum & 0xffff)
+	// an odd byte at the end is padded with zero
+	if length%2 != 0 {
+		sum += uint32(data[length-1]) << 8
+	}
+
+	// add the carries from the top 16 bits to the bottom 16 bits,
+	// until there are none
+	for sum>>16 != 0 {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
 
 	// return 1's complement of sum
 	return uint16(^sum)
@@ -0,0 +1,174 @@
+package netstack
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// =============================================================================
+// Hooks are the points in the IP path where packets can be inspected,
+// altered or dropped, e.g. by the packet filter. They follow the netfilter
+// model:
+//
+//	--> PREROUTING --> [route] --> FORWARD --> POSTROUTING -->
+//	                      |                        ^
+//	                    INPUT                    OUTPUT
+//	                      |                        |
+//	                      v                        |
+//	                    [local sockets / ICMP] ----+
+//
+// When a hook runs, skb.Data starts with the IP header.
+//
+// Like iptables, the hooks only cover IPv4. The transport protocols get
+// their packets after INPUT and send them through OUTPUT, so they are
+// covered, but ARP and other link-layer traffic never reaches a hook and
+// can't be filtered.
+// =============================================================================
+
+type Hook int
+
+const (
+	HookPrerouting Hook = iota
+	HookInput
+	HookForward
+	HookOutput
+	HookPostrouting
+	NumHooks
+)
+
+func (h Hook) String() string {
+	switch h {
+	case HookPrerouting:
+		return "PREROUTING"
+	case HookInput:
+		return "INPUT"
+	case HookForward:
+		return "FORWARD"
+	case HookOutput:
+		return "OUTPUT"
+	case HookPostrouting:
+		return "POSTROUTING"
+	case NumHooks:
+	}
+
+	return "UNKNOWN"
+}
+
+// Verdict is the result of running a hook on a packet
+type Verdict int
+
+const (
+	VerdictAccept Verdict = iota
+	VerdictDrop
+
+	// The reject verdicts drop the packet and tell the sender why
+	VerdictRejectNetUnreachable
+	VerdictRejectHostUnreachable
+	VerdictRejectProtoUnreachable
+	VerdictRejectPortUnreachable
+	VerdictRejectAdminProhibited
+	VerdictRejectTCPReset
+)
+
+func (v Verdict) IsReject() bool {
+	return v >= VerdictRejectNetUnreachable
+}
+
+// Hook priorities. Lower values run first.
+const (
+	// Connection tracking runs first, so the filter can match on the
+	// state, and confirms new connections once everything else accepted
+	// the packet. Destination NAT happens before the filter and routing,
+	// source NAT after.
+	HookPriorityConntrack        = -200
+	HookPriorityNATDst           = -100
+	HookPriorityFilter           = 0
+	HookPriorityNATSrc           = 100
+	HookPriorityConntrackConfirm = 300
+)
+
+var ErrPacketFiltered = errors.New("packet rejected by filter")
+
+// HookFunc inspects a packet at the given hook and returns a verdict
+type HookFunc func(hook Hook, skb *SkBuff) Verdict
+
+type hookEntry struct {
+	priority int
+	fn       HookFunc
+}
+
+type Hooks struct {
+	mu      sync.RWMutex
+	entries [NumHooks][]hookEntry
+}
+
+func NewHooks() *Hooks {
+	return &Hooks{}
+}
+
+// Register adds a function to be run at the given hook
+func (hooks *Hooks) Register(hook Hook, priority int, fn HookFunc) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+
+	hooks.entries[hook] = append(hooks.entries[hook], hookEntry{priority, fn})
+	sort.SliceStable(hooks.entries[hook], func(i, j int) bool {
+		return hooks.entries[hook][i].priority < hooks.entries[hook][j].priority
+	})
+}
+
+// Run runs the registered functions for a hook in priority order,
+// stopping at the first one that doesn't accept the packet.
+// A nil Hooks accepts everything.
+func (hooks *Hooks) Run(hook Hook, skb *SkBuff) Verdict {
+	if hooks == nil {
+		return VerdictAccept
+	}
+
+	hooks.mu.RLock()
+	entries := hooks.entries[hook]
+	hooks.mu.RUnlock()
+
+	for _, entry := range entries {
+		if verdict := entry.fn(hook, skb); verdict != VerdictAccept {
+			return verdict
+		}
+	}
+
+	return VerdictAccept
+}
+
+// ConnState is the connection tracking state of a packet
+type ConnState uint8
+
+const (
+	ConnStateUntracked ConnState = iota
+	ConnStateNew
+	ConnStateEstablished
+	ConnStateRelated
+	ConnStateInvalid
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateUntracked:
+		return "UNTRACKED"
+	case ConnStateNew:
+		return "NEW"
+	case ConnStateEstablished:
+		return "ESTABLISHED"
+	case ConnStateRelated:
+		return "RELATED"
+	case ConnStateInvalid:
+		return "INVALID"
+	}
+
+	return "UNKNOWN"
+}
+
+// Resetter is implemented by protocols that can answer a packet with
+// a reset, i.e. TCP. skb.Data must start with the transport header.
+type Resetter interface {
+	SendReset(skb *SkBuff)
+}
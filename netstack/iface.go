@@ -13,11 +13,15 @@ type IfAddr struct {
 type NetworkInterface interface {
 	Read() ([]byte, error)
 	Write([]byte) error
+	GetName() string
 	GetType() ProtocolType
 	GetHWAddr() net.HardwareAddr
 	GetIfAddrs() []IfAddr
 	HasIPAddr(ip net.IP) bool
 
+	// Largest IP packet the interface sends
+	GetMTU() uint16
+
 	// HandleRX is called when a packet is received from the "wire"
 	HandleRx([]byte)
 
@@ -199,8 +199,8 @@ func (eth *EthernetProtocol) HandleTx(skb *netstack.SkBuff) {
 
 	// Get the destination hardware address from the arp cache
 	// TODO: Only look up the "next hop" address, so the ARP cache
-	// isn't huge.
-	destHWAddr, err := eth.neigh.Resolve(skb.GetDstIP())
+	// isn't huge. Forwarded packets already do this.
+	destHWAddr, err := eth.neigh.Resolve(skb.GetNextHop())
 	if err != nil {
 		eth.Log.Printf("Error resolving destination hardware address: %v", err)
 
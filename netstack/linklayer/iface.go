@@ -27,6 +27,10 @@ type Iface struct {
 	// TODO: Add interface statistics (low priority)
 }
 
+func (dev *Iface) GetName() string {
+	return dev.Name
+}
+
 func (dev *Iface) GetType() netstack.ProtocolType {
 	return dev.IfType
 }
@@ -58,6 +62,10 @@ func (dev *Iface) GetIfAddrs() []netstack.IfAddr {
 	return dev.IfAddrs
 }
 
+func (dev *Iface) GetMTU() uint16 {
+	return dev.Mtu
+}
+
 func (dev *Iface) HasIPAddr(ip net.IP) bool {
 	for _, ifAddr := range dev.IfAddrs {
 		if ifAddr.IP.Equal(ip) {
@@ -91,6 +99,7 @@ func NewTap(tap *tuntap.Interface, name string, hwAddr net.HardwareAddr, addrs [
 	netdev.tap = tap
 	netdev.HwAddr = hwAddr
 	netdev.IfAddrs = addrs
+	netdev.Mtu = 1500
 	netdev.IfType = netstack.ProtocolTypeEthernet
 	netdev.txChan = make(chan *netstack.SkBuff)
 
@@ -98,7 +107,8 @@ func NewTap(tap *tuntap.Interface, name string, hwAddr net.HardwareAddr, addrs [
 }
 
 func (dev *TAPDevice) Read() ([]byte, error) {
-	data := make([]byte, 1500)
+	// Room for a packet of the MTU in an Ethernet frame
+	data := make([]byte, int(dev.Mtu)+EthernetHeaderSize)
 	n, err := dev.tap.Read(data)
 
 	return data[:n], err
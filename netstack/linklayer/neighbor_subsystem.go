@@ -45,7 +45,7 @@ func (neigh *NeighborSubsystem) Resolve(ip net.IP) (net.HardwareAddr, error) {
 // SendRequest sends an ARP request to the specified IP address
 // This function should be called as a goroutine
 func (neigh *NeighborSubsystem) SendRequest(skb *netstack.SkBuff) {
-	dstIP := skb.GetDstIP()
+	dstIP := skb.GetNextHop()
 	if dstIP == nil {
 		return
 	}
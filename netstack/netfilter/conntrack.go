@@ -0,0 +1,578 @@
+package netfilter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+)
+
+// =============================================================================
+// Tuple
+// Identifies one direction of a flow. For ICMP queries the ports hold the
+// query ID, so a reply's tuple is the reverse of its request's.
+// =============================================================================
+
+type Tuple struct {
+	SrcIP    netip.Addr
+	DstIP    netip.Addr
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func (t Tuple) Reverse() Tuple {
+	return Tuple{
+		SrcIP:    t.DstIP,
+		DstIP:    t.SrcIP,
+		Protocol: t.Protocol,
+		SrcPort:  t.DstPort,
+		DstPort:  t.SrcPort,
+	}
+}
+
+func (t Tuple) String() string {
+	switch t.Protocol {
+	case networklayer.ProtocolTCP, networklayer.ProtocolUDP:
+		return fmt.Sprintf("%s %s:%d -> %s:%d", protocolName(t.Protocol), t.SrcIP, t.SrcPort, t.DstIP, t.DstPort)
+	case networklayer.ProtocolICMP:
+		return fmt.Sprintf("%s %s -> %s id=%d", protocolName(t.Protocol), t.SrcIP, t.DstIP, t.SrcPort)
+	}
+
+	return fmt.Sprintf("%s %s -> %s", protocolName(t.Protocol), t.SrcIP, t.DstIP)
+}
+
+func toAddr(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip.To4())
+	return addr
+}
+
+// ICMP query types. Requests can start a connection, replies only
+// belong to one.
+var icmpQueries = map[uint8]bool{
+	networklayer.ICMPTypeEcho: true,
+	13:                        true, // timestamp
+	15:                        true, // information
+	17:                        true, // address mask
+}
+
+var icmpReplies = map[uint8]bool{
+	networklayer.ICMPTypeEchoReply: true,
+	14:                             true,
+	16:                             true,
+	18:                             true,
+}
+
+// packetTuple returns the tuple of the packet's direction of its flow.
+// It fails for ICMP messages that aren't queries or replies.
+func packetTuple(pkt *Packet) (Tuple, bool) {
+	t := Tuple{
+		SrcIP:    toAddr(pkt.SrcIP),
+		DstIP:    toAddr(pkt.DstIP),
+		Protocol: pkt.Protocol,
+	}
+
+	switch pkt.Protocol {
+	case networklayer.ProtocolTCP, networklayer.ProtocolUDP:
+		t.SrcPort = pkt.SrcPort
+		t.DstPort = pkt.DstPort
+	case networklayer.ProtocolICMP:
+		if !icmpQueries[pkt.ICMPType] && !icmpReplies[pkt.ICMPType] {
+			return t, false
+		}
+
+		t.SrcPort = pkt.ICMPID
+		t.DstPort = pkt.ICMPID
+	}
+
+	return t, true
+}
+
+// =============================================================================
+// Conn
+// A tracked connection. The original direction is the one of the packet
+// that created it.
+// =============================================================================
+
+type Direction int
+
+const (
+	DirOriginal Direction = iota
+	DirReply
+)
+
+// TCPConnState is the state of a TCP connection as seen from the middle,
+// following the flags of the packets in both directions.
+type TCPConnState string
+
+const (
+	TCPConnNone        TCPConnState = "NONE"
+	TCPConnSynSent     TCPConnState = "SYN_SENT"
+	TCPConnSynRecv     TCPConnState = "SYN_RECV"
+	TCPConnEstablished TCPConnState = "ESTABLISHED"
+	TCPConnFinWait     TCPConnState = "FIN_WAIT"
+	TCPConnCloseWait   TCPConnState = "CLOSE_WAIT"
+	TCPConnLastAck     TCPConnState = "LAST_ACK"
+	TCPConnTimeWait    TCPConnState = "TIME_WAIT"
+	TCPConnClose       TCPConnState = "CLOSE"
+)
+
+type Conn struct {
+	ID       uint64
+	Orig     Tuple
+	Reply    Tuple
+	TCPState TCPConnState `json:",omitempty"`
+
+	// SeenReply is set once a packet went the other way
+	SeenReply bool
+
+	Expires time.Time
+
+	// Counters, indexed by Direction
+	Packets [2]uint64
+	Bytes   [2]uint64
+
+	confirmed bool
+	finSeen   [2]bool
+
+	// natDone records, by manipType, whether NAT has been set up
+	natDone [2]bool
+}
+
+// connRef is what a packet carries as its connection, along with
+// its direction and whether it's an ICMP error related to the connection
+type connRef struct {
+	conn    *Conn
+	dir     Direction
+	related bool
+}
+
+func (conn *Conn) String() string {
+	s := fmt.Sprintf("%s reply=%s", conn.Orig, conn.Reply)
+	if conn.TCPState != "" {
+		s += " " + string(conn.TCPState)
+	}
+
+	return s
+}
+
+func (conn *Conn) direction(t Tuple) Direction {
+	if t == conn.Orig {
+		return DirOriginal
+	}
+
+	return DirReply
+}
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// updateTCP moves the connection along with the flags of a packet going
+// in dir. It returns false if the packet doesn't fit the connection.
+func (conn *Conn) updateTCP(dir Direction, flags uint8) bool {
+	flags &= tcpFlagFIN | tcpFlagSYN | tcpFlagRST | tcpFlagACK
+
+	switch {
+	case flags&tcpFlagSYN != 0 && flags&(tcpFlagFIN|tcpFlagRST) != 0:
+		return false
+	case flags&tcpFlagRST != 0:
+		conn.TCPState = TCPConnClose
+	case flags == tcpFlagSYN:
+		if dir != DirOriginal || (conn.TCPState != TCPConnNone && conn.TCPState != TCPConnSynSent) {
+			return false
+		}
+
+		conn.TCPState = TCPConnSynSent
+	case flags == tcpFlagSYN|tcpFlagACK:
+		if dir != DirReply || (conn.TCPState != TCPConnSynSent && conn.TCPState != TCPConnSynRecv) {
+			return false
+		}
+
+		conn.TCPState = TCPConnSynRecv
+	case flags&tcpFlagFIN != 0:
+		switch conn.TCPState {
+		case TCPConnEstablished, TCPConnFinWait, TCPConnCloseWait, TCPConnLastAck:
+		default:
+			return false
+		}
+
+		conn.finSeen[dir] = true
+		if conn.finSeen[DirOriginal] && conn.finSeen[DirReply] {
+			conn.TCPState = TCPConnLastAck
+		} else if conn.TCPState == TCPConnEstablished {
+			conn.TCPState = TCPConnFinWait
+		}
+	case flags == tcpFlagACK:
+		switch conn.TCPState {
+		case TCPConnNone, TCPConnSynSent:
+			return false
+		case TCPConnSynRecv:
+			if dir == DirOriginal {
+				conn.TCPState = TCPConnEstablished
+			}
+		case TCPConnFinWait:
+			// The other side acked the FIN, and may keep sending
+			if !conn.finSeen[dir] {
+				conn.TCPState = TCPConnCloseWait
+			}
+		case TCPConnLastAck:
+			conn.TCPState = TCPConnTimeWait
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// =============================================================================
+// Timeouts
+// How long a connection lives without seeing a packet
+// =============================================================================
+
+type Timeouts struct {
+	TCP map[TCPConnState]time.Duration
+
+	// UDP flows that have seen a reply live longer
+	UDP       time.Duration
+	UDPStream time.Duration
+
+	ICMP time.Duration
+
+	// Any other protocol
+	Generic time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	TCP: map[TCPConnState]time.Duration{
+		TCPConnSynSent:     2 * time.Minute,
+		TCPConnSynRecv:     60 * time.Second,
+		TCPConnEstablished: 5 * 24 * time.Hour,
+		TCPConnFinWait:     2 * time.Minute,
+		TCPConnCloseWait:   60 * time.Second,
+		TCPConnLastAck:     30 * time.Second,
+		TCPConnTimeWait:    2 * time.Minute,
+		TCPConnClose:       10 * time.Second,
+	},
+	UDP:       30 * time.Second,
+	UDPStream: 120 * time.Second,
+	ICMP:      30 * time.Second,
+	Generic:   600 * time.Second,
+}
+
+func (timeouts *Timeouts) timeout(conn *Conn) time.Duration {
+	switch conn.Orig.Protocol {
+	case networklayer.ProtocolTCP:
+		return timeouts.TCP[conn.TCPState]
+	case networklayer.ProtocolUDP:
+		if conn.SeenReply {
+			return timeouts.UDPStream
+		}
+
+		return timeouts.UDP
+	case networklayer.ProtocolICMP:
+		return timeouts.ICMP
+	}
+
+	return timeouts.Generic
+}
+
+// =============================================================================
+// Conntrack
+// Follows the flows passing through the hooks, forwarded and locally
+// terminated alike, and labels each packet with its state for the filter.
+// A connection is created by the first packet of a flow, and only added
+// to the table once that packet got through the hooks, so dropped
+// packets don't fill the table.
+// =============================================================================
+
+const (
+	DefaultConntrackMax = 65536
+	conntrackGCInterval = 10 * time.Second
+)
+
+var ErrConntrackFull = errors.New("connection tracking table full")
+
+type Conntrack struct {
+	mu       sync.Mutex
+	table    map[Tuple]*Conn
+	count    int
+	nextID   uint64
+	Timeouts Timeouts
+	Max      int
+	Log      *log.Logger
+
+	now func() time.Time
+}
+
+func NewConntrack() *Conntrack {
+	return &Conntrack{
+		table:    make(map[Tuple]*Conn),
+		nextID:   1,
+		Timeouts: DefaultTimeouts,
+		Max:      DefaultConntrackMax,
+		Log:      netstack.NewLogger("CONNTRACK"),
+		now:      time.Now,
+	}
+}
+
+// Hook is the netstack.HookFunc for connection tracking. Packets are
+// tracked where they enter, PREROUTING or OUTPUT, and new connections are
+// confirmed where they leave, INPUT or POSTROUTING.
+func (ct *Conntrack) Hook(hook netstack.Hook, skb *netstack.SkBuff) netstack.Verdict {
+	switch hook {
+	case netstack.HookPrerouting, netstack.HookOutput:
+		ct.track(skb)
+	case netstack.HookInput, netstack.HookPostrouting:
+		return ct.confirm(skb)
+	case netstack.HookForward, netstack.NumHooks:
+	}
+
+	return netstack.VerdictAccept
+}
+
+func (ct *Conntrack) track(skb *netstack.SkBuff) {
+	pkt, err := ParsePacket(skb.Data)
+	if err != nil {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	// Without reassembly, non-initial fragments can't be tracked
+	if pkt.Fragment {
+		return
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	now := ct.now()
+
+	if pkt.Protocol == networklayer.ProtocolICMP && isICMPError(pkt.ICMPType) {
+		ct.trackRelated(skb, pkt, now)
+		return
+	}
+
+	tuple, ok := packetTuple(pkt)
+	if !ok {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	conn := ct.lookup(tuple, now)
+
+	// A SYN on a closed connection starts a new one with the same tuple
+	if conn != nil && pkt.Protocol == networklayer.ProtocolTCP &&
+		pkt.TCPFlags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN &&
+		(conn.TCPState == TCPConnTimeWait || conn.TCPState == TCPConnClose) {
+		ct.remove(conn)
+		conn = nil
+	}
+
+	if conn == nil {
+		ct.trackNew(skb, pkt, tuple, now)
+		return
+	}
+
+	dir := conn.direction(tuple)
+
+	if pkt.Protocol == networklayer.ProtocolTCP && !conn.updateTCP(dir, pkt.TCPFlags) {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	if dir == DirReply {
+		conn.SeenReply = true
+	}
+
+	ct.account(conn, dir, pkt, now)
+	skb.SetConn(connRef{conn: conn, dir: dir})
+
+	if conn.SeenReply {
+		skb.SetConnState(netstack.ConnStateEstablished)
+	} else {
+		skb.SetConnState(netstack.ConnStateNew)
+	}
+}
+
+// trackNew creates an unconfirmed connection for the first packet of a flow
+func (ct *Conntrack) trackNew(skb *netstack.SkBuff, pkt *Packet, tuple Tuple, now time.Time) {
+	conn := &Conn{
+		Orig:  tuple,
+		Reply: tuple.Reverse(),
+	}
+
+	switch pkt.Protocol {
+	case networklayer.ProtocolTCP:
+		// Only a SYN opens a connection
+		conn.TCPState = TCPConnNone
+		if pkt.TCPFlags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST|tcpFlagFIN) != tcpFlagSYN || !conn.updateTCP(DirOriginal, pkt.TCPFlags) {
+			skb.SetConnState(netstack.ConnStateInvalid)
+			return
+		}
+	case networklayer.ProtocolICMP:
+		if !icmpQueries[pkt.ICMPType] {
+			skb.SetConnState(netstack.ConnStateInvalid)
+			return
+		}
+	}
+
+	ct.account(conn, DirOriginal, pkt, now)
+	skb.SetConn(connRef{conn: conn, dir: DirOriginal})
+	skb.SetConnState(netstack.ConnStateNew)
+}
+
+// trackRelated links an ICMP error to the connection of the packet it quotes
+func (ct *Conntrack) trackRelated(skb *netstack.SkBuff, pkt *Packet, now time.Time) {
+	if pkt.Inner == nil {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	tuple, ok := packetTuple(pkt.Inner)
+	if !ok {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	// The error travels like a reply to the quoted packet. Looking up
+	// the reply also finds the connection after NAT, as the quoted
+	// packet is translated.
+	tuple = tuple.Reverse()
+
+	conn := ct.lookup(tuple, now)
+	if conn == nil {
+		skb.SetConnState(netstack.ConnStateInvalid)
+		return
+	}
+
+	dir := conn.direction(tuple)
+	ct.account(conn, dir, pkt, now)
+	skb.SetConn(connRef{conn: conn, dir: dir, related: true})
+	skb.SetConnState(netstack.ConnStateRelated)
+}
+
+func (ct *Conntrack) account(conn *Conn, dir Direction, pkt *Packet, now time.Time) {
+	conn.Packets[dir]++
+	conn.Bytes[dir] += uint64(pkt.Length)
+	conn.Expires = now.Add(ct.Timeouts.timeout(conn))
+}
+
+// confirm adds the packet's connection to the table if it's new
+func (ct *Conntrack) confirm(skb *netstack.SkBuff) netstack.Verdict {
+	ref, ok := skb.GetConn().(connRef)
+	if !ok {
+		return netstack.VerdictAccept
+	}
+
+	conn := ref.conn
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if conn.confirmed {
+		return netstack.VerdictAccept
+	}
+
+	// Another packet of the flow may have got here first. If another
+	// flow took the reply tuple, e.g. the same NAT port, the two can't
+	// be told apart.
+	now := ct.now()
+	if ct.lookup(conn.Orig, now) != nil {
+		return netstack.VerdictAccept
+	}
+
+	if ct.lookup(conn.Reply, now) != nil {
+		ct.Log.Printf("reply tuple clash, dropping packet: %s", conn)
+		return netstack.VerdictDrop
+	}
+
+	if ct.count >= ct.Max {
+		ct.Log.Printf("%s, dropping packet: %s", ErrConntrackFull, conn)
+		return netstack.VerdictDrop
+	}
+
+	conn.ID = ct.nextID
+	conn.confirmed = true
+	ct.nextID++
+	ct.table[conn.Orig] = conn
+	ct.table[conn.Reply] = conn
+	ct.count++
+
+	return netstack.VerdictAccept
+}
+
+// lookup returns the live connection for a tuple in either direction
+func (ct *Conntrack) lookup(tuple Tuple, now time.Time) *Conn {
+	conn, ok := ct.table[tuple]
+	if !ok {
+		return nil
+	}
+
+	if now.After(conn.Expires) {
+		ct.remove(conn)
+		return nil
+	}
+
+	return conn
+}
+
+func (ct *Conntrack) remove(conn *Conn) {
+	delete(ct.table, conn.Orig)
+	delete(ct.table, conn.Reply)
+	ct.count--
+}
+
+// Expire removes the connections that timed out
+func (ct *Conntrack) Expire() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	now := ct.now()
+
+	for tuple, conn := range ct.table {
+		if tuple == conn.Orig && now.After(conn.Expires) {
+			ct.remove(conn)
+		}
+	}
+}
+
+func (ct *Conntrack) gcLoop() {
+	ticker := time.NewTicker(conntrackGCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ct.Expire()
+	}
+}
+
+// List returns a copy of the confirmed connections, oldest first
+func (ct *Conntrack) List() []Conn {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	conns := []Conn{}
+
+	for tuple, conn := range ct.table {
+		if tuple == conn.Orig {
+			conns = append(conns, *conn)
+		}
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+
+	return conns
+}
@@ -0,0 +1,184 @@
+package netfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+	"github.com/stretchr/testify/assert"
+)
+
+func genIPv4Packet(src, dst string, protocol uint8, payload []byte) []byte {
+	ipHeader := &networklayer.IPv4Header{
+		Version:       4,
+		TotalLength:   uint16(networklayer.IPv4HeaderSize + len(payload)),
+		TTL:           64,
+		Protocol:      protocol,
+		SourceIP:      net.ParseIP(src),
+		DestinationIP: net.ParseIP(dst),
+	}
+
+	return append(ipHeader.Marshal(), payload...)
+}
+
+func genUDPPacket(src, dst string, srcPort, dstPort uint16) []byte {
+	udpHeader := make([]byte, udpHeaderSize)
+	binary.BigEndian.PutUint16(udpHeader[0:2], srcPort)
+	binary.BigEndian.PutUint16(udpHeader[2:4], dstPort)
+
+	return genIPv4Packet(src, dst, networklayer.ProtocolUDP, udpHeader)
+}
+
+func genICMPPacket(src, dst string, icmpType uint8, id uint16) []byte {
+	icmpHeader := make([]byte, icmpEchoHeaderSize)
+	icmpHeader[0] = icmpType
+	binary.BigEndian.PutUint16(icmpHeader[4:6], id)
+
+	return genIPv4Packet(src, dst, networklayer.ProtocolICMP, icmpHeader)
+}
+
+// genICMPError makes an ICMP error quoting orig
+func genICMPError(src, dst string, icmpType uint8, orig []byte) []byte {
+	icmpHeader := make([]byte, icmpErrorHeaderSize)
+	icmpHeader[0] = icmpType
+
+	return genIPv4Packet(src, dst, networklayer.ProtocolICMP, append(icmpHeader, orig[:networklayer.IPv4HeaderSize+8]...))
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestConntrack() (*Conntrack, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	ct := NewConntrack()
+	ct.now = clock.now
+
+	return ct, clock
+}
+
+// forward runs the packet through the hooks a forwarded packet passes
+func forward(ct *Conntrack, b []byte) *netstack.SkBuff {
+	skb := netstack.NewSkBuff(b)
+	ct.Hook(netstack.HookPrerouting, skb)
+	ct.Hook(netstack.HookPostrouting, skb)
+
+	return skb
+}
+
+func Test_Conntrack_TCP(t *testing.T) {
+	ct, _ := newTestConntrack()
+
+	client, server := "10.88.45.1", "192.168.1.10"
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		state   netstack.ConnState
+		tcpConn TCPConnState
+	}{
+		{"syn", genTCPPacket(client, server, 40000, 80, tcpFlagSYN), netstack.ConnStateNew, TCPConnSynSent},
+		{"syn retransmit", genTCPPacket(client, server, 40000, 80, tcpFlagSYN), netstack.ConnStateNew, TCPConnSynSent},
+		{"syn ack", genTCPPacket(server, client, 80, 40000, tcpFlagSYN|tcpFlagACK), netstack.ConnStateEstablished, TCPConnSynRecv},
+		{"ack", genTCPPacket(client, server, 40000, 80, tcpFlagACK), netstack.ConnStateEstablished, TCPConnEstablished},
+		{"syn in established", genTCPPacket(client, server, 40000, 80, tcpFlagSYN), netstack.ConnStateInvalid, TCPConnEstablished},
+		{"client fin", genTCPPacket(client, server, 40000, 80, tcpFlagFIN|tcpFlagACK), netstack.ConnStateEstablished, TCPConnFinWait},
+		{"server ack", genTCPPacket(server, client, 80, 40000, tcpFlagACK), netstack.ConnStateEstablished, TCPConnCloseWait},
+		{"server fin", genTCPPacket(server, client, 80, 40000, tcpFlagFIN|tcpFlagACK), netstack.ConnStateEstablished, TCPConnLastAck},
+		{"client ack", genTCPPacket(client, server, 40000, 80, tcpFlagACK), netstack.ConnStateEstablished, TCPConnTimeWait},
+		{"reopen", genTCPPacket(client, server, 40000, 80, tcpFlagSYN), netstack.ConnStateNew, TCPConnSynSent},
+	}
+
+	for _, tt := range tests {
+		skb := forward(ct, tt.packet)
+		assert.Equal(t, tt.state, skb.GetConnState(), tt.name)
+
+		conns := ct.List()
+		assert.Len(t, conns, 1, tt.name)
+		assert.Equal(t, tt.tcpConn, conns[0].TCPState, tt.name)
+	}
+
+	// Mid-stream packets of unknown connections don't create entries
+	skb := forward(ct, genTCPPacket(client, server, 40001, 80, tcpFlagACK))
+	assert.Equal(t, netstack.ConnStateInvalid, skb.GetConnState())
+	assert.Len(t, ct.List(), 1)
+}
+
+func Test_Conntrack_UDP_Timeout(t *testing.T) {
+	ct, clock := newTestConntrack()
+
+	skb := forward(ct, genUDPPacket("10.88.45.1", "8.8.8.8", 5353, 53))
+	assert.Equal(t, netstack.ConnStateNew, skb.GetConnState())
+
+	skb = forward(ct, genUDPPacket("8.8.8.8", "10.88.45.1", 53, 5353))
+	assert.Equal(t, netstack.ConnStateEstablished, skb.GetConnState())
+
+	conns := ct.List()
+	assert.Len(t, conns, 1)
+	assert.True(t, conns[0].SeenReply)
+	assert.Equal(t, [2]uint64{1, 1}, conns[0].Packets)
+
+	// Replied flows use the longer timeout
+	clock.t = clock.t.Add(DefaultTimeouts.UDP + time.Second)
+	ct.Expire()
+	assert.Len(t, ct.List(), 1)
+
+	clock.t = clock.t.Add(DefaultTimeouts.UDPStream)
+	ct.Expire()
+	assert.Len(t, ct.List(), 0)
+
+	skb = forward(ct, genUDPPacket("8.8.8.8", "10.88.45.1", 53, 5353))
+	assert.Equal(t, netstack.ConnStateNew, skb.GetConnState())
+}
+
+func Test_Conntrack_ICMP(t *testing.T) {
+	ct, _ := newTestConntrack()
+
+	// A reply without a request
+	skb := forward(ct, genICMPPacket("8.8.8.8", "10.88.45.1", networklayer.ICMPTypeEchoReply, 7))
+	assert.Equal(t, netstack.ConnStateInvalid, skb.GetConnState())
+
+	skb = forward(ct, genICMPPacket("10.88.45.1", "8.8.8.8", networklayer.ICMPTypeEcho, 7))
+	assert.Equal(t, netstack.ConnStateNew, skb.GetConnState())
+
+	skb = forward(ct, genICMPPacket("8.8.8.8", "10.88.45.1", networklayer.ICMPTypeEchoReply, 7))
+	assert.Equal(t, netstack.ConnStateEstablished, skb.GetConnState())
+
+	// Errors are related to the flow of the packet they quote
+	probe := genUDPPacket("10.88.45.1", "8.8.8.8", 33434, 33435)
+	forward(ct, probe)
+
+	skb = forward(ct, genICMPError("192.168.1.1", "10.88.45.1", networklayer.ICMPTypeTimeExceeded, probe))
+	assert.Equal(t, netstack.ConnStateRelated, skb.GetConnState())
+
+	other := genUDPPacket("10.88.45.1", "8.8.8.8", 33434, 33436)
+	skb = forward(ct, genICMPError("192.168.1.1", "10.88.45.1", networklayer.ICMPTypeTimeExceeded, other))
+	assert.Equal(t, netstack.ConnStateInvalid, skb.GetConnState())
+
+	assert.Len(t, ct.List(), 2)
+}
+
+func Test_Conntrack_Unconfirmed(t *testing.T) {
+	ct, _ := newTestConntrack()
+
+	// The first packet is dropped before confirmation, e.g. by the filter
+	skb := netstack.NewSkBuff(genUDPPacket("10.88.45.1", "8.8.8.8", 5353, 53))
+	ct.Hook(netstack.HookPrerouting, skb)
+	assert.Equal(t, netstack.ConnStateNew, skb.GetConnState())
+	assert.Len(t, ct.List(), 0)
+
+	ct.Max = 1
+	forward(ct, genUDPPacket("10.88.45.1", "8.8.8.8", 5353, 53))
+	assert.Len(t, ct.List(), 1)
+
+	skb = netstack.NewSkBuff(genUDPPacket("10.88.45.1", "8.8.8.8", 5354, 53))
+	ct.Hook(netstack.HookOutput, skb)
+	assert.Equal(t, netstack.VerdictDrop, ct.Hook(netstack.HookPostrouting, skb))
+}
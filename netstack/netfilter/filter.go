@@ -0,0 +1,435 @@
+package netfilter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+)
+
+// =============================================================================
+// Rule
+// A rule matches packets at one of the hooks (its chain), and decides
+// what to do with them. Empty match fields match everything.
+// =============================================================================
+
+type Action string
+
+const (
+	ActionAccept Action = "ACCEPT"
+	ActionDrop   Action = "DROP"
+	ActionReject Action = "REJECT"
+
+	// ActionLog logs the packet and carries on with the next rule
+	ActionLog Action = "LOG"
+)
+
+type RejectType string
+
+const (
+	RejectPortUnreachable  RejectType = "icmp-port-unreachable"
+	RejectNetUnreachable   RejectType = "icmp-net-unreachable"
+	RejectHostUnreachable  RejectType = "icmp-host-unreachable"
+	RejectProtoUnreachable RejectType = "icmp-proto-unreachable"
+	RejectAdminProhibited  RejectType = "icmp-admin-prohibited"
+	RejectTCPReset         RejectType = "tcp-reset"
+)
+
+// PortRange matches ports from Min to Max inclusive. The zero value
+// matches any port.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (pr PortRange) IsAny() bool {
+	return pr.Min == 0 && pr.Max == 0
+}
+
+func (pr PortRange) Contains(port uint16) bool {
+	if pr.IsAny() {
+		return true
+	}
+
+	max := pr.Max
+	if max == 0 {
+		max = pr.Min
+	}
+
+	return port >= pr.Min && port <= max
+}
+
+type Rule struct {
+	// ID is assigned when the rule is added
+	ID int
+
+	// Chain is the hook the rule is attached to
+	Chain netstack.Hook
+
+	// Interface names
+	InIface  string
+	OutIface string
+
+	// Addresses, either a single IP or a CIDR
+	Src string
+	Dst string
+
+	// IP protocol number, 0 matches any
+	Protocol uint8
+
+	// Ports, for TCP and UDP rules
+	SrcPorts PortRange
+	DstPorts PortRange
+
+	// TCP flags. A packet matches if (flags & TCPFlagsMask) == TCPFlags.
+	TCPFlags     uint8
+	TCPFlagsMask uint8
+
+	// Connection tracking states
+	States []netstack.ConnState
+
+	Action     Action
+	RejectWith RejectType
+	LogPrefix  string
+
+	// Counters for matched packets
+	Packets uint64
+	Bytes   uint64
+
+	src *net.IPNet
+	dst *net.IPNet
+}
+
+var ErrInvalidRule = errors.New("invalid filter rule")
+
+func parseNet(addr string) (*net.IPNet, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	if !strings.Contains(addr, "/") {
+		addr += "/32"
+	}
+
+	_, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRule, err)
+	}
+
+	return ipNet, nil
+}
+
+// compile validates the rule and parses its address fields
+func (rule *Rule) compile() error {
+	if rule.Chain < 0 || rule.Chain >= netstack.NumHooks {
+		return fmt.Errorf("%w: unknown chain %d", ErrInvalidRule, rule.Chain)
+	}
+
+	// Only some interfaces are known at each hook
+	if rule.InIface != "" && (rule.Chain == netstack.HookOutput || rule.Chain == netstack.HookPostrouting) {
+		return fmt.Errorf("%w: no input interface in %s", ErrInvalidRule, rule.Chain)
+	}
+
+	if rule.OutIface != "" && (rule.Chain == netstack.HookPrerouting || rule.Chain == netstack.HookInput) {
+		return fmt.Errorf("%w: no output interface in %s", ErrInvalidRule, rule.Chain)
+	}
+
+	hasPorts := !rule.SrcPorts.IsAny() || !rule.DstPorts.IsAny()
+	if hasPorts && rule.Protocol != networklayer.ProtocolTCP && rule.Protocol != networklayer.ProtocolUDP {
+		return fmt.Errorf("%w: ports need protocol tcp or udp", ErrInvalidRule)
+	}
+
+	if rule.TCPFlagsMask != 0 && rule.Protocol != networklayer.ProtocolTCP {
+		return fmt.Errorf("%w: tcp flags need protocol tcp", ErrInvalidRule)
+	}
+
+	switch rule.Action {
+	case ActionAccept, ActionDrop, ActionLog:
+	case ActionReject:
+		if rule.RejectWith == "" {
+			rule.RejectWith = RejectPortUnreachable
+		}
+
+		if _, ok := rejectVerdicts[rule.RejectWith]; !ok {
+			return fmt.Errorf("%w: unknown reject type %q", ErrInvalidRule, rule.RejectWith)
+		}
+
+		if rule.RejectWith == RejectTCPReset && rule.Protocol != networklayer.ProtocolTCP {
+			return fmt.Errorf("%w: tcp-reset needs protocol tcp", ErrInvalidRule)
+		}
+
+		// Rejecting our own packets with an ICMP error makes no sense,
+		// the sender gets an error instead.
+		if rule.Chain == netstack.HookOutput || rule.Chain == netstack.HookPostrouting {
+			return fmt.Errorf("%w: REJECT not allowed in %s", ErrInvalidRule, rule.Chain)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action %q", ErrInvalidRule, rule.Action)
+	}
+
+	var err error
+
+	if rule.src, err = parseNet(rule.Src); err != nil {
+		return err
+	}
+
+	if rule.dst, err = parseNet(rule.Dst); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var rejectVerdicts = map[RejectType]netstack.Verdict{
+	RejectPortUnreachable:  netstack.VerdictRejectPortUnreachable,
+	RejectNetUnreachable:   netstack.VerdictRejectNetUnreachable,
+	RejectHostUnreachable:  netstack.VerdictRejectHostUnreachable,
+	RejectProtoUnreachable: netstack.VerdictRejectProtoUnreachable,
+	RejectAdminProhibited:  netstack.VerdictRejectAdminProhibited,
+	RejectTCPReset:         netstack.VerdictRejectTCPReset,
+}
+
+func ifaceName(iface netstack.NetworkInterface, err error) string {
+	if err != nil {
+		return ""
+	}
+
+	return iface.GetName()
+}
+
+func (rule *Rule) matches(skb *netstack.SkBuff, pkt *Packet) bool {
+	if rule.InIface != "" && rule.InIface != ifaceName(skb.GetRxIface()) {
+		return false
+	}
+
+	if rule.OutIface != "" && rule.OutIface != ifaceName(skb.GetTxIface()) {
+		return false
+	}
+
+	if rule.src != nil && !rule.src.Contains(pkt.SrcIP) {
+		return false
+	}
+
+	if rule.dst != nil && !rule.dst.Contains(pkt.DstIP) {
+		return false
+	}
+
+	if rule.Protocol != 0 && rule.Protocol != pkt.Protocol {
+		return false
+	}
+
+	// Non-initial fragments have no transport header to match on
+	if pkt.Fragment && (!rule.SrcPorts.IsAny() || !rule.DstPorts.IsAny() || rule.TCPFlagsMask != 0) {
+		return false
+	}
+
+	if !rule.SrcPorts.Contains(pkt.SrcPort) || !rule.DstPorts.Contains(pkt.DstPort) {
+		return false
+	}
+
+	if pkt.TCPFlags&rule.TCPFlagsMask != rule.TCPFlags {
+		return false
+	}
+
+	if len(rule.States) > 0 && !rule.matchesState(skb.GetConnState()) {
+		return false
+	}
+
+	return true
+}
+
+func (rule *Rule) matchesState(state netstack.ConnState) bool {
+	for _, s := range rule.States {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// =============================================================================
+// Filter
+// The rule engine. Each hook has a chain of rules that are checked in
+// order, and a policy that applies when no rule decides.
+// =============================================================================
+
+type chain struct {
+	rules  []*Rule
+	policy Action
+}
+
+type Filter struct {
+	mu     sync.Mutex
+	chains [netstack.NumHooks]chain
+	nextID int
+	Log    *log.Logger
+}
+
+var (
+	ErrRuleNotFound  = errors.New("filter rule not found")
+	ErrInvalidPolicy = errors.New("chain policy must be ACCEPT or DROP")
+)
+
+func NewFilter() *Filter {
+	f := &Filter{
+		nextID: 1,
+		Log:    netstack.NewLogger("FILTER"),
+	}
+
+	for i := range f.chains {
+		f.chains[i].policy = ActionAccept
+	}
+
+	return f
+}
+
+// Add appends a rule to the end of its chain and returns the rule's ID
+func (f *Filter) Add(rule Rule) (int, error) {
+	if err := rule.compile(); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule.ID = f.nextID
+	rule.Packets = 0
+	rule.Bytes = 0
+	f.nextID++
+
+	ch := &f.chains[rule.Chain]
+	ch.rules = append(ch.rules, &rule)
+
+	return rule.ID, nil
+}
+
+// Delete removes the rule with the given ID
+func (f *Filter) Delete(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range f.chains {
+		ch := &f.chains[i]
+		for j, rule := range ch.rules {
+			if rule.ID == id {
+				ch.rules = append(ch.rules[:j], ch.rules[j+1:]...)
+				return nil
+			}
+		}
+	}
+
+	return ErrRuleNotFound
+}
+
+// List returns a copy of all rules, in chain order
+func (f *Filter) List() []Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := []Rule{}
+
+	for i := range f.chains {
+		for _, rule := range f.chains[i].rules {
+			rules = append(rules, *rule)
+		}
+	}
+
+	return rules
+}
+
+// Flush removes all rules from a chain
+func (f *Filter) Flush(hook netstack.Hook) error {
+	if hook < 0 || hook >= netstack.NumHooks {
+		return fmt.Errorf("%w: unknown chain %d", ErrInvalidRule, hook)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chains[hook].rules = nil
+
+	return nil
+}
+
+// SetPolicy sets what happens to packets that no rule in the chain decides on
+func (f *Filter) SetPolicy(hook netstack.Hook, policy Action) error {
+	if hook < 0 || hook >= netstack.NumHooks {
+		return fmt.Errorf("%w: unknown chain %d", ErrInvalidRule, hook)
+	}
+
+	if policy != ActionAccept && policy != ActionDrop {
+		return ErrInvalidPolicy
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chains[hook].policy = policy
+
+	return nil
+}
+
+// Policy returns the policy of a chain
+func (f *Filter) Policy(hook netstack.Hook) Action {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.chains[hook].policy
+}
+
+// Hook is the netstack.HookFunc for the filter
+func (f *Filter) Hook(hook netstack.Hook, skb *netstack.SkBuff) netstack.Verdict {
+	pkt, err := ParsePacket(skb.Data)
+	if err != nil {
+		// Let the protocols deal with malformed packets
+		return netstack.VerdictAccept
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := &f.chains[hook]
+
+	for _, rule := range ch.rules {
+		if !rule.matches(skb, pkt) {
+			continue
+		}
+
+		rule.Packets++
+		rule.Bytes += uint64(pkt.Length)
+
+		switch rule.Action {
+		case ActionLog:
+			f.logPacket(rule, hook, skb, pkt)
+		case ActionAccept:
+			return netstack.VerdictAccept
+		case ActionDrop:
+			return netstack.VerdictDrop
+		case ActionReject:
+			return rejectVerdicts[rule.RejectWith]
+		}
+	}
+
+	if ch.policy == ActionDrop {
+		return netstack.VerdictDrop
+	}
+
+	return netstack.VerdictAccept
+}
+
+func (f *Filter) logPacket(rule *Rule, hook netstack.Hook, skb *netstack.SkBuff, pkt *Packet) {
+	f.Log.Printf("%s%s IN=%s OUT=%s STATE=%s %s",
+		rule.LogPrefix,
+		hook,
+		ifaceName(skb.GetRxIface()),
+		ifaceName(skb.GetTxIface()),
+		skb.GetConnState(),
+		pkt,
+	)
+}
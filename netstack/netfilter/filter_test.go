@@ -0,0 +1,130 @@
+package netfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+	"github.com/stretchr/testify/assert"
+)
+
+// genTCPPacket makes a raw IPv4 packet with a bare TCP header
+func genTCPPacket(src, dst string, srcPort, dstPort uint16, flags uint8) []byte {
+	ipHeader := &networklayer.IPv4Header{
+		Version:       4,
+		TotalLength:   networklayer.IPv4HeaderSize + tcpHeaderMinSize,
+		TTL:           64,
+		Protocol:      networklayer.ProtocolTCP,
+		SourceIP:      net.ParseIP(src),
+		DestinationIP: net.ParseIP(dst),
+	}
+
+	tcpHeader := make([]byte, tcpHeaderMinSize)
+	binary.BigEndian.PutUint16(tcpHeader[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcpHeader[2:4], dstPort)
+	tcpHeader[12] = 5 << 4
+	tcpHeader[13] = flags
+
+	return append(ipHeader.Marshal(), tcpHeader...)
+}
+
+func Test_Filter_Rules(t *testing.T) {
+	f := NewFilter()
+
+	// Allow ssh from the lab network, reject everything else to port 22
+	_, err := f.Add(Rule{
+		Chain:    netstack.HookInput,
+		Src:      "10.88.45.0/24",
+		Protocol: networklayer.ProtocolTCP,
+		DstPorts: PortRange{Min: 22},
+		Action:   ActionAccept,
+	})
+	assert.NoError(t, err)
+
+	rejectID, err := f.Add(Rule{
+		Chain:      netstack.HookInput,
+		Protocol:   networklayer.ProtocolTCP,
+		DstPorts:   PortRange{Min: 22},
+		Action:     ActionReject,
+		RejectWith: RejectTCPReset,
+	})
+	assert.NoError(t, err)
+
+	// Drop SYNs to anything in the high port range
+	_, err = f.Add(Rule{
+		Chain:        netstack.HookInput,
+		Protocol:     networklayer.ProtocolTCP,
+		DstPorts:     PortRange{Min: 8000, Max: 8999},
+		TCPFlags:     0x02,
+		TCPFlagsMask: 0x12,
+		Action:       ActionDrop,
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		skb     *netstack.SkBuff
+		verdict netstack.Verdict
+	}{
+		{"ssh from lab", netstack.NewSkBuff(genTCPPacket("10.88.45.1", "10.88.45.69", 5555, 22, 0x02)), netstack.VerdictAccept},
+		{"ssh from outside", netstack.NewSkBuff(genTCPPacket("8.8.8.8", "10.88.45.69", 5555, 22, 0x02)), netstack.VerdictRejectTCPReset},
+		{"syn to 8080", netstack.NewSkBuff(genTCPPacket("8.8.8.8", "10.88.45.69", 5555, 8080, 0x02)), netstack.VerdictDrop},
+		{"ack to 8080", netstack.NewSkBuff(genTCPPacket("8.8.8.8", "10.88.45.69", 5555, 8080, 0x10)), netstack.VerdictAccept},
+		{"syn to 9000", netstack.NewSkBuff(genTCPPacket("8.8.8.8", "10.88.45.69", 5555, 9000, 0x02)), netstack.VerdictAccept},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.verdict, f.Hook(netstack.HookInput, tt.skb), tt.name)
+	}
+
+	// Rules only apply to their own chain
+	assert.Equal(t, netstack.VerdictAccept, f.Hook(netstack.HookForward, tests[1].skb))
+
+	// Counters
+	rules := f.List()
+	assert.Len(t, rules, 3)
+	assert.Equal(t, uint64(1), rules[0].Packets)
+	assert.Equal(t, uint64(1), rules[1].Packets)
+
+	// Deleting the reject rule and dropping by policy
+	assert.NoError(t, f.Delete(rejectID))
+	assert.NoError(t, f.SetPolicy(netstack.HookInput, ActionDrop))
+	assert.Equal(t, netstack.VerdictDrop, f.Hook(netstack.HookInput, tests[1].skb))
+}
+
+func Test_Filter_States(t *testing.T) {
+	f := NewFilter()
+
+	_, err := f.Add(Rule{
+		Chain:  netstack.HookInput,
+		States: []netstack.ConnState{netstack.ConnStateEstablished, netstack.ConnStateRelated},
+		Action: ActionAccept,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, f.SetPolicy(netstack.HookInput, ActionDrop))
+
+	skb := netstack.NewSkBuff(genTCPPacket("8.8.8.8", "10.88.45.69", 443, 40000, 0x10))
+	assert.Equal(t, netstack.VerdictDrop, f.Hook(netstack.HookInput, skb))
+
+	skb.SetConnState(netstack.ConnStateEstablished)
+	assert.Equal(t, netstack.VerdictAccept, f.Hook(netstack.HookInput, skb))
+}
+
+func Test_Filter_InvalidRules(t *testing.T) {
+	f := NewFilter()
+
+	invalid := []Rule{
+		{Chain: netstack.HookInput, DstPorts: PortRange{Min: 80}, Action: ActionAccept},
+		{Chain: netstack.HookInput, Src: "10.0.0.0/33", Action: ActionAccept},
+		{Chain: netstack.HookInput, Action: ActionReject, RejectWith: RejectTCPReset},
+		{Chain: netstack.HookOutput, InIface: "tap0", Action: ActionDrop},
+		{Chain: netstack.HookInput, Action: "MASQUERADE"},
+	}
+
+	for _, rule := range invalid {
+		_, err := f.Add(rule)
+		assert.ErrorIs(t, err, ErrInvalidRule)
+	}
+}
@@ -0,0 +1,556 @@
+package netfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+)
+
+// =============================================================================
+// NAT Rule
+// NAT rules are only consulted for the first packet of a connection. The
+// translation is stored in the connection's reply tuple, and applied to
+// every packet of the connection in both directions, as well as to ICMP
+// errors about it.
+// =============================================================================
+
+type NATType string
+
+const (
+	// NATSource rewrites the source to ToAddr, in POSTROUTING
+	NATSource NATType = "SNAT"
+
+	// NATMasquerade rewrites the source to the address of the
+	// outgoing interface, in POSTROUTING
+	NATMasquerade NATType = "MASQUERADE"
+
+	// NATDestination rewrites the destination to ToAddr, in
+	// PREROUTING for forwarded packets and OUTPUT for local ones
+	NATDestination NATType = "DNAT"
+)
+
+type NATRule struct {
+	// ID is assigned when the rule is added
+	ID int
+
+	Type NATType
+
+	// Interface names. InIface is for DNAT, OutIface for SNAT and MASQUERADE.
+	InIface  string
+	OutIface string
+
+	// Addresses, either a single IP or a CIDR
+	Src string
+	Dst string
+
+	// IP protocol number, 0 matches any
+	Protocol uint8
+
+	// Destination ports, for TCP and UDP rules
+	DstPorts PortRange
+
+	// ToAddr is the new address, not used by MASQUERADE
+	ToAddr string
+
+	// ToPorts is the new port range. If empty, source NAT keeps the port
+	// when it can and destination NAT keeps it always.
+	ToPorts PortRange
+
+	// Conns counts the connections translated by the rule
+	Conns uint64
+
+	src    *net.IPNet
+	dst    *net.IPNet
+	toAddr netip.Addr
+}
+
+var ErrNATPortsExhausted = errors.New("no free NAT port")
+
+// compile validates the rule and parses its address fields
+func (rule *NATRule) compile() error {
+	switch rule.Type {
+	case NATSource, NATMasquerade:
+		if rule.InIface != "" {
+			return fmt.Errorf("%w: no input interface in %s", ErrInvalidRule, rule.Type)
+		}
+	case NATDestination:
+		if rule.OutIface != "" {
+			return fmt.Errorf("%w: no output interface in %s", ErrInvalidRule, rule.Type)
+		}
+	default:
+		return fmt.Errorf("%w: unknown NAT type %q", ErrInvalidRule, rule.Type)
+	}
+
+	hasPorts := !rule.DstPorts.IsAny() || !rule.ToPorts.IsAny()
+	if hasPorts && rule.Protocol != networklayer.ProtocolTCP && rule.Protocol != networklayer.ProtocolUDP {
+		return fmt.Errorf("%w: ports need protocol tcp or udp", ErrInvalidRule)
+	}
+
+	if rule.ToPorts.Max != 0 && rule.ToPorts.Max < rule.ToPorts.Min {
+		return fmt.Errorf("%w: empty port range", ErrInvalidRule)
+	}
+
+	if rule.Type == NATMasquerade {
+		if rule.ToAddr != "" {
+			return fmt.Errorf("%w: MASQUERADE uses the interface address", ErrInvalidRule)
+		}
+	} else {
+		ip := net.ParseIP(rule.ToAddr).To4()
+		if ip == nil {
+			return fmt.Errorf("%w: invalid address %q", ErrInvalidRule, rule.ToAddr)
+		}
+
+		rule.toAddr = toAddr(ip)
+	}
+
+	var err error
+
+	if rule.src, err = parseNet(rule.Src); err != nil {
+		return err
+	}
+
+	if rule.dst, err = parseNet(rule.Dst); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (rule *NATRule) matches(skb *netstack.SkBuff, t Tuple) bool {
+	if rule.InIface != "" && rule.InIface != ifaceName(skb.GetRxIface()) {
+		return false
+	}
+
+	if rule.OutIface != "" && rule.OutIface != ifaceName(skb.GetTxIface()) {
+		return false
+	}
+
+	if rule.src != nil && !rule.src.Contains(t.SrcIP.AsSlice()) {
+		return false
+	}
+
+	if rule.dst != nil && !rule.dst.Contains(t.DstIP.AsSlice()) {
+		return false
+	}
+
+	if rule.Protocol != 0 && rule.Protocol != t.Protocol {
+		return false
+	}
+
+	return rule.DstPorts.Contains(t.DstPort)
+}
+
+// =============================================================================
+// NAT
+// =============================================================================
+
+// manipType is the part of a packet a hook translates. The destination is
+// translated where packets enter, before routing, the source where they
+// leave.
+type manipType int
+
+const (
+	manipSrc manipType = iota
+	manipDst
+)
+
+type NAT struct {
+	mu     sync.Mutex
+	rules  []*NATRule
+	nextID int
+	ct     *Conntrack
+	Log    *log.Logger
+}
+
+func NewNAT(ct *Conntrack) *NAT {
+	return &NAT{
+		nextID: 1,
+		ct:     ct,
+		Log:    netstack.NewLogger("NAT"),
+	}
+}
+
+// Add appends a NAT rule and returns its ID
+func (nat *NAT) Add(rule NATRule) (int, error) {
+	if err := rule.compile(); err != nil {
+		return 0, err
+	}
+
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	rule.ID = nat.nextID
+	rule.Conns = 0
+	nat.nextID++
+
+	nat.rules = append(nat.rules, &rule)
+
+	return rule.ID, nil
+}
+
+// Delete removes the NAT rule with the given ID. Connections that are
+// already translated keep their translation.
+func (nat *NAT) Delete(id int) error {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	for i, rule := range nat.rules {
+		if rule.ID == id {
+			nat.rules = append(nat.rules[:i], nat.rules[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrRuleNotFound
+}
+
+// List returns a copy of the NAT rules
+func (nat *NAT) List() []NATRule {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	rules := []NATRule{}
+	for _, rule := range nat.rules {
+		rules = append(rules, *rule)
+	}
+
+	return rules
+}
+
+// Hook is the netstack.HookFunc for NAT
+func (nat *NAT) Hook(hook netstack.Hook, skb *netstack.SkBuff) netstack.Verdict {
+	ref, ok := skb.GetConn().(connRef)
+	if !ok {
+		return netstack.VerdictAccept
+	}
+
+	manip := manipSrc
+	if hook == netstack.HookPrerouting || hook == netstack.HookOutput {
+		manip = manipDst
+	}
+
+	// Connections are guarded by the conntrack lock
+	nat.ct.mu.Lock()
+	defer nat.ct.mu.Unlock()
+
+	conn := ref.conn
+
+	if !conn.confirmed && !conn.natDone[manip] {
+		conn.natDone[manip] = true
+
+		if err := nat.setup(conn, manip, hook, skb); err != nil {
+			nat.Log.Printf("%s, dropping packet: %s", err, conn)
+			return netstack.VerdictDrop
+		}
+	}
+
+	// Nothing to do for connections that aren't translated
+	if conn.Reply == conn.Orig.Reverse() {
+		return netstack.VerdictAccept
+	}
+
+	if ref.related {
+		translateICMPError(skb, ref, manip)
+	} else {
+		translate(skb.Data, target(ref), manip)
+	}
+
+	// The hooks run before the IP layer reads the addresses for routing
+	skb.SetSrcIP(net.IP(skb.Data[12:16]))
+	skb.SetDstIP(net.IP(skb.Data[16:20]))
+
+	return netstack.VerdictAccept
+}
+
+// setup finds the NAT rule for a new connection and stores the
+// translation in its reply tuple
+func (nat *NAT) setup(conn *Conn, manip manipType, hook netstack.Hook, skb *netstack.SkBuff) error {
+	// Locally delivered packets only have their destination translated
+	if hook == netstack.HookInput {
+		return nil
+	}
+
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	// The packet as it looks now, after any destination NAT
+	t := conn.Reply.Reverse()
+
+	for _, rule := range nat.rules {
+		if (rule.Type == NATDestination) != (manip == manipDst) || !rule.matches(skb, t) {
+			continue
+		}
+
+		var err error
+
+		switch rule.Type {
+		case NATDestination:
+			conn.Reply.SrcIP = rule.toAddr
+			if !rule.ToPorts.IsAny() {
+				conn.Reply.SrcPort = rule.ToPorts.Min
+			}
+		case NATSource, NATMasquerade:
+			addr := rule.toAddr
+			if rule.Type == NATMasquerade {
+				if addr, err = masqueradeAddr(skb); err != nil {
+					return err
+				}
+			}
+
+			err = nat.allocSrc(conn, addr, rule.ToPorts)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rule.Conns++
+
+		return nil
+	}
+
+	return nil
+}
+
+func masqueradeAddr(skb *netstack.SkBuff) (netip.Addr, error) {
+	iface, err := skb.GetTxIface()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, ifAddr := range iface.GetIfAddrs() {
+		if ip := ifAddr.IP.To4(); ip != nil {
+			return toAddr(ip), nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("no address on %s", iface.GetName())
+}
+
+// Ports used for source NAT when the rule doesn't give a range
+var (
+	defaultNATPorts   = PortRange{Min: 1024, Max: 65535}
+	defaultNATICMPIDs = PortRange{Min: 1, Max: 65535}
+)
+
+// allocSrc sets the reply tuple's destination to addr, with a port that
+// no other connection uses towards the same peer. The connection keeps
+// its port if it can.
+func (nat *NAT) allocSrc(conn *Conn, addr netip.Addr, ports PortRange) error {
+	reply := conn.Reply
+	reply.DstIP = addr
+
+	now := nat.ct.now()
+
+	switch reply.Protocol {
+	case networklayer.ProtocolTCP, networklayer.ProtocolUDP, networklayer.ProtocolICMP:
+	default:
+		// No ports to tell connections apart
+		if nat.ct.lookup(reply, now) != nil {
+			return ErrNATPortsExhausted
+		}
+
+		conn.Reply = reply
+
+		return nil
+	}
+
+	if ports.IsAny() {
+		ports = defaultNATPorts
+		if reply.Protocol == networklayer.ProtocolICMP {
+			ports = defaultNATICMPIDs
+		}
+	} else if ports.Max == 0 {
+		ports.Max = ports.Min
+	}
+
+	setPort := func(port uint16) {
+		reply.DstPort = port
+		if reply.Protocol == networklayer.ProtocolICMP {
+			reply.SrcPort = port
+		}
+	}
+
+	if ports.Contains(reply.DstPort) && nat.ct.lookup(reply, now) == nil {
+		conn.Reply = reply
+		return nil
+	}
+
+	// Search the range from a random start
+	n := int(ports.Max) - int(ports.Min) + 1
+	start := rand.Intn(n)
+
+	for i := 0; i < n; i++ {
+		setPort(uint16(int(ports.Min) + (start+i)%n))
+
+		if nat.ct.lookup(reply, now) == nil {
+			conn.Reply = reply
+			return nil
+		}
+	}
+
+	return ErrNATPortsExhausted
+}
+
+// target is the tuple a packet should have after translation
+func target(ref connRef) Tuple {
+	if ref.dir == DirOriginal {
+		return ref.conn.Reply.Reverse()
+	}
+
+	return ref.conn.Orig.Reverse()
+}
+
+// =============================================================================
+// Packet rewriting
+// =============================================================================
+
+const (
+	ipv4SrcOffset = 12
+	ipv4DstOffset = 16
+)
+
+// translate rewrites the source or destination address and port of the
+// IPv4 packet in b to those of t, fixing up the checksums. b may be a
+// packet quoted in an ICMP error, so its transport header can be cut short.
+func translate(b []byte, t Tuple, manip manipType) {
+	addrOffset, portOffset := ipv4SrcOffset, 0
+	addr, port := t.SrcIP.As4(), t.SrcPort
+
+	if manip == manipDst {
+		addrOffset, portOffset = ipv4DstOffset, 2
+		addr, port = t.DstIP.As4(), t.DstPort
+	}
+
+	headerLen := int(b[0]&0x0f) * 4
+	l4 := b[headerLen:]
+
+	var newPort [2]byte
+
+	binary.BigEndian.PutUint16(newPort[:], port)
+
+	// The transport checksum covers the addresses in the pseudo header.
+	// ICMP has no pseudo header, but the query ID is in its checksum.
+	switch b[9] {
+	case networklayer.ProtocolTCP:
+		updateChecksum(l4, 16, b[addrOffset:addrOffset+4], addr[:])
+		rewrite(l4, 16, portOffset, newPort[:])
+	case networklayer.ProtocolUDP:
+		// A zero UDP checksum means there is none
+		if len(l4) >= 8 && binary.BigEndian.Uint16(l4[6:8]) != 0 {
+			updateChecksum(l4, 6, b[addrOffset:addrOffset+4], addr[:])
+			rewrite(l4, 6, portOffset, newPort[:])
+
+			if binary.BigEndian.Uint16(l4[6:8]) == 0 {
+				binary.BigEndian.PutUint16(l4[6:8], 0xffff)
+			}
+		} else {
+			rewrite(l4, -1, portOffset, newPort[:])
+		}
+	case networklayer.ProtocolICMP:
+		if len(l4) >= 1 && !isICMPError(l4[0]) {
+			rewrite(l4, 2, 4, newPort[:])
+		}
+	}
+
+	copy(b[addrOffset:addrOffset+4], addr[:])
+	networklayer.SetIPv4Checksum(b)
+}
+
+// rewrite replaces the field at offset in b with val, updating the
+// checksum at csumOffset to match. A negative csumOffset means there
+// is no checksum. Fields past the end of b are left alone.
+func rewrite(b []byte, csumOffset, offset int, val []byte) {
+	if offset+len(val) > len(b) {
+		return
+	}
+
+	if csumOffset >= 0 {
+		updateChecksum(b, csumOffset, b[offset:offset+len(val)], val)
+	}
+
+	copy(b[offset:], val)
+}
+
+// updateChecksum adjusts the checksum at csumOffset in b for a change
+// of some 16 bit aligned words, as in RFC 1624:
+//
+//	HC' = ~(~HC + ~m + m')
+func updateChecksum(b []byte, csumOffset int, from, to []byte) {
+	if csumOffset+2 > len(b) {
+		return
+	}
+
+	sum := uint32(^binary.BigEndian.Uint16(b[csumOffset:]))
+
+	for i := 0; i+1 < len(from); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(from[i:]))
+		sum += uint32(binary.BigEndian.Uint16(to[i:]))
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	binary.BigEndian.PutUint16(b[csumOffset:], ^uint16(sum))
+}
+
+// translateICMPError translates an ICMP error about a translated
+// connection. The quoted packet went the other way, so it's restored
+// to how its sender saw it, and the outer addresses are translated as
+// far as they belong to the connection.
+func translateICMPError(skb *netstack.SkBuff, ref connRef, manip manipType) {
+	b := skb.Data
+	headerLen := int(b[0]&0x0f) * 4
+
+	end := int(binary.BigEndian.Uint16(b[2:4]))
+	if end > len(b) {
+		end = len(b)
+	}
+
+	icmp := b[headerLen:end]
+	if len(icmp) < icmpErrorHeaderSize+networklayer.IPv4HeaderSize {
+		return
+	}
+
+	// Tuples of the error's direction before and after translation
+	before, after := ref.conn.Orig, ref.conn.Reply.Reverse()
+	if ref.dir == DirReply {
+		before, after = ref.conn.Reply, ref.conn.Orig.Reverse()
+	}
+
+	if manip == manipDst {
+		// The quoted packet ends up as the reverse of the error's direction
+		inner := icmp[icmpErrorHeaderSize:]
+		translate(inner, after.Reverse(), manipSrc)
+		translate(inner, after.Reverse(), manipDst)
+
+		// The ICMP checksum covers the quoted packet, redo it
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:4], netstack.Checksum(icmp))
+	}
+
+	outer := Tuple{
+		SrcIP: toAddr(net.IP(b[ipv4SrcOffset : ipv4SrcOffset+4])),
+		DstIP: toAddr(net.IP(b[ipv4DstOffset : ipv4DstOffset+4])),
+	}
+
+	switch {
+	case manip == manipDst && outer.DstIP == before.DstIP:
+		outer.DstIP = after.DstIP
+	case manip == manipSrc && outer.SrcIP == before.SrcIP:
+		outer.SrcIP = after.SrcIP
+	default:
+		return
+	}
+
+	translate(b[:end], outer, manip)
+}
@@ -0,0 +1,197 @@
+package netfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIface only has what the NAT rules look at
+type fakeIface struct {
+	netstack.NetworkInterface
+	name string
+	ip   net.IP
+}
+
+func (iface *fakeIface) GetName() string {
+	return iface.name
+}
+
+func (iface *fakeIface) GetIfAddrs() []netstack.IfAddr {
+	return []netstack.IfAddr{{IP: iface.ip}}
+}
+
+// l4Checksum sums the transport segment of b with its pseudo header
+func l4Checksum(b []byte) uint16 {
+	headerLen := int(b[0]&0x0f) * 4
+	l4 := b[headerLen:]
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:8], b[12:20])
+	pseudo[9] = b[9]
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(l4)))
+
+	return netstack.Checksum(append(pseudo, l4...))
+}
+
+// withChecksum fills in the UDP or TCP checksum of b
+func withChecksum(b []byte) []byte {
+	offset := 6
+	if b[9] == networklayer.ProtocolTCP {
+		offset = 16
+	}
+
+	l4 := b[networklayer.IPv4HeaderSize:]
+	l4[offset], l4[offset+1] = 0, 0
+	binary.BigEndian.PutUint16(l4[offset:], l4Checksum(b))
+
+	return b
+}
+
+func assertChecksums(t *testing.T, b []byte) {
+	headerLen := int(b[0]&0x0f) * 4
+	assert.Zero(t, netstack.Checksum(b[:headerLen]), "ip checksum")
+	assert.Zero(t, l4Checksum(b), "l4 checksum")
+}
+
+func newTestNetfilter() (*Netfilter, *netstack.Hooks) {
+	ct, _ := newTestConntrack()
+	nf := &Netfilter{
+		Filter:    NewFilter(),
+		Conntrack: ct,
+		NAT:       NewNAT(ct),
+	}
+
+	hooks := netstack.NewHooks()
+	nf.register(hooks)
+
+	return nf, hooks
+}
+
+// routeOut runs a forwarded packet through the hooks, out of iface
+func routeOut(hooks *netstack.Hooks, b []byte, iface netstack.NetworkInterface) *netstack.SkBuff {
+	skb := netstack.NewSkBuff(b)
+	skb.SetTxIface(iface)
+
+	for _, hook := range []netstack.Hook{netstack.HookPrerouting, netstack.HookForward, netstack.HookPostrouting} {
+		if hooks.Run(hook, skb) != netstack.VerdictAccept {
+			return nil
+		}
+	}
+
+	return skb
+}
+
+func Test_NAT_Masquerade(t *testing.T) {
+	nf, hooks := newTestNetfilter()
+	wan := &fakeIface{name: "eth0", ip: net.IPv4(192, 168, 1, 5).To4()}
+	lan := &fakeIface{name: "tap0", ip: net.IPv4(10, 88, 45, 69).To4()}
+
+	_, err := nf.NAT.Add(NATRule{Type: NATMasquerade, OutIface: "eth0"})
+	assert.NoError(t, err)
+
+	// Outgoing, the source becomes the interface address and keeps its port
+	skb := routeOut(hooks, withChecksum(genUDPPacket("10.88.45.1", "8.8.8.8", 40000, 53)), wan)
+	pkt, _ := ParsePacket(skb.Data)
+	assert.Equal(t, "192.168.1.5", pkt.SrcIP.String())
+	assert.Equal(t, uint16(40000), pkt.SrcPort)
+	assert.Equal(t, "192.168.1.5", skb.GetSrcIP().String())
+	assertChecksums(t, skb.Data)
+
+	// The reply is translated back
+	reply := withChecksum(genUDPPacket("8.8.8.8", "192.168.1.5", 53, 40000))
+	skb = routeOut(hooks, reply, lan)
+	pkt, _ = ParsePacket(skb.Data)
+	assert.Equal(t, "10.88.45.1", pkt.DstIP.String())
+	assert.Equal(t, uint16(40000), pkt.DstPort)
+	assert.Equal(t, netstack.ConnStateEstablished, skb.GetConnState())
+	assertChecksums(t, skb.Data)
+
+	// Another client using the same port gets a different one
+	skb = routeOut(hooks, withChecksum(genUDPPacket("10.88.45.2", "8.8.8.8", 40000, 53)), wan)
+	pkt, _ = ParsePacket(skb.Data)
+	assert.Equal(t, "192.168.1.5", pkt.SrcIP.String())
+	assert.NotEqual(t, uint16(40000), pkt.SrcPort)
+	assert.GreaterOrEqual(t, pkt.SrcPort, uint16(1024))
+	assertChecksums(t, skb.Data)
+
+	// An ICMP error about the first flow goes to the client, quoting
+	// the packet as the client sent it
+	quoted := withChecksum(genUDPPacket("192.168.1.5", "8.8.8.8", 40000, 53))
+	icmpErr := genICMPError("172.16.0.1", "192.168.1.5", networklayer.ICMPTypeTimeExceeded, quoted)
+	icmp := icmpErr[networklayer.IPv4HeaderSize:]
+	binary.BigEndian.PutUint16(icmp[2:4], netstack.Checksum(icmp))
+
+	skb = routeOut(hooks, icmpErr, lan)
+	assert.Equal(t, netstack.ConnStateRelated, skb.GetConnState())
+
+	pkt, _ = ParsePacket(skb.Data)
+	assert.Equal(t, "172.16.0.1", pkt.SrcIP.String())
+	assert.Equal(t, "10.88.45.1", pkt.DstIP.String())
+	assert.Equal(t, "10.88.45.1", pkt.Inner.SrcIP.String())
+	assert.Equal(t, uint16(40000), pkt.Inner.SrcPort)
+	assert.Zero(t, netstack.Checksum(skb.Data[:networklayer.IPv4HeaderSize]))
+	assert.Zero(t, netstack.Checksum(skb.Data[networklayer.IPv4HeaderSize:]))
+
+	inner := skb.Data[networklayer.IPv4HeaderSize+icmpErrorHeaderSize:]
+	assert.Zero(t, netstack.Checksum(inner[:networklayer.IPv4HeaderSize]))
+}
+
+func Test_NAT_PortForward(t *testing.T) {
+	nf, hooks := newTestNetfilter()
+	lan := &fakeIface{name: "tap0", ip: net.IPv4(10, 88, 45, 69).To4()}
+	wan := &fakeIface{name: "eth0", ip: net.IPv4(192, 168, 1, 5).To4()}
+
+	_, err := nf.NAT.Add(NATRule{
+		Type:     NATDestination,
+		Dst:      "192.168.1.5",
+		Protocol: networklayer.ProtocolTCP,
+		DstPorts: PortRange{Min: 8080},
+		ToAddr:   "10.88.45.10",
+		ToPorts:  PortRange{Min: 80},
+	})
+	assert.NoError(t, err)
+
+	skb := routeOut(hooks, withChecksum(genTCPPacket("1.2.3.4", "192.168.1.5", 5555, 8080, tcpFlagSYN)), lan)
+	pkt, _ := ParsePacket(skb.Data)
+	assert.Equal(t, "10.88.45.10", pkt.DstIP.String())
+	assert.Equal(t, uint16(80), pkt.DstPort)
+	assertChecksums(t, skb.Data)
+
+	skb = routeOut(hooks, withChecksum(genTCPPacket("10.88.45.10", "1.2.3.4", 80, 5555, tcpFlagSYN|tcpFlagACK)), wan)
+	pkt, _ = ParsePacket(skb.Data)
+	assert.Equal(t, "192.168.1.5", pkt.SrcIP.String())
+	assert.Equal(t, uint16(8080), pkt.SrcPort)
+	assertChecksums(t, skb.Data)
+
+	conns := nf.Conntrack.List()
+	assert.Len(t, conns, 1)
+	assert.Equal(t, TCPConnSynRecv, conns[0].TCPState)
+	assert.Equal(t, uint64(1), nf.NAT.List()[0].Conns)
+
+	// Other ports are left alone
+	skb = routeOut(hooks, withChecksum(genTCPPacket("1.2.3.4", "192.168.1.5", 5555, 22, tcpFlagSYN)), lan)
+	pkt, _ = ParsePacket(skb.Data)
+	assert.Equal(t, "192.168.1.5", pkt.DstIP.String())
+}
+
+func Test_NAT_InvalidRules(t *testing.T) {
+	nat := NewNAT(NewConntrack())
+
+	invalid := []NATRule{
+		{Type: "REDIRECT", ToAddr: "10.0.0.1"},
+		{Type: NATDestination, ToAddr: "not an address"},
+		{Type: NATMasquerade, ToAddr: "10.0.0.1"},
+		{Type: NATSource, InIface: "tap0", ToAddr: "10.0.0.1"},
+		{Type: NATDestination, ToAddr: "10.0.0.1", ToPorts: PortRange{Min: 80}},
+	}
+
+	for _, rule := range invalid {
+		_, err := nat.Add(rule)
+		assert.ErrorIs(t, err, ErrInvalidRule)
+	}
+}
@@ -0,0 +1,50 @@
+package netfilter
+
+import (
+	"github.com/mattcarp12/matnet/netstack"
+)
+
+// =============================================================================
+// Netfilter
+// The packet filtering framework: connection tracking, NAT and the
+// packet filter, attached to the IP hooks.
+// =============================================================================
+
+type Netfilter struct {
+	Filter    *Filter
+	Conntrack *Conntrack
+	NAT       *NAT
+}
+
+// Init creates the connection tracker, NAT and the packet filter and
+// attaches them to the hooks
+func Init(hooks *netstack.Hooks) *Netfilter {
+	ct := NewConntrack()
+	nf := &Netfilter{
+		Filter:    NewFilter(),
+		Conntrack: ct,
+		NAT:       NewNAT(ct),
+	}
+
+	nf.register(hooks)
+
+	go nf.Conntrack.gcLoop()
+
+	return nf
+}
+
+func (nf *Netfilter) register(hooks *netstack.Hooks) {
+	hooks.Register(netstack.HookPrerouting, netstack.HookPriorityConntrack, nf.Conntrack.Hook)
+	hooks.Register(netstack.HookOutput, netstack.HookPriorityConntrack, nf.Conntrack.Hook)
+	hooks.Register(netstack.HookInput, netstack.HookPriorityConntrackConfirm, nf.Conntrack.Hook)
+	hooks.Register(netstack.HookPostrouting, netstack.HookPriorityConntrackConfirm, nf.Conntrack.Hook)
+
+	hooks.Register(netstack.HookPrerouting, netstack.HookPriorityNATDst, nf.NAT.Hook)
+	hooks.Register(netstack.HookOutput, netstack.HookPriorityNATDst, nf.NAT.Hook)
+	hooks.Register(netstack.HookInput, netstack.HookPriorityNATSrc, nf.NAT.Hook)
+	hooks.Register(netstack.HookPostrouting, netstack.HookPriorityNATSrc, nf.NAT.Hook)
+
+	for hook := netstack.Hook(0); hook < netstack.NumHooks; hook++ {
+		hooks.Register(hook, netstack.HookPriorityFilter, nf.Filter.Hook)
+	}
+}
@@ -0,0 +1,198 @@
+package netfilter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+)
+
+// =============================================================================
+// Packet is a parsed view of the headers of an IPv4 packet, as seen at
+// one of the hooks. It is used to match packets against filter rules.
+// =============================================================================
+
+type Packet struct {
+	SrcIP     net.IP
+	DstIP     net.IP
+	Protocol  uint8
+	HeaderLen int
+	Length    int
+
+	// Fragment is set for non-initial fragments, which have no
+	// transport header.
+	Fragment bool
+
+	// TCP and UDP
+	SrcPort uint16
+	DstPort uint16
+
+	// TCP
+	TCPFlags uint8
+
+	// ICMP
+	ICMPType uint8
+	ICMPCode uint8
+	ICMPID   uint16
+
+	// Inner is the packet quoted in the body of an ICMP error message.
+	// Only its addresses, protocol and ports are parsed.
+	Inner *Packet
+}
+
+var ErrShortPacket = errors.New("packet too short")
+
+const (
+	tcpHeaderMinSize  = 20
+	udpHeaderSize     = 8
+	icmpHeaderMinSize = 4
+)
+
+// ParsePacket parses the IPv4 header and the start of the transport
+// header from b, which must begin with the IPv4 header. It doesn't
+// validate checksums, that is left to the protocols.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < networklayer.IPv4HeaderSize || b[0]>>4 != 4 {
+		return nil, ErrShortPacket
+	}
+
+	pkt := &Packet{
+		SrcIP:     net.IP(b[12:16]),
+		DstIP:     net.IP(b[16:20]),
+		Protocol:  b[9],
+		HeaderLen: int(b[0]&0x0f) * 4,
+		Length:    int(binary.BigEndian.Uint16(b[2:4])),
+		Fragment:  binary.BigEndian.Uint16(b[6:8])&0x1fff != 0,
+	}
+
+	if pkt.HeaderLen < networklayer.IPv4HeaderSize || pkt.HeaderLen > len(b) {
+		return nil, ErrShortPacket
+	}
+
+	if pkt.Fragment {
+		return pkt, nil
+	}
+
+	l4 := b[pkt.HeaderLen:]
+
+	switch pkt.Protocol {
+	case networklayer.ProtocolTCP:
+		if len(l4) < tcpHeaderMinSize {
+			return nil, ErrShortPacket
+		}
+
+		pkt.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		pkt.TCPFlags = l4[13]
+	case networklayer.ProtocolUDP:
+		if len(l4) < udpHeaderSize {
+			return nil, ErrShortPacket
+		}
+
+		pkt.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	case networklayer.ProtocolICMP:
+		if len(l4) < icmpHeaderMinSize {
+			return nil, ErrShortPacket
+		}
+
+		pkt.ICMPType = l4[0]
+		pkt.ICMPCode = l4[1]
+
+		if isICMPError(pkt.ICMPType) {
+			// The error quotes the offending IP header and at least
+			// 8 bytes of its payload, after the 8 byte ICMP header
+			if len(l4) >= icmpErrorHeaderSize {
+				pkt.Inner = parseInnerPacket(l4[icmpErrorHeaderSize:])
+			}
+		} else if len(l4) >= icmpEchoHeaderSize {
+			pkt.ICMPID = binary.BigEndian.Uint16(l4[4:6])
+		}
+	}
+
+	return pkt, nil
+}
+
+const (
+	icmpEchoHeaderSize   = 8
+	icmpErrorHeaderSize  = 8
+	icmpTypeSourceQuench = 4
+)
+
+func isICMPError(icmpType uint8) bool {
+	switch icmpType {
+	case networklayer.ICMPTypeDstUnreach,
+		icmpTypeSourceQuench,
+		networklayer.ICMPTypeRedirect,
+		networklayer.ICMPTypeTimeExceeded,
+		networklayer.ICMPTypeParameterProblem:
+		return true
+	}
+
+	return false
+}
+
+// parseInnerPacket parses the packet quoted in an ICMP error. Unlike
+// ParsePacket, it only needs the first 8 bytes of the transport header.
+func parseInnerPacket(b []byte) *Packet {
+	if len(b) < networklayer.IPv4HeaderSize || b[0]>>4 != 4 {
+		return nil
+	}
+
+	pkt := &Packet{
+		SrcIP:     net.IP(b[12:16]),
+		DstIP:     net.IP(b[16:20]),
+		Protocol:  b[9],
+		HeaderLen: int(b[0]&0x0f) * 4,
+		Length:    int(binary.BigEndian.Uint16(b[2:4])),
+		Fragment:  binary.BigEndian.Uint16(b[6:8])&0x1fff != 0,
+	}
+
+	if pkt.HeaderLen < networklayer.IPv4HeaderSize || pkt.HeaderLen+8 > len(b) {
+		return nil
+	}
+
+	l4 := b[pkt.HeaderLen:]
+
+	switch pkt.Protocol {
+	case networklayer.ProtocolTCP, networklayer.ProtocolUDP:
+		pkt.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	case networklayer.ProtocolICMP:
+		pkt.ICMPType = l4[0]
+		pkt.ICMPCode = l4[1]
+		pkt.ICMPID = binary.BigEndian.Uint16(l4[4:6])
+	}
+
+	return pkt
+}
+
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case networklayer.ProtocolTCP:
+		return "TCP"
+	case networklayer.ProtocolUDP:
+		return "UDP"
+	case networklayer.ProtocolICMP:
+		return "ICMP"
+	default:
+		return fmt.Sprint(protocol)
+	}
+}
+
+func (pkt *Packet) String() string {
+	s := fmt.Sprintf("SRC=%s DST=%s LEN=%d PROTO=%s", pkt.SrcIP, pkt.DstIP, pkt.Length, protocolName(pkt.Protocol))
+
+	switch pkt.Protocol {
+	case networklayer.ProtocolTCP:
+		s += fmt.Sprintf(" SPT=%d DPT=%d FLAGS=0x%02x", pkt.SrcPort, pkt.DstPort, pkt.TCPFlags)
+	case networklayer.ProtocolUDP:
+		s += fmt.Sprintf(" SPT=%d DPT=%d", pkt.SrcPort, pkt.DstPort)
+	case networklayer.ProtocolICMP:
+		s += fmt.Sprintf(" TYPE=%d CODE=%d", pkt.ICMPType, pkt.ICMPCode)
+	}
+
+	return s
+}
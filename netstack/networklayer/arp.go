@@ -242,7 +242,7 @@ func (arp *ARPProtocol) ARPRequest(skb *netstack.SkBuff) {
 	}
 
 	// Get target IP address
-	targetIP := skb.GetDstIP()
+	targetIP := skb.GetNextHop()
 
 	// Get the source IP address
 	srcIP := skb.GetSrcIP()
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"log"
+	"net"
 
 	"github.com/mattcarp12/matnet/netstack"
 )
@@ -30,6 +31,21 @@ const (
 	ICMPTypeParameterProblem = 12
 )
 
+// Destination Unreachable codes
+const (
+	ICMPCodeNetUnreachable   = 0
+	ICMPCodeHostUnreachable  = 1
+	ICMPCodeProtoUnreachable = 2
+	ICMPCodePortUnreachable  = 3
+	ICMPCodeAdminProhibited  = 13
+)
+
+// Time Exceeded codes
+const (
+	ICMPCodeTTLExceeded        = 0
+	ICMPCodeReassemblyExceeded = 1
+)
+
 // function to unmarshal the ICMP header
 func (icmp *ICMPv4Header) Unmarshal(data []byte) error {
 	// check the length of the ICMP header
@@ -167,8 +183,101 @@ func (icmp *ICMPv4) HandleRedirect(skb *netstack.SkBuff) {
 	// Update routing table
 }
 
-// function to send PARAMETER PROBLEM message
-func (icmp *ICMPv4) SendParamProblem(skb *netstack.SkBuff, code uint8) {}
+// function to send DESTINATION UNREACHABLE message
+func (icmp *ICMPv4) SendDestUnreachable(skb *netstack.SkBuff, code uint8) {
+	icmp.sendError(skb, ICMPTypeDstUnreach, code, [4]byte{})
+}
+
+// function to send PARAMETER PROBLEM message. The pointer identifies
+// the octet of the original header where the error was detected.
+func (icmp *ICMPv4) SendParamProblem(skb *netstack.SkBuff, code uint8, pointer uint8) {
+	icmp.sendError(skb, ICMPTypeParameterProblem, code, [4]byte{pointer})
+}
 
 // function to send TIME EXCEEDED message
-func (icmp *ICMPv4) SendTimeExceeded(skb *netstack.SkBuff, code uint8) {}
+func (icmp *ICMPv4) SendTimeExceeded(skb *netstack.SkBuff, code uint8) {
+	icmp.sendError(skb, ICMPTypeTimeExceeded, code, [4]byte{})
+}
+
+// sendError sends an ICMP error message about the packet in skb back
+// to its source. skb.Data must still begin with the offending IPv4 header.
+func (icmp *ICMPv4) sendError(skb *netstack.SkBuff, icmpType, code uint8, rest [4]byte) {
+	orig := skb.Data
+	if len(orig) < IPv4HeaderSize {
+		return
+	}
+
+	if !icmpErrorAllowed(orig) {
+		return
+	}
+
+	rxIface, err := skb.GetRxIface()
+	if err != nil || len(rxIface.GetIfAddrs()) == 0 {
+		return
+	}
+
+	// The body is the rest of the ICMP header followed by the original
+	// IP header and the first 8 bytes of its payload.
+	headerLen := int(orig[0]&0x0f) * 4
+	if headerLen < IPv4HeaderSize || headerLen > len(orig) {
+		headerLen = IPv4HeaderSize
+	}
+
+	quoteLen := headerLen + 8
+	if quoteLen > len(orig) {
+		quoteLen = len(orig)
+	}
+
+	icmpHeader := &ICMPv4Header{
+		Type: icmpType,
+		Code: code,
+		Body: append(rest[:], orig[:quoteLen]...),
+	}
+	icmpHeader.Checksum = netstack.Checksum(icmpHeader.Marshal())
+
+	errSkb := netstack.NewSkBuff(icmpHeader.Marshal())
+	errSkb.SetTxIface(rxIface)
+	errSkb.SetType(netstack.ProtocolTypeIPv4)
+	errSkb.SetSrcIP(rxIface.GetIfAddrs()[0].IP)
+	errSkb.SetDstIP(net.IP(orig[12:16]))
+	errSkb.SetL4Header(icmpHeader)
+
+	icmp.Log.Printf("Sending ICMP type %d code %d to %s", icmpType, code, errSkb.GetDstIP())
+
+	// Send the ICMP error to IP
+	icmp.ip.TxChan() <- errSkb
+
+	// Make sure to read the skb response
+	errSkb.GetResp()
+}
+
+// icmpErrorAllowed implements the checks from RFC 1122 3.2.2: an ICMP
+// error must not be sent about another ICMP error, a non-initial fragment,
+// or a datagram that wasn't sent to or from a single host.
+func icmpErrorAllowed(orig []byte) bool {
+	srcIP := net.IP(orig[12:16])
+	dstIP := net.IP(orig[16:20])
+
+	if srcIP.IsUnspecified() || srcIP.IsMulticast() || srcIP.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	if dstIP.IsMulticast() || dstIP.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	// non-initial fragment
+	if binary.BigEndian.Uint16(orig[6:8])&0x1fff != 0 {
+		return false
+	}
+
+	headerLen := int(orig[0]&0x0f) * 4
+	if orig[9] == ProtocolICMP && headerLen >= IPv4HeaderSize && len(orig) > headerLen {
+		switch orig[headerLen] {
+		case ICMPTypeDstUnreach, ICMPTypeRedirect, ICMPTypeTimeExceeded, ICMPTypeParameterProblem:
+			return false
+		}
+	}
+
+	return true
+}
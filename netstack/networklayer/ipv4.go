@@ -3,6 +3,7 @@ package networklayer
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -29,6 +30,7 @@ type IPv4Header struct {
 	HeaderChecksum uint16
 	SourceIP       net.IP
 	DestinationIP  net.IP
+	Options        IPv4Options
 }
 
 const (
@@ -37,7 +39,10 @@ const (
 	ProtocolUDP  = 17
 )
 
-const IPv4HeaderSize = 20
+const (
+	IPv4HeaderSize    = 20
+	IPv4HeaderMaxSize = 60
+)
 
 var (
 	ErrInvalidIPv4Header = errors.New("invalid IPv4 header")
@@ -45,15 +50,24 @@ var (
 	ErrInvalidCheckSum   = errors.New("invalid checksum")
 )
 
+// Size returns the length of the marshaled header in bytes,
+// including any options and padding.
+func (h *IPv4Header) Size() int {
+	return IPv4HeaderSize + h.Options.Size()
+}
+
 func (h *IPv4Header) Marshal() []byte {
+	options := h.Options.Marshal()
+
 	// make byte buffer for IPv4 header
-	b := make([]byte, IPv4HeaderSize)
+	b := make([]byte, IPv4HeaderSize, IPv4HeaderSize+len(options))
 
 	// version and IHL
-	b[0] = (4 << 4) | (5 & 0x0f)
+	ihl := uint8((IPv4HeaderSize + len(options)) / 4)
+	b[0] = (4 << 4) | (ihl & 0x0f)
 
 	// type of service
-	b[1] = 0
+	b[1] = h.TypeOfService
 
 	// total length
 	binary.BigEndian.PutUint16(b[2:4], uint16(h.TotalLength))
@@ -61,11 +75,8 @@ func (h *IPv4Header) Marshal() []byte {
 	// identification
 	binary.BigEndian.PutUint16(b[4:6], h.Identification)
 
-	// flags
-	b[6] = (h.Flags << 5) & 0xe0
-
-	// fragment offset
-	binary.BigEndian.PutUint16(b[6:8], h.FragmentOffset)
+	// flags and fragment offset
+	binary.BigEndian.PutUint16(b[6:8], uint16(h.Flags)<<13|h.FragmentOffset&0x1fff)
 
 	// TTL
 	b[8] = h.TTL
@@ -82,6 +93,9 @@ func (h *IPv4Header) Marshal() []byte {
 	// destination IP
 	copy(b[16:20], h.DestinationIP.To4())
 
+	// options, already padded to a multiple of 4 bytes
+	b = append(b, options...)
+
 	return b
 }
 
@@ -100,8 +114,9 @@ func (h *IPv4Header) Unmarshal(b []byte) error {
 	// IHL
 	h.IHL = b[0] & 0x0f
 
-	// Enforce IHL value of 5 since not supporting IP options
-	if h.IHL != 5 {
+	// IHL is in 32-bit words, and must at least cover the fixed header
+	headerLen := int(h.IHL) * 4
+	if headerLen < IPv4HeaderSize || len(b) < headerLen {
 		return ErrInvalidIPv4Header
 	}
 
@@ -110,6 +125,9 @@ func (h *IPv4Header) Unmarshal(b []byte) error {
 
 	// total length
 	h.TotalLength = binary.BigEndian.Uint16(b[2:4])
+	if int(h.TotalLength) < headerLen {
+		return ErrInvalidIPv4Header
+	}
 
 	// identification
 	h.Identification = binary.BigEndian.Uint16(b[4:6])
@@ -140,11 +158,19 @@ func (h *IPv4Header) Unmarshal(b []byte) error {
 	// destination IP
 	h.DestinationIP = net.IP(b[16:20])
 
-	// Check the checksum of the header
-	if netstack.Checksum(b[0:IPv4HeaderSize]) != 0 {
+	// Check the checksum of the header, which covers the options too
+	if netstack.Checksum(b[0:headerLen]) != 0 {
 		return ErrInvalidCheckSum
 	}
 
+	// options
+	h.Options = nil
+	if headerLen > IPv4HeaderSize {
+		if err := h.Options.Unmarshal(b[IPv4HeaderSize:headerLen]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -190,6 +216,254 @@ func GetIPProtocolType(skb *netstack.SkBuff) (uint8, error) {
 	}
 }
 
+// =============================================================================
+// IPv4 Options
+// =============================================================================
+
+// Option types. The type byte is made up of a copied flag (1 bit),
+// an option class (2 bits) and an option number (5 bits).
+const (
+	IPv4OptionEndOfList   = 0
+	IPv4OptionNop         = 1
+	IPv4OptionSecurity    = 130
+	IPv4OptionLSRR        = 131
+	IPv4OptionRecordRoute = 7
+	IPv4OptionStreamID    = 136
+	IPv4OptionSSRR        = 137
+	IPv4OptionTimestamp   = 68
+	IPv4OptionRouterAlert = 148
+)
+
+// Timestamp option flags (low 4 bits of the fourth byte)
+const (
+	IPv4TimestampOnly       = 0
+	IPv4TimestampAndAddr    = 1
+	IPv4TimestampPrespecify = 3
+)
+
+const ipv4OptionsMaxSize = IPv4HeaderMaxSize - IPv4HeaderSize
+
+var ErrInvalidIPv4Option = errors.New("invalid IPv4 option")
+
+// IPv4OptionError is returned when an option fails validation.
+// Pointer is the offset, from the start of the IPv4 header, of the
+// octet where the problem was found, as reported in an ICMP
+// Parameter Problem message.
+type IPv4OptionError struct {
+	Pointer uint8
+}
+
+func (e *IPv4OptionError) Error() string {
+	return fmt.Sprintf("%s at octet %d", ErrInvalidIPv4Option, e.Pointer)
+}
+
+func (e *IPv4OptionError) Unwrap() error {
+	return ErrInvalidIPv4Option
+}
+
+func optionError(offset int) error {
+	return &IPv4OptionError{Pointer: uint8(IPv4HeaderSize + offset)}
+}
+
+// IPv4Option is a single option in TLV form. Data does not include the
+// type and length octets. End of List and No Operation are single octet
+// options and have no Data.
+type IPv4Option struct {
+	Type uint8
+	Data []byte
+}
+
+// Copied reports whether the option must be copied into all fragments.
+func (o IPv4Option) Copied() bool {
+	return o.Type&0x80 != 0
+}
+
+func (o IPv4Option) Class() uint8 {
+	return (o.Type >> 5) & 0x03
+}
+
+func (o IPv4Option) Number() uint8 {
+	return o.Type & 0x1f
+}
+
+func (o IPv4Option) Len() int {
+	if o.Type == IPv4OptionEndOfList || o.Type == IPv4OptionNop {
+		return 1
+	}
+
+	return 2 + len(o.Data)
+}
+
+func (o IPv4Option) Marshal() []byte {
+	if o.Type == IPv4OptionEndOfList || o.Type == IPv4OptionNop {
+		return []byte{o.Type}
+	}
+
+	b := make([]byte, 2, o.Len())
+	b[0] = o.Type
+	b[1] = uint8(o.Len())
+
+	return append(b, o.Data...)
+}
+
+type IPv4Options []IPv4Option
+
+// Size returns the length of the marshaled options, padded
+// to a multiple of 4 bytes.
+func (opts IPv4Options) Size() int {
+	n := 0
+	for _, o := range opts {
+		n += o.Len()
+	}
+
+	return (n + 3) &^ 3
+}
+
+func (opts IPv4Options) Marshal() []byte {
+	b := make([]byte, 0, opts.Size())
+	for _, o := range opts {
+		b = append(b, o.Marshal()...)
+	}
+
+	// Pad with End of List octets up to a 32-bit boundary
+	for len(b)%4 != 0 {
+		b = append(b, IPv4OptionEndOfList)
+	}
+
+	return b
+}
+
+// Unmarshal parses the options area of an IPv4 header. Offsets in
+// any returned IPv4OptionError are relative to the start of the header.
+func (opts *IPv4Options) Unmarshal(b []byte) error {
+	if len(b) > ipv4OptionsMaxSize {
+		return ErrInvalidIPv4Header
+	}
+
+	for i := 0; i < len(b); {
+		optType := b[i]
+
+		switch optType {
+		case IPv4OptionEndOfList:
+			// Everything after End of List is padding
+			return nil
+		case IPv4OptionNop:
+			*opts = append(*opts, IPv4Option{Type: optType})
+			i++
+
+			continue
+		}
+
+		// Every other option has a length octet, which counts
+		// the type and length octets as well.
+		if i+1 >= len(b) {
+			return optionError(i)
+		}
+
+		optLen := int(b[i+1])
+		if optLen < 2 || i+optLen > len(b) {
+			return optionError(i + 1)
+		}
+
+		option := IPv4Option{
+			Type: optType,
+			Data: b[i+2 : i+optLen],
+		}
+
+		if err := option.validate(); err != nil {
+			var optErr *IPv4OptionError
+			if errors.As(err, &optErr) {
+				optErr.Pointer += uint8(i)
+			}
+
+			return err
+		}
+
+		*opts = append(*opts, option)
+		i += optLen
+	}
+
+	return nil
+}
+
+// validate checks the contents of the options we understand.
+// Unknown options are passed through untouched.
+func (o IPv4Option) validate() error {
+	switch o.Type {
+	case IPv4OptionRecordRoute, IPv4OptionLSRR, IPv4OptionSSRR:
+		// pointer octet followed by a list of addresses
+		if len(o.Data) < 1 || (len(o.Data)-1)%4 != 0 {
+			return optionError(1)
+		}
+
+		if o.Data[0] < 4 {
+			return optionError(2)
+		}
+	case IPv4OptionTimestamp:
+		// pointer octet, overflow/flag octet, then the timestamp entries
+		if len(o.Data) < 2 {
+			return optionError(1)
+		}
+
+		if o.Data[0] < 5 {
+			return optionError(2)
+		}
+
+		entrySize := 4
+		switch o.Data[1] & 0x0f {
+		case IPv4TimestampOnly:
+		case IPv4TimestampAndAddr, IPv4TimestampPrespecify:
+			entrySize = 8
+		default:
+			return optionError(3)
+		}
+
+		if (len(o.Data)-2)%entrySize != 0 {
+			return optionError(1)
+		}
+	case IPv4OptionRouterAlert:
+		if len(o.Data) != 2 {
+			return optionError(1)
+		}
+	case IPv4OptionStreamID:
+		if len(o.Data) != 2 {
+			return optionError(1)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the first option of the given type.
+func (opts IPv4Options) Get(optType uint8) (IPv4Option, bool) {
+	for _, o := range opts {
+		if o.Type == optType {
+			return o, true
+		}
+	}
+
+	return IPv4Option{}, false
+}
+
+// HasRouterAlert reports whether the packet carries a Router Alert
+// option (RFC 2113), which IGMP and RSVP rely on.
+func (opts IPv4Options) HasRouterAlert() bool {
+	_, ok := opts.Get(IPv4OptionRouterAlert)
+
+	return ok
+}
+
+// ParseIPv4Options parses and validates a raw options buffer, as
+// passed in by a socket. The buffer must fit in an IPv4 header.
+func ParseIPv4Options(b []byte) (IPv4Options, error) {
+	opts := IPv4Options{}
+	if err := opts.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
 // =============================================================================
 // IPv4 Protocol
 // =============================================================================
@@ -197,11 +471,19 @@ func GetIPProtocolType(skb *netstack.SkBuff) (uint8, error) {
 type IPv4 struct {
 	netstack.IProtocol
 	Icmp *ICMPv4
+
+	// Hooks run at each point in the IP path, e.g. by the packet filter
+	Hooks *netstack.Hooks
+
+	// Forwarding turns on routing of packets that aren't addressed to us
+	Forwarding   bool
+	RoutingTable netstack.RoutingTable
 }
 
 func NewIPv4() *IPv4 {
 	ipv4 := &IPv4{
-		IProtocol: netstack.NewIProtocol(netstack.ProtocolTypeIPv4),
+		IProtocol:  netstack.NewIProtocol(netstack.ProtocolTypeIPv4),
+		Forwarding: netstack.DefaultIPForwarding,
 	}
 	ipv4.Log = netstack.NewLogger("IPV4")
 
@@ -216,28 +498,61 @@ func (ipv4 *IPv4) HandleRx(skb *netstack.SkBuff) {
 	if err := ipv4Header.Unmarshal(skb.Data); err != nil {
 		// If there is a problem with the IPv4 header, we may
 		// need to send a ICMP error message back to the sender.
-		switch err {
-		case ErrInvalidIPv4Header:
-			ipv4.Icmp.SendParamProblem(skb, 0)
-		case ErrTTLZero:
+		var optErr *IPv4OptionError
+
+		switch {
+		case errors.As(err, &optErr):
+			ipv4.Log.Printf("dropping packet: %v", err)
+			ipv4.Icmp.SendParamProblem(skb, 0, optErr.Pointer)
+		case errors.Is(err, ErrInvalidIPv4Header):
+			ipv4.Icmp.SendParamProblem(skb, 0, 0)
+		case errors.Is(err, ErrTTLZero):
 			ipv4.Icmp.SendTimeExceeded(skb, 0)
-		case ErrInvalidCheckSum:
+		case errors.Is(err, ErrInvalidCheckSum):
 			ipv4.Log.Println("invalid checksum")
 		}
 
 		return
 	}
 
+	// The frame may be longer than the datagram, if the link layer
+	// padded it. A datagram longer than the frame was truncated.
+	if int(ipv4Header.TotalLength) > len(skb.Data) {
+		ipv4.Log.Println("dropping truncated packet")
+		return
+	}
+
+	skb.Data = skb.Data[:ipv4Header.TotalLength]
+
 	rxIface, err := skb.GetRxIface()
 	if err != nil {
 		ipv4.Log.Println("failed to get rx iface")
 		return
 	}
 
+	// Fill in the skb from the header, so the hooks and
+	// the upper layers can use it
+	skb.SetSrcIP(ipv4Header.SourceIP)
+	skb.SetDstIP(ipv4Header.DestinationIP)
+	skb.SetL3Header(ipv4Header)
+	skb.SetTOS(ipv4Header.TypeOfService)
+	skb.SetTTL(ipv4Header.TTL)
+
+	if verdict := ipv4.Hooks.Run(netstack.HookPrerouting, skb); verdict != netstack.VerdictAccept {
+		ipv4.reject(skb, verdict)
+		return
+	}
+
 	// Check the Destination IP matches the IP of the interface,
-	// only for global unicast addresses
+	// only for global unicast addresses. Anything else gets
+	// forwarded, if we're acting as a router.
 	if ipv4Header.DestinationIP.IsGlobalUnicast() && !rxIface.HasIPAddr(ipv4Header.DestinationIP) {
-		ipv4.Log.Println("Destination IP does not match the IP of the interface")
+		ipv4.forward(skb, ipv4Header)
+		return
+	}
+
+	if verdict := ipv4.Hooks.Run(netstack.HookInput, skb); verdict != netstack.VerdictAccept {
+		ipv4.reject(skb, verdict)
 		return
 	}
 
@@ -245,10 +560,7 @@ func (ipv4 *IPv4) HandleRx(skb *netstack.SkBuff) {
 
 	// Everything is good, now update the skb before passing
 	// it to the transport layer or ICMP
-	skb.SetSrcIP(ipv4Header.SourceIP)
-	skb.SetDstIP(ipv4Header.DestinationIP)
 	skb.SetType(ipv4Header.GetL4Type())
-	skb.SetL3Header(ipv4Header)
 	skb.StripBytes(int(ipv4Header.IHL) * 4)
 
 	// Check if packet is ICMP
@@ -271,20 +583,34 @@ func (ipv4 *IPv4) HandleTx(skb *netstack.SkBuff) {
 		return
 	}
 
+	// Options attached by the socket, if any
+	options, err := ParseIPv4Options(skb.GetIPOptions())
+	if err != nil {
+		skb.Error(err)
+		return
+	}
+
+	// Use the default TTL unless the socket set one
+	ttl := skb.GetTTL()
+	if ttl == 0 {
+		ttl = netstack.DefaultTTL
+	}
+
 	// Create a new IPv4 header
 	ipv4Header := &IPv4Header{
 		Version:        4,
-		IHL:            5,
-		TypeOfService:  0,
-		TotalLength:    uint16(len(skb.Data) + IPv4HeaderSize),
+		IHL:            uint8((IPv4HeaderSize + options.Size()) / 4),
+		TypeOfService:  skb.GetTOS(),
+		TotalLength:    uint16(len(skb.Data) + IPv4HeaderSize + options.Size()),
 		Identification: 0,
 		Flags:          0,
 		FragmentOffset: 0,
-		TTL:            64,
+		TTL:            ttl,
 		Protocol:       protocolType,
 		HeaderChecksum: 0,
 		SourceIP:       skb.GetSrcIP().To4(),
 		DestinationIP:  skb.GetDstIP().To4(),
+		Options:        options,
 	}
 
 	// Calculate the checksum for the IPv4 header
@@ -294,6 +620,23 @@ func (ipv4 *IPv4) HandleTx(skb *netstack.SkBuff) {
 	skb.SetL3Header(ipv4Header)
 	skb.PrependBytes(ipv4Header.Marshal())
 
+	// Locally generated packets that are filtered out are reported
+	// back to the sender as an error
+	if verdict := ipv4.Hooks.Run(netstack.HookOutput, skb); verdict != netstack.VerdictAccept {
+		skb.Error(netstack.ErrPacketFiltered)
+		return
+	}
+
+	// Destination NAT in OUTPUT can send the packet somewhere else
+	if !skb.GetDstIP().Equal(ipv4Header.DestinationIP) {
+		ipv4.reroute(skb)
+	}
+
+	if verdict := ipv4.Hooks.Run(netstack.HookPostrouting, skb); verdict != netstack.VerdictAccept {
+		skb.Error(netstack.ErrPacketFiltered)
+		return
+	}
+
 	// Passing to link layer, so need to set the skb type
 	// to the type of the interface
 	skb.SetType(netstack.ProtocolTypeEthernet)
@@ -301,3 +644,141 @@ func (ipv4 *IPv4) HandleTx(skb *netstack.SkBuff) {
 	// Send the skb to the next layer
 	ipv4.TxDown(skb)
 }
+
+// reroute looks up the route for a locally generated packet whose
+// destination changed after the socket routed it
+func (ipv4 *IPv4) reroute(skb *netstack.SkBuff) {
+	if ipv4.RoutingTable == nil {
+		return
+	}
+
+	route := ipv4.RoutingTable.Lookup(skb.GetDstIP())
+	if route.Iface == nil {
+		return
+	}
+
+	nextHop := route.NextHop
+	if nextHop == nil {
+		nextHop = route.Gateway
+	}
+
+	skb.SetTxIface(route.Iface)
+	skb.SetNextHop(nextHop)
+}
+
+// forward routes a packet that isn't addressed to us on towards
+// its destination. skb.Data must still start with the IPv4 header.
+func (ipv4 *IPv4) forward(skb *netstack.SkBuff, ipv4Header *IPv4Header) {
+	if !ipv4.Forwarding || ipv4.RoutingTable == nil {
+		ipv4.Log.Println("Destination IP does not match the IP of the interface")
+		return
+	}
+
+	// The TTL has to be above zero after we decrement it
+	if ipv4Header.TTL <= 1 {
+		ipv4.Icmp.SendTimeExceeded(skb, ICMPCodeTTLExceeded)
+		return
+	}
+
+	route := ipv4.RoutingTable.Lookup(ipv4Header.DestinationIP)
+	if route.Iface == nil {
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodeNetUnreachable)
+		return
+	}
+
+	nextHop := route.NextHop
+	if nextHop == nil {
+		nextHop = route.Gateway
+	}
+
+	skb.SetTxIface(route.Iface)
+	skb.SetNextHop(nextHop)
+
+	if verdict := ipv4.Hooks.Run(netstack.HookForward, skb); verdict != netstack.VerdictAccept {
+		ipv4.reject(skb, verdict)
+		return
+	}
+
+	// Decrement the TTL, which means the checksum has to be redone
+	ipv4Header.TTL--
+	skb.SetTTL(ipv4Header.TTL)
+	skb.Data[8] = ipv4Header.TTL
+	SetIPv4Checksum(skb.Data)
+
+	if verdict := ipv4.Hooks.Run(netstack.HookPostrouting, skb); verdict != netstack.VerdictAccept {
+		ipv4.reject(skb, verdict)
+		return
+	}
+
+	skb.SetType(netstack.ProtocolTypeEthernet)
+	ipv4.TxDown(skb)
+
+	// Nobody is waiting on the response for a forwarded packet,
+	// so drain it here to keep the interface from blocking
+	go skb.GetResp()
+}
+
+// reject handles a received packet that a hook didn't accept. Dropped packets
+// are silently discarded, rejected ones are answered with an ICMP error or a
+// TCP reset. skb.Data must still start with the IPv4 header.
+func (ipv4 *IPv4) reject(skb *netstack.SkBuff, verdict netstack.Verdict) {
+	switch verdict {
+	case netstack.VerdictAccept, netstack.VerdictDrop:
+	case netstack.VerdictRejectNetUnreachable:
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodeNetUnreachable)
+	case netstack.VerdictRejectHostUnreachable:
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodeHostUnreachable)
+	case netstack.VerdictRejectProtoUnreachable:
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodeProtoUnreachable)
+	case netstack.VerdictRejectPortUnreachable:
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodePortUnreachable)
+	case netstack.VerdictRejectAdminProhibited:
+		ipv4.Icmp.SendDestUnreachable(skb, ICMPCodeAdminProhibited)
+	case netstack.VerdictRejectTCPReset:
+		ipv4.sendReset(skb)
+	}
+}
+
+// sendReset asks TCP to answer the packet in skb with a RST
+func (ipv4 *IPv4) sendReset(skb *netstack.SkBuff) {
+	l3Header, err := skb.GetL3Header()
+	if err != nil {
+		return
+	}
+
+	ipv4Header, ok := l3Header.(*IPv4Header)
+	if !ok || ipv4Header.Protocol != ProtocolTCP {
+		return
+	}
+
+	tcp, err := ipv4.GetLayer().GetNextLayer().GetProtocol(netstack.ProtocolTypeTCP)
+	if err != nil {
+		return
+	}
+
+	resetter, ok := tcp.(netstack.Resetter)
+	if !ok {
+		return
+	}
+
+	rxIface, err := skb.GetRxIface()
+	if err != nil {
+		return
+	}
+
+	rstSkb := netstack.NewSkBuff(skb.Data[int(ipv4Header.IHL)*4:])
+	rstSkb.SetSrcIP(ipv4Header.SourceIP)
+	rstSkb.SetDstIP(ipv4Header.DestinationIP)
+	rstSkb.SetRxIface(rxIface)
+
+	resetter.SendReset(rstSkb)
+}
+
+// SetIPv4Checksum recomputes the header checksum of the raw
+// IPv4 packet in b, after a header field has been changed.
+func SetIPv4Checksum(b []byte) {
+	headerLen := int(b[0]&0x0f) * 4
+
+	b[10], b[11] = 0, 0
+	binary.BigEndian.PutUint16(b[10:12], netstack.Checksum(b[:headerLen]))
+}
@@ -0,0 +1,185 @@
+package networklayer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeIPv4Header(options IPv4Options) *IPv4Header {
+	h := &IPv4Header{
+		Version:        4,
+		TypeOfService:  0xb8,
+		TotalLength:    uint16(IPv4HeaderSize + options.Size()),
+		Identification: 0x1234,
+		Flags:          0x2,
+		FragmentOffset: 0,
+		TTL:            1,
+		Protocol:       2,
+		SourceIP:       net.IPv4(10, 88, 45, 69).To4(),
+		DestinationIP:  net.IPv4(224, 0, 0, 22).To4(),
+		Options:        options,
+	}
+	h.HeaderChecksum = netstack.Checksum(h.Marshal())
+
+	return h
+}
+
+func Test_IPv4_Options_RoundTrip(t *testing.T) {
+	options := IPv4Options{
+		{Type: IPv4OptionRouterAlert, Data: []byte{0, 0}},
+		{Type: IPv4OptionNop},
+		{Type: IPv4OptionRecordRoute, Data: []byte{4, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	b := makeIPv4Header(options).Marshal()
+
+	// 4 + 1 + 11 bytes of options, padded to 16
+	assert.Len(t, b, IPv4HeaderSize+16)
+	assert.Equal(t, uint8(9), b[0]&0x0f)
+	assert.Equal(t, uint8(0xb8), b[1])
+	assert.Equal(t, uint8(0x40), b[6])
+
+	h := &IPv4Header{}
+	assert.NoError(t, h.Unmarshal(b))
+	assert.Equal(t, uint8(9), h.IHL)
+	assert.Equal(t, uint8(0xb8), h.TypeOfService)
+	assert.Equal(t, uint8(0x2), h.Flags)
+	assert.Equal(t, options, h.Options)
+	assert.True(t, h.Options.HasRouterAlert())
+}
+
+func Test_IPv4_Options_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []byte
+		pointer uint8
+	}{
+		{"length too short", []byte{IPv4OptionRouterAlert, 1, 0, 0}, 21},
+		{"length past end", []byte{IPv4OptionNop, IPv4OptionRecordRoute, 11, 4}, 22},
+		{"router alert length", []byte{IPv4OptionRouterAlert, 3, 0, 0}, 21},
+		{"record route pointer", []byte{IPv4OptionRecordRoute, 7, 3, 0, 0, 0, 0, 0}, 22},
+		{"timestamp flag", []byte{IPv4OptionTimestamp, 4, 5, 2}, 23},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeIPv4Header(nil).Marshal()
+			b = append(b, tt.options...)
+			b[0] = 0x40 | uint8(len(b)/4)
+			b[3] = uint8(len(b))
+			b[10], b[11] = 0, 0
+			sum := netstack.Checksum(b)
+			b[10], b[11] = byte(sum>>8), byte(sum)
+
+			var optErr *IPv4OptionError
+
+			err := (&IPv4Header{}).Unmarshal(b)
+			assert.ErrorIs(t, err, ErrInvalidIPv4Option)
+			assert.True(t, errors.As(err, &optErr))
+			assert.Equal(t, tt.pointer, optErr.Pointer)
+		})
+	}
+}
+
+func Test_IPv4_Header_BadIHL(t *testing.T) {
+	b := makeIPv4Header(nil).Marshal()
+	b[0] = 0x44
+
+	assert.ErrorIs(t, (&IPv4Header{}).Unmarshal(b), ErrInvalidIPv4Header)
+}
+
+type fakeIface struct {
+	netstack.NetworkInterface
+}
+
+// fakeUDPHeader stands in for the UDP header the transport layer
+// puts on an outgoing skb
+type fakeUDPHeader struct{}
+
+func (fakeUDPHeader) Marshal() []byte                { return nil }
+func (fakeUDPHeader) Unmarshal([]byte) error         { return nil }
+func (fakeUDPHeader) GetType() netstack.ProtocolType { return netstack.ProtocolTypeUDP }
+func (fakeUDPHeader) GetSrcPort() uint16             { return 0 }
+func (fakeUDPHeader) GetDstPort() uint16             { return 0 }
+
+// newTestIPv4 makes an IPv4 protocol between a link and a transport
+// layer, whose channels the test reads
+func newTestIPv4() (*IPv4, *netstack.Layer, *netstack.Layer) {
+	ipv4 := NewIPv4()
+
+	linkLayer := netstack.NewLayer()
+	networkLayer := netstack.NewLayer(ipv4)
+	transportLayer := netstack.NewLayer()
+	networkLayer.SetPrevLayer(linkLayer)
+	networkLayer.SetNextLayer(transportLayer)
+	ipv4.SetLayer(networkLayer)
+
+	return ipv4, linkLayer, transportLayer
+}
+
+func Test_IPv4_HandleTx_IPControl(t *testing.T) {
+	tests := []struct {
+		name string
+		ctl  netstack.IPControl
+		ecn  uint8
+		tos  uint8
+		ttl  uint8
+	}{
+		{"defaults", netstack.IPControl{}, netstack.ECNNotECT, 0, netstack.DefaultTTL},
+		{"socket settings", netstack.IPControl{TOS: 0xb8, TTL: 5}, netstack.ECNNotECT, 0xb8, 5},
+		{"ECN keeps the DSCP", netstack.IPControl{TOS: 0xb8}, netstack.ECNECT0, 0xba, netstack.DefaultTTL},
+		{"ECN replaces ECN", netstack.IPControl{TOS: 0xb9}, netstack.ECNCE, 0xbb, netstack.DefaultTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipv4, linkLayer, _ := newTestIPv4()
+
+			skb := netstack.NewSkBuff([]byte("hello"))
+			skb.SetL4Header(fakeUDPHeader{})
+			skb.SetSrcIP(net.IPv4(10, 88, 45, 69))
+			skb.SetDstIP(net.IPv4(10, 88, 45, 1))
+			skb.SetIPControl(tt.ctl)
+
+			if tt.ecn != netstack.ECNNotECT {
+				skb.SetECN(tt.ecn)
+				assert.Equal(t, tt.ecn, skb.GetECN())
+			}
+
+			go ipv4.HandleTx(skb)
+			skb = <-linkLayer.TxChan()
+
+			h := &IPv4Header{}
+			assert.NoError(t, h.Unmarshal(skb.Data))
+			assert.Equal(t, tt.tos, h.TypeOfService)
+			assert.Equal(t, tt.ttl, h.TTL)
+		})
+	}
+}
+
+func Test_IPv4_HandleRx_IPControl(t *testing.T) {
+	ipv4, _, transportLayer := newTestIPv4()
+
+	// The TOS and TTL of a received packet are kept on the skb for
+	// the socket's ancillary data
+	h := makeIPv4Header(nil)
+	h.Protocol = ProtocolUDP
+	h.TotalLength += 5
+	h.HeaderChecksum = 0
+	h.HeaderChecksum = netstack.Checksum(h.Marshal())
+
+	skb := netstack.NewSkBuff(append(h.Marshal(), "hello"...))
+	skb.SetRxIface(&fakeIface{})
+
+	go ipv4.HandleRx(skb)
+	skb = <-transportLayer.RxChan()
+
+	assert.Equal(t, []byte("hello"), skb.Data)
+	assert.Equal(t, uint8(0xb8), skb.GetTOS())
+	assert.Equal(t, uint8(1), skb.GetTTL())
+	assert.Equal(t, uint8(netstack.ECNNotECT), skb.GetECN())
+}
@@ -5,13 +5,15 @@ import (
 	"github.com/mattcarp12/matnet/netstack/linklayer"
 )
 
-func Init(linkLayer *linklayer.LinkLayer) *netstack.Layer {
+func Init(linkLayer *linklayer.LinkLayer, routingTable netstack.RoutingTable, hooks *netstack.Hooks) *netstack.Layer {
 	arp := NewARP()
 	linkLayer.AddNeighborProtocol(arp)
 
 	ipv4 := NewIPv4()
 	icmpv4 := NewICMPv4(ipv4)
 	ipv4.Icmp = icmpv4
+	ipv4.Hooks = hooks
+	ipv4.RoutingTable = routingTable
 
 	ipv6 := NewIPV6()
 
@@ -39,6 +39,42 @@ func (s SockAddr) GetType() AddressType {
 	}
 }
 
+// =============================================================================
+// IPControl holds the IP header fields that the upper layers control
+// on a per-packet basis. On transmit these are set from the socket, and
+// on receive they're filled in from the IP header.
+// =============================================================================
+type IPControl struct {
+	// Type of service byte: the DSCP in the top 6 bits and the
+	// ECN codepoint in the bottom 2 bits (RFC 2474, RFC 3168)
+	TOS uint8
+
+	// Time to live. Zero means use the default.
+	TTL uint8
+
+	// Raw IP options
+	Options []byte
+}
+
+// ECN codepoints (RFC 3168)
+const (
+	ECNNotECT = 0x00
+	ECNECT1   = 0x01
+	ECNECT0   = 0x02
+	ECNCE     = 0x03
+	ECNMask   = 0x03
+)
+
+const DefaultTTL = 64
+
+func (ctl IPControl) DSCP() uint8 {
+	return ctl.TOS >> 2
+}
+
+func (ctl IPControl) ECN() uint8 {
+	return ctl.TOS & ECNMask
+}
+
 // =============================================================================
 // SkBuff is the struct that represents a packet as it moves
 // through the networking stack.
@@ -53,6 +89,10 @@ type SkBuff struct {
 	l2Header     L2Header
 	l3Header     L3Header
 	l4Header     L4Header
+	ipControl    IPControl
+	nextHop      net.IP
+	connState    ConnState
+	conn         any
 	RespChan     chan SkbResponse
 
 	// Resp SkbResponse
@@ -153,6 +193,84 @@ func (skb *SkBuff) SetL4Header(header L4Header) {
 	skb.l4Header = header
 }
 
+// GetNextHop returns the address the link layer should resolve to
+// deliver the packet. Unless a route set one, that's the destination.
+func (skb *SkBuff) GetNextHop() net.IP {
+	if skb.nextHop != nil {
+		return skb.nextHop
+	}
+
+	return skb.dstAddr.IP
+}
+
+func (skb *SkBuff) SetNextHop(ip net.IP) {
+	skb.nextHop = ip
+}
+
+// GetConnState returns the connection tracking state of the packet.
+// Packets are untracked unless connection tracking sets a state.
+func (skb *SkBuff) GetConnState() ConnState {
+	return skb.connState
+}
+
+func (skb *SkBuff) SetConnState(state ConnState) {
+	skb.connState = state
+}
+
+// GetConn returns the connection tracking entry of the packet. It's
+// opaque to the stack, only connection tracking and NAT look inside.
+func (skb *SkBuff) GetConn() any {
+	return skb.conn
+}
+
+func (skb *SkBuff) SetConn(conn any) {
+	skb.conn = conn
+}
+
+func (skb *SkBuff) GetIPControl() IPControl {
+	return skb.ipControl
+}
+
+func (skb *SkBuff) SetIPControl(ctl IPControl) {
+	skb.ipControl = ctl
+}
+
+// GetIPOptions returns the raw IP options to send with the packet,
+// as set by the socket that created it.
+func (skb *SkBuff) GetIPOptions() []byte {
+	return skb.ipControl.Options
+}
+
+func (skb *SkBuff) SetIPOptions(options []byte) {
+	skb.ipControl.Options = options
+}
+
+func (skb *SkBuff) GetTOS() uint8 {
+	return skb.ipControl.TOS
+}
+
+func (skb *SkBuff) SetTOS(tos uint8) {
+	skb.ipControl.TOS = tos
+}
+
+func (skb *SkBuff) GetTTL() uint8 {
+	return skb.ipControl.TTL
+}
+
+func (skb *SkBuff) SetTTL(ttl uint8) {
+	skb.ipControl.TTL = ttl
+}
+
+// GetECN returns the ECN codepoint, the low two bits of the TOS byte
+func (skb *SkBuff) GetECN() uint8 {
+	return skb.ipControl.TOS & ECNMask
+}
+
+// SetECN sets the ECN codepoint without touching the DSCP bits
+func (skb *SkBuff) SetECN(ecn uint8) {
+	skb.ipControl.TOS = skb.ipControl.TOS&^ECNMask | ecn&ECNMask
+}
+
 func (skb *SkBuff) GetSrcAddr() SockAddr {
 	return skb.srcAddr
 }
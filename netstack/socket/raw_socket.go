@@ -1,9 +1,5 @@
 package socket
 
-import (
-	"net"
-)
-
 type RawSocket struct {
 	SocketMeta
 }
@@ -22,14 +18,14 @@ func (s *RawSocket) Bind(addr SockAddr) error {
 	return nil
 }
 
-// Listen...
-func (s *RawSocket) Listen() error {
-	return nil
+// Listen is only supported by stream sockets
+func (s *RawSocket) Listen(backlog int) error {
+	return ErrNotSupported
 }
 
-// Accept...
-func (s *RawSocket) Accept() (net.Conn, error) {
-	return nil, nil
+// Accept is only supported by stream sockets
+func (s *RawSocket) Accept() (Socket, error) {
+	return nil, ErrNotSupported
 }
 
 // Connect...
@@ -42,9 +38,14 @@ func (s *RawSocket) Close() error {
 	return nil
 }
 
+// Shutdown only applies to connections
+func (s *RawSocket) Shutdown(how ShutdownHow) error {
+	return ErrNotSupported
+}
+
 // Read...
-func (s *RawSocket) Read() ([]byte, error) {
-	return []byte{}, nil
+func (s *RawSocket) Read() ([]byte, *ControlMessage, error) {
+	return []byte{}, nil, nil
 }
 
 // Write...
@@ -53,8 +54,8 @@ func (s *RawSocket) Write(b []byte) (int, error) {
 }
 
 // ReadFrom...
-func (s *RawSocket) ReadFrom(b []byte, addr *SockAddr) (int, error) {
-	return 0, nil
+func (s *RawSocket) ReadFrom(size int) (Datagram, error) {
+	return Datagram{}, nil
 }
 
 // WriteTo...
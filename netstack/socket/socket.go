@@ -8,9 +8,14 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/netfilter"
+	"github.com/mattcarp12/matnet/netstack/networklayer"
+	"github.com/mattcarp12/matnet/netstack/transportlayer"
 )
 
 type SockAddr = netstack.SockAddr
@@ -35,6 +40,32 @@ const (
 	SyscallWrite    SockSyscallType = "write"
 	SyscallReadFrom SockSyscallType = "readfrom"
 	SyscallWriteTo  SockSyscallType = "writeto"
+	SyscallShutdown SockSyscallType = "shutdown"
+
+	SyscallSetSockOpt SockSyscallType = "setsockopt"
+	SyscallGetSockOpt SockSyscallType = "getsockopt"
+
+	// Packet filter management
+	SyscallFilterAdd    SockSyscallType = "filter_add"
+	SyscallFilterDelete SockSyscallType = "filter_delete"
+	SyscallFilterList   SockSyscallType = "filter_list"
+	SyscallFilterFlush  SockSyscallType = "filter_flush"
+	SyscallFilterPolicy SockSyscallType = "filter_policy"
+
+	// Connection tracking
+	SyscallConntrackList SockSyscallType = "conntrack_list"
+
+	// NAT rule management
+	SyscallNATAdd    SockSyscallType = "nat_add"
+	SyscallNATDelete SockSyscallType = "nat_delete"
+	SyscallNATList   SockSyscallType = "nat_list"
+
+	// TCP settings. The congestion control algorithm for new
+	// connections is set by name in Data, and returned in Data.
+	SyscallTCPCongestion SockSyscallType = "tcp_congestion"
+
+	// The stats of all TCP connections, like ss -ti
+	SyscallTCPConnList SockSyscallType = "tcp_conn_list"
 )
 
 type SockSyscallRequest struct {
@@ -45,6 +76,24 @@ type SockSyscallRequest struct {
 	Addr        SockAddr
 	Flags       int
 	Data        []byte
+	Backlog     int         // Used by listen
+	Size        int         // Used by readfrom, the size of the buffer, 0 for any
+	How         ShutdownHow // Used by shutdown
+
+	// Socket option fields, used by setsockopt. Integer options are passed
+	// in OptValue, anything else is passed in Data.
+	OptLevel SockOptLevel
+	OptName  SockOptName
+	OptValue int
+
+	// Packet filter fields
+	Rule   *netfilter.Rule `json:",omitempty"`
+	RuleID int             `json:",omitempty"`
+	Chain  netstack.Hook
+	Policy netfilter.Action `json:",omitempty"`
+
+	// NAT fields. NAT rules are deleted by RuleID.
+	NATRule *netfilter.NATRule `json:",omitempty"`
 }
 
 type SockSyscallResponse struct {
@@ -53,7 +102,30 @@ type SockSyscallResponse struct {
 	Err          error `json:"-"`
 	ErrMsg       string
 	Data         []byte
+	Control      *ControlMessage `json:",omitempty"`
 	BytesWritten int
+
+	// Accept returns the new socket in SockID, and the peer address here.
+	// Readfrom returns the sender of the datagram here.
+	Addr SockAddr
+
+	// Readfrom results, besides Data and Control
+	Iface     string `json:",omitempty"` // The interface the datagram arrived on
+	Truncated bool   `json:",omitempty"` // The datagram didn't fit in the buffer
+
+	// Packet filter results
+	RuleID int              `json:",omitempty"`
+	Rules  []netfilter.Rule `json:",omitempty"`
+
+	// Connection tracking results
+	Conns []netfilter.Conn `json:",omitempty"`
+
+	// NAT results
+	NATRules []netfilter.NATRule `json:",omitempty"`
+
+	// TCP connection stats, of one socket for TCP_INFO or of all
+	TCPInfo  *transportlayer.TCPStats  `json:",omitempty"`
+	TCPConns []transportlayer.TCPStats `json:",omitempty"`
 }
 
 func (req SockSyscallRequest) MakeResponse() SockSyscallResponse {
@@ -95,18 +167,32 @@ func (resp SockSyscallResponse) Bytes() []byte {
 // ============================================================================
 type Socket interface {
 	Bind(addr SockAddr) error
-	Listen() error
-	Accept() (net.Conn, error)
+	Listen(backlog int) error
+	Accept() (Socket, error)
 	Connect(addr SockAddr) error
 	Close() error
-	Read() ([]byte, error)
+	Read() ([]byte, *ControlMessage, error)
 	Write(b []byte) (int, error)
-	ReadFrom(b []byte, addr *SockAddr) (int, error)
+	ReadFrom(size int) (Datagram, error)
 	WriteTo(b []byte, addr SockAddr) (int, error)
+	SetSockOpt(level SockOptLevel, name SockOptName, value int, data []byte) error
+	Shutdown(how ShutdownHow) error
 
 	SocketMetaOps
 }
 
+// ShutdownHow tells which directions of a connection shutdown closes,
+// with the same values as the Linux constants
+type ShutdownHow int
+
+const (
+	ShutdownRead ShutdownHow = iota
+	ShutdownWrite
+	ShutdownBoth
+)
+
+var ErrInvalidShutdown = errors.New("invalid shutdown direction")
+
 // Each socket is identified by a globally unique ID.
 type SockID string
 
@@ -134,6 +220,13 @@ const (
 var (
 	ErrInvalidSocketType = errors.New("invalid socket type")
 	ErrInvalidSocketAddr = errors.New("invalid socket address")
+	ErrNotSupported      = errors.New("operation not supported on socket")
+)
+
+// Flags of reads and writes
+const (
+	// Urgent data of a TCP connection, see SockOptOOBInline
+	MsgOOB = 0x1
 )
 
 func ParseSockAddr(addr string) (SockAddr, error) {
@@ -164,6 +257,128 @@ func ParseSockAddr(addr string) (SockAddr, error) {
 	return sockAddr, nil
 }
 
+// ============================================================================
+// Socket Options
+// ============================================================================
+
+type SockOptLevel int
+
+// Option levels, with the same values as the Linux constants
+const (
+	SockOptLevelIP     SockOptLevel = 0
+	SockOptLevelSocket SockOptLevel = 1
+	SockOptLevelTCP    SockOptLevel = 6
+)
+
+type SockOptName int
+
+// IP level options
+const (
+	SockOptIPTOS     SockOptName = 1
+	SockOptIPTTL     SockOptName = 2
+	SockOptIPOptions SockOptName = 4
+	SockOptIPRecvTTL SockOptName = 12
+	SockOptIPRecvTOS SockOptName = 13
+)
+
+// Socket level options
+const (
+	// Probe the peer of an idle TCP connection, see the TCP
+	// level SockOptTCPKeep options for the settings
+	SockOptKeepAlive SockOptName = 9
+
+	// Leave urgent bytes received in the stream, instead of reading
+	// them with MsgOOB
+	SockOptOOBInline SockOptName = 10
+
+	// Make close wait until the peer acknowledged the data sent, for up
+	// to the value in seconds. With 0 close aborts the connection, and
+	// a negative value turns lingering off.
+	SockOptLinger SockOptName = 13
+)
+
+// TCP level options
+const (
+	// Send small segments right away, without Nagle's algorithm
+	SockOptTCPNoDelay SockOptName = 1
+
+	// Only send full sized segments until the option is cleared
+	SockOptTCPCork SockOptName = 3
+
+	// Keep-alive settings. Times are in seconds.
+	SockOptTCPKeepIdle  SockOptName = 4 // Idle time before the first probe
+	SockOptTCPKeepIntvl SockOptName = 5 // Time between probes
+	SockOptTCPKeepCnt   SockOptName = 6 // Unanswered probes before the connection is dropped
+
+	// The state and stats of the connection, can only be read
+	SockOptTCPInfo SockOptName = 11
+
+	// The congestion control algorithm, by name in the data buffer
+	SockOptTCPCongestion SockOptName = 13
+
+	// Let a listener take data in the SYNs of clients with a Fast Open
+	// cookie. The value is how many of these connections may be in the
+	// handshake at once, 0 turns it off.
+	SockOptTCPFastOpen SockOptName = 23
+)
+
+var (
+	ErrInvalidSockOpt      = errors.New("invalid socket option")
+	ErrInvalidSockOptValue = errors.New("invalid socket option value")
+)
+
+// SocketOptions holds the option values set on a socket
+type SocketOptions struct {
+	// IP header fields used for each outgoing packet
+	IP netstack.IPControl
+
+	// Return the TOS and TTL of received packets as ancillary data
+	RecvTOS bool
+	RecvTTL bool
+
+	// TCP congestion control algorithm, empty for the default
+	TCPCongestion string
+
+	// Coalescing of small writes, see SockOptTCPNoDelay and SockOptTCPCork
+	TCPNoDelay bool
+	TCPCork    bool
+
+	// Keep-alive, see SockOptKeepAlive. Zero settings take the defaults.
+	KeepAlive    bool
+	TCPKeepIdle  time.Duration
+	TCPKeepIntvl time.Duration
+	TCPKeepCnt   int
+
+	// Lingering on close, see SockOptLinger
+	Linger        bool
+	LingerTimeout time.Duration
+
+	// Fast Open on listeners, see SockOptTCPFastOpen
+	TCPFastOpen int
+
+	// Urgent data read inline, see SockOptOOBInline
+	OOBInline bool
+}
+
+// ControlMessage holds ancillary data about a received packet. It is
+// returned by reads on sockets with IP_RECVTOS or IP_RECVTTL set, and
+// only the requested fields are filled in.
+type ControlMessage struct {
+	TOS uint8
+	TTL uint8
+}
+
+// Datagram is a datagram returned by ReadFrom, with where it came from.
+// A datagram larger than the buffer is cut off, and the rest of it is
+// lost.
+type Datagram struct {
+	Data      []byte
+	From      SockAddr
+	Iface     string // Name of the interface it arrived on
+	Truncated bool   // Data only holds the start of the datagram
+	Control   *ControlMessage
+}
+
 // ============================================================================
 // SocketMeta - helper struct for Socket implementations
 // Implements methods common for all sockets
@@ -220,6 +435,12 @@ type SocketMeta struct {
 
 	// RxChan
 	RxChan chan *netstack.SkBuff
+
+	// Socket options. optionsMu guards the IP header settings and
+	// the ancillary data flags, which reads and writes use while the
+	// socket layer sets options.
+	optionsMu sync.Mutex
+	Options   SocketOptions
 }
 
 const socketRxChanSize = 100
@@ -332,3 +553,100 @@ func (meta *SocketMeta) GetRxChan() chan *netstack.SkBuff {
 func (meta *SocketMeta) SetRxChan(rxChan chan *netstack.SkBuff) {
 	meta.RxChan = rxChan
 }
+
+// SetSockOpt handles the options common to all socket types. Socket
+// implementations with protocol level options handle those first and
+// fall back to this method.
+func (meta *SocketMeta) SetSockOpt(level SockOptLevel, name SockOptName, value int, data []byte) error {
+	switch level {
+	case SockOptLevelIP:
+		return meta.setIPSockOpt(name, value, data)
+	default:
+		return ErrInvalidSockOpt
+	}
+}
+
+func (meta *SocketMeta) setIPSockOpt(name SockOptName, value int, data []byte) error {
+	meta.optionsMu.Lock()
+	defer meta.optionsMu.Unlock()
+
+	switch name {
+	case SockOptIPTOS:
+		if value < 0 || value > 0xff {
+			return ErrInvalidSockOptValue
+		}
+
+		// TCP manages the ECN bits itself, so stream sockets
+		// only get to set the DSCP.
+		tos := uint8(value)
+		if meta.Type == SocketTypeStream {
+			tos = tos&^netstack.ECNMask | meta.Options.IP.ECN()
+		}
+
+		meta.Options.IP.TOS = tos
+	case SockOptIPTTL:
+		// -1 restores the default TTL
+		if value == -1 {
+			value = 0
+		} else if value < 1 || value > 0xff {
+			return ErrInvalidSockOptValue
+		}
+
+		meta.Options.IP.TTL = uint8(value)
+	case SockOptIPOptions:
+		// Make sure the options are well formed before we put them
+		// on the wire. An empty buffer clears the options.
+		if _, err := networklayer.ParseIPv4Options(data); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidSockOptValue, err)
+		}
+
+		meta.Options.IP.Options = data
+	case SockOptIPRecvTOS:
+		meta.Options.RecvTOS = value != 0
+	case SockOptIPRecvTTL:
+		meta.Options.RecvTTL = value != 0
+	default:
+		return ErrInvalidSockOpt
+	}
+
+	return nil
+}
+
+// ipControl returns the IP header settings for an outgoing packet
+func (meta *SocketMeta) ipControl() netstack.IPControl {
+	meta.optionsMu.Lock()
+	defer meta.optionsMu.Unlock()
+
+	return meta.Options.IP
+}
+
+// options returns a copy of the socket options
+func (meta *SocketMeta) options() SocketOptions {
+	meta.optionsMu.Lock()
+	defer meta.optionsMu.Unlock()
+
+	return meta.Options
+}
+
+// controlMessage builds the ancillary data for a received packet,
+// or returns nil if the socket hasn't asked for any.
+func (meta *SocketMeta) controlMessage(skb *netstack.SkBuff) *ControlMessage {
+	meta.optionsMu.Lock()
+	defer meta.optionsMu.Unlock()
+
+	if !meta.Options.RecvTOS && !meta.Options.RecvTTL {
+		return nil
+	}
+
+	cm := &ControlMessage{}
+
+	if meta.Options.RecvTOS {
+		cm.TOS = skb.GetTOS()
+	}
+
+	if meta.Options.RecvTTL {
+		cm.TTL = skb.GetTTL()
+	}
+
+	return cm
+}
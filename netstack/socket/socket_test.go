@@ -0,0 +1,113 @@
+package socket
+
+import (
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Socket_SetSockOpt_IP(t *testing.T) {
+	s := NewUDPSocket()
+
+	tests := []struct {
+		name  SockOptName
+		value int
+		err   error
+	}{
+		{SockOptIPTOS, -1, ErrInvalidSockOptValue},
+		{SockOptIPTOS, 0x100, ErrInvalidSockOptValue},
+		{SockOptIPTTL, 0, ErrInvalidSockOptValue},
+		{SockOptIPTTL, 0x100, ErrInvalidSockOptValue},
+		{SockOptIPTTL, -2, ErrInvalidSockOptValue},
+		{SockOptName(99), 0, ErrInvalidSockOpt},
+	}
+
+	for _, tt := range tests {
+		assert.ErrorIs(t, s.SetSockOpt(SockOptLevelIP, tt.name, tt.value, nil), tt.err)
+	}
+
+	assert.Equal(t, netstack.IPControl{}, s.Options.IP)
+
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPTOS, 0xb9, nil))
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPTTL, 5, nil))
+	assert.Equal(t, netstack.IPControl{TOS: 0xb9, TTL: 5}, s.Options.IP)
+
+	// -1 restores the default TTL
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPTTL, -1, nil))
+	assert.Equal(t, uint8(0), s.Options.IP.TTL)
+}
+
+func Test_Socket_SetSockOpt_TOS_Stream(t *testing.T) {
+	s := NewTCPSocket()
+
+	// A stream socket only sets the DSCP, the ECN bits are left
+	// to TCP
+	s.Options.IP.TOS = netstack.ECNECT0
+
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPTOS, 0xb9, nil))
+	assert.Equal(t, uint8(0xba), s.Options.IP.TOS)
+	assert.Equal(t, uint8(0xb8>>2), s.Options.IP.DSCP())
+	assert.Equal(t, uint8(netstack.ECNECT0), s.Options.IP.ECN())
+}
+
+func Test_Socket_Read_ControlMessage(t *testing.T) {
+	s := NewUDPSocket()
+
+	receive := func() ([]byte, *ControlMessage) {
+		skb := netstack.NewSkBuff([]byte("hello"))
+		skb.SetTOS(0xb8)
+		skb.SetTTL(9)
+		s.RxChan <- skb
+
+		data, cm, err := s.Read()
+		assert.NoError(t, err)
+
+		return data, cm
+	}
+
+	// No ancillary data unless it is asked for
+	data, cm := receive()
+	assert.Equal(t, []byte("hello"), data)
+	assert.Nil(t, cm)
+
+	// Only the fields asked for are filled in
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPRecvTOS, 1, nil))
+
+	_, cm = receive()
+	assert.Equal(t, &ControlMessage{TOS: 0xb8}, cm)
+
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPRecvTTL, 1, nil))
+
+	_, cm = receive()
+	assert.Equal(t, &ControlMessage{TOS: 0xb8, TTL: 9}, cm)
+
+	assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPRecvTOS, 0, nil))
+
+	_, cm = receive()
+	assert.Equal(t, &ControlMessage{TTL: 9}, cm)
+}
+
+func Test_Socket_SetSockOpt_WhileReading(t *testing.T) {
+	s := NewUDPSocket()
+
+	// The socket layer sets options while a read is running
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			_, _, err := s.Read()
+			assert.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPRecvTTL, i%2, nil))
+		assert.NoError(t, s.SetSockOpt(SockOptLevelIP, SockOptIPTTL, i+1, nil))
+		s.RxChan <- netstack.NewSkBuff([]byte("hello"))
+	}
+
+	<-done
+}
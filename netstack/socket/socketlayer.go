@@ -4,8 +4,11 @@ import (
 	"errors"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/mattcarp12/matnet/netstack"
+	"github.com/mattcarp12/matnet/netstack/netfilter"
+	"github.com/mattcarp12/matnet/netstack/transportlayer"
 )
 
 var sockLog = log.New(os.Stdout, "[Socket] ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
@@ -20,6 +23,7 @@ type SocketLayer struct {
 	SyscallReqChan  chan SockSyscallRequest
 	SyscallRespChan chan SockSyscallResponse
 	RoutingTable    netstack.RoutingTable
+	Netfilter       *netfilter.Netfilter
 }
 
 func (socketLayer *SocketLayer) err(err error, resp SockSyscallResponse) {
@@ -55,6 +59,22 @@ func (socketLayer *SocketLayer) SyscallRxLoop() {
 			socketLayer.readfrom(syscall)
 		case SyscallWriteTo:
 			socketLayer.writeto(syscall)
+		case SyscallSetSockOpt:
+			socketLayer.setsockopt(syscall)
+		case SyscallGetSockOpt:
+			socketLayer.getsockopt(syscall)
+		case SyscallShutdown:
+			socketLayer.shutdown(syscall)
+		case SyscallFilterAdd, SyscallFilterDelete, SyscallFilterList, SyscallFilterFlush, SyscallFilterPolicy:
+			socketLayer.filter(syscall)
+		case SyscallConntrackList:
+			socketLayer.conntrack(syscall)
+		case SyscallNATAdd, SyscallNATDelete, SyscallNATList:
+			socketLayer.nat(syscall)
+		case SyscallTCPCongestion:
+			socketLayer.tcpCongestion(syscall)
+		case SyscallTCPConnList:
+			socketLayer.tcpConnList(syscall)
 		default:
 			panic("unknown syscall type")
 		}
@@ -125,9 +145,10 @@ func (socketLayer *SocketLayer) socket(syscall SockSyscallRequest) {
 		return
 	}
 
-	// Add to map. At this point the socket doesn't have a port associated to it,
-	// so we can't add an entry to the port_map.
-	sm.socketMap[sockID] = sock
+	sock.SetSrcPort(port)
+
+	// Add to map
+	sm.addSocket(sock)
 
 	// Send response
 	resp.SockID = sockID
@@ -153,7 +174,9 @@ func (socketLayer *SocketLayer) bind(syscall SockSyscallRequest) {
 
 	// Cast to socket manager
 	sm := socketProtocol.(*SocketManager)
-	err = sm.bind(sock, syscall.Addr)
+	if err = sm.bind(sock, syscall.Addr); err == nil {
+		err = sock.Bind(syscall.Addr)
+	}
 
 	// Handle the response
 	resp.Err = err
@@ -162,11 +185,7 @@ func (socketLayer *SocketLayer) bind(syscall SockSyscallRequest) {
 	socketLayer.SyscallRespChan <- resp
 }
 
-func (socketLayer *SocketLayer) listen(syscall SockSyscallRequest) {}
-
-func (socketLayer *SocketLayer) accept(syscall SockSyscallRequest) {}
-
-func (socketLayer *SocketLayer) connect(syscall SockSyscallRequest) {
+func (socketLayer *SocketLayer) listen(syscall SockSyscallRequest) {
 	resp := syscall.MakeResponse()
 
 	// Get socket from map
@@ -176,38 +195,70 @@ func (socketLayer *SocketLayer) connect(syscall SockSyscallRequest) {
 		return
 	}
 
-	// Set destination address
-	destAddr := syscall.Addr
-	sock.SetDestAddr(destAddr)
+	// Handle the response
+	resp.Err = sock.Listen(syscall.Backlog)
 
-	// lookup the route for this destination
-	route := socketLayer.RoutingTable.Lookup(destAddr.IP)
-	sock.SetRoute(&route)
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
 
-	// Set the socket's source ip address
-	sock.SetSrcIP(route.Network.IP)
+// accept responds with the ID of a new socket for the next connection
+// on a listening socket, and the address of the peer.
+func (socketLayer *SocketLayer) accept(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
 
-	// Set the socket's source port
-	socketManager, err := socketLayer.GetProtocol(sock.GetProtocol().GetType())
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
 	if err != nil {
-		socketLayer.err(err, resp)
+		socketLayer.err(ErrInvalidSocketID, resp)
 		return
 	}
-	sm := socketManager.(*SocketManager)
 
-	port, err := sm.getUnusedPort()
+	// Get the socket manager for this protocol
+	socketProtocol, err := socketLayer.GetProtocol(sock.GetProtocol().GetType())
 	if err != nil {
 		socketLayer.err(err, resp)
 		return
 	}
 
-	err = sm.assignPort(port, sock)
+	sm := socketProtocol.(*SocketManager)
+
+	// Waiting for a connection can take forever, so wait
+	// in the background and keep handling other syscalls
+	go func() {
+		conn, err := sock.Accept()
+		if err != nil {
+			socketLayer.err(err, resp)
+			return
+		}
+
+		sockID := NewSockID(sock.GetType())
+		conn.SetID(sockID)
+		sm.addSocket(conn)
+
+		resp.SockID = sockID
+		resp.Addr = conn.GetDestAddr()
+
+		// Send response back to socket layer
+		socketLayer.SyscallRespChan <- resp
+	}()
+}
+
+func (socketLayer *SocketLayer) connect(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
 	if err != nil {
-		socketLayer.err(err, resp)
+		socketLayer.err(ErrInvalidSocketID, resp)
 		return
 	}
 
-	sock.SetSrcPort(port)
+	// Set destination address
+	destAddr := syscall.Addr
+	sock.SetDestAddr(destAddr)
+
+	socketLayer.setRoute(sock, destAddr)
 
 	// Connect to destination (blocking call)
 	err = sock.Connect(destAddr)
@@ -219,6 +270,16 @@ func (socketLayer *SocketLayer) connect(syscall SockSyscallRequest) {
 	socketLayer.SyscallRespChan <- resp
 }
 
+// setRoute looks up the route to dest, and sets it and the
+// source address it takes on the socket
+func (socketLayer *SocketLayer) setRoute(sock Socket, dest SockAddr) {
+	route := socketLayer.RoutingTable.Lookup(dest.IP)
+	sockLog.Printf("SocketLayer: route to IP %s: %v", dest.IP.String(), route)
+
+	sock.SetRoute(&route)
+	sock.SetSrcIP(route.Network.IP)
+}
+
 func (socketLayer *SocketLayer) close(syscall SockSyscallRequest) {
 	// Get socket from map
 	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
@@ -227,8 +288,30 @@ func (socketLayer *SocketLayer) close(syscall SockSyscallRequest) {
 		return
 	}
 
-	// Close socket
-	err = sock.Close()
+	// Closes may linger until the peer acknowledged the data
+	go func() {
+		// Close socket
+		err := sock.Close()
+
+		// Handle the response
+		resp := syscall.MakeResponse()
+		resp.Err = err
+
+		// Send response back to socket layer
+		socketLayer.SyscallRespChan <- resp
+	}()
+}
+
+func (socketLayer *SocketLayer) shutdown(syscall SockSyscallRequest) {
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
+	if err != nil {
+		socketLayer.err(ErrInvalidSocketID, syscall.MakeResponse())
+
+		return
+	}
+
+	err = sock.Shutdown(syscall.How)
 
 	// Handle the response
 	resp := syscall.MakeResponse()
@@ -247,21 +330,104 @@ func (socketLayer *SocketLayer) read(syscall SockSyscallRequest) {
 		return
 	}
 
-	// Read from socket
-	data, err := sock.Read()
+	// Urgent data is read without waiting
+	if syscall.Flags&MsgOOB != 0 {
+		tcpSock, ok := sock.(*TCPSocket)
+		if !ok {
+			socketLayer.err(ErrNotSupported, syscall.MakeResponse())
+			return
+		}
 
-	// Handle the response
-	resp := syscall.MakeResponse()
-	resp.Err = err
-	resp.Data = data
+		resp := syscall.MakeResponse()
+		resp.Data, resp.Err = tcpSock.ReadOOB()
+		socketLayer.SyscallRespChan <- resp
 
-	// Send response back to socket layer
-	socketLayer.SyscallRespChan <- resp
+		return
+	}
+
+	// Reads wait for data, so wait in the background
+	// and keep handling other syscalls
+	go func() {
+		// Read from socket
+		data, control, err := sock.Read()
+
+		// Handle the response
+		resp := syscall.MakeResponse()
+		resp.Err = err
+		resp.Data = data
+		resp.Control = control
+
+		// Send response back to socket layer
+		socketLayer.SyscallRespChan <- resp
+	}()
 }
 
-func (socketLayer *SocketLayer) write(syscall SockSyscallRequest) {}
+func (socketLayer *SocketLayer) write(syscall SockSyscallRequest) {
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
+	if err != nil {
+		socketLayer.err(ErrInvalidSocketID, syscall.MakeResponse())
+
+		return
+	}
+
+	// Only TCP has urgent data
+	tcpSock, ok := sock.(*TCPSocket)
+	oob := syscall.Flags&MsgOOB != 0
 
-func (socketLayer *SocketLayer) readfrom(syscall SockSyscallRequest) {}
+	if oob && !ok {
+		socketLayer.err(ErrNotSupported, syscall.MakeResponse())
+		return
+	}
+
+	// Writes wait for room in the send buffer
+	go func() {
+		var (
+			n   int
+			err error
+		)
+
+		if oob {
+			n, err = tcpSock.WriteOOB(syscall.Data)
+		} else {
+			n, err = sock.Write(syscall.Data)
+		}
+
+		// Handle the response
+		resp := syscall.MakeResponse()
+		resp.BytesWritten = n
+		resp.Err = err
+
+		// Send response back to socket layer
+		socketLayer.SyscallRespChan <- resp
+	}()
+}
+
+func (socketLayer *SocketLayer) readfrom(syscall SockSyscallRequest) {
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
+	if err != nil {
+		socketLayer.err(ErrInvalidSocketID, syscall.MakeResponse())
+
+		return
+	}
+
+	// Like reads, wait for a datagram in the background
+	go func() {
+		dgram, err := sock.ReadFrom(syscall.Size)
+
+		resp := syscall.MakeResponse()
+		resp.Err = err
+		resp.Data = dgram.Data
+		resp.Addr = dgram.From
+		resp.Iface = dgram.Iface
+		resp.Truncated = dgram.Truncated
+		resp.Control = dgram.Control
+
+		// Send response back to socket layer
+		socketLayer.SyscallRespChan <- resp
+	}()
+}
 
 func (socketLayer *SocketLayer) writeto(syscall SockSyscallRequest) {
 	// Get socket from map
@@ -272,16 +438,39 @@ func (socketLayer *SocketLayer) writeto(syscall SockSyscallRequest) {
 		return
 	}
 
-	// Lookup the route to the destination
+	// A connected datagram socket keeps the route to its peer
+	if udpSock, ok := sock.(*UDPSocket); ok {
+		if _, connected := udpSock.connectedPeer(); connected {
+			socketLayer.err(ErrIsConnected, syscall.MakeResponse())
+			return
+		}
+	}
+
 	dest := syscall.Addr
-	route := socketLayer.RoutingTable.Lookup(dest.IP)
-	sockLog.Printf("SocketLayer: writeto: route to IP %s: %v", dest.IP.String(), route)
 
-	// Set the route on the socket
-	sock.SetRoute(&route)
+	// A stream socket that isn't connected yet connects to the
+	// destination, sending the data with Fast Open. It waits for
+	// the handshake if the data doesn't fit in the send buffer.
+	// A connected one keeps its route and ignores the address.
+	if tcpSock, ok := sock.(*TCPSocket); ok {
+		if tcpSock.TCB == nil {
+			socketLayer.setRoute(sock, dest)
+			sock.SetDestAddr(dest)
+		}
 
-	// set the source address on the socket
-	sock.SetSrcIP(route.Network.IP)
+		go func() {
+			n, err := sock.WriteTo(syscall.Data, dest)
+
+			resp := syscall.MakeResponse()
+			resp.BytesWritten = n
+			resp.Err = err
+			socketLayer.SyscallRespChan <- resp
+		}()
+
+		return
+	}
+
+	socketLayer.setRoute(sock, dest)
 
 	// Pass the skb to the socket (blocking call)
 	n, err := sock.WriteTo(syscall.Data, syscall.Addr)
@@ -295,6 +484,188 @@ func (socketLayer *SocketLayer) writeto(syscall SockSyscallRequest) {
 	socketLayer.SyscallRespChan <- resp
 }
 
+func (socketLayer *SocketLayer) setsockopt(syscall SockSyscallRequest) {
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
+	if err != nil {
+		socketLayer.err(ErrInvalidSocketID, syscall.MakeResponse())
+
+		return
+	}
+
+	err = sock.SetSockOpt(syscall.OptLevel, syscall.OptName, syscall.OptValue, syscall.Data)
+
+	// Handle the response
+	resp := syscall.MakeResponse()
+	resp.Err = err
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+// getsockopt reads a socket option. TCP_INFO is the only one that can be read.
+func (socketLayer *SocketLayer) getsockopt(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	// Get socket from map
+	sock, err := socketLayer.getSocket(syscall.SockType, syscall.SockID)
+	if err != nil {
+		socketLayer.err(ErrInvalidSocketID, resp)
+
+		return
+	}
+
+	tcpSock, ok := sock.(*TCPSocket)
+	if !ok || syscall.OptLevel != SockOptLevelTCP || syscall.OptName != SockOptTCPInfo {
+		socketLayer.err(ErrInvalidSockOpt, resp)
+
+		return
+	}
+
+	info, err := tcpSock.Info()
+	if err != nil {
+		socketLayer.err(err, resp)
+
+		return
+	}
+
+	resp.TCPInfo = &info
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+var ErrFilterNotEnabled = errors.New("packet filter not enabled")
+
+// filter handles the packet filter management calls
+func (socketLayer *SocketLayer) filter(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	if socketLayer.Netfilter == nil {
+		socketLayer.err(ErrFilterNotEnabled, resp)
+		return
+	}
+
+	filter := socketLayer.Netfilter.Filter
+
+	switch syscall.SyscallType {
+	case SyscallFilterAdd:
+		if syscall.Rule == nil {
+			resp.Err = netfilter.ErrInvalidRule
+			break
+		}
+
+		resp.RuleID, resp.Err = filter.Add(*syscall.Rule)
+	case SyscallFilterDelete:
+		resp.Err = filter.Delete(syscall.RuleID)
+	case SyscallFilterList:
+		resp.Rules = filter.List()
+	case SyscallFilterFlush:
+		resp.Err = filter.Flush(syscall.Chain)
+	case SyscallFilterPolicy:
+		resp.Err = filter.SetPolicy(syscall.Chain, syscall.Policy)
+	}
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+// conntrack lists the tracked connections
+func (socketLayer *SocketLayer) conntrack(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	if socketLayer.Netfilter == nil {
+		socketLayer.err(ErrFilterNotEnabled, resp)
+		return
+	}
+
+	resp.Conns = socketLayer.Netfilter.Conntrack.List()
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+// tcpCongestion sets the congestion control algorithm for new TCP
+// connections, if one is given, and returns the current one
+func (socketLayer *SocketLayer) tcpCongestion(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	tcp, err := socketLayer.tcpProtocol()
+	if err != nil {
+		socketLayer.err(err, resp)
+		return
+	}
+
+	if len(syscall.Data) > 0 {
+		resp.Err = tcp.SetCongestionControl(string(syscall.Data))
+	}
+
+	resp.Data = []byte(tcp.GetCongestionControl())
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+// tcpConnList returns the stats of all TCP connections
+func (socketLayer *SocketLayer) tcpConnList(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	tcp, err := socketLayer.tcpProtocol()
+	if err != nil {
+		socketLayer.err(err, resp)
+		return
+	}
+
+	resp.TCPConns = tcp.Connections()
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
+// tcpProtocol returns the TCP protocol of the transport layer
+func (socketLayer *SocketLayer) tcpProtocol() (*transportlayer.TCPProtocol, error) {
+	l4Protocol, err := socketLayer.GetPrevLayer().GetProtocol(netstack.ProtocolTypeTCP)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp, ok := l4Protocol.(*transportlayer.TCPProtocol)
+	if !ok {
+		return nil, errors.New("TCP protocol is not a TCPProtocol")
+	}
+
+	return tcp, nil
+}
+
+// nat handles the NAT rule management calls
+func (socketLayer *SocketLayer) nat(syscall SockSyscallRequest) {
+	resp := syscall.MakeResponse()
+
+	if socketLayer.Netfilter == nil {
+		socketLayer.err(ErrFilterNotEnabled, resp)
+		return
+	}
+
+	nat := socketLayer.Netfilter.NAT
+
+	switch syscall.SyscallType {
+	case SyscallNATAdd:
+		if syscall.NATRule == nil {
+			resp.Err = netfilter.ErrInvalidRule
+			break
+		}
+
+		resp.RuleID, resp.Err = nat.Add(*syscall.NATRule)
+	case SyscallNATDelete:
+		resp.Err = nat.Delete(syscall.RuleID)
+	case SyscallNATList:
+		resp.NATRules = nat.List()
+	}
+
+	// Send response back to socket layer
+	socketLayer.SyscallRespChan <- resp
+}
+
 func sockTypeToProtocol(sockType SocketType) (netstack.ProtocolType, error) {
 	switch sockType {
 	case SocketTypeStream:
@@ -325,7 +696,10 @@ func (socketLayer *SocketLayer) getSocket(sockType SocketType, sockID SockID) (S
 	sm := protocol.(*SocketManager)
 
 	// Get socket from map
+	sm.mu.Lock()
 	sock, ok := sm.socketMap[sockID]
+	sm.mu.Unlock()
+
 	if !ok {
 		return nil, ErrInvalidSocketID
 	}
@@ -333,7 +707,7 @@ func (socketLayer *SocketLayer) getSocket(sockType SocketType, sockID SockID) (S
 	return sock, nil
 }
 
-func Init(transportLayer *netstack.Layer, routingTable netstack.RoutingTable) *SocketLayer {
+func Init(transportLayer *netstack.Layer, routingTable netstack.RoutingTable, nf *netfilter.Netfilter) *SocketLayer {
 	// Create socket layer "protocols", i.e. the socket managers
 	udpSocketProtocol := NewSocketManager(netstack.ProtocolTypeUDP)
 	tcpSocketProtocol := NewSocketManager(netstack.ProtocolTypeTCP)
@@ -344,6 +718,7 @@ func Init(transportLayer *netstack.Layer, routingTable netstack.RoutingTable) *S
 		SyscallReqChan:  make(chan SockSyscallRequest),
 		SyscallRespChan: make(chan SockSyscallResponse),
 		RoutingTable:    routingTable,
+		Netfilter:       nf,
 	}
 
 	socketLayer.SetPrevLayer(transportLayer)
@@ -370,6 +745,9 @@ func Init(transportLayer *netstack.Layer, routingTable netstack.RoutingTable) *S
 
 type SocketManager struct {
 	netstack.IProtocol
+
+	// mu guards the maps, since accept adds sockets from its own goroutine
+	mu          sync.Mutex
 	socketMap   map[SockID]Socket
 	portMap     map[uint16]SockID
 	currentPort uint16 // next unassigned port
@@ -391,14 +769,23 @@ func (sm *SocketManager) HandleRx(skb *netstack.SkBuff) {
 	port := skb.GetDstPort()
 
 	// Get the socket from the map
+	sm.mu.Lock()
 	sockID := sm.portMap[port]
 	sock := sm.socketMap[sockID]
+	sm.mu.Unlock()
 
 	// If the socket is nil, then we don't have a socket for this port
 	if sock == nil {
 		return
 	}
 
+	// A datagram socket filters its datagrams and doesn't wait
+	// for room in its queue
+	if udpSock, ok := sock.(*UDPSocket); ok {
+		udpSock.deliver(skb)
+		return
+	}
+
 	// Pass the skb to the socket
 	sock.GetRxChan() <- skb
 }
@@ -409,6 +796,9 @@ func (sm *SocketManager) HandleTx(skb *netstack.SkBuff) {}
 var ErrSocketAlreadyBound = errors.New("Socket already bound")
 
 func (sm *SocketManager) bind(sock Socket, addr netstack.SockAddr) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	// Check if the socket is already bound
 	currPort := sock.GetSrcPort()
 
@@ -432,6 +822,9 @@ func (sm *SocketManager) bind(sock Socket, addr netstack.SockAddr) error {
 var ErrNoPortsAvailable = errors.New("no ports available")
 
 func (sm *SocketManager) getUnusedPort() (uint16, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	// TODO: Make this more efficient. Maybe use a priority queue?
 	for i := sm.currentPort; i < 65535; i++ {
 		if _, ok := sm.portMap[i]; !ok {
@@ -446,6 +839,9 @@ func (sm *SocketManager) getUnusedPort() (uint16, error) {
 var ErrPortAlreadyAssigned = errors.New("port already assigned")
 
 func (sm *SocketManager) assignPort(port uint16, sock Socket) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	if _, ok := sm.portMap[port]; ok {
 		return ErrPortAlreadyAssigned
 	}
@@ -454,3 +850,11 @@ func (sm *SocketManager) assignPort(port uint16, sock Socket) error {
 
 	return nil
 }
+
+// addSocket adds the socket to the socket map
+func (sm *SocketManager) addSocket(sock Socket) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.socketMap[sock.GetID()] = sock
+}
@@ -4,12 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/mattcarp12/matnet/netstack/transportlayer"
 )
 
 type TCPSocket struct {
 	SocketMeta
+
+	// The connection, or the listener for listening sockets
+	TCB *transportlayer.TCB
+
+	// The connection was shut down for writing, its FIN is queued
+	writeShutdown bool
 }
 
 func NewTCPSocket() *TCPSocket {
@@ -21,19 +28,75 @@ func NewTCPSocket() *TCPSocket {
 	return s
 }
 
-// Bind...
+var (
+	ErrSocketInUse  = errors.New("socket already connected or listening")
+	ErrNotListening = errors.New("socket is not listening")
+	ErrNotConnected = errors.New("socket is not connected")
+)
+
+// Bind sets the local address. The port was already reserved by the socket manager.
 func (s *TCPSocket) Bind(addr SockAddr) error {
+	s.SrcAddr.IP = addr.IP
+
 	return nil
 }
 
-// Listen...
-func (s *TCPSocket) Listen() error {
-	return nil
+// Listen creates a listening TCB on the socket's local address. Sockets
+// that weren't bound to an address listen on all interfaces.
+func (s *TCPSocket) Listen(backlog int) error {
+	tcpProtocol, ok := s.Protocol.(*transportlayer.TCPProtocol)
+	if !ok {
+		return errors.New("TCP socket does not have a TCP protocol")
+	}
+
+	if s.TCB != nil {
+		return ErrSocketInUse
+	}
+
+	localAddr := s.SrcAddr
+	if localAddr.IP == nil {
+		localAddr.IP = net.IPv4zero
+	}
+
+	ipControl := s.ipControl()
+
+	tcb, err := tcpProtocol.Listen(localAddr, backlog, &ipControl)
+	if err != nil {
+		return fmt.Errorf("TCPSocket Listen: %w", err)
+	}
+
+	s.TCB = tcb
+
+	return s.applyOptions()
 }
 
-// Accept...
-func (s *TCPSocket) Accept() (net.Conn, error) {
-	return nil, nil
+// Accept waits for a connection on a listening socket, and returns a
+// new socket for it. The new socket inherits the listener's options.
+func (s *TCPSocket) Accept() (Socket, error) {
+	if s.TCB == nil || !s.TCB.IsListener() {
+		return nil, ErrNotListening
+	}
+
+	tcb, err := s.TCB.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("TCPSocket Accept: %w", err)
+	}
+
+	conn := NewTCPSocket()
+	conn.Protocol = s.Protocol
+	conn.SrcAddr = tcb.SrcAddr
+	conn.DestAddr = tcb.DstAddr
+	conn.NetworkInterface = tcb.TxIface
+	conn.Options = s.options()
+	conn.TCB = tcb
+
+	tcb.SetIPControl(conn.Options.IP)
+
+	if err := conn.applyOptions(); err != nil {
+		return nil, fmt.Errorf("TCPSocket Accept: %w", err)
+	}
+
+	return conn, nil
 }
 
 // Connect calls the OpenConnection function of the TCP protocol
@@ -43,18 +106,164 @@ func (s *TCPSocket) Connect(_ SockAddr) error {
 		return errors.New("TCP socket does not have a TCP protocol")
 	}
 
-	err := tcpProtocol.OpenConnection(
+	if s.TCB != nil {
+		return ErrSocketInUse
+	}
+
+	ipControl := s.ipControl()
+
+	tcb, err := tcpProtocol.OpenConnection(
 		s.SocketMeta.SrcAddr,
 		s.SocketMeta.DestAddr,
 		s.SocketMeta.GetNetworkInterface(),
+		&ipControl,
 	)
 	if err != nil {
 		return fmt.Errorf("TCPSocket Connect: error opening connection: %v", err)
 	}
 
+	s.TCB = tcb
+
+	return s.applyOptions()
+}
+
+// SetSockOpt handles the TCP level options, keep-alive, linger and
+// urgent data, the others are common to all sockets
+func (s *TCPSocket) SetSockOpt(level SockOptLevel, name SockOptName, value int, data []byte) error {
+	if level == SockOptLevelSocket {
+		switch name {
+		case SockOptKeepAlive:
+			s.Options.KeepAlive = value != 0
+
+			return s.setKeepAlive()
+		case SockOptOOBInline:
+			s.Options.OOBInline = value != 0
+
+			if s.TCB != nil {
+				s.TCB.SetOOBInline(s.Options.OOBInline)
+			}
+
+			return nil
+		case SockOptLinger:
+			s.Options.Linger = value >= 0
+			s.Options.LingerTimeout = time.Duration(value) * time.Second
+
+			return nil
+		}
+	}
+
+	if level != SockOptLevelTCP {
+		if err := s.SocketMeta.SetSockOpt(level, name, value, data); err != nil {
+			return err
+		}
+
+		// The connection has its own copy of the IP header settings
+		if level == SockOptLevelIP && s.TCB != nil {
+			s.TCB.SetIPControl(s.ipControl())
+		}
+
+		return nil
+	}
+
+	switch name {
+	case SockOptTCPCongestion:
+		algorithm := string(data)
+		if _, err := transportlayer.NewCongestionControl(algorithm); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidSockOptValue, err)
+		}
+
+		s.Options.TCPCongestion = algorithm
+
+		// Connections switch right away
+		if s.TCB != nil {
+			return s.TCB.SetCongestionControl(algorithm)
+		}
+	case SockOptTCPNoDelay:
+		s.Options.TCPNoDelay = value != 0
+
+		if s.TCB != nil {
+			return s.TCB.SetNoDelay(s.Options.TCPNoDelay)
+		}
+	case SockOptTCPCork:
+		s.Options.TCPCork = value != 0
+
+		if s.TCB != nil {
+			return s.TCB.SetCork(s.Options.TCPCork)
+		}
+	case SockOptTCPKeepIdle, SockOptTCPKeepIntvl, SockOptTCPKeepCnt:
+		if value < 1 {
+			return ErrInvalidSockOptValue
+		}
+
+		switch name {
+		case SockOptTCPKeepIdle:
+			s.Options.TCPKeepIdle = time.Duration(value) * time.Second
+		case SockOptTCPKeepIntvl:
+			s.Options.TCPKeepIntvl = time.Duration(value) * time.Second
+		default:
+			s.Options.TCPKeepCnt = value
+		}
+
+		return s.setKeepAlive()
+	case SockOptTCPFastOpen:
+		if value < 0 {
+			return ErrInvalidSockOptValue
+		}
+
+		s.Options.TCPFastOpen = value
+
+		if s.TCB != nil && s.TCB.IsListener() {
+			return s.TCB.SetFastOpen(value)
+		}
+	default:
+		return ErrInvalidSockOpt
+	}
+
+	return nil
+}
+
+// applyOptions sets the TCP level options of the socket on its TCB
+func (s *TCPSocket) applyOptions() error {
+	if err := s.TCB.SetNoDelay(s.Options.TCPNoDelay); err != nil {
+		return err
+	}
+
+	if err := s.TCB.SetCork(s.Options.TCPCork); err != nil {
+		return err
+	}
+
+	if err := s.setKeepAlive(); err != nil {
+		return err
+	}
+
+	s.TCB.SetOOBInline(s.Options.OOBInline)
+
+	if s.TCB.IsListener() {
+		if err := s.TCB.SetFastOpen(s.Options.TCPFastOpen); err != nil {
+			return err
+		}
+	}
+
+	if s.Options.TCPCongestion != "" {
+		return s.TCB.SetCongestionControl(s.Options.TCPCongestion)
+	}
+
 	return nil
 }
 
+// setKeepAlive passes the keep-alive options to the TCB
+func (s *TCPSocket) setKeepAlive() error {
+	if s.TCB == nil {
+		return nil
+	}
+
+	return s.TCB.SetKeepAlive(s.Options.KeepAlive, transportlayer.KeepAliveConfig{
+		Idle:     s.Options.TCPKeepIdle,
+		Interval: s.Options.TCPKeepIntvl,
+		Count:    s.Options.TCPKeepCnt,
+	})
+}
+
 // Close...
 func (s *TCPSocket) Close() error {
 	// Get the TCP protocol
@@ -63,31 +272,151 @@ func (s *TCPSocket) Close() error {
 		return errors.New("TCPSocket Close: TCP socket does not have a TCP protocol attached")
 	}
 
-	// Close the connection
-	err := tcpProtocol.CloseConnection(s.SocketMeta.GetSrcAddr(), s.SocketMeta.GetDestAddr())
-	if err != nil {
-		return fmt.Errorf("TCPSocket Close: error closing connection: %w", err)
+	if s.TCB != nil && s.TCB.IsListener() {
+		return tcpProtocol.CloseListener(s.TCB)
+	}
+
+	// Lingering for no time at all resets the connection
+	if s.Options.Linger && s.Options.LingerTimeout == 0 && s.TCB != nil {
+		return s.TCB.Abort()
+	}
+
+	// Close the connection. One shut down for writing has sent its FIN already.
+	if !s.writeShutdown {
+		err := tcpProtocol.CloseConnection(s.SocketMeta.GetSrcAddr(), s.SocketMeta.GetDestAddr())
+		if err != nil {
+			return fmt.Errorf("TCPSocket Close: error closing connection: %w", err)
+		}
+	}
+
+	// Wait until the peer has everything
+	if s.Options.Linger && s.TCB != nil {
+		return s.TCB.Linger(s.Options.LingerTimeout)
 	}
 
 	return nil
 }
 
-// Read...
-func (s *TCPSocket) Read() ([]byte, error) {
-	return []byte{}, nil
+// Info returns the state and stats of the connection, for TCP_INFO
+func (s *TCPSocket) Info() (transportlayer.TCPStats, error) {
+	if s.TCB == nil {
+		return transportlayer.TCPStats{}, ErrNotConnected
+	}
+
+	return s.TCB.Stats(), nil
+}
+
+// Shutdown closes the connection for reading, writing or both
+func (s *TCPSocket) Shutdown(how ShutdownHow) error {
+	if s.TCB == nil || s.TCB.IsListener() {
+		return ErrNotConnected
+	}
+
+	switch how {
+	case ShutdownRead:
+		return s.TCB.ShutdownRead()
+	case ShutdownWrite:
+		s.writeShutdown = true
+		return s.TCB.ShutdownWrite()
+	case ShutdownBoth:
+		if err := s.TCB.ShutdownRead(); err != nil {
+			return err
+		}
+
+		s.writeShutdown = true
+
+		return s.TCB.ShutdownWrite()
+	default:
+		return ErrInvalidShutdown
+	}
+}
+
+// Read waits for data on the connection
+func (s *TCPSocket) Read() ([]byte, *ControlMessage, error) {
+	if s.TCB == nil || s.TCB.IsListener() {
+		return nil, nil, ErrNotConnected
+	}
+
+	data, err := s.TCB.Read()
+
+	return data, nil, err
 }
 
-// Write...
+// Write sends b on the connection
 func (s *TCPSocket) Write(b []byte) (int, error) {
-	return 0, nil
+	if s.TCB == nil || s.TCB.IsListener() {
+		return 0, ErrNotConnected
+	}
+
+	return s.TCB.Write(b)
+}
+
+// ReadOOB returns the urgent byte the peer sent, without waiting
+func (s *TCPSocket) ReadOOB() ([]byte, error) {
+	if s.TCB == nil || s.TCB.IsListener() {
+		return nil, ErrNotConnected
+	}
+
+	b, err := s.TCB.ReadOOB()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte{b}, nil
 }
 
-// ReadFrom...
-func (s *TCPSocket) ReadFrom(b []byte, addr *SockAddr) (int, error) {
-	return 0, errors.New("not implemented")
+// WriteOOB sends b on the connection, with its last byte urgent
+func (s *TCPSocket) WriteOOB(b []byte) (int, error) {
+	if s.TCB == nil || s.TCB.IsListener() {
+		return 0, ErrNotConnected
+	}
+
+	return s.TCB.WriteUrgent(b)
+}
+
+// ReadFrom is only supported by datagram sockets, a stream has no
+// boundaries to keep
+func (s *TCPSocket) ReadFrom(size int) (Datagram, error) {
+	return Datagram{}, ErrNotSupported
 }
 
-// WriteTo...
-func (s *TCPSocket) WriteTo(b []byte, addr SockAddr) (int, error) {
-	return 0, errors.New("not implemented")
+// WriteTo connects to addr with TCP Fast Open, the SYN carries the start
+// of b if the server gave us a cookie before. The socket layer has set
+// the addresses already. A connected socket writes b as usual.
+func (s *TCPSocket) WriteTo(b []byte, _ SockAddr) (int, error) {
+	if s.TCB != nil {
+		return s.Write(b)
+	}
+
+	tcpProtocol, ok := s.Protocol.(*transportlayer.TCPProtocol)
+	if !ok {
+		return 0, errors.New("TCP socket does not have a TCP protocol")
+	}
+
+	ipControl := s.ipControl()
+
+	tcb, n, err := tcpProtocol.OpenConnectionData(
+		s.SocketMeta.SrcAddr,
+		s.SocketMeta.DestAddr,
+		s.SocketMeta.GetNetworkInterface(),
+		&ipControl,
+		b,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("TCPSocket WriteTo: error opening connection: %w", err)
+	}
+
+	s.TCB = tcb
+
+	if err := s.applyOptions(); err != nil {
+		return n, err
+	}
+
+	// The rest goes out once the send buffer has room
+	if n < len(b) {
+		m, err := tcb.Write(b[n:])
+		return n + m, err
+	}
+
+	return n, nil
 }
@@ -1,15 +1,33 @@
 package socket
 
 import (
-	"net"
+	"errors"
+	"sync"
 
 	"github.com/mattcarp12/matnet/netstack"
 )
 
+/*
+	A connected UDP socket has a fixed peer, like in BSD. Write sends to
+	it, and datagrams from any other address are dropped when they arrive,
+	so they don't take room in the receive queue. Like any UDP socket, it
+	drops the datagrams that don't fit in the queue instead of holding up
+	the delivery to other sockets. The socket layer picks the route and
+	source address when connecting.
+*/
+
 type UDPSocket struct {
 	SocketMeta
+
+	// The peer of a connected socket. mu guards them, delivery
+	// checks them while the socket layer connects.
+	mu        sync.Mutex
+	peer      SockAddr
+	connected bool
 }
 
+var ErrIsConnected = errors.New("socket is already connected")
+
 func NewUDPSocket() *UDPSocket {
 	s := &UDPSocket{
 		SocketMeta: *NewSocketMeta(),
@@ -24,21 +42,45 @@ func (s *UDPSocket) Bind(addr SockAddr) error {
 	return nil
 }
 
-// Listen...
-func (s *UDPSocket) Listen() error {
-	return nil
+// Listen is only supported by stream sockets
+func (s *UDPSocket) Listen(backlog int) error {
+	return ErrNotSupported
 }
 
-// Accept...
-func (s *UDPSocket) Accept() (net.Conn, error) {
-	return nil, nil
+// Accept is only supported by stream sockets
+func (s *UDPSocket) Accept() (Socket, error) {
+	return nil, ErrNotSupported
 }
 
-// Connect...
+// Connect fixes the peer of the socket. The socket layer has set
+// the route and source address already.
 func (s *UDPSocket) Connect(addr SockAddr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peer = addr
+	s.connected = true
+
 	return nil
 }
 
+// fromPeer tells whether a received datagram is for the socket. A
+// connected socket only takes the ones from its peer.
+func (s *UDPSocket) fromPeer(skb *netstack.SkBuff) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.connected || skb.GetSrcIP().Equal(s.peer.IP) && skb.GetSrcPort() == s.peer.Port
+}
+
+// connectedPeer returns the peer of a connected socket
+func (s *UDPSocket) connectedPeer() (SockAddr, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peer, s.connected
+}
+
 // Close...
 func (s *UDPSocket) Close() error {
 	// Tell UDP protocol to close socket
@@ -46,33 +88,84 @@ func (s *UDPSocket) Close() error {
 	return nil
 }
 
-// Read...
-func (s *UDPSocket) Read() ([]byte, error) {
+// Shutdown only applies to connections
+func (s *UDPSocket) Shutdown(how ShutdownHow) error {
+	return ErrNotSupported
+}
+
+// deliver queues a received datagram for the socket, or drops it
+// if it isn't from the peer or the queue is full
+func (s *UDPSocket) deliver(skb *netstack.SkBuff) {
+	if !s.fromPeer(skb) {
+		return
+	}
+
+	select {
+	case s.RxChan <- skb:
+	default:
+	}
+}
+
+// Read waits for a datagram
+func (s *UDPSocket) Read() ([]byte, *ControlMessage, error) {
 	sockLog.Printf("UDP Read()")
 
 	skb := <-s.RxChan
 
 	sockLog.Printf("Read: %v\n", skb)
 
-	return skb.Data, nil
+	return skb.Data, s.controlMessage(skb), nil
 }
 
-// Write...
+// Write sends b to the peer of a connected socket
 func (s *UDPSocket) Write(b []byte) (int, error) {
-	return 0, nil
+	peer, ok := s.connectedPeer()
+	if !ok {
+		return 0, ErrNotConnected
+	}
+
+	return s.send(b, peer)
 }
 
-// ReadFrom...
-func (s *UDPSocket) ReadFrom(b []byte, addr *SockAddr) (int, error) {
-	return 0, nil
+// ReadFrom waits for a datagram, and returns it with its sender and
+// the interface it arrived on. One larger than size is cut off.
+func (s *UDPSocket) ReadFrom(size int) (Datagram, error) {
+	skb := <-s.RxChan
+
+	dgram := Datagram{
+		Data:    skb.Data,
+		From:    SockAddr{IP: skb.GetSrcIP(), Port: skb.GetSrcPort()},
+		Control: s.controlMessage(skb),
+	}
+
+	if iface, err := skb.GetRxIface(); err == nil {
+		dgram.Iface = iface.GetName()
+	}
+
+	if size > 0 && len(dgram.Data) > size {
+		dgram.Data = dgram.Data[:size]
+		dgram.Truncated = true
+	}
+
+	return dgram, nil
 }
 
-// WriteTo...
-// At this point the socket should have an iterface and source address set
+// WriteTo sends b to destAddr. A connected socket only sends to its
+// peer, with Write.
 func (s *UDPSocket) WriteTo(b []byte, destAddr SockAddr) (int, error) {
+	if _, ok := s.connectedPeer(); ok {
+		return 0, ErrIsConnected
+	}
+
 	// Set socket destination address
 	s.DestAddr = destAddr
 
+	return s.send(b, destAddr)
+}
+
+// send passes a datagram to UDP. At this point the socket should
+// have an interface and source address set.
+func (s *UDPSocket) send(b []byte, destAddr SockAddr) (int, error) {
 	// Create new skbuff
 	skb := netstack.NewSkBuff(b)
 
@@ -80,9 +173,12 @@ func (s *UDPSocket) WriteTo(b []byte, destAddr SockAddr) (int, error) {
 	skb.SetTxIface(s.SocketMeta.Route.Iface)
 
 	// Set the skbuff source and destination addresses
-	skb.SetDstAddr(s.DestAddr)
+	skb.SetDstAddr(destAddr)
 	skb.SetSrcAddr(s.SrcAddr)
 
+	// Set the IP header fields chosen with socket options
+	skb.SetIPControl(s.ipControl())
+
 	// Set skbuff type to UDP
 	skb.SetType(netstack.ProtocolTypeUDP)
 
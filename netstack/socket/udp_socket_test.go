@@ -0,0 +1,139 @@
+package socket
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+var peerIP = net.IPv4(10, 88, 45, 1).To4()
+
+// newTestUDPSocket makes a UDP socket on port 5000, with the socket
+// manager that delivers its datagrams
+func newTestUDPSocket(t *testing.T) (*UDPSocket, *SocketManager) {
+	sm := NewSocketManager(netstack.ProtocolTypeUDP)
+
+	s := NewUDPSocket()
+	s.SetID(NewSockID(SocketTypeDatagram))
+	s.SetSrcPort(5000)
+
+	assert.NoError(t, sm.assignPort(5000, s))
+	sm.addSocket(s)
+
+	return s, sm
+}
+
+// fakeUDP stands in for the UDP protocol a socket sends to
+type fakeUDP struct {
+	netstack.Protocol
+	txChan chan *netstack.SkBuff
+}
+
+func (p fakeUDP) TxChan() chan *netstack.SkBuff { return p.txChan }
+
+// genDatagram makes a datagram from srcIP and srcPort to the socket
+func genDatagram(srcIP net.IP, srcPort uint16, data string) *netstack.SkBuff {
+	skb := netstack.NewSkBuff([]byte(data))
+	skb.SetSrcAddr(SockAddr{IP: srcIP, Port: srcPort})
+	skb.SetDstAddr(SockAddr{IP: net.IPv4(10, 88, 45, 69).To4(), Port: 5000})
+
+	return skb
+}
+
+func Test_UDPSocket_Deliver(t *testing.T) {
+	s, sm := newTestUDPSocket(t)
+
+	read := func(expected string) {
+		data, _, err := s.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	// An unconnected socket takes datagrams from anyone
+	sm.HandleRx(genDatagram(net.IPv4(10, 88, 45, 2).To4(), 53, "anyone"))
+	read("anyone")
+
+	assert.NoError(t, s.Connect(SockAddr{IP: peerIP, Port: 53}))
+
+	// A connected one only from its peer, the others don't take
+	// room in the queue
+	sm.HandleRx(genDatagram(net.IPv4(10, 88, 45, 2).To4(), 53, "other IP"))
+	sm.HandleRx(genDatagram(peerIP, 54, "other port"))
+	sm.HandleRx(genDatagram(peerIP, 53, "peer"))
+
+	assert.Len(t, s.RxChan, 1)
+	read("peer")
+
+	// A full queue drops datagrams instead of holding up delivery
+	for i := 0; i <= socketRxChanSize; i++ {
+		sm.HandleRx(genDatagram(peerIP, 53, "peer"))
+	}
+
+	assert.Len(t, s.RxChan, socketRxChanSize)
+}
+
+func Test_UDPSocket_Write(t *testing.T) {
+	s := NewUDPSocket()
+	txChan := make(chan *netstack.SkBuff)
+	s.SetProtocol(fakeUDP{txChan: txChan})
+	s.SetRoute(&netstack.Route{})
+
+	peer := SockAddr{IP: peerIP, Port: 53}
+
+	// An unconnected socket has no peer to write to
+	_, err := s.Write([]byte("hello"))
+	assert.ErrorIs(t, err, ErrNotConnected)
+
+	assert.NoError(t, s.Connect(peer))
+
+	go func() {
+		skb := <-txChan
+		assert.Equal(t, peer, skb.GetDstAddr())
+		skb.TxSuccess()
+	}()
+
+	n, err := s.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// A connected socket only sends to its peer
+	_, err = s.WriteTo([]byte("hello"), SockAddr{IP: net.IPv4(10, 88, 45, 2).To4(), Port: 53})
+	assert.ErrorIs(t, err, ErrIsConnected)
+}
+
+// fakeIface stands in for the interface a datagram arrives on
+type fakeIface struct {
+	netstack.NetworkInterface
+	name string
+}
+
+func (iface fakeIface) GetName() string { return iface.name }
+
+func Test_UDPSocket_ReadFrom(t *testing.T) {
+	s := NewUDPSocket()
+
+	skb := genDatagram(peerIP, 53, "hello")
+	skb.SetRxIface(fakeIface{name: "tap0"})
+	s.RxChan <- skb
+	s.RxChan <- genDatagram(net.IPv4(10, 88, 45, 2).To4(), 54, "world")
+
+	// Each call returns one datagram, with its sender and interface
+	dgram, err := s.ReadFrom(100)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), dgram.Data)
+	assert.Equal(t, SockAddr{IP: peerIP, Port: 53}, dgram.From)
+	assert.Equal(t, "tap0", dgram.Iface)
+	assert.False(t, dgram.Truncated)
+
+	// The rest of a datagram larger than size is dropped
+	dgram, err = s.ReadFrom(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("wor"), dgram.Data)
+	assert.Equal(t, SockAddr{IP: net.IPv4(10, 88, 45, 2).To4(), Port: 54}, dgram.From)
+	assert.Equal(t, "", dgram.Iface)
+	assert.True(t, dgram.Truncated)
+
+	assert.Len(t, s.RxChan, 0)
+}
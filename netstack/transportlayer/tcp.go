@@ -4,9 +4,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattcarp12/matnet/netstack/util"
@@ -69,6 +72,10 @@ func (h TCPHeader) Marshal() []byte {
 }
 
 func (h *TCPHeader) Unmarshal(b []byte) error {
+	if len(b) < TCPHeaderMinSize {
+		return ErrInvalidTCPHeader
+	}
+
 	h.SrcPort = binary.BigEndian.Uint16(b[0:2])
 	h.DstPort = binary.BigEndian.Uint16(b[2:4])
 	h.SeqNum = binary.BigEndian.Uint32(b[4:8])
@@ -79,15 +86,29 @@ func (h *TCPHeader) Unmarshal(b []byte) error {
 	h.Checksum = binary.BigEndian.Uint16(b[16:18])
 	h.UrgentPtr = binary.BigEndian.Uint16(b[18:20])
 
+	if h.SizeInBytes() < TCPHeaderMinSize || h.SizeInBytes() > len(b) {
+		return ErrInvalidTCPHeader
+	}
+
+	h.Options = nil
+
 	if h.SizeInBytes() > TCPHeaderMinSize {
-		h.Options = TCPOptions{}
-		optionsBytes := b[20:h.SizeInBytes()]
-		h.Options.Unmarshal(optionsBytes)
+		optionsBytes := b[TCPHeaderMinSize:h.SizeInBytes()]
+		if err := h.Options.Unmarshal(optionsBytes); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// SetOptions sets the options of the header, and
+// the header length to fit them
+func (h *TCPHeader) SetOptions(options TCPOptions) {
+	h.Options = options
+	h.HeaderLen = uint8((TCPHeaderMinSize + len(options.Marshal())) / TCPWordSize)
+}
+
 func (h TCPHeader) SizeInBytes() int {
 	return int(h.HeaderLen * TCPWordSize)
 }
@@ -148,79 +169,184 @@ func (h *TCPHeader) SetACK() {
 type TCPOptionKind uint8
 
 const (
-	TCPOptionKindEndOfOptions TCPOptionKind = 0
-	TCPOptionKindNop                        = 1
-	TCPOptionKindMSS                        = 2
-	TCPOptionKindWS                         = 3
+	TCPOptionKindEndOfOptions  TCPOptionKind = 0
+	TCPOptionKindNop           TCPOptionKind = 1
+	TCPOptionKindMSS           TCPOptionKind = 2
+	TCPOptionKindWS            TCPOptionKind = 3
+	TCPOptionKindSACKPermitted TCPOptionKind = 4
+	TCPOptionKindSACK          TCPOptionKind = 5
+	TCPOptionKindTimestamps    TCPOptionKind = 8
 )
 
+// Lengths of the options, including the kind and length bytes
+const (
+	tcpOptionLenMSS           = 4
+	tcpOptionLenWS            = 3
+	tcpOptionLenSACKPermitted = 2
+	tcpOptionLenTimestamps    = 10
+	tcpSACKBlockSize          = 8
+
+	// The header length field leaves room for 40 bytes of options
+	TCPOptionsMaxSize = 40
+)
+
+var ErrInvalidTCPOptions = errors.New("invalid TCP options")
+
+// SACKBlock is a block of data the receiver holds beyond
+// the cumulative ACK (RFC 2018)
+type SACKBlock struct {
+	Left  uint32 // First sequence number of the block
+	Right uint32 // Sequence number after the block
+}
+
+// TCPOption is a single option of a TCP header. Only the
+// fields of its kind are used.
 type TCPOption struct {
-	Kind      TCPOptionKind
-	Mss       uint16
-	Nop       uint8
-	Nop2      uint8
-	WScale    uint8
-	SackPerm  uint8
-	Sack      uint8
-	Timestamp uint8
+	Kind   TCPOptionKind
+	MSS    uint16      // Maximum segment size (RFC 9293 3.7.1)
+	WScale uint8       // Window scale shift count (RFC 7323 2)
+	TSVal  uint32      // Timestamp value (RFC 7323 3)
+	TSEcr  uint32      // Timestamp echo reply
+	Blocks []SACKBlock // SACK blocks (RFC 2018)
+	Data   []byte      // Contents of options of other kinds
 }
 
 type TCPOptions []TCPOption
 
+// Marshal encodes the options, padded with zeros to a whole
+// number of words
 func (o TCPOptions) Marshal() []byte {
 	b := make([]byte, 0)
 	for _, option := range o {
 		b = append(b, option.Marshal()...)
 	}
+
+	for len(b)%TCPWordSize != 0 {
+		b = append(b, byte(TCPOptionKindEndOfOptions))
+	}
+
 	return b
 }
 
 func (o TCPOption) Marshal() []byte {
-	b := make([]byte, 12)
-	binary.BigEndian.PutUint16(b[0:2], o.Mss)
-	b[2] = o.Nop
-	b[3] = o.Nop2
-	b[4] = o.WScale
-	b[5] = o.SackPerm
-	b[6] = o.Sack
-	b[7] = o.Timestamp
+	switch o.Kind {
+	case TCPOptionKindEndOfOptions, TCPOptionKindNop:
+		return []byte{byte(o.Kind)}
+	case TCPOptionKindMSS:
+		b := []byte{byte(o.Kind), tcpOptionLenMSS, 0, 0}
+		binary.BigEndian.PutUint16(b[2:4], o.MSS)
+
+		return b
+	case TCPOptionKindWS:
+		return []byte{byte(o.Kind), tcpOptionLenWS, o.WScale}
+	case TCPOptionKindSACKPermitted:
+		return []byte{byte(o.Kind), tcpOptionLenSACKPermitted}
+	case TCPOptionKindSACK:
+		b := make([]byte, 2+tcpSACKBlockSize*len(o.Blocks))
+		b[0] = byte(o.Kind)
+		b[1] = byte(len(b))
+
+		for i, block := range o.Blocks {
+			binary.BigEndian.PutUint32(b[2+i*tcpSACKBlockSize:], block.Left)
+			binary.BigEndian.PutUint32(b[6+i*tcpSACKBlockSize:], block.Right)
+		}
 
-	return b
+		return b
+	case TCPOptionKindTimestamps:
+		b := make([]byte, tcpOptionLenTimestamps)
+		b[0] = byte(o.Kind)
+		b[1] = tcpOptionLenTimestamps
+		binary.BigEndian.PutUint32(b[2:6], o.TSVal)
+		binary.BigEndian.PutUint32(b[6:10], o.TSEcr)
+
+		return b
+	default:
+		return append([]byte{byte(o.Kind), byte(2 + len(o.Data))}, o.Data...)
+	}
 }
 
-func (o *TCPOptions) Unmarshal(b []byte) {
-	remainingLength := len(b)
-	optionLength := 0
+// Unmarshal decodes the options in b. NOPs are skipped, and decoding
+// stops at the end of option list. Options of unknown kinds keep their
+// contents in Data.
+func (o *TCPOptions) Unmarshal(b []byte) error {
+	for len(b) > 0 {
+		kind := TCPOptionKind(b[0])
+
+		switch kind {
+		case TCPOptionKindEndOfOptions:
+			return nil
+		case TCPOptionKindNop:
+			b = b[1:]
+			continue
+		}
 
-	for {
-		optionKind := TCPOptionKind(b[0])
-		option := TCPOption{}
-		option.Kind = optionKind
+		// Every other option has a length, which counts
+		// the kind and length bytes
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return fmt.Errorf("%w: bad length for kind %d", ErrInvalidTCPOptions, kind)
+		}
 
-		switch optionKind {
-		case TCPOptionKindEndOfOptions, TCPOptionKindNop:
-			// End of options
-			return
-		case TCPOptionKindMSS:
-			// MSS
-			option.Mss = binary.BigEndian.Uint16(b[2:4])
-			optionLength = int(b[1])
+		length := int(b[1])
+		data := b[2:length]
+		option := TCPOption{Kind: kind}
+
+		var ok bool
 
+		switch kind {
+		case TCPOptionKindMSS:
+			if ok = length == tcpOptionLenMSS; ok {
+				option.MSS = binary.BigEndian.Uint16(data)
+			}
+		case TCPOptionKindWS:
+			if ok = length == tcpOptionLenWS; ok {
+				option.WScale = data[0]
+			}
+		case TCPOptionKindSACKPermitted:
+			ok = length == tcpOptionLenSACKPermitted
+		case TCPOptionKindSACK:
+			if ok = len(data) > 0 && len(data)%tcpSACKBlockSize == 0; ok {
+				for i := 0; i < len(data); i += tcpSACKBlockSize {
+					option.Blocks = append(option.Blocks, SACKBlock{
+						Left:  binary.BigEndian.Uint32(data[i : i+4]),
+						Right: binary.BigEndian.Uint32(data[i+4 : i+8]),
+					})
+				}
+			}
+		case TCPOptionKindTimestamps:
+			if ok = length == tcpOptionLenTimestamps; ok {
+				option.TSVal = binary.BigEndian.Uint32(data[0:4])
+				option.TSEcr = binary.BigEndian.Uint32(data[4:8])
+			}
 		default:
-			fmt.Printf("Unknown option kind: %d\n", optionKind)
+			ok = true
+			option.Data = append([]byte(nil), data...)
 		}
 
-		b = b[optionLength:]
-		remainingLength -= optionLength
+		if !ok {
+			return fmt.Errorf("%w: bad length %d for kind %d", ErrInvalidTCPOptions, length, kind)
+		}
 
 		*o = append(*o, option)
+		b = b[length:]
+	}
 
-		if remainingLength == 0 {
-			return
+	return nil
+}
+
+// Find returns the first option of the kind
+func (o TCPOptions) Find(kind TCPOptionKind) (TCPOption, bool) {
+	for _, option := range o {
+		if option.Kind == kind {
+			return option, true
 		}
 	}
+
+	return TCPOption{}, false
 }
 
+// The protocol number of TCP in the IP header and the pseudo header
+const tcpProtocolNumber = 6
+
 type TCPPseudoHeader struct {
 	SrcIP    net.IP
 	DstIP    net.IP
@@ -288,11 +414,40 @@ const (
 	TCP_STATE_TIME_WAIT
 )
 
+var tcpStateNames = [...]string{
+	TCP_STATE_CLOSED:      "CLOSED",
+	TCP_STATE_LISTEN:      "LISTEN",
+	TCP_STATE_SYN_SENT:    "SYN_SENT",
+	TCP_STATE_SYN_RCVD:    "SYN_RCVD",
+	TCP_STATE_ESTABLISHED: "ESTABLISHED",
+	TCP_STATE_FIN_WAIT_1:  "FIN_WAIT_1",
+	TCP_STATE_FIN_WAIT_2:  "FIN_WAIT_2",
+	TCP_STATE_CLOSE_WAIT:  "CLOSE_WAIT",
+	TCP_STATE_CLOSING:     "CLOSING",
+	TCP_STATE_LAST_ACK:    "LAST_ACK",
+	TCP_STATE_TIME_WAIT:   "TIME_WAIT",
+}
+
+func (state TCPState) String() string {
+	if state < 0 || int(state) >= len(tcpStateNames) {
+		return fmt.Sprintf("TCPState(%d)", int(state))
+	}
+
+	return tcpStateNames[state]
+}
+
 type TCB struct {
 	TCP   *TCPProtocol
 	ID    string
 	State TCPState
 
+	// mu guards the connection state. The main loop holds it while
+	// processing a segment, and the socket layer while making calls.
+	// cond is signalled whenever the main loop has processed a
+	// segment, for the calls that wait on the connection.
+	mu   sync.Mutex
+	cond *sync.Cond
+
 	SendUNA uint32 // Unacknowledged sequence number
 	SendNXT uint32 // Next sequence number to send
 	SendWND uint32 // Window size
@@ -301,11 +456,122 @@ type TCB struct {
 	SendWL2 uint32 // Ack num used for last window update
 	SendISN uint32 // Initial sequence number
 
+	maxSendWND uint32 // Largest window the peer offered
+
 	RecvNXT uint32 // Next sequence number to receive
 	RecvWND uint32 // Window size
 	RecvUP  uint32 // Urgent pointer
 	RecvISN uint32 // Initial sequence number
 
+	SendMSS uint16 // Largest segment we send
+	RecvMSS uint16 // Largest segment we take, advertised in our SYN
+
+	// Options negotiated in the handshake (RFC 7323, RFC 2018). The
+	// windows of segments other than SYNs are scaled by the shift counts.
+	windowScaling bool
+	SendWScale    uint8 // Shift of the windows the peer advertises
+	RecvWScale    uint8 // Shift of the windows we advertise
+	SACKPermitted bool
+	TSEnabled     bool   // Timestamps on every segment
+	TSRecent      uint32 // Timestamp to echo to the peer
+	tsOffset      uint32 // Random offset of our timestamp clock
+	lastAckSent   uint32 // The ACK number we sent last (Last.ACK.sent)
+
+	// Data written by the user, starting at SendUNA. The bytes up
+	// to SendNXT are in flight, the rest hasn't been sent yet.
+	sendBuf []byte
+
+	// In-order data received, waiting for the user to read it.
+	// RecvWND is the room left in it that the peer was told about.
+	recvBuf      []byte
+	recvQueued   uint32 // Data received the user hasn't read yet
+	readShutdown bool   // The user won't read, received data is discarded
+
+	// Retransmission (RFC 6298). Segments that take up sequence space
+	// stay on the retransmission queue until they are acknowledged,
+	// and the timer runs while the queue isn't empty.
+	SRTT      time.Duration // Smoothed round trip time
+	RTTVAR    time.Duration // Round trip time variation
+	RTO       time.Duration // Retransmission timeout
+	retxQueue []tcpSegment
+	retxTimer tcbTimer
+	retries   int // Retransmissions since the last new ACK
+
+	// Congestion control (RFC 5681). The algorithm keeps the window
+	// in ccState, the TCB counts the duplicate ACKs and retransmits
+	// the segments they report lost.
+	cc          CongestionControl
+	ccState     CongestionState
+	dupAcks     int
+	recover     uint32 // Highest sequence number sent when fast recovery started (RFC 6582)
+	retransmits int    // Segments retransmitted over the connection
+
+	// Selective acknowledgments (RFC 2018, RFC 6675). The segments the
+	// peer SACKed are marked on the retransmission queue.
+	sackTrigger uint32 // Sequence number of the last out of order segment
+	highRxt     uint32 // Highest sequence number retransmitted in recovery
+
+	// Counters of what went over the connection, for Stats
+	bytesSent     uint64 // Data sent, retransmissions included
+	bytesAcked    uint64
+	bytesReceived uint64 // Data received in order
+	segsSent      uint64
+	segsReceived  uint64
+
+	finPending  bool  // The user closed, send a FIN after the data
+	finSent     bool  // Our FIN is at SendNXT-1
+	finReceived bool  // The peer has nothing more to send
+	err         error // Why the connection was closed, for the user
+
+	// Nagle's algorithm (RFC 896) holds small segments while data is in
+	// flight, unless noDelay is set. cork holds them until it is cleared.
+	noDelay bool
+	cork    bool
+
+	// Delayed ACKs (RFC 1122 4.2.3.2)
+	ackPending  uint32 // Data received since our last ACK
+	recvSegSize uint32 // Largest segment received, a full sized one of the peer
+	ackNow      bool   // ACK right away once the data queued so far is in
+	delAckTimer tcbTimer
+
+	// The persist timer probes a zero window (RFC 9293 3.8.6.1)
+	persistTimer   tcbTimer
+	persistBackoff int
+	swsOverride    bool // Send a small segment, the persist timer expired
+
+	// Keep-alive probes of an idle connection (RFC 1122 4.2.3.6)
+	keepAlive       bool
+	keepAliveConfig KeepAliveConfig
+	lastRecv        time.Time // When the peer last sent a segment
+	keepAliveProbes int       // Probes sent since then
+	keepAliveTimer  tcbTimer
+
+	// TIME_WAIT lasts 2*MSL, the timer deletes the TCB after it
+	timeWaitTimer tcbTimer
+
+	// Explicit Congestion Notification (RFC 3168)
+	ecn        bool   // Negotiated in the handshake
+	ecnEcho    bool   // We received a CE mark, set ECE until the peer sends CWR
+	ecnCWR     bool   // We reduced the window for an ECE, set CWR on the next data
+	ecnRecover uint32 // SendNXT at the last reduction, earlier ECEs are for the same congestion
+
+	// TCP Fast Open (RFC 7413). The cookie goes in our SYN, or in the
+	// SYN-ACK of a passive open when the peer needs a new one.
+	fastOpen         bool   // We opened the connection with Fast Open
+	fastOpenCookie   []byte // Empty to ask for a cookie, nil for no option
+	fastOpenListener *TCB   // The listener that counts us as pending
+
+	// Urgent data (RFC 6093). The mark is where the urgent byte is, or
+	// was, in the receive buffer.
+	urgentSend   bool // SendUP is set, the peer may not have all urgent data
+	urgentRecv   bool // RecvUP is set
+	urgentWait   bool // The urgent byte at RecvUP-1 hasn't arrived yet
+	oobInline    bool // Urgent bytes stay in the stream
+	oobByte      byte // The urgent byte taken out of the stream
+	oobValid     bool // oobByte wasn't read yet
+	urgMark      int  // Bytes to read before the mark
+	urgMarkValid bool
+
 	RxChan       chan TCPBuffer
 	RxChanSorted chan TCPBuffer
 	RxQueue      *util.Heap[TCPBuffer]
@@ -316,15 +582,54 @@ type TCB struct {
 	DstAddr netstack.SockAddr
 	TxIface netstack.NetworkInterface
 
+	// A copy of the IP header settings of the owning socket, which
+	// changes them with SetIPControl. TCP fills in the ECN bits of
+	// the TOS byte itself.
+	IPControl netstack.IPControl
+
+	// Passive open. A listening TCB keeps the connections that are
+	// still in the handshake in its SYN queue, and the established
+	// ones wait in the accept queue until the user accepts them.
+	// Both queues are guarded by TCP.mu.
+	Listener    *TCB // The listening TCB a passive open came from
+	Backlog     int
+	SynQueue    map[string]*TCB
+	AcceptQueue chan *TCB
+
+	// Connections a listener accepted with Fast Open that are still in
+	// the handshake, and how many there may be. Guarded by TCP.mu.
+	fastOpenPending int
+	fastOpenQueue   int
+
 	Log *log.Logger
 }
 
 const (
 	TCP_QUEUE_SIZE = 1024
+
+	// Without an MSS option we may only send segments of the
+	// minimum size every host accepts (RFC 9293 3.7.1)
+	TCPDefaultMSS = 536
+
+	TCPSendBufferSize = 64 * 1024
+	TCPRecvBufferSize = 256 * 1024
+
+	// The window scale shift we offer, enough to advertise the whole
+	// receive buffer, and the largest one allowed (RFC 7323 2.3)
+	TCPWindowScale    = 3
+	TCPMaxWindowScale = 14
 )
 
+// NewTCB creates a TCB, adds it to the connection table and
+// starts its main loop.
 func (tcp *TCPProtocol) NewTCB(connID string) *TCB {
+	tcb := tcp.newTCB(connID)
+	tcp.addTCB(tcb)
+
+	return tcb
+}
 
+func (tcp *TCPProtocol) newTCB(connID string) *TCB {
 	rxQueue := util.NewHeap(tcpBuffLess)
 
 	tcb := &TCB{
@@ -335,15 +640,204 @@ func (tcp *TCPProtocol) NewTCB(connID string) *TCB {
 		RxChanSorted: make(chan TCPBuffer, TCP_QUEUE_SIZE),
 		QuitChan:     make(chan struct{}),
 		RxQueue:      rxQueue,
-		RecvWND:      0xffff,
+		RecvWND:      TCPRecvBufferSize,
+		SendMSS:      TCPDefaultMSS,
+		RecvMSS:      TCPDefaultMSS,
+		tsOffset:     randomUint32(),
+		RTO:          tcp.Retransmit.InitialRTO,
+		lastRecv:     time.Now(),
 		Log:          tcp.Log,
 	}
+	tcb.cond = sync.NewCond(&tcb.mu)
 
-	tcp.ConnTable[connID] = tcb
+	tcb.initCongestionControl(tcp.GetCongestionControl())
+
+	return tcb
+}
+
+// addTCB adds the TCB to the connection table and starts its main loop
+func (tcp *TCPProtocol) addTCB(tcb *TCB) {
+	tcp.mu.Lock()
+	tcp.ConnTable[tcb.ID] = tcb
+	tcp.mu.Unlock()
 
 	go tcb.MainLoop()
+}
 
-	return tcb
+// removeTCB deletes the TCB from the connection table, and from the
+// SYN queue of its listener, and stops its main loop.
+func (tcp *TCPProtocol) removeTCB(tcb *TCB) {
+	tcp.mu.Lock()
+	defer tcp.mu.Unlock()
+
+	if tcp.ConnTable[tcb.ID] != tcb {
+		return
+	}
+
+	delete(tcp.ConnTable, tcb.ID)
+
+	if tcb.Listener != nil {
+		delete(tcb.Listener.SynQueue, tcb.ID)
+	}
+
+	close(tcb.QuitChan)
+}
+
+// SetIPControl changes the IP header settings used by the connection
+func (tcb *TCB) SetIPControl(ipControl netstack.IPControl) {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.IPControl = copyIPControl(&ipControl)
+}
+
+// IsListener reports whether the TCB was created by Listen
+func (tcb *TCB) IsListener() bool {
+	return tcb.AcceptQueue != nil
+}
+
+// initCongestionControl sets up a new connection with the named
+// congestion control algorithm, or the default one if there is none
+// by that name
+func (tcb *TCB) initCongestionControl(name string) {
+	cc, err := NewCongestionControl(name)
+	if err != nil {
+		tcb.Log.Printf("TCP: %v %q, using %v\n", err, name, DefaultCongestionControl)
+		cc, _ = NewCongestionControl(DefaultCongestionControl)
+	}
+
+	tcb.cc = cc
+	tcb.ccState = CongestionState{MSS: uint32(tcb.SendMSS)}
+	tcb.cc.Init(&tcb.ccState)
+}
+
+// SetCongestionControl switches the connection to the named congestion
+// control algorithm. Connections accepted on a listener use the
+// listener's algorithm.
+func (tcb *TCB) SetCongestionControl(name string) error {
+	cc, err := NewCongestionControl(name)
+	if err != nil {
+		return err
+	}
+
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.cc = cc
+
+	return nil
+}
+
+// TCPStats is a snapshot of the state of a connection, what
+// TCP_INFO and the connection list tell about it
+type TCPStats struct {
+	State   TCPState
+	SrcAddr netstack.SockAddr // Local address
+	DstAddr netstack.SockAddr // Remote address
+
+	// Options negotiated in the handshake
+	SendMSS    uint16
+	RecvMSS    uint16
+	SendWScale uint8
+	RecvWScale uint8
+	SACK       bool
+	Timestamps bool
+	ECN        bool
+
+	SendWND uint32 // The peer's window
+	RecvWND uint32 // Our window
+
+	CongestionControl string
+
+	Cwnd       uint32 // Congestion window, in bytes
+	Ssthresh   uint32 // Slow start threshold, in bytes
+	InFlight   uint32 // Bytes sent and not acknowledged yet
+	InRecovery bool
+
+	SRTT        time.Duration
+	RTTVAR      time.Duration
+	RTO         time.Duration
+	Retransmits int
+
+	BytesSent        uint64 // Data sent, retransmissions included
+	BytesAcked       uint64
+	BytesReceived    uint64 // Data received in order
+	SegmentsSent     uint64
+	SegmentsReceived uint64
+	OutOfOrder       int // Segments waiting for the ones before them
+}
+
+// Stats returns the current state of the connection
+func (tcb *TCB) Stats() TCPStats {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	return TCPStats{
+		State:             tcb.State,
+		SrcAddr:           tcb.SrcAddr,
+		DstAddr:           tcb.DstAddr,
+		SendMSS:           tcb.SendMSS,
+		RecvMSS:           tcb.RecvMSS,
+		SendWScale:        tcb.SendWScale,
+		RecvWScale:        tcb.RecvWScale,
+		SACK:              tcb.SACKPermitted,
+		Timestamps:        tcb.TSEnabled,
+		ECN:               tcb.ecn,
+		SendWND:           tcb.SendWND,
+		RecvWND:           tcb.RecvWND,
+		CongestionControl: tcb.cc.Name(),
+		Cwnd:              tcb.ccState.Cwnd,
+		Ssthresh:          tcb.ccState.Ssthresh,
+		InFlight:          tcb.SendNXT - tcb.SendUNA,
+		InRecovery:        tcb.ccState.InRecovery,
+		SRTT:              tcb.SRTT,
+		RTTVAR:            tcb.RTTVAR,
+		RTO:               tcb.RTO,
+		Retransmits:       tcb.retransmits,
+		BytesSent:         tcb.bytesSent,
+		BytesAcked:        tcb.bytesAcked,
+		BytesReceived:     tcb.bytesReceived,
+		SegmentsSent:      tcb.segsSent,
+		SegmentsReceived:  tcb.segsReceived,
+		OutOfOrder:        tcb.RxQueue.Len(),
+	}
+}
+
+// Connections returns the stats of all connections and listeners,
+// ordered by their addresses
+func (tcp *TCPProtocol) Connections() []TCPStats {
+	tcp.mu.Lock()
+
+	tcbs := make([]*TCB, 0, len(tcp.ListenTable)+len(tcp.ConnTable))
+	for _, tcb := range tcp.ListenTable {
+		tcbs = append(tcbs, tcb)
+	}
+
+	for _, tcb := range tcp.ConnTable {
+		tcbs = append(tcbs, tcb)
+	}
+
+	tcp.mu.Unlock()
+
+	stats := make([]TCPStats, len(tcbs))
+	for i, tcb := range tcbs {
+		stats[i] = tcb.Stats()
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if a, b := stats[i].SrcAddr.String(), stats[j].SrcAddr.String(); a != b {
+			return a < b
+		}
+
+		return stats[i].DstAddr.String() < stats[j].DstAddr.String()
+	})
+
+	return stats
+}
+
+// RxDrops returns the counts of received segments dropped as malformed
+func (tcp *TCPProtocol) RxDrops() RxDrops {
+	return tcp.rxDrops.load()
 }
 
 type TCPBuffer struct {
@@ -352,7 +846,7 @@ type TCPBuffer struct {
 }
 
 func tcpBuffLess(a, b TCPBuffer) bool {
-	return a.Header.SeqNum < b.Header.SeqNum
+	return seqLT(a.Header.SeqNum, b.Header.SeqNum)
 }
 
 /*
@@ -365,12 +859,18 @@ func (tcb *TCB) MainLoop() {
 		// RxChan is where we receive packets from the network stack.
 		// They are not in sorted order, so we need to sort them.
 		case skb := <-tcb.RxChan:
+			tcb.mu.Lock()
 			tcb.sortSegment(skb)
+			tcb.cond.Broadcast()
+			tcb.mu.Unlock()
 
 		// RxChanSorted are the packets we have received in sorted order,
 		// starting with RecvNXT sequence number.
 		case skb := <-tcb.RxChanSorted:
+			tcb.mu.Lock()
 			tcb.handleSegmentArrives(skb)
+			tcb.cond.Broadcast()
+			tcb.mu.Unlock()
 
 		// QuitChan is where we receive a signal to quit (obvi).
 		case <-tcb.QuitChan:
@@ -384,7 +884,37 @@ func (tcb *TCB) MainLoop() {
 // ============================================================================
 type TCPProtocol struct {
 	netstack.IProtocol
-	ConnTable map[string]*TCB
+
+	// mu guards the connection and listen tables
+	mu          sync.Mutex
+	ConnTable   map[string]*TCB
+	ListenTable map[string]*TCB // Listening TCBs by local address
+
+	Retransmit RetransmitConfig
+
+	// Maximum segment lifetime. Connections stay in TIME_WAIT for twice as long.
+	MSL time.Duration
+
+	// Keep-alive settings of connections that don't set their own
+	KeepAlive KeepAliveConfig
+
+	// Answer SYNs with SYN cookies when the SYN queue of a listener is full
+	SynCookies bool
+
+	// Key of the hashes of initial sequence numbers and SYN cookies
+	secret [32]byte
+
+	// Name of the congestion control algorithm of new connections
+	congestionControl atomic.Value
+
+	// Fast Open cookies servers gave us
+	fastOpenCache fastOpenCache
+
+	// Negotiate ECN on new connections
+	ECN bool
+
+	// Received segments dropped as malformed
+	rxDrops RxDrops
 }
 
 var (
@@ -397,14 +927,25 @@ var (
 	ErrConnectionIllegal     = errors.New("illegal connection")
 	ErrConnectionClosing     = errors.New("connection is closing")
 	ErrInvalidState          = errors.New("tcp: invalid state")
+	ErrAddrInUse             = errors.New("address already in use")
+	ErrListenerClosed        = errors.New("listener closed")
+	ErrConnectionTimeout     = errors.New("connection timed out")
 )
 
 func NewTCP() *TCPProtocol {
 	tcp := &TCPProtocol{
-		IProtocol: netstack.NewIProtocol(netstack.ProtocolTypeTCP),
-		ConnTable: make(map[string]*TCB),
+		IProtocol:   netstack.NewIProtocol(netstack.ProtocolTypeTCP),
+		ConnTable:   make(map[string]*TCB),
+		ListenTable: make(map[string]*TCB),
+		Retransmit:  DefaultRetransmitConfig,
+		MSL:         DefaultMSL,
+		KeepAlive:   DefaultKeepAliveConfig,
+		SynCookies:  true,
+		ECN:         true,
+		secret:      newSecret(),
 	}
 	tcp.Log = netstack.NewLogger("TCP")
+	tcp.congestionControl.Store(DefaultCongestionControl)
 
 	return tcp
 }
@@ -412,11 +953,31 @@ func NewTCP() *TCPProtocol {
 /*
 	TCP HandleRx algorithm
 	- Unmarshal the TCP header
-	- Find the TCB. Error if TCB does not exist.
+	- Find the TCB. If there is none, find a listening TCB for the
+	  local address. If there is neither, answer with a reset.
 	- Check the sequence numbers, make sure packet is within the window.
 	- Put the packet into the segment processing queue.
 */
 
+// SetCongestionControl selects the congestion control algorithm for
+// new connections. Existing connections keep theirs.
+func (tcp *TCPProtocol) SetCongestionControl(name string) error {
+	if _, err := NewCongestionControl(name); err != nil {
+		return err
+	}
+
+	tcp.congestionControl.Store(name)
+
+	return nil
+}
+
+// GetCongestionControl returns the congestion control algorithm
+// for new connections
+func (tcp *TCPProtocol) GetCongestionControl() string {
+	name, _ := tcp.congestionControl.Load().(string)
+	return name
+}
+
 func (tcp *TCPProtocol) HandleRx(skb *netstack.SkBuff) {
 	tcp.Log.Printf("HandleRx: %+v\n", skb)
 
@@ -425,11 +986,19 @@ func (tcp *TCPProtocol) HandleRx(skb *netstack.SkBuff) {
 
 	// Unmarshal the TCP header, handle errors
 	if err := tcpHeader.Unmarshal(skb.Data); err != nil {
-		skb.Error(err)
+		tcp.Log.Printf("HandleRx: %v\n", err)
+		atomic.AddUint64(&tcp.rxDrops.BadHeader, 1)
+
+		return
+	}
+
+	if !checksumValid(skb, tcpProtocolNumber, skb.Data) {
+		tcp.Log.Printf("HandleRx: invalid checksum\n")
+		atomic.AddUint64(&tcp.rxDrops.BadChecksum, 1)
+
 		return
 	}
 
-	skb.StripBytes(tcpHeader.SizeInBytes())
 	skb.SetSrcPort(tcpHeader.SrcPort)
 	skb.SetDstPort(tcpHeader.DstPort)
 
@@ -438,349 +1007,1112 @@ func (tcp *TCPProtocol) HandleRx(skb *netstack.SkBuff) {
 	// Find the TCB for this connection. Here, LocalAddr = DstAddr, RemoteAddr = SrcAddr.
 	connID := ConnectionID(skb.GetDstAddr(), skb.GetSrcAddr())
 
-	var tcb *TCB
-
-	tcb, ok := tcp.ConnTable[connID]
-	if !ok || tcb == nil {
-		// TCB does not exist. All data is discarded.
-		if tcpHeader.IsRST() {
-			skb.Error(ErrConnectionNoExistRST)
-			return
-		}
-
-		tcp.SendEmptyRst(tcpHeader)
-	}
+	tcp.mu.Lock()
+	tcb := tcp.ConnTable[connID]
+	listener := tcp.lookupListener(skb.GetDstAddr())
+	tcp.mu.Unlock()
 
 	tcp.Log.Printf("\n\n********************************************************************\nRECEIVED TCP SEGMENT\n")
 	tcp.Log.Printf("TCP Header: %+v\n", tcpHeader)
-	tcp.Log.Printf("TCB: %+v\n", tcb)
+	tcp.Log.Printf("Connection: %v\n", connID)
 	tcp.Log.Printf("Header IsSyn: %v\n", tcpHeader.IsSYN())
 	tcp.Log.Printf("Header IsACK: %v\n", tcpHeader.IsACK())
 	tcp.Log.Printf("Header IsFIN: %v\n", tcpHeader.IsFIN())
 	tcp.Log.Printf("\n********************************************************************\n\n")
 
-	// Put the packet into the TCB's RxQueue
-	tcb.RxChan <- TCPBuffer{
-		Header: tcpHeader,
-		SkBuff: skb,
-	}
-}
-
-// This is where incoming packets are checked for seq numbers, and
-// put into the TCB's processing queue in the correct order.
-func (tcb *TCB) sortSegment(tcpBuff TCPBuffer) {
-	header := tcpBuff.Header
-	skb := tcpBuff.SkBuff
+	switch {
+	case tcb != nil:
+		skb.StripBytes(tcpHeader.SizeInBytes())
 
-	// If we're in the SYN-SENT state, the usual processing does not apply.
-	// We must handle this case specially.
-	if tcb.State == TCP_STATE_SYN_SENT {
-		if err := tcb.HandleSynSent(tcpBuff); err != nil {
-			skb.Error(err)
+		// Put the packet into the TCB's RxQueue
+		tcb.RxChan <- TCPBuffer{
+			Header: tcpHeader,
+			SkBuff: skb,
 		}
-		return
+	case listener != nil:
+		tcp.handleListen(listener, tcpHeader, skb)
+	default:
+		// TCB does not exist. All data is discarded, and anything
+		// but a reset is answered with one.
+		tcp.SendReset(skb)
 	}
+}
 
-	// First check the sequence number, make sure it's in the window
-	if header.SeqNum < tcb.RecvNXT || header.SeqNum > tcb.RecvNXT+tcb.RecvWND {
-		tcb.Log.Printf("TCP: SeqNum out of window\n")
-		skb.Error(ErrInvalidSequenceNumber)
-		return
+// lookupListener finds the listening TCB for a local address. A listener
+// bound to the address itself is preferred over one bound to 0.0.0.0.
+// Must be called with tcp.mu held.
+func (tcp *TCPProtocol) lookupListener(localAddr netstack.SockAddr) *TCB {
+	if listener, ok := tcp.ListenTable[localAddr.String()]; ok {
+		return listener
 	}
 
-	// The new segment is within the window, so put it in the TCB's RxQueue.
-	tcb.RxQueue.Push(tcpBuff)
+	wildcard := netstack.SockAddr{IP: net.IPv4zero, Port: localAddr.Port}
 
-	// Check the next packet in the queue, see if it's ready to be processed
-	tcpBuff2 := tcb.RxQueue.Peek()
+	return tcp.ListenTable[wildcard.String()]
+}
 
-	if tcpBuff2.Header.SeqNum != tcb.RecvNXT {
+// handleListen processes a segment for a listening TCB, following
+// the LISTEN state rules of RFC 9293 3.10.7.2. A SYN creates a child
+// TCB in SYN_RCVD, which waits in the SYN queue until the handshake
+// completes. skb.Data still starts with the TCP header.
+func (tcp *TCPProtocol) handleListen(listener *TCB, header *TCPHeader, skb *netstack.SkBuff) {
+	// First check for an RST. There is nothing it could reset.
+	if header.IsRST() {
 		return
 	}
 
-	// If we're here, we have a packet that matches the next sequence number.
-	// So enqueue it to the sorted channel, and also all the next packets
-	// that are ready to be processed, incrementing RecvNXT as we go.
-	for {
-		if tcb.RxQueue.Len() == 0 {
-			break
+	// Second check for an ACK. Nothing has been sent yet, so it is bad,
+	// unless it returns a SYN cookie.
+	if header.IsACK() {
+		if tcp.SynCookies && tcp.acceptSynCookie(listener, header, skb) {
+			return
 		}
 
-		tcpBuff := tcb.RxQueue.Peek()
-
-		// Check the sequence number, make sure it equals RecvNXT
-		if tcpBuff.Header.SeqNum != tcb.RecvNXT {
-			break
-		}
+		tcp.SendReset(skb)
+		return
+	}
 
-		// If we're here, we have a packet that matches the next sequence number.
-		tcpBuff = tcb.RxQueue.Pop()
-		tcb.RxChanSorted <- tcpBuff
+	// Third check for a SYN. Anything else is dropped.
+	if !header.IsSYN() {
+		return
+	}
 
-		// At this point, the TCP Header has been stripped from the skbuff data buffer,
-		// and all that is left is the application data. So we can increment the RecvNXT,
-		// by the length of the application data.
-		tcb.RecvNXT += uint32(len(tcpBuff.SkBuff.Data))
+	rxIface, err := skb.GetRxIface()
+	if err != nil {
+		tcp.Log.Printf("handleListen: %v\n", err)
+		return
 	}
-}
 
-// This is where the main TCP logic happens. This function should be called with packets
-// in sequence number order.
-func (tcb *TCB) handleSegmentArrives(tcpBuff TCPBuffer) {
-	tcb.Log.Printf("\n\nTCP: handleSegmentArrives\n\n")
+	localAddr := skb.GetDstAddr()
+	remoteAddr := skb.GetSrcAddr()
+	connID := ConnectionID(localAddr, remoteAddr)
 
-	header := tcpBuff.Header
-	skb := tcpBuff.SkBuff
+	settings := listener.childSettings()
 
-	// Handle the TCP packet
+	tcp.mu.Lock()
 
-	// If we received an ACK, set SendNXT to the AckNum
-	if header.IsACK() {
-		tcb.SendNXT = header.AckNum
+	if listener.State != TCP_STATE_LISTEN {
+		tcp.mu.Unlock()
+		return
 	}
 
-	switch tcb.State {
-	default:
-		skb.Error(ErrInvalidState)
-	case TCP_STATE_LISTEN:
-		if header.IsSYN() {
-			tcb.SendSynAck(tcpBuff)
+	// Drop the SYN when the queues are full. The peer retransmits
+	// it, and by then the user may have accepted some connections.
+	// A full SYN queue alone may be a SYN flood, which SYN cookies
+	// withstand.
+	if len(listener.SynQueue) >= listener.Backlog || len(listener.AcceptQueue) == cap(listener.AcceptQueue) {
+		synQueueFull := len(listener.AcceptQueue) < cap(listener.AcceptQueue)
+		tcp.mu.Unlock()
+
+		if synQueueFull && tcp.SynCookies {
+			tcp.sendSynCookie(listener, header, skb, rxIface, settings)
 			return
 		}
-	case TCP_STATE_SYN_RCVD:
-		// Here we sent a SYN+ACK, and now we are waiting for an ACK.
-		if header.IsACK() && header.AckNum == tcb.SendNXT {
-			tcb.State = TCP_STATE_ESTABLISHED
-		}
-	case TCP_STATE_SYN_SENT:
-		// This should have already been handled in sortSegment.
-		tcb.Log.Printf("Error: Should not be in SYN_SENT state at this point.\n")
-		skb.Error(ErrInvalidState)
 
-	case TCP_STATE_FIN_WAIT_1:
-		// Here we sent a FIN segment, and now we are waiting for a FIN+ACK.
-		if header.IsACK() && header.AckNum == tcb.SendNXT {
-			tcb.State = TCP_STATE_FIN_WAIT_2
-
-			// If we received a FIN+ACK, we need to ACK it.
-			if header.IsFIN() {
-				tcb.Log.Printf("\n\nRECEIVED A FIN+ACK\n\n")
-				tcb.SendAck(tcpBuff)
-			}
-		}
+		tcp.Log.Printf("handleListen: queues full on %v, dropping SYN from %v\n", listener.SrcAddr, remoteAddr)
 
-	case TCP_STATE_FIN_WAIT_2:
-		// Here we received an ACK for our FIN segment, and now we are waiting for a FIN+ACK.
-		if header.IsACK() && header.IsFIN() && header.AckNum == tcb.SendNXT {
-			// Need to ACK the FIN
-			tcb.SendAck(tcpBuff)
-			tcb.State = TCP_STATE_CLOSE_WAIT
-		}
+		return
+	}
 
-	case TCP_STATE_ESTABLISHED:
+	tcb := tcp.newChildTCB(listener, header, skb, rxIface, tcp.ISN(localAddr, remoteAddr), settings)
 
+	// A connection that took the data of its SYN goes to the user
+	// right away, the queues were checked for room above
+	if tcp.fastOpenSyn(listener, tcb, header, skb) {
+		listener.AcceptQueue <- tcb
+	} else {
+		listener.SynQueue[connID] = tcb
 	}
-}
-
-func (tcp *TCPProtocol) HandleTx(skb *netstack.SkBuff) {
-	// Create new TCP header
 
-	// Calculate checksum
+	tcp.ConnTable[connID] = tcb
 
-	// Set the skb's L4 header to the TCP header
+	tcp.mu.Unlock()
 
-	// Prepend the TCP header to the skb
+	// Hold the TCB until the SYN-ACK is out, so the main loop
+	// doesn't process the ACK before we sent what it acknowledges
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
 
-	// Passing to the network layer, so set the skb type
-	// to the type of the socket address family (ipv4, ipv6, etc)
+	go tcb.MainLoop()
 
-	// Send to the network layer
-	tcp.TxDown(skb)
+	if err := tcb.transmit(TCP_SYN|TCP_ACK, tcb.SendISN, nil); err != nil {
+		tcp.Log.Printf("handleListen: error sending SYN-ACK: %v\n", err)
+	}
 }
 
-func ISN() uint32 {
-	// TODO: Find a better way to do this
-
-	// Generate a random ISN
-	rand.Seed(time.Now().UnixNano())
-	return rand.Uint32()
+// childSettings are what a connection takes from its listener. The
+// socket layer changes them under the listener's lock.
+type childSettings struct {
+	ccName    string
+	ipControl netstack.IPControl
 }
 
-// ==============================================================================
-// TCP Event Handlers
-// ==============================================================================
+// childSettings copies the settings of a listener for a new connection
+func (tcb *TCB) childSettings() childSettings {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
 
-// SendSynAck sends a SYN/ACK packet to the remote TCP in response
-// to a SYN packet. The TCB is updated with the remote TCP's ISN.
-// The TCBs state is set to TCP_STATE_SYN_RCVD.
-func (tcb *TCB) SendSynAck(tcpBuff TCPBuffer) {
-	requestHeader := tcpBuff.Header
-	skb := tcpBuff.SkBuff
+	return childSettings{
+		ccName:    tcb.cc.Name(),
+		ipControl: copyIPControl(&tcb.IPControl),
+	}
+}
 
-	// Create a new TCP header
-	newHeader := &TCPHeader{}
-
-	// Set the TCP header fields
-	newHeader.SrcPort = requestHeader.GetDstPort()
-	newHeader.DstPort = requestHeader.GetSrcPort()
-	newHeader.BitFlags = TCP_SYN | TCP_ACK
-	newHeader.SeqNum = ISN()
-	newHeader.AckNum = requestHeader.SeqNum + 1
-	newHeader.HeaderLen = 5
-	newHeader.Window = 0xFFFF
-	newHeader.UrgentPtr = 0
-
-	// Update the TCB
-	tcb.SendISN = newHeader.SeqNum
-	tcb.SendNXT = newHeader.SeqNum + 1
-	tcb.SendWND = 0xFFFF
-	tcb.SendUP = 0
-	tcb.SendWL1 = newHeader.SeqNum
-	tcb.SendWL2 = newHeader.SeqNum
+// newChildTCB creates the TCB of a passive open for the SYN in header,
+// in SYN_RCVD with isn as its initial sequence number
+func (tcp *TCPProtocol) newChildTCB(
+	listener *TCB,
+	header *TCPHeader,
+	skb *netstack.SkBuff,
+	rxIface netstack.NetworkInterface,
+	isn uint32,
+	settings childSettings,
+) *TCB {
+	localAddr := skb.GetDstAddr()
+	remoteAddr := skb.GetSrcAddr()
+
+	tcb := tcp.newTCB(ConnectionID(localAddr, remoteAddr))
 	tcb.State = TCP_STATE_SYN_RCVD
-	tcb.RecvISN = requestHeader.SeqNum
-	tcb.RecvNXT = requestHeader.SeqNum + 1
-	tcb.RecvWND = 0xFFFF
-	tcb.RecvUP = 0
-
-	// Set the skb's L4 header to the TCP header
-	newSkb := netstack.NewSkBuff([]byte{})
-
-	newSkb.SetSrcIP(skb.GetDstIP())
-	newSkb.SetDstIP(skb.GetSrcIP())
-	newSkb.SetSrcPort(skb.GetDstPort())
-	newSkb.SetDstPort(skb.GetSrcPort())
-
-	setSkbType(newSkb)
-
-	// Send to the network layer
-	tcb.TCP.TxDown(newSkb)
+	tcb.SendISN = isn
+	tcb.SendUNA = isn
+	tcb.SendNXT = isn + 1
+	tcb.SendWND = uint32(header.Window)
+	tcb.RecvISN = header.SeqNum
+	tcb.RecvNXT = header.SeqNum + 1
+	tcb.SrcAddr = localAddr
+	tcb.DstAddr = remoteAddr
+	tcb.TxIface = rxIface
+	tcb.IPControl = settings.ipControl
+	tcb.Listener = listener
+	tcb.recover = isn
+	tcb.ecnRecover = isn
+	tcb.highRxt = isn
+	tcb.setRecvMSS()
+	tcb.negotiate(header)
+	tcb.initCongestionControl(settings.ccName)
+	tcb.ecn = tcp.ECN && ecnSyn(header)
 
-	// Wait for skb to be sent
-	newSkb.GetResp()
+	return tcb
 }
 
-func (tcb *TCB) SendAck(tcpBuff TCPBuffer) {
-	requestHeader := tcpBuff.Header
-	skb := tcpBuff.SkBuff
+// queueAccept moves a connection that completed the handshake from the
+// SYN queue of its listener to the accept queue. It returns false if
+// the connection can't be queued, and should be reset.
+func (tcp *TCPProtocol) queueAccept(tcb *TCB) bool {
+	tcp.mu.Lock()
+	defer tcp.mu.Unlock()
 
-	tcb.Log.Printf("Sending Ack for %+v\n", requestHeader)
-	newHeader := &TCPHeader{}
+	listener := tcb.Listener
+	delete(listener.SynQueue, tcb.ID)
 
-	newHeader.SrcPort = requestHeader.GetDstPort()
-	newHeader.DstPort = requestHeader.GetSrcPort()
-	newHeader.BitFlags = TCP_ACK
-	newHeader.SeqNum = tcb.SendNXT
-	newHeader.AckNum = tcb.RecvNXT
-	newHeader.HeaderLen = 5
-	newHeader.Window = 0xFFFF
-	newHeader.UrgentPtr = 0
+	if listener.State != TCP_STATE_LISTEN {
+		return false
+	}
 
-	newSkb := netstack.NewSkBuff([]byte{})
-	newSkb.SetDstIP(skb.GetSrcIP())
-	newSkb.SetSrcIP(skb.GetDstIP())
-	newSkb.SetSrcPort(newHeader.SrcPort)
-	newSkb.SetDstPort(newHeader.DstPort)
+	select {
+	case listener.AcceptQueue <- tcb:
+		return true
+	default:
+		tcp.Log.Printf("queueAccept: accept queue full on %v\n", listener.SrcAddr)
+		return false
+	}
+}
 
-	setTCPChecksum(newSkb, newHeader)
+// This is where incoming packets are checked for seq numbers, and
+// put into the TCB's processing queue in the correct order.
+func (tcb *TCB) sortSegment(tcpBuff TCPBuffer) {
+	header := tcpBuff.Header
 
-	newSkb.SetL4Header(newHeader)
-	newSkb.PrependBytes(newHeader.Marshal())
+	tcb.segsReceived++
+	tcb.keepAliveReceived()
 
-	rxIface, err := skb.GetRxIface()
-	if err != nil {
-		tcb.Log.Printf("Error getting rxIface: %v\n", err)
+	// If we're in the SYN-SENT state, the usual processing does not apply.
+	// We must handle this case specially.
+	if tcb.State == TCP_STATE_SYN_SENT {
+		if err := tcb.HandleSynSent(tcpBuff); err != nil {
+			tcb.Log.Printf("TCP: %v\n", err)
+		}
 		return
 	}
 
-	newSkb.SetTxIface(rxIface)
+	// Resets are checked before anything else, their
+	// timestamps don't matter (RFC 7323 5.3)
+	if header.IsRST() {
+		tcb.handleReset(header)
+		return
+	}
+
+	if tcb.State == TCP_STATE_SYN_RCVD && header.IsSYN() && header.SeqNum == tcb.RecvISN {
+		// The peer didn't get our SYN-ACK and sent its SYN again
+		if !header.IsACK() {
+			if err := tcb.SendSynAck(); err != nil {
+				tcb.Log.Printf("TCP: error resending SYN-ACK: %v\n", err)
+			}
+			return
+		}
+
+		// In a simultaneous open the SYN-ACK of the peer acknowledges
+		// our SYN. We have its SYN already, the rest is a usual segment.
+		header.BitFlags &^= TCP_SYN
+		header.SeqNum++
+	}
+
+	// A SYN in a synchronized state gets a challenge ACK. If the peer
+	// restarted, it answers with a RST for the old connection (RFC 5961 4).
+	if header.IsSYN() {
+		tcb.SendAck()
+		return
+	}
+
+	// Old duplicates are recognized by their timestamps
+	if !tcb.checkTimestamp(header) {
+		tcb.Log.Printf("TCP: PAWS dropped segment %v\n", header.SeqNum)
+		tcb.SendAck()
+
+		return
+	}
+
+	retransmitted := len(tcpBuff.SkBuff.Data) > 0 && seqLT(header.SeqNum, tcb.RecvNXT)
 
-	setSkbType(newSkb)
+	// The urgent pointer counts from the sequence number before trimming
+	seq := header.SeqNum
 
-	tcb.TCP.TxDown(newSkb)
+	// First check the sequence number, make sure it's in the window.
+	// Segments with nothing new are acknowledged, so the peer
+	// learns what we expect next.
+	if !tcb.trimSegment(tcpBuff) {
+		tcb.Log.Printf("TCP: SeqNum out of window\n")
+		tcb.SendAck()
+
+		// The peer didn't get the ACK of its FIN
+		if tcb.State == TCP_STATE_TIME_WAIT && header.IsFIN() {
+			tcb.startTimeWaitTimer()
+		}
+
+		return
+	}
 
-	newSkb.GetResp()
+	tcb.updateTSRecent(header)
+	tcb.ecnReceived(tcpBuff)
+	tcb.urgentReceived(header, seq)
+
+	// Data past a hole is acknowledged right away, so the peer
+	// learns about the hole from the duplicate ACKs (RFC 5681 4.2)
+	outOfOrder := len(tcpBuff.SkBuff.Data) > 0 && seqGT(header.SeqNum, tcb.RecvNXT)
+	if outOfOrder {
+		tcb.sackTrigger = header.SeqNum
+	}
+
+	// A segment that fills a hole is acknowledged right away, as is a
+	// retransmission of data we had, the peer may have missed our ACK
+	filled := len(tcpBuff.SkBuff.Data) > 0 && !outOfOrder && tcb.RxQueue.Len() > 0
+	if filled || retransmitted {
+		tcb.ackNow = true
+	}
+
+	// The new segment is within the window, so put it in the TCB's RxQueue.
+	tcb.RxQueue.Push(tcpBuff)
+
+	// Enqueue the segments that are ready to be processed to the
+	// sorted channel, incrementing RecvNXT as we go.
+	for tcb.RxQueue.Len() > 0 {
+		// Check the sequence number, make sure it's up to RecvNXT
+		if seqGT(tcb.RxQueue.Peek().Header.SeqNum, tcb.RecvNXT) {
+			break
+		}
+
+		tcpBuff := tcb.RxQueue.Pop()
+
+		// Retransmissions can overlap the segments before them
+		if !tcb.trimSegment(tcpBuff) {
+			continue
+		}
+
+		tcb.RxChanSorted <- tcpBuff
+
+		// At this point, the TCP Header has been stripped from the skbuff data buffer,
+		// and all that is left is the application data. So we can increment the RecvNXT,
+		// by the length of the application data. The data takes up room in the window
+		// until the user reads it.
+		n := uint32(len(tcpBuff.SkBuff.Data))
+		tcb.RecvNXT += n
+		tcb.RecvWND -= n
+		tcb.recvQueued += n
+		tcb.bytesReceived += uint64(n)
+	}
+
+	if outOfOrder {
+		tcb.SendAck()
+	}
 }
 
-func (tcp *TCPProtocol) SendEmptyRst(tcpHeader *TCPHeader) {
-	// Create a new TCP header
-	newHeader := &TCPHeader{}
-
-	// Set the TCP header fields
-	newHeader.SrcPort = tcpHeader.GetDstPort()
-	newHeader.DstPort = tcpHeader.GetSrcPort()
-	newHeader.BitFlags = TCP_RST
-	newHeader.AckNum = tcpHeader.SeqNum + 1
-	newHeader.HeaderLen = 5
-	newHeader.Window = 0xFFFF
-	newHeader.UrgentPtr = 0
-	if tcpHeader.IsACK() {
-		newHeader.SeqNum = tcpHeader.AckNum
+// trimSegment cuts the data of a segment down to the part that is in the
+// receive window. It returns false if there is nothing new in the segment.
+func (tcb *TCB) trimSegment(tcpBuff TCPBuffer) bool {
+	header := tcpBuff.Header
+	skb := tcpBuff.SkBuff
+
+	seq := header.SeqNum
+	end := seq + uint32(len(skb.Data))
+	wndEnd := tcb.RecvNXT + tcb.RecvWND
+
+	// Data we already have. A FIN right after it is still new.
+	if seqLT(seq, tcb.RecvNXT) {
+		if seqLT(end, tcb.RecvNXT) || end == tcb.RecvNXT && !header.IsFIN() {
+			return false
+		}
+
+		skb.StripBytes(int(tcb.RecvNXT - seq))
+		header.SeqNum = tcb.RecvNXT
+		seq = tcb.RecvNXT
+	}
+
+	if seqGT(seq, wndEnd) {
+		return false
+	}
+
+	// Data past the window, the peer sends it again later
+	if seqGT(end, wndEnd) {
+		skb.Data = skb.Data[:wndEnd-seq]
+		header.BitFlags &^= TCP_FIN
+	}
+
+	return true
+}
+
+// This is where the main TCP logic happens. This function should be called with packets
+// in sequence number order.
+func (tcb *TCB) handleSegmentArrives(tcpBuff TCPBuffer) {
+	tcb.Log.Printf("\n\nTCP: handleSegmentArrives\n\n")
+
+	header := tcpBuff.Header
+	skb := tcpBuff.SkBuff
+
+	// Handle the TCP packet
+
+	switch tcb.State {
+	default:
+		tcb.Log.Printf("TCP: segment in state %v: %v\n", tcb.State, ErrInvalidState)
+	case TCP_STATE_SYN_RCVD:
+		// Here we sent a SYN+ACK, and now we are waiting for an ACK.
+		if !header.IsACK() {
+			return
+		}
+
+		if header.AckNum != tcb.SendNXT {
+			tcb.TCP.resetFor(header, len(skb.Data), skb)
+			return
+		}
+
+		tcb.acknowledge(header)
+		tcb.SendUNA = header.AckNum
+		tcb.setSendWindow(header, uint32(header.Window)<<tcb.SendWScale)
+		tcb.State = TCP_STATE_ESTABLISHED
+		tcb.fastOpenDone()
+
+		// Hand the connection to the listener. One accepted with
+		// Fast Open was handed over already.
+		if tcb.Listener != nil && !tcb.TCP.queueAccept(tcb) {
+			tcb.reset()
+			return
+		}
+
+		// The ACK may already carry data
+		fallthrough
+	case TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT:
+		if !tcb.processAck(tcpBuff) {
+			return
+		}
+
+		if tcb.State == TCP_STATE_ESTABLISHED && tcb.receive(tcpBuff) {
+			if tcb.finReceived {
+				tcb.State = TCP_STATE_CLOSE_WAIT
+			}
+
+			tcb.delayAck(tcpBuff)
+		}
+
+		// The ACK may have opened the window
+		if err := tcb.output(); err != nil {
+			tcb.Log.Printf("TCP: error sending data: %v\n", err)
+		}
+	case TCP_STATE_SYN_SENT:
+		// This should have already been handled in sortSegment.
+		tcb.Log.Printf("Error: Should not be in SYN_SENT state at this point.\n")
+
+	case TCP_STATE_FIN_WAIT_1, TCP_STATE_FIN_WAIT_2:
+		// Here we sent a FIN segment. The peer can still send data
+		// until it sends its own FIN.
+		if !tcb.processAck(tcpBuff) {
+			return
+		}
+
+		if err := tcb.output(); err != nil {
+			tcb.Log.Printf("TCP: error sending data: %v\n", err)
+		}
+
+		finAcked := tcb.finSent && tcb.SendUNA == tcb.SendNXT
+		if finAcked {
+			tcb.State = TCP_STATE_FIN_WAIT_2
+		}
+
+		if !tcb.receive(tcpBuff) {
+			return
+		}
+
+		if tcb.finReceived {
+			tcb.Log.Printf("\n\nRECEIVED A FIN\n\n")
+
+			if finAcked {
+				tcb.enterTimeWait()
+			} else {
+				tcb.State = TCP_STATE_CLOSING
+			}
+		}
+
+		tcb.delayAck(tcpBuff)
+
+	case TCP_STATE_CLOSING, TCP_STATE_LAST_ACK:
+		// Both sides sent a FIN, we wait for ours to be acknowledged
+		if !tcb.processAck(tcpBuff) {
+			return
+		}
+
+		if err := tcb.output(); err != nil {
+			tcb.Log.Printf("TCP: error sending data: %v\n", err)
+		}
+
+		if !tcb.finSent || tcb.SendUNA != tcb.SendNXT {
+			return
+		}
+
+		if tcb.State == TCP_STATE_CLOSING {
+			tcb.enterTimeWait()
+		} else {
+			tcb.close()
+		}
+
+	case TCP_STATE_TIME_WAIT:
+		// Only a retransmission of the peer's FIN is expected. It is
+		// acknowledged, and the 2*MSL wait starts over.
+		if header.IsFIN() {
+			tcb.SendAck()
+			tcb.startTimeWaitTimer()
+		}
+	}
+}
+
+// processAck handles the ACK field of a segment in a synchronized state,
+// freeing the acknowledged data and updating the send window. It returns
+// false if the rest of the segment should be dropped.
+func (tcb *TCB) processAck(tcpBuff TCPBuffer) bool {
+	header := tcpBuff.Header
+
+	if !header.IsACK() {
+		return false
+	}
+
+	// The peer acknowledges something we haven't sent
+	if seqGT(header.AckNum, tcb.SendNXT) {
+		tcb.SendAck()
+		return false
+	}
+
+	// Old duplicates don't update the window
+	if seqLT(header.AckNum, tcb.SendUNA) {
+		return true
+	}
+
+	// The scoreboard is updated before the acknowledged
+	// segments leave the retransmission queue
+	sacked := tcb.updateScoreboard(header)
+
+	if seqGT(header.AckNum, tcb.SendUNA) {
+		rtt := tcb.acknowledge(header)
+		acked := header.AckNum - tcb.SendUNA
+
+		// The FIN is acknowledged too, but isn't in the buffer
+		n := int(acked)
+		if n > len(tcb.sendBuf) {
+			n = len(tcb.sendBuf)
+		}
+
+		tcb.sendBuf = tcb.sendBuf[n:]
+		tcb.SendUNA = header.AckNum
+		tcb.bytesAcked += uint64(n)
+
+		tcb.congestionAck(acked, rtt)
+	} else if tcb.isDuplicateAck(tcpBuff) || sacked && header.AckNum == tcb.SendUNA {
+		tcb.duplicateAck()
+	}
+
+	// Take the window from the most recent segment
+	if seqLT(tcb.SendWL1, header.SeqNum) || tcb.SendWL1 == header.SeqNum && seqLEQ(tcb.SendWL2, header.AckNum) {
+		tcb.setSendWindow(header, uint32(header.Window)<<tcb.SendWScale)
+	}
+
+	tcb.ecnAck(header)
+
+	return true
+}
+
+// receive delivers the data of an in-order segment to the receive buffer.
+// It returns true if the segment has to be acknowledged.
+func (tcb *TCB) receive(tcpBuff TCPBuffer) bool {
+	data := tcpBuff.SkBuff.Data
+	received := len(data)
+
+	data = tcb.urgentData(tcpBuff.Header.SeqNum, data)
+
+	if tcb.readShutdown {
+		// Nobody reads it, so it doesn't take up room in the window
+		tcb.recvQueued -= uint32(len(data))
+		tcb.openRecvWindow()
 	} else {
-		newHeader.SeqNum = 0
+		tcb.recvBuf = append(tcb.recvBuf, data...)
+	}
+
+	// The FIN takes up one sequence number
+	if tcpBuff.Header.IsFIN() && !tcb.finReceived {
+		tcb.RecvNXT++
+		tcb.finReceived = true
+	}
+
+	return received > 0 || tcpBuff.Header.IsFIN()
+}
+
+// close deletes the TCB once the connection is over
+func (tcb *TCB) close() {
+	tcb.State = TCP_STATE_CLOSED
+	tcb.stopRetransmitTimer()
+	tcb.stopPersistTimer()
+	tcb.stopDelAckTimer()
+	tcb.stopKeepAliveTimer()
+	tcb.stopTimeWaitTimer()
+	tcb.retxQueue = nil
+	tcb.fastOpenDone()
+	tcb.TCP.removeTCB(tcb)
+}
+
+// closeWithError deletes the TCB, and fails the calls waiting on it with err
+func (tcb *TCB) closeWithError(err error) {
+	tcb.err = err
+	tcb.close()
+}
+
+// output sends as much of the send buffer as the send window allows,
+// and the FIN once the user closed and everything else is sent.
+func (tcb *TCB) output() error {
+	for {
+		offset := int(tcb.SendNXT - tcb.SendUNA)
+		if offset >= len(tcb.sendBuf) {
+			break
+		}
+
+		room := tcb.sendRoom()
+		if room <= 0 {
+			break
+		}
+
+		n := len(tcb.sendBuf) - offset
+		size := tcb.segmentDataSize()
+		if n > size {
+			n = size
+		}
+
+		if n > room {
+			n = room
+		}
+
+		if !tcb.sendWorthwhile(n, size, offset+n == len(tcb.sendBuf)) {
+			break
+		}
+
+		// Push the last segment of what the user wrote
+		flags := uint8(TCP_ACK)
+		if offset+n == len(tcb.sendBuf) {
+			flags |= TCP_PSH
+		}
+
+		if err := tcb.transmit(flags, tcb.SendNXT, tcb.sendBuf[offset:offset+n]); err != nil {
+			return err
+		}
+
+		tcb.SendNXT += uint32(n)
 	}
 
-	// Create a new skb
-	newSkb := netstack.NewSkBuff([]byte{})
+	if tcb.finPending && !tcb.finSent && tcb.SendNXT == tcb.SendUNA+uint32(len(tcb.sendBuf)) {
+		if err := tcb.transmit(TCP_FIN|TCP_ACK, tcb.SendNXT, nil); err != nil {
+			return err
+		}
+
+		tcb.SendNXT++
+		tcb.finSent = true
+	}
+
+	tcb.updatePersistTimer()
+
+	return nil
+}
+
+// Write appends b to the send buffer and sends what the window allows.
+// It waits for the handshake to complete, and for room in the buffer.
+func (tcb *TCB) Write(b []byte) (int, error) {
+	return tcb.write(b, false)
+}
+
+// write is Write, urgent makes the last byte of b urgent
+func (tcb *TCB) write(b []byte, urgent bool) (int, error) {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	written := 0
+
+	for written < len(b) {
+		if tcb.err != nil {
+			return written, tcb.err
+		}
+
+		switch tcb.State {
+		case TCP_STATE_SYN_SENT, TCP_STATE_SYN_RCVD:
+			tcb.cond.Wait()
+			continue
+		case TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT:
+		default:
+			return written, ErrConnectionClosing
+		}
+
+		if tcb.finPending {
+			return written, ErrConnectionClosing
+		}
+
+		room := TCPSendBufferSize - len(tcb.sendBuf)
+		if room == 0 {
+			tcb.cond.Wait()
+			continue
+		}
+
+		n := len(b) - written
+		if n > room {
+			n = room
+		}
+
+		tcb.sendBuf = append(tcb.sendBuf, b[written:written+n]...)
+		written += n
+
+		if urgent && written == len(b) {
+			tcb.SendUP = tcb.SendUNA + uint32(len(tcb.sendBuf))
+			tcb.urgentSend = true
+		}
+
+		if err := tcb.output(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Read returns the data received so far, waiting for some if there is
+// none. It returns io.EOF once the peer closed and all data was read.
+func (tcb *TCB) Read() ([]byte, error) {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	for len(tcb.recvBuf) == 0 {
+		switch {
+		case tcb.err != nil:
+			return nil, tcb.err
+		case tcb.finReceived, tcb.readShutdown:
+			return nil, io.EOF
+		case tcb.State == TCP_STATE_CLOSED:
+			return nil, ErrConnectionNoExist
+		}
+
+		tcb.cond.Wait()
+	}
+
+	// Reads stop at the urgent mark
+	n := tcb.readSize()
+	data := tcb.recvBuf[:n:n]
+	tcb.recvBuf = tcb.recvBuf[n:]
+	tcb.recvQueued -= uint32(n)
+	tcb.urgentRead(n)
+
+	if len(tcb.recvBuf) == 0 {
+		tcb.recvBuf = nil
+	}
+
+	// Tell the peer it can send again
+	if tcb.openRecvWindow() {
+		tcb.SendAck()
+	}
+
+	return data, nil
+}
+
+func (tcp *TCPProtocol) HandleTx(skb *netstack.SkBuff) {
+	// Create new TCP header
+
+	// Calculate checksum
+
+	// Set the skb's L4 header to the TCP header
+
+	// Prepend the TCP header to the skb
+
+	// Passing to the network layer, so set the skb type
+	// to the type of the socket address family (ipv4, ipv6, etc)
 
 	// Send to the network layer
-	tcp.TxDown(newSkb)
+	tcp.TxDown(skb)
 }
 
-// OpenConnection...
-// This function is meant to be called by the Socket layer,
-// in response to a socket open request.
-//
-// This function sends a SYN packet to the remote TCP
-// and returns immediately.
-func (tcp *TCPProtocol) OpenConnection(srcAddr, dstAddr netstack.SockAddr, iface netstack.NetworkInterface) error {
-	tcp.Log.Printf("OpenConnection: %v -> %v\n", srcAddr, dstAddr)
+// copyIPControl copies IP header settings, which may be nil for
+// the defaults, so the TCB doesn't share them with the socket
+func copyIPControl(ipControl *netstack.IPControl) netstack.IPControl {
+	if ipControl == nil {
+		return netstack.IPControl{}
+	}
+
+	c := *ipControl
+	c.Options = append([]byte(nil), ipControl.Options...)
+
+	return c
+}
 
-	// Make empty skb
-	skb := netstack.NewSkBuff([]byte{})
+// setIPControl copies the socket's IP header settings onto an outgoing skb
+func (tcb *TCB) setIPControl(skb *netstack.SkBuff) {
+	skb.SetIPControl(tcb.IPControl)
+}
+
+// ==============================================================================
+// TCP Event Handlers
+// ==============================================================================
+
+// sendSegment sends a segment on the connection with the given flags
+// and sequence number. The ACK number and window come from the TCB.
+func (tcb *TCB) sendSegment(flags uint8, seq uint32, data []byte) error {
+	return tcb.sendSegmentOptions(flags, seq, data, tcb.segmentOptions(flags))
+}
+
+// sendSegmentOptions sends a segment with the given options
+func (tcb *TCB) sendSegmentOptions(flags uint8, seq uint32, data []byte, options TCPOptions) error {
+	skb := netstack.NewSkBuff(data)
+
+	flags, ect := tcb.ecnFlags(flags, seq, data)
+	flags, urgentPtr := tcb.urgentFlags(flags, seq)
+
+	skb.SetSrcAddr(tcb.SrcAddr)
+	skb.SetDstAddr(tcb.DstAddr)
+	skb.SetTxIface(tcb.TxIface)
+	tcb.setIPControl(skb)
 
-	skb.SetSrcAddr(srcAddr)
-	skb.SetDstAddr(dstAddr)
-	skb.SetTxIface(iface)
+	if ect {
+		skb.SetECN(netstack.ECNECT0)
+	} else {
+		skb.SetECN(netstack.ECNNotECT)
+	}
 
 	if err := setSkbType(skb); err != nil {
 		return err
 	}
 
 	// Make TCP header
-	header := &TCPHeader{}
-	isn := ISN()
+	header := &TCPHeader{
+		SrcPort:   tcb.SrcAddr.Port,
+		DstPort:   tcb.DstAddr.Port,
+		SeqNum:    seq,
+		BitFlags:  flags,
+		Window:    tcb.advertisedWindow(flags),
+		UrgentPtr: urgentPtr,
+	}
 
-	header.SrcPort = srcAddr.Port
-	header.DstPort = dstAddr.Port
-	header.BitFlags = TCP_SYN
-	header.SeqNum = isn
-	header.AckNum = 0
-	header.HeaderLen = 5
-	header.Window = 0xFFFF
-	header.UrgentPtr = 0
+	if flags&TCP_ACK != 0 {
+		header.AckNum = tcb.RecvNXT
+		tcb.lastAckSent = tcb.RecvNXT
+		tcb.ackSent()
+	}
+
+	header.SetOptions(options)
 
 	setTCPChecksum(skb, header)
 	skb.SetL4Header(header)
 	skb.PrependBytes(header.Marshal())
 
+	tcb.segsSent++
+	tcb.bytesSent += uint64(len(data))
+
 	// Send to the network layer
-	tcp.TxDown(skb)
+	tcb.TCP.TxDown(skb)
+
+	if skbResp := skb.GetResp(); skbResp.Error != nil {
+		return skbResp.Error
+	}
+
+	return nil
+}
+
+// SendSynAck sends a SYN/ACK packet to the remote TCP in response
+// to a SYN packet. The TCB must already hold both ISNs.
+func (tcb *TCB) SendSynAck() error {
+	return tcb.sendSegment(TCP_SYN|TCP_ACK, tcb.SendISN, nil)
+}
+
+// SendAck acknowledges everything received up to RecvNXT
+func (tcb *TCB) SendAck() error {
+	tcb.Log.Printf("Sending Ack for %v\n", tcb.RecvNXT)
+
+	return tcb.sendSegment(TCP_ACK, tcb.SendNXT, nil)
+}
+
+// reset aborts the connection, sending a RST to the remote TCP.
+// Must be called with tcb.mu held.
+func (tcb *TCB) reset() {
+	if err := tcb.sendSegment(TCP_RST, tcb.SendNXT, nil); err != nil {
+		tcb.Log.Printf("reset: error sending RST: %v\n", err)
+	}
+
+	tcb.closeWithError(ErrConnectionReset)
+	tcb.cond.Broadcast()
+}
+
+// SendReset answers the segment in skb with a RST, following the reset
+// generation rules of RFC 9293 3.10.7.1. It is used for segments that
+// don't belong to any connection, and by the packet filter to reject
+// connections. skb.Data must start with the TCP header, and the skb's
+// addresses and rx iface must be set.
+func (tcp *TCPProtocol) SendReset(skb *netstack.SkBuff) {
+	header := &TCPHeader{}
+	if err := header.Unmarshal(skb.Data); err != nil {
+		return
+	}
+
+	tcp.resetFor(header, len(skb.Data)-header.SizeInBytes(), skb)
+}
+
+// resetFor answers the segment with header and dataLen bytes of data
+// with a RST. skb is the received segment, it supplies the addresses
+// and the interface to answer on.
+func (tcp *TCPProtocol) resetFor(header *TCPHeader, dataLen int, skb *netstack.SkBuff) {
+	// Never answer a reset with a reset
+	if header.IsRST() {
+		return
+	}
+
+	rxIface, err := skb.GetRxIface()
+	if err != nil {
+		return
+	}
+
+	rstHeader := &TCPHeader{
+		SrcPort:   header.DstPort,
+		DstPort:   header.SrcPort,
+		HeaderLen: 5,
+	}
+
+	if header.IsACK() {
+		// <SEQ=SEG.ACK><CTL=RST>
+		rstHeader.SeqNum = header.AckNum
+		rstHeader.BitFlags = TCP_RST
+	} else {
+		// <SEQ=0><ACK=SEG.SEQ+SEG.LEN><CTL=RST,ACK>
+		segLen := uint32(dataLen)
+		if header.IsSYN() {
+			segLen++
+		}
+
+		if header.IsFIN() {
+			segLen++
+		}
+
+		rstHeader.AckNum = header.SeqNum + segLen
+		rstHeader.BitFlags = TCP_RST | TCP_ACK
+	}
+
+	rstSkb := netstack.NewSkBuff([]byte{})
+	rstSkb.SetSrcIP(skb.GetDstIP())
+	rstSkb.SetDstIP(skb.GetSrcIP())
+	rstSkb.SetSrcPort(rstHeader.SrcPort)
+	rstSkb.SetDstPort(rstHeader.DstPort)
+	rstSkb.SetTxIface(rxIface)
+
+	if err := setSkbType(rstSkb); err != nil {
+		return
+	}
+
+	setTCPChecksum(rstSkb, rstHeader)
+	rstSkb.SetL4Header(rstHeader)
+	rstSkb.PrependBytes(rstHeader.Marshal())
+
+	// Send to the network layer
+	tcp.TxDown(rstSkb)
+	rstSkb.GetResp()
+}
+
+// OpenConnection...
+// This function is meant to be called by the Socket layer,
+// in response to a socket open request.
+//
+// This function sends a SYN packet to the remote TCP
+// and returns immediately.
+func (tcp *TCPProtocol) OpenConnection(
+	srcAddr, dstAddr netstack.SockAddr,
+	iface netstack.NetworkInterface,
+	ipControl *netstack.IPControl,
+) (*TCB, error) {
+	tcb, _, err := tcp.openConnection(srcAddr, dstAddr, iface, ipControl, false, nil)
+
+	return tcb, err
+}
+
+// openConnection sends the SYN of an active open, with Fast Open
+// if fastOpen is set. It returns how much of data was queued.
+func (tcp *TCPProtocol) openConnection(
+	srcAddr, dstAddr netstack.SockAddr,
+	iface netstack.NetworkInterface,
+	ipControl *netstack.IPControl,
+	fastOpen bool,
+	data []byte,
+) (*TCB, int, error) {
+	tcp.Log.Printf("OpenConnection: %v -> %v\n", srcAddr, dstAddr)
+
+	connID := ConnectionID(srcAddr, dstAddr)
+
+	tcp.mu.Lock()
+	_, ok := tcp.ConnTable[connID]
+	tcp.mu.Unlock()
+
+	if ok {
+		return nil, 0, ErrAddrInUse
+	}
+
+	// Create a new TCB
+	isn := tcp.ISN(srcAddr, dstAddr)
+
+	tcb := tcp.newTCB(connID)
+	tcb.State = TCP_STATE_SYN_SENT
+	tcb.SendISN = isn
+	tcb.SendUNA = isn
+	tcb.SendNXT = isn + 1
+	tcb.SrcAddr = srcAddr
+	tcb.DstAddr = dstAddr
+	tcb.TxIface = iface
+	tcb.IPControl = copyIPControl(ipControl)
+	tcb.recover = isn
+	tcb.ecnRecover = isn
+	tcb.highRxt = isn
+	tcb.setRecvMSS()
+	tcb.ecn = tcp.ECN
+
+	var synData []byte
+
+	queued := 0
+	if fastOpen {
+		synData, queued = tcb.fastOpenConnect(data)
+	}
+
+	// Hold the TCB until the SYN is out, the SYN-ACK could
+	// arrive before TxDown returns
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcp.addTCB(tcb)
+
+	if err := tcb.transmit(TCP_SYN, isn, synData); err != nil {
+		tcp.Log.Printf("OpenConnection: Error sending SYN: %v\n", err)
+		tcp.removeTCB(tcb)
+
+		return nil, 0, err
+	}
+
+	return tcb, queued, nil
+}
+
+// Listen creates a listening TCB on localAddr, which may have the
+// 0.0.0.0 address to listen on all interfaces. Up to backlog
+// connections wait in each of the SYN and accept queues.
+func (tcp *TCPProtocol) Listen(
+	localAddr netstack.SockAddr,
+	backlog int,
+	ipControl *netstack.IPControl,
+) (*TCB, error) {
+	tcp.Log.Printf("Listen: %v\n", localAddr)
+
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	} else if backlog > MaxBacklog {
+		backlog = MaxBacklog
+	}
+
+	tcp.mu.Lock()
+	defer tcp.mu.Unlock()
+
+	if _, ok := tcp.ListenTable[localAddr.String()]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	tcb := tcp.newTCB(localAddr.String())
+	tcb.State = TCP_STATE_LISTEN
+	tcb.SrcAddr = localAddr
+	tcb.IPControl = copyIPControl(ipControl)
+	tcb.Backlog = backlog
+	tcb.SynQueue = make(map[string]*TCB)
+	tcb.AcceptQueue = make(chan *TCB, backlog)
+
+	tcp.ListenTable[tcb.ID] = tcb
+
+	return tcb, nil
+}
+
+const (
+	DefaultBacklog = 128
+	MaxBacklog     = 4096
+)
+
+// Accept waits for a connection on a listening TCB, and returns the
+// TCB of the connection. It fails once the listener is closed.
+func (tcb *TCB) Accept() (*TCB, error) {
+	child, ok := <-tcb.AcceptQueue
+	if !ok {
+		return nil, ErrListenerClosed
+	}
+
+	return child, nil
+}
+
+// CloseListener stops listening. Connections that haven't been
+// accepted yet are reset, and pending Accept calls fail.
+func (tcp *TCPProtocol) CloseListener(listener *TCB) error {
+	tcp.Log.Printf("CloseListener: %v\n", listener.SrcAddr)
+
+	tcp.mu.Lock()
+
+	if listener.State != TCP_STATE_LISTEN {
+		tcp.mu.Unlock()
+		return fmt.Errorf("CloseListener: %w", ErrConnectionIllegal)
+	}
+
+	listener.State = TCP_STATE_CLOSED
+	delete(tcp.ListenTable, listener.ID)
 
-	if skbResp := skb.GetResp(); skbResp.Error != nil {
-		tcp.Log.Printf("OpenConnection: Error sending SYN: %v\n", skbResp.Error)
-		return skbResp.Error
+	children := make([]*TCB, 0, len(listener.SynQueue)+len(listener.AcceptQueue))
+	for _, child := range listener.SynQueue {
+		children = append(children, child)
 	}
 
-	// Create a new TCB
-	connID := ConnectionID(srcAddr, dstAddr)
-	tcb := tcp.NewTCB(connID)
-	tcb.State = TCP_STATE_SYN_SENT
-	tcb.SendUNA = isn
-	tcb.SendNXT = isn + 1
-	tcb.SrcAddr = srcAddr
-	tcb.DstAddr = dstAddr
-	tcb.TxIface = iface
+	for len(listener.AcceptQueue) > 0 {
+		children = append(children, <-listener.AcceptQueue)
+	}
+
+	close(listener.AcceptQueue)
+
+	tcp.mu.Unlock()
+
+	for _, child := range children {
+		child.mu.Lock()
+		child.reset()
+		child.mu.Unlock()
+	}
 
 	return nil
 }
@@ -791,11 +2123,12 @@ func setTCPChecksum(skb *netstack.SkBuff, header *TCPHeader) {
 
 	// Make pseudo header
 	// TODO: Handle IPv6
+	srcIP, dstIP := pseudoHeaderIPs(skb)
 	ph := &TCPPseudoHeader{
-		SrcIP:    skb.GetSrcIP(),
-		DstIP:    skb.GetDstIP(),
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
 		Zero:     0,
-		Protocol: 6,
+		Protocol: tcpProtocolNumber,
 		Length:   uint16(header.HeaderLen*4) + uint16(len(skb.Data)),
 	}
 
@@ -815,12 +2148,18 @@ func (tcp *TCPProtocol) CloseConnection(srcAddr, dstAddr netstack.SockAddr) erro
 	// Get the TCB
 	connID := ConnectionID(srcAddr, dstAddr)
 
+	tcp.mu.Lock()
 	tcb, ok := tcp.ConnTable[connID]
+	tcp.mu.Unlock()
+
 	if !ok {
 		tcp.Log.Printf("CloseConnection: No TCB for %v\n", connID)
 		return fmt.Errorf("CloseConnection: No TCB for %v. %w", connID, ErrConnectionNoExist)
 	}
 
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
 	switch tcb.State {
 	case TCP_STATE_CLOSED:
 		tcp.Log.Printf("CloseConnection: Connection %v already closed\n", connID)
@@ -828,20 +2167,13 @@ func (tcp *TCPProtocol) CloseConnection(srcAddr, dstAddr netstack.SockAddr) erro
 
 	case TCP_STATE_LISTEN, TCP_STATE_SYN_SENT:
 		// Delete the TCB
-		delete(tcp.ConnTable, connID)
+		tcb.close()
 		tcp.Log.Printf("CloseConnection: Connection %v closed\n", connID)
 		return nil
 
-	// Normal case
-	case TCP_STATE_SYN_RCVD, TCP_STATE_ESTABLISHED:
-		// Queue a FIN, enter FIN_WAIT_1 state
-		tcb.State = TCP_STATE_FIN_WAIT_1
-		return tcp.SendFin(tcb)
-
-	case TCP_STATE_CLOSE_WAIT:
-		// Send a FIN, enter CLOSING state
-		tcb.State = TCP_STATE_CLOSING
-		return tcp.SendFin(tcb)
+	// Normal case. Queue a FIN, and enter FIN_WAIT_1 or LAST_ACK.
+	case TCP_STATE_SYN_RCVD, TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT:
+		return tcb.shutdownWrite()
 
 	case TCP_STATE_FIN_WAIT_1, TCP_STATE_FIN_WAIT_2, TCP_STATE_CLOSING, TCP_STATE_LAST_ACK, TCP_STATE_TIME_WAIT:
 		return fmt.Errorf("CloseConnection: %w", ErrConnectionClosing)
@@ -850,70 +2182,43 @@ func (tcp *TCPProtocol) CloseConnection(srcAddr, dstAddr netstack.SockAddr) erro
 	return nil
 }
 
-// SendFin sends a FIN packet to the remote TCP
+// SendFin queues a FIN for the remote TCP. It goes out after the data
+// in the send buffer, and takes up one sequence number.
 func (tcp *TCPProtocol) SendFin(tcb *TCB) error {
-	// Make empty skb
-	skb := netstack.NewSkBuff([]byte{})
-
-	skb.SetSrcAddr(tcb.SrcAddr)
-	skb.SetDstAddr(tcb.DstAddr)
-	skb.SetTxIface(tcb.TxIface)
+	tcb.finPending = true
 
-	if err := setSkbType(skb); err != nil {
+	if err := tcb.output(); err != nil {
+		tcp.Log.Printf("SendFin: Error sending FIN: %v\n", err)
 		return err
 	}
 
-	// Make TCP header
-	header := &TCPHeader{}
-
-	header.SrcPort = tcb.SrcAddr.Port
-	header.DstPort = tcb.DstAddr.Port
-	header.BitFlags = TCP_FIN | TCP_ACK
-	header.SeqNum = tcb.SendNXT
-	header.AckNum = tcb.RecvNXT
-	header.HeaderLen = 5
-	header.Window = 0xFFFF
-	header.UrgentPtr = 0
-
-	setTCPChecksum(skb, header)
-	skb.SetL4Header(header)
-	skb.PrependBytes(header.Marshal())
-
-	// Send to the network layer
-	tcp.TxDown(skb)
-
-	if skbResp := skb.GetResp(); skbResp.Error != nil {
-		tcp.Log.Printf("SendFin: Error sending FIN: %v\n", skbResp.Error)
-		return skbResp.Error
-	}
-
 	return nil
 }
 
 // HandleSynSent is called when a packet is received and the state is TCP_STATE_SYN_SENT
 func (tcb *TCB) HandleSynSent(tcpBuff TCPBuffer) error {
 	header := tcpBuff.Header
+	skb := tcpBuff.SkBuff
 
 	tcb.Log.Printf("HandleSynSent: %v\n", header)
 	// First check the ACK bit
 	if header.IsACK() {
-		if header.AckNum <= tcb.SendISN || header.AckNum > tcb.SendNXT {
-			tcb.TCP.SendEmptyRst(header)
+		if seqLEQ(header.AckNum, tcb.SendISN) || seqGT(header.AckNum, tcb.SendNXT) {
+			tcb.TCP.resetFor(header, len(skb.Data), skb)
 			return fmt.Errorf("HandleSynSent: %w", ErrInvalidSequenceNumber)
 		}
 	}
 
-	// Check if the ACK number is valid
-	if header.AckNum < tcb.SendUNA && header.AckNum > tcb.SendNXT {
-		return fmt.Errorf("HandleSynSent: %w", ErrInvalidAckNumber)
-	}
-
-	// Second check the RST bit
+	// Second check the RST bit. Only a RST that acknowledges our SYN
+	// resets the connection, anyone could send a bare one to kill the
+	// connection attempt (RFC 9293 3.10.7.3).
 	if header.IsRST() {
-		// TODO: How to signal to the user that the connection was reset?
+		if !header.IsACK() {
+			return nil
+		}
 
 		// Remove the TCB
-		delete(tcb.TCP.ConnTable, tcb.ID)
+		tcb.closeWithError(ErrConnectionReset)
 
 		return ErrConnectionReset
 	}
@@ -924,27 +2229,561 @@ func (tcb *TCB) HandleSynSent(tcpBuff TCPBuffer) error {
 	if header.IsSYN() {
 		tcb.RecvNXT = header.SeqNum + 1
 		tcb.RecvISN = header.SeqNum
-		tcb.SendUNA = header.AckNum
+		tcb.negotiate(header)
+
+		// ECN is on if the SYN-ACK agrees to it. A simultaneous
+		// open goes without.
+		tcb.ecn = tcb.ecn && header.IsACK() && ecnSynAck(header)
+
+		// The window of a SYN is never scaled
+		tcb.setSendWindow(header, uint32(header.Window))
 
 		// Update the state
-		if tcb.SendUNA > tcb.SendISN {
+		if header.IsACK() {
+			tcb.acknowledge(header)
+			tcb.SendUNA = header.AckNum
 			tcb.State = TCP_STATE_ESTABLISHED
-			tcb.SendAck(tcpBuff)
-		} else {
-			tcb.State = TCP_STATE_SYN_RCVD
-			tcb.SendSynAck(tcpBuff)
+
+			if !tcb.fastOpen {
+				return tcb.SendAck()
+			}
+
+			tcb.fastOpenEstablished(header)
+
+			if err := tcb.SendAck(); err != nil {
+				return err
+			}
+
+			// Send the data the SYN didn't carry
+			return tcb.output()
 		}
+
+		// Simultaneous open. The SYN-ACK replaces our SYN
+		// on the retransmission queue, the data of a Fast
+		// Open is sent after the handshake.
+		tcb.State = TCP_STATE_SYN_RCVD
+		tcb.stopRetransmitTimer()
+		tcb.retxQueue = nil
+		tcb.SendNXT = tcb.SendISN + 1
+		tcb.fastOpenCookie = nil
+
+		return tcb.transmit(TCP_SYN|TCP_ACK, tcb.SendISN, nil)
+	}
+
+	return nil
+}
+
+// ==============================================================================
+// TCP Retransmission
+// ==============================================================================
+
+// RetransmitConfig holds the settings of the retransmission timer
+type RetransmitConfig struct {
+	InitialRTO time.Duration
+	MinRTO     time.Duration
+	MaxRTO     time.Duration
+
+	// How often a segment is retransmitted before the connection
+	// is aborted, during the handshake and after it
+	MaxSynRetries int
+	MaxRetries    int
+}
+
+// DefaultRetransmitConfig follows RFC 6298, with the retry
+// counts of Linux
+var DefaultRetransmitConfig = RetransmitConfig{
+	InitialRTO:    time.Second,
+	MinRTO:        time.Second,
+	MaxRTO:        60 * time.Second,
+	MaxSynRetries: 6,
+	MaxRetries:    15,
+}
+
+// The clock granularity G of RFC 6298
+const rttClockGranularity = time.Millisecond
+
+// tcpSegment is a segment on the retransmission queue
+type tcpSegment struct {
+	seq           uint32
+	flags         uint8
+	data          []byte
+	sentAt        time.Time
+	retransmitted bool
+	sacked        bool // The peer holds it, but hasn't acknowledged it yet
+}
+
+// end is the sequence number after the segment
+func (seg tcpSegment) end() uint32 {
+	end := seg.seq + uint32(len(seg.data))
+
+	if seg.flags&TCP_SYN != 0 {
+		end++
+	}
+
+	if seg.flags&TCP_FIN != 0 {
+		end++
+	}
+
+	return end
+}
+
+// transmit sends a segment that takes up sequence space, and keeps
+// it on the retransmission queue until it is acknowledged
+func (tcb *TCB) transmit(flags uint8, seq uint32, data []byte) error {
+	if err := tcb.sendSegment(flags, seq, data); err != nil {
+		return err
+	}
+
+	tcb.retxQueue = append(tcb.retxQueue, tcpSegment{
+		seq:    seq,
+		flags:  flags,
+		data:   data,
+		sentAt: time.Now(),
+	})
+
+	// The timer runs for the oldest segment
+	if !tcb.retxTimer.running() {
+		tcb.startRetransmitTimer()
 	}
 
 	return nil
 }
 
+// acknowledge removes the segments ack covers from the retransmission
+// queue, and takes a round trip time sample from the oldest of them.
+// It returns the sample, or 0 if there is none.
+func (tcb *TCB) acknowledge(header *TCPHeader) time.Duration {
+	ack := header.AckNum
+
+	acked := 0
+	for acked < len(tcb.retxQueue) && seqLEQ(tcb.retxQueue[acked].end(), ack) {
+		acked++
+	}
+
+	if acked == 0 {
+		return 0
+	}
+
+	// The timestamp the peer echoes tells when the segment it
+	// acknowledges was sent (RFC 7323 4.1). Without timestamps,
+	// Karn's algorithm applies: the ACK of a retransmitted
+	// segment could be for any of its transmissions.
+	var rtt time.Duration
+	if tsEcr, ok := tcb.echoedTimestamp(header); ok {
+		rtt = time.Duration(tcb.tsNow()-tsEcr) * time.Millisecond
+		tcb.sampleRTT(rtt)
+	} else if oldest := tcb.retxQueue[0]; !oldest.retransmitted {
+		rtt = time.Since(oldest.sentAt)
+		tcb.sampleRTT(rtt)
+	}
+
+	tcb.retxQueue = tcb.retxQueue[acked:]
+	tcb.retries = 0
+
+	// Restart the timer for the rest of the queue (RFC 6298 5.2, 5.3)
+	if len(tcb.retxQueue) == 0 {
+		tcb.stopRetransmitTimer()
+	} else {
+		tcb.startRetransmitTimer()
+	}
+
+	return rtt
+}
+
+// sampleRTT updates the RTO with a round trip time measurement
+// (RFC 6298 2.2, 2.3)
+func (tcb *TCB) sampleRTT(rtt time.Duration) {
+	if tcb.SRTT == 0 {
+		tcb.SRTT = rtt
+		tcb.RTTVAR = rtt / 2
+	} else {
+		delta := tcb.SRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+
+		tcb.RTTVAR = (3*tcb.RTTVAR + delta) / 4
+		tcb.SRTT = (7*tcb.SRTT + rtt) / 8
+	}
+
+	variance := 4 * tcb.RTTVAR
+	if variance < rttClockGranularity {
+		variance = rttClockGranularity
+	}
+
+	tcb.RTO = tcb.clampRTO(tcb.SRTT + variance)
+}
+
+func (tcb *TCB) clampRTO(rto time.Duration) time.Duration {
+	config := tcb.TCP.Retransmit
+
+	if rto < config.MinRTO {
+		return config.MinRTO
+	}
+
+	if rto > config.MaxRTO {
+		return config.MaxRTO
+	}
+
+	return rto
+}
+
+func (tcb *TCB) startRetransmitTimer() {
+	tcb.retxTimer.start(&tcb.mu, tcb.RTO, tcb.retransmitTimeout)
+}
+
+func (tcb *TCB) stopRetransmitTimer() {
+	tcb.retxTimer.stop()
+}
+
+// retransmitTimeout resends the oldest unacknowledged segment with a
+// backed off timer, or aborts the connection after too many tries
+func (tcb *TCB) retransmitTimeout() {
+	if len(tcb.retxQueue) == 0 {
+		return
+	}
+
+	limit := tcb.TCP.Retransmit.MaxRetries
+	if tcb.State == TCP_STATE_SYN_SENT || tcb.State == TCP_STATE_SYN_RCVD {
+		limit = tcb.TCP.Retransmit.MaxSynRetries
+	}
+
+	if tcb.retries >= limit {
+		tcb.Log.Printf("TCP: %v: giving up after %d retransmissions\n", tcb.ID, tcb.retries)
+		tcb.closeWithError(ErrConnectionTimeout)
+		tcb.cond.Broadcast()
+
+		return
+	}
+
+	tcb.retries++
+
+	// Back off the timer (RFC 6298 5.5)
+	tcb.RTO = tcb.clampRTO(2 * tcb.RTO)
+
+	// The window shrinks on the first timeout of the segment. Later
+	// ones keep ssthresh from before (RFC 5681 3.1).
+	synchronized := tcb.State != TCP_STATE_SYN_SENT && tcb.State != TCP_STATE_SYN_RCVD
+	if synchronized && tcb.retries == 1 {
+		tcb.congestionTimeout()
+	}
+
+	tcb.retransmitFirst()
+	tcb.startRetransmitTimer()
+}
+
+// retransmitFirst resends the oldest segment on the retransmission queue
+func (tcb *TCB) retransmitFirst() {
+	if len(tcb.retxQueue) == 0 {
+		return
+	}
+
+	tcb.retransmitSegment(&tcb.retxQueue[0])
+}
+
+// retransmitSegment resends a segment on the retransmission queue
+func (tcb *TCB) retransmitSegment(seg *tcpSegment) {
+	seg.retransmitted = true
+	tcb.retransmits++
+
+	if seqGT(seg.end(), tcb.highRxt) {
+		tcb.highRxt = seg.end()
+	}
+
+	if err := tcb.sendSegment(seg.flags, seg.seq, seg.data); err != nil {
+		tcb.Log.Printf("TCP: error retransmitting: %v\n", err)
+	}
+}
+
+// ==============================================================================
+// TCP Option Negotiation
+// ==============================================================================
+
+// The IPv4 and TCP headers without options
+const tcpIPHeadersSize = 40
+
+// setRecvMSS sets the MSS we advertise from the MTU of the
+// interface (RFC 9293 3.7.1)
+func (tcb *TCB) setRecvMSS() {
+	tcb.RecvMSS = TCPDefaultMSS
+
+	if tcb.TxIface != nil {
+		if mtu := int(tcb.TxIface.GetMTU()); mtu-tcpIPHeadersSize > TCPDefaultMSS {
+			tcb.RecvMSS = uint16(mtu - tcpIPHeadersSize)
+		}
+	}
+}
+
+// negotiate takes the options of the peer's SYN or SYN-ACK. Window
+// scaling, SACK and timestamps are used if both sides offer them, and
+// our SYN offers all of them.
+func (tcb *TCB) negotiate(header *TCPHeader) {
+	options := header.Options
+
+	// Without an MSS option the peer takes the default. We don't send
+	// more than our own interface fits either.
+	tcb.SendMSS = TCPDefaultMSS
+	if option, ok := options.Find(TCPOptionKindMSS); ok && option.MSS > 0 {
+		tcb.SendMSS = option.MSS
+	}
+
+	if tcb.SendMSS > tcb.RecvMSS {
+		tcb.SendMSS = tcb.RecvMSS
+	}
+
+	if option, ok := options.Find(TCPOptionKindWS); ok {
+		tcb.windowScaling = true
+		tcb.SendWScale = option.WScale
+		tcb.RecvWScale = TCPWindowScale
+
+		if tcb.SendWScale > TCPMaxWindowScale {
+			tcb.SendWScale = TCPMaxWindowScale
+		}
+	}
+
+	_, tcb.SACKPermitted = options.Find(TCPOptionKindSACKPermitted)
+
+	if option, ok := options.Find(TCPOptionKindTimestamps); ok {
+		tcb.TSEnabled = true
+		tcb.TSRecent = option.TSVal
+	}
+
+	// The congestion window is counted in segments of the new size
+	tcb.ccState.MSS = uint32(tcb.SendMSS)
+	tcb.cc.Init(&tcb.ccState)
+}
+
+// segmentOptions are the options of an outgoing segment
+func (tcb *TCB) segmentOptions(flags uint8) TCPOptions {
+	switch {
+	case flags&TCP_SYN != 0:
+		return tcb.synOptions(flags&TCP_ACK != 0)
+	case flags&TCP_RST != 0:
+		return nil
+	}
+
+	var options TCPOptions
+	if tcb.TSEnabled {
+		options = append(options, tcb.timestampOption())
+	}
+
+	// ACKs report the out of order data we hold
+	if flags&TCP_ACK != 0 {
+		if sack, ok := tcb.sackOption(len(options.Marshal())); ok {
+			options = append(options, sack)
+		}
+	}
+
+	return options
+}
+
+// synOptions are the options of our SYN, or of our SYN-ACK,
+// which only has the ones the peer's SYN offered
+func (tcb *TCB) synOptions(synAck bool) TCPOptions {
+	options := TCPOptions{{Kind: TCPOptionKindMSS, MSS: tcb.RecvMSS}}
+
+	if !synAck || tcb.windowScaling {
+		options = append(options, TCPOption{Kind: TCPOptionKindWS, WScale: TCPWindowScale})
+	}
+
+	if !synAck || tcb.SACKPermitted {
+		options = append(options, TCPOption{Kind: TCPOptionKindSACKPermitted})
+	}
+
+	if !synAck || tcb.TSEnabled {
+		options = append(options, tcb.timestampOption())
+	}
+
+	if tcb.fastOpenCookie != nil {
+		options = append(options, TCPOption{Kind: TCPOptionKindFastOpen, Data: tcb.fastOpenCookie})
+	}
+
+	return options
+}
+
+// segmentDataSize is the most data a segment carries. The MSS
+// doesn't count the options, so they take room from it (RFC 6691).
+func (tcb *TCB) segmentDataSize() int {
+	return int(tcb.SendMSS) - len(tcb.segmentOptions(TCP_ACK).Marshal())
+}
+
+// advertisedWindow is the window field of an outgoing segment. The
+// window of a SYN is never scaled (RFC 7323 2.2).
+func (tcb *TCB) advertisedWindow(flags uint8) uint16 {
+	wnd := tcb.RecvWND
+	if flags&TCP_SYN == 0 {
+		wnd >>= tcb.RecvWScale
+	}
+
+	if wnd > 0xffff {
+		wnd = 0xffff
+	}
+
+	return uint16(wnd)
+}
+
+// tsNow is our timestamp clock, which ticks every millisecond
+func (tcb *TCB) tsNow() uint32 {
+	return uint32(time.Now().UnixMilli()) + tcb.tsOffset
+}
+
+func (tcb *TCB) timestampOption() TCPOption {
+	return TCPOption{
+		Kind:  TCPOptionKindTimestamps,
+		TSVal: tcb.tsNow(),
+		TSEcr: tcb.TSRecent,
+	}
+}
+
+// echoedTimestamp returns the timestamp of ours the segment echoes
+func (tcb *TCB) echoedTimestamp(header *TCPHeader) (uint32, bool) {
+	if !tcb.TSEnabled {
+		return 0, false
+	}
+
+	option, ok := header.Options.Find(TCPOptionKindTimestamps)
+	if !ok || option.TSEcr == 0 {
+		return 0, false
+	}
+
+	return option.TSEcr, true
+}
+
+// checkTimestamp protects against wrapped sequence numbers (PAWS, RFC
+// 7323 5.3). It returns false for a segment with an older timestamp
+// than the last one, which is an old duplicate. Resets don't count.
+func (tcb *TCB) checkTimestamp(header *TCPHeader) bool {
+	if !tcb.TSEnabled || header.IsRST() {
+		return true
+	}
+
+	option, ok := header.Options.Find(TCPOptionKindTimestamps)
+	if !ok {
+		return true
+	}
+
+	// Timestamps wrap around too
+	return int32(option.TSVal-tcb.TSRecent) >= 0
+}
+
+// updateTSRecent keeps the timestamp to echo. It is taken from the
+// segments at the left edge of the window, so it is the timestamp
+// of the oldest segment our next ACK acknowledges (RFC 7323 4.3).
+func (tcb *TCB) updateTSRecent(header *TCPHeader) {
+	if !tcb.TSEnabled {
+		return
+	}
+
+	option, ok := header.Options.Find(TCPOptionKindTimestamps)
+	if ok && int32(option.TSVal-tcb.TSRecent) >= 0 && seqLEQ(header.SeqNum, tcb.lastAckSent) {
+		tcb.TSRecent = option.TSVal
+	}
+}
+
 // ==============================================================================
 // Sequence Number Functions
 // ==============================================================================
 
+/*
+	Sequence numbers wrap around at 2^32, so they are compared with
+	serial number arithmetic (RFC 1982): a comes before b if b is less
+	than 2^31 ahead of it. The data in flight and the windows are much
+	smaller than that, so the comparisons hold across the wrap.
+*/
+
+// IsLessThan reports whether seq1 comes before seq2, on a connection
+// whose sequence numbers start at isn
 func IsLessThan(isn, seq1, seq2 uint32) bool {
-	// Compare using modular arithmetic
-	// return (seq1-isn)%0xffffffff < (seq2-isn)%0xffffffff
-	return seq1 < seq2
+	return seq1-isn < seq2-isn
+}
+
+// seqLT reports whether a comes before b
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqLEQ reports whether a comes before b or is b
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// seqGT reports whether a comes after b
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// seqGEQ reports whether a comes after b or is b
+func seqGEQ(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+// ==============================================================================
+// TCP Connection Termination
+// ==============================================================================
+
+// DefaultMSL is the maximum segment lifetime of Linux, where
+// TIME_WAIT lasts a minute
+const DefaultMSL = 30 * time.Second
+
+// handleReset checks the sequence number of a RST (RFC 5961 3.2). Only
+// a RST at RecvNXT resets the connection. One elsewhere in the window
+// gets a challenge ACK, which the real peer answers with a RST at
+// RecvNXT, so a blind attacker has to guess the exact number.
+func (tcb *TCB) handleReset(header *TCPHeader) {
+	seq := header.SeqNum
+
+	if seq != tcb.RecvNXT {
+		if seqGT(seq, tcb.RecvNXT) && seqLT(seq, tcb.RecvNXT+tcb.RecvWND) {
+			tcb.SendAck()
+		}
+
+		return
+	}
+
+	switch tcb.State {
+	case TCP_STATE_SYN_RCVD:
+		// The peer refused the connection. A passive open goes back
+		// to LISTEN, which for us means forgetting the child TCB.
+		if tcb.Listener != nil {
+			tcb.close()
+		} else {
+			tcb.closeWithError(ErrConnectionReset)
+		}
+
+	case TCP_STATE_CLOSING, TCP_STATE_LAST_ACK, TCP_STATE_TIME_WAIT:
+		// The user closed already, there is nobody to tell
+		tcb.close()
+
+	default:
+		tcb.closeWithError(ErrConnectionReset)
+	}
+}
+
+// enterTimeWait moves the connection to TIME_WAIT once both FINs are
+// acknowledged. The TCB stays for 2*MSL to acknowledge the peer's FIN
+// again if it is retransmitted, and to keep old segments of the
+// connection from being taken for a new one (RFC 9293 3.6.1).
+func (tcb *TCB) enterTimeWait() {
+	tcb.State = TCP_STATE_TIME_WAIT
+	tcb.stopRetransmitTimer()
+	tcb.retxQueue = nil
+	tcb.startTimeWaitTimer()
+}
+
+func (tcb *TCB) startTimeWaitTimer() {
+	tcb.timeWaitTimer.start(&tcb.mu, 2*tcb.TCP.MSL, tcb.timeWaitTimeout)
+}
+
+func (tcb *TCB) stopTimeWaitTimer() {
+	tcb.timeWaitTimer.stop()
+}
+
+// timeWaitTimeout deletes the TCB at the end of TIME_WAIT
+func (tcb *TCB) timeWaitTimeout() {
+	if tcb.State != TCP_STATE_TIME_WAIT {
+		return
+	}
+
+	tcb.close()
+	tcb.cond.Broadcast()
 }
@@ -0,0 +1,488 @@
+package transportlayer
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// ==============================================================================
+// TCP Congestion Control
+// ==============================================================================
+
+/*
+	Congestion control decides how much data may be in flight on a
+	connection. The TCB detects the congestion signals, and hands them
+	to the connection's algorithm, which adjusts the congestion window
+	(RFC 5681):
+
+	- OnAck for each ACK of new data, and for duplicate ACKs during
+	  fast recovery
+	- OnLoss when three duplicate ACKs start fast retransmit and
+	  fast recovery (RFC 6582)
+	- OnRTO when the retransmission timer expires
+	- OnECN when the peer echoes a congestion experienced mark
+
+	The TCB retransmits the lost segments and leaves fast recovery
+	itself. Each connection gets its own instance of the algorithm,
+	so the algorithms can keep per connection state.
+*/
+
+// CongestionState is the part of the TCB the congestion control works on.
+// All sizes are in bytes.
+type CongestionState struct {
+	Cwnd       uint32 // Congestion window
+	Ssthresh   uint32 // Slow start threshold
+	MSS        uint32 // Sender maximum segment size
+	InFlight   uint32 // Data sent and not acknowledged yet
+	SRTT       time.Duration
+	InRecovery bool // Between fast retransmit and the ACK of all data sent before it
+}
+
+// AckEvent describes an ACK to the congestion control
+type AckEvent struct {
+	Acked     uint32        // Bytes newly acknowledged
+	RTT       time.Duration // Round trip time sample, 0 if there is none
+	Duplicate bool          // A duplicate ACK, which acknowledges nothing
+	Now       time.Time
+}
+
+type CongestionControl interface {
+	// Name is the name the algorithm is selected by
+	Name() string
+
+	// Init sets up the window of a new connection. A connection that
+	// switches algorithms keeps its window.
+	Init(cs *CongestionState)
+
+	OnAck(cs *CongestionState, ev AckEvent)
+	OnLoss(cs *CongestionState)
+	OnRTO(cs *CongestionState)
+	OnECN(cs *CongestionState)
+}
+
+var ErrUnknownCongestionControl = errors.New("unknown congestion control algorithm")
+
+const (
+	CongestionControlReno  = "reno"
+	CongestionControlCubic = "cubic"
+
+	DefaultCongestionControl = CongestionControlCubic
+
+	// Duplicate ACKs that are taken as a loss (RFC 5681 3.2)
+	DupAckThreshold = 3
+)
+
+var congestionControls = map[string]func() CongestionControl{
+	CongestionControlReno:  func() CongestionControl { return &NewReno{} },
+	CongestionControlCubic: func() CongestionControl { return &Cubic{} },
+}
+
+// NewCongestionControl creates an instance of the named algorithm
+func NewCongestionControl(name string) (CongestionControl, error) {
+	newCC, ok := congestionControls[name]
+	if !ok {
+		return nil, ErrUnknownCongestionControl
+	}
+
+	return newCC(), nil
+}
+
+// CongestionControls returns the names of the available algorithms
+func CongestionControls() []string {
+	names := make([]string, 0, len(congestionControls))
+	for name := range congestionControls {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// initialWindow is the congestion window a connection starts with
+// (RFC 5681 3.1)
+func initialWindow(mss uint32) uint32 {
+	switch {
+	case mss > 2190:
+		return 2 * mss
+	case mss > 1095:
+		return 3 * mss
+	default:
+		return 4 * mss
+	}
+}
+
+// lossThreshold halves the data in flight, but leaves room for at
+// least two segments (RFC 5681 3.1, equation 4)
+func lossThreshold(cs *CongestionState) uint32 {
+	ssthresh := cs.InFlight / 2
+	if ssthresh < 2*cs.MSS {
+		ssthresh = 2 * cs.MSS
+	}
+
+	return ssthresh
+}
+
+// slowStart grows the window by up to one segment per ACK,
+// without going past ssthresh (RFC 5681 3.1, RFC 3465)
+func slowStart(cs *CongestionState, acked uint32) {
+	if acked > cs.MSS {
+		acked = cs.MSS
+	}
+
+	cs.Cwnd += acked
+	if cs.Cwnd > cs.Ssthresh {
+		cs.Cwnd = cs.Ssthresh
+	}
+}
+
+// recoveryAck adjusts the window for an ACK during fast recovery
+// (RFC 6582 3.2). Each duplicate ACK means a segment has left the
+// network, so the window is inflated to send a new one. A partial ACK
+// deflates it by the data it acknowledged, and sends one more segment
+// in place of the retransmission.
+func recoveryAck(cs *CongestionState, ev AckEvent) {
+	if ev.Duplicate {
+		cs.Cwnd += cs.MSS
+		return
+	}
+
+	if ev.Acked >= cs.Cwnd {
+		cs.Cwnd = cs.MSS
+	} else {
+		cs.Cwnd -= ev.Acked
+	}
+
+	if ev.Acked >= cs.MSS {
+		cs.Cwnd += cs.MSS
+	}
+}
+
+// updateCongestionState copies the connection state the
+// algorithms look at into ccState
+func (tcb *TCB) updateCongestionState() {
+	tcb.ccState.MSS = uint32(tcb.SendMSS)
+	tcb.ccState.InFlight = tcb.SendNXT - tcb.SendUNA
+	tcb.ccState.SRTT = tcb.SRTT
+}
+
+// isDuplicateAck reports whether a segment is a duplicate ACK: one that
+// acknowledges nothing new while data is outstanding, carries nothing
+// and leaves the window as it was (RFC 5681 2)
+func (tcb *TCB) isDuplicateAck(tcpBuff TCPBuffer) bool {
+	header := tcpBuff.Header
+
+	return tcb.SendNXT != tcb.SendUNA &&
+		len(tcpBuff.SkBuff.Data) == 0 &&
+		!header.IsSYN() && !header.IsFIN() &&
+		header.AckNum == tcb.SendUNA &&
+		uint32(header.Window)<<tcb.SendWScale == tcb.SendWND
+}
+
+// duplicateAck counts a duplicate ACK. The third one is taken as the
+// loss of the segment at SendUNA, which is retransmitted right away,
+// and starts fast recovery (RFC 5681 3.2, RFC 6582 3.2).
+func (tcb *TCB) duplicateAck() {
+	tcb.dupAcks++
+	tcb.updateCongestionState()
+
+	if tcb.ccState.InRecovery {
+		if tcb.SACKPermitted {
+			tcb.sackRecovery()
+		} else {
+			tcb.cc.OnAck(&tcb.ccState, AckEvent{Duplicate: true, Now: time.Now()})
+		}
+
+		return
+	}
+
+	// With SACK, the scoreboard may show the loss before the third
+	// duplicate ACK arrives (RFC 6675 5)
+	if tcb.dupAcks != DupAckThreshold && !tcb.firstSegmentLost() {
+		return
+	}
+
+	// Losses of data sent before the last recovery started were
+	// already dealt with, only a timeout recovers them
+	if seqLEQ(tcb.SendUNA, tcb.recover) {
+		return
+	}
+
+	tcb.recover = tcb.SendNXT - 1
+	tcb.cc.OnLoss(&tcb.ccState)
+	tcb.ccState.InRecovery = true
+
+	// SACK recovery counts the segments that left the network in
+	// pipe, instead of inflating the window for them
+	if tcb.SACKPermitted {
+		tcb.ccState.Cwnd = tcb.ccState.Ssthresh
+		tcb.highRxt = tcb.SendUNA
+		tcb.retransmitFirst()
+		tcb.sackRecovery()
+
+		return
+	}
+
+	tcb.retransmitFirst()
+}
+
+// congestionAck passes an ACK of new data to the congestion control.
+// During fast recovery an ACK that doesn't cover all the data sent
+// before it started means the next segment was lost too, which is
+// retransmitted right away (RFC 6582 3.2).
+func (tcb *TCB) congestionAck(acked uint32, rtt time.Duration) {
+	tcb.dupAcks = 0
+	tcb.updateCongestionState()
+
+	if tcb.ccState.InRecovery {
+		if seqGT(tcb.SendUNA, tcb.recover) {
+			// Full ACK, deflate the window
+			tcb.ccState.InRecovery = false
+
+			cwnd := tcb.ccState.InFlight
+			if cwnd < tcb.ccState.MSS {
+				cwnd = tcb.ccState.MSS
+			}
+
+			cwnd += tcb.ccState.MSS
+			if cwnd > tcb.ccState.Ssthresh {
+				cwnd = tcb.ccState.Ssthresh
+			}
+
+			tcb.ccState.Cwnd = cwnd
+
+			return
+		}
+
+		// With SACK, the scoreboard tells what else to retransmit,
+		// and the window stays as it is until recovery ends
+		if tcb.SACKPermitted {
+			tcb.sackRecovery()
+			return
+		}
+
+		tcb.retransmitFirst()
+	}
+
+	tcb.cc.OnAck(&tcb.ccState, AckEvent{Acked: acked, RTT: rtt, Now: time.Now()})
+}
+
+// congestionTimeout tells the congestion control the retransmission
+// timer expired. Everything in flight counts as lost, so a fast
+// recovery in progress is over.
+func (tcb *TCB) congestionTimeout() {
+	tcb.updateCongestionState()
+	tcb.cc.OnRTO(&tcb.ccState)
+
+	tcb.ccState.InRecovery = false
+	tcb.dupAcks = 0
+	tcb.recover = tcb.SendNXT - 1
+
+	tcb.clearScoreboard()
+}
+
+// ==============================================================================
+// NewReno
+// ==============================================================================
+
+// NewReno is the standard TCP congestion control of RFC 5681,
+// with the fast recovery of RFC 6582.
+type NewReno struct {
+	// Bytes acknowledged in congestion avoidance since the
+	// window last grew
+	ackedBytes uint32
+}
+
+func (r *NewReno) Name() string {
+	return CongestionControlReno
+}
+
+func (r *NewReno) Init(cs *CongestionState) {
+	cs.Cwnd = initialWindow(cs.MSS)
+	cs.Ssthresh = math.MaxUint32
+	r.ackedBytes = 0
+}
+
+func (r *NewReno) OnAck(cs *CongestionState, ev AckEvent) {
+	if cs.InRecovery {
+		recoveryAck(cs, ev)
+		return
+	}
+
+	if ev.Duplicate {
+		return
+	}
+
+	if cs.Cwnd < cs.Ssthresh {
+		slowStart(cs, ev.Acked)
+		return
+	}
+
+	// Congestion avoidance: one segment per window of data
+	// acknowledged (RFC 5681 3.1, equation 3)
+	r.ackedBytes += ev.Acked
+	if r.ackedBytes >= cs.Cwnd {
+		r.ackedBytes -= cs.Cwnd
+		cs.Cwnd += cs.MSS
+	}
+}
+
+func (r *NewReno) OnLoss(cs *CongestionState) {
+	cs.Ssthresh = lossThreshold(cs)
+	cs.Cwnd = cs.Ssthresh + DupAckThreshold*cs.MSS
+	r.ackedBytes = 0
+}
+
+// OnRTO starts over with a window of one segment (RFC 5681 3.1)
+func (r *NewReno) OnRTO(cs *CongestionState) {
+	cs.Ssthresh = lossThreshold(cs)
+	cs.Cwnd = cs.MSS
+	r.ackedBytes = 0
+}
+
+// OnECN reduces the window as for a loss, but there is nothing
+// to retransmit (RFC 3168 6.1.2)
+func (r *NewReno) OnECN(cs *CongestionState) {
+	cs.Ssthresh = lossThreshold(cs)
+	cs.Cwnd = cs.Ssthresh
+	r.ackedBytes = 0
+}
+
+// ==============================================================================
+// CUBIC
+// ==============================================================================
+
+// CUBIC constants (RFC 9438 4)
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// Cubic is the CUBIC congestion control of RFC 9438. After a loss the
+// window grows along a cubic function of the time since the loss, which
+// is flat around the window the loss happened at. The window never
+// grows slower than it would with Reno.
+type Cubic struct {
+	wMax       float64   // Window before the last reduction, in segments
+	k          float64   // Seconds until the window reaches wMax
+	epochStart time.Time // Start of the congestion avoidance stage, zero before it
+	wEst       float64   // The window Reno would have, in segments
+}
+
+func (c *Cubic) Name() string {
+	return CongestionControlCubic
+}
+
+func (c *Cubic) Init(cs *CongestionState) {
+	cs.Cwnd = initialWindow(cs.MSS)
+	cs.Ssthresh = math.MaxUint32
+	*c = Cubic{}
+}
+
+func (c *Cubic) OnAck(cs *CongestionState, ev AckEvent) {
+	if cs.InRecovery {
+		recoveryAck(cs, ev)
+		return
+	}
+
+	if ev.Duplicate {
+		return
+	}
+
+	if cs.Cwnd < cs.Ssthresh {
+		slowStart(cs, ev.Acked)
+		return
+	}
+
+	mss := float64(cs.MSS)
+	cwnd := float64(cs.Cwnd) / mss
+
+	if c.epochStart.IsZero() {
+		c.startEpoch(cwnd, ev.Now)
+	}
+
+	// Target the window of one round trip from now (RFC 9438 4.2)
+	t := ev.Now.Sub(c.epochStart) + cs.SRTT
+	target := c.window(t.Seconds())
+
+	if target < cwnd {
+		target = cwnd
+	} else if target > 1.5*cwnd {
+		target = 1.5 * cwnd
+	}
+
+	// The Reno friendly region (RFC 9438 4.3)
+	alpha := 3 * (1 - cubicBeta) / (1 + cubicBeta)
+	c.wEst += alpha * float64(ev.Acked) / float64(cs.Cwnd)
+
+	var next float64
+	if c.window(ev.Now.Sub(c.epochStart).Seconds()) < c.wEst {
+		next = c.wEst
+	} else {
+		// Grow by (target - cwnd) / cwnd segments per segment acknowledged
+		next = cwnd + (target-cwnd)*float64(ev.Acked)/float64(cs.Cwnd)
+	}
+
+	if grown := uint32(next * mss); grown > cs.Cwnd {
+		cs.Cwnd = grown
+	}
+}
+
+// startEpoch begins a congestion avoidance stage with a window of
+// cwnd segments (RFC 9438 4.2)
+func (c *Cubic) startEpoch(cwnd float64, now time.Time) {
+	c.epochStart = now
+	c.wEst = cwnd
+
+	if c.wMax <= cwnd {
+		// No loss yet, or the window has grown past the last one
+		c.wMax = cwnd
+		c.k = 0
+	} else {
+		c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+	}
+}
+
+// window is W_cubic(t), in segments
+func (c *Cubic) window(t float64) float64 {
+	d := t - c.k
+	return cubicC*d*d*d + c.wMax
+}
+
+// reduce sets ssthresh for a congestion event, and remembers the window
+// it happened at. With fast convergence a flow that lost before
+// reaching its last wMax gives up some more bandwidth (RFC 9438 4.6, 4.7).
+func (c *Cubic) reduce(cs *CongestionState) {
+	cwnd := float64(cs.Cwnd) / float64(cs.MSS)
+
+	if cwnd < c.wMax {
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = cwnd
+	}
+
+	c.epochStart = time.Time{}
+
+	cs.Ssthresh = uint32(float64(cs.Cwnd) * cubicBeta)
+	if cs.Ssthresh < 2*cs.MSS {
+		cs.Ssthresh = 2 * cs.MSS
+	}
+}
+
+func (c *Cubic) OnLoss(cs *CongestionState) {
+	c.reduce(cs)
+	cs.Cwnd = cs.Ssthresh + DupAckThreshold*cs.MSS
+}
+
+// OnRTO starts over with a window of one segment (RFC 9438 4.8)
+func (c *Cubic) OnRTO(cs *CongestionState) {
+	c.reduce(cs)
+	cs.Cwnd = cs.MSS
+}
+
+func (c *Cubic) OnECN(cs *CongestionState) {
+	c.reduce(cs)
+	cs.Cwnd = cs.Ssthresh
+}
@@ -0,0 +1,170 @@
+package transportlayer
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_NewReno(t *testing.T) {
+	cc := &NewReno{}
+	cs := &CongestionState{MSS: 1000}
+
+	cc.Init(cs)
+	assert.Equal(t, uint32(4000), cs.Cwnd)
+	assert.Equal(t, uint32(math.MaxUint32), cs.Ssthresh)
+
+	// Slow start grows by at most one segment per ACK
+	cc.OnAck(cs, AckEvent{Acked: 1000})
+	assert.Equal(t, uint32(5000), cs.Cwnd)
+
+	cc.OnAck(cs, AckEvent{Acked: 3000})
+	assert.Equal(t, uint32(6000), cs.Cwnd)
+
+	// Congestion avoidance grows by one segment per window
+	cs.Ssthresh = 6000
+
+	cc.OnAck(cs, AckEvent{Acked: 3000})
+	assert.Equal(t, uint32(6000), cs.Cwnd)
+
+	cc.OnAck(cs, AckEvent{Acked: 3000})
+	assert.Equal(t, uint32(7000), cs.Cwnd)
+
+	// Fast recovery halves the data in flight, and inflates the
+	// window for the segments that left the network
+	cs.InFlight = 8000
+	cc.OnLoss(cs)
+	cs.InRecovery = true
+	assert.Equal(t, uint32(4000), cs.Ssthresh)
+	assert.Equal(t, uint32(7000), cs.Cwnd)
+
+	cc.OnAck(cs, AckEvent{Duplicate: true})
+	assert.Equal(t, uint32(8000), cs.Cwnd)
+
+	// A partial ACK deflates the window by what it acknowledged
+	cc.OnAck(cs, AckEvent{Acked: 1500})
+	assert.Equal(t, uint32(7500), cs.Cwnd)
+
+	// A timeout starts over from one segment
+	cs.InRecovery = false
+	cs.InFlight = 2000
+	cc.OnRTO(cs)
+	assert.Equal(t, uint32(2000), cs.Ssthresh)
+	assert.Equal(t, uint32(1000), cs.Cwnd)
+
+	// ECN reduces the window without inflating it
+	cs.InFlight = 10000
+	cc.OnECN(cs)
+	assert.Equal(t, uint32(5000), cs.Ssthresh)
+	assert.Equal(t, uint32(5000), cs.Cwnd)
+}
+
+func Test_TCP_Cubic(t *testing.T) {
+	cc := &Cubic{}
+	cs := &CongestionState{MSS: 1000}
+
+	cc.Init(cs)
+	assert.Equal(t, uint32(4000), cs.Cwnd)
+
+	// A loss at 100 segments multiplies the window by beta
+	cs.Cwnd = 100000
+	cs.Ssthresh = 100000
+	cc.OnLoss(cs)
+	assert.Equal(t, uint32(70000), cs.Ssthresh)
+	assert.Equal(t, uint32(73000), cs.Cwnd)
+	assert.Equal(t, 100.0, cc.wMax)
+
+	// After recovery the window grows back towards wMax,
+	// reaching it after K seconds
+	cs.Cwnd = cs.Ssthresh
+	start := time.Now()
+
+	cc.OnAck(cs, AckEvent{Acked: 1000, Now: start})
+	assert.InDelta(t, math.Cbrt(30/cubicC), cc.k, 1e-9)
+
+	prev := cs.Cwnd
+	for i := 1; i <= 100; i++ {
+		cc.OnAck(cs, AckEvent{Acked: 1000, Now: start.Add(time.Duration(i) * 50 * time.Millisecond)})
+		assert.GreaterOrEqual(t, cs.Cwnd, prev)
+		prev = cs.Cwnd
+	}
+
+	assert.Greater(t, cs.Cwnd, uint32(70000))
+	assert.Less(t, cs.Cwnd, uint32(100000))
+
+	// A loss below the last wMax gives up some more (fast convergence)
+	cs.Cwnd = 80000
+	cc.OnLoss(cs)
+	assert.Equal(t, 68.0, cc.wMax)
+	assert.Equal(t, uint32(56000), cs.Ssthresh)
+
+	// A timeout starts over from one segment
+	cs.Cwnd = 80000
+	cc.OnRTO(cs)
+	assert.Equal(t, uint32(56000), cs.Ssthresh)
+	assert.Equal(t, uint32(1000), cs.Cwnd)
+}
+
+func Test_TCP_FastRetransmit(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	assert.ErrorIs(t, tcp.SetCongestionControl("vegas"), ErrUnknownCongestionControl)
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, listener.SetCongestionControl(CongestionControlReno))
+
+	// Connections use the algorithm of their listener
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+	mss := uint32(TCPDefaultMSS)
+
+	stats := conn.Stats()
+	assert.Equal(t, CongestionControlReno, stats.CongestionControl)
+	assert.Equal(t, 4*mss, stats.Cwnd)
+
+	// The initial window has room for four segments
+	_, err = conn.Write(make([]byte, 4*mss))
+	assert.NoError(t, err)
+
+	for i := uint32(0); i < 4; i++ {
+		assert.Equal(t, iss+1+i*mss, nextSegment(t, sent).Header.SeqNum)
+	}
+
+	// The second segment is lost. The ACK of the first is followed by
+	// three duplicates, the third retransmits it and starts fast recovery.
+	for i := 0; i < 4; i++ {
+		tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1+mss, nil))
+	}
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, iss+1+mss, seg.Header.SeqNum)
+
+	stats = conn.Stats()
+	assert.True(t, stats.InRecovery)
+	assert.Equal(t, 2*mss, stats.Ssthresh)
+	assert.Equal(t, 5*mss, stats.Cwnd)
+
+	// A partial ACK retransmits the next lost segment
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1+2*mss, nil))
+
+	seg = nextSegment(t, sent)
+	assert.Equal(t, iss+1+2*mss, seg.Header.SeqNum)
+
+	// The ACK of everything ends fast recovery with a deflated window
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1+4*mss, nil))
+
+	assert.Eventually(t, func() bool {
+		return !conn.Stats().InRecovery
+	}, time.Second, 10*time.Millisecond)
+
+	stats = conn.Stats()
+	assert.Equal(t, 2*mss, stats.Cwnd)
+	assert.Equal(t, uint32(0), stats.InFlight)
+	assert.Equal(t, 2, stats.Retransmits)
+	assert.Len(t, sent, 0)
+}
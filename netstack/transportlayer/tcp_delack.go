@@ -0,0 +1,66 @@
+package transportlayer
+
+import (
+	"time"
+)
+
+// ==============================================================================
+// TCP Delayed Acknowledgments
+// ==============================================================================
+
+/*
+	Instead of acknowledging every segment, the receiver waits a little,
+	so the ACK can go out with data or a window update, or cover the next
+	segment too. At least every second full sized segment is acknowledged
+	right away, and no ACK is delayed for more than TCPDelayedAckTimeout
+	(RFC 1122 4.2.3.2, RFC 5681 4.2). Out of order segments, the segments
+	that fill a hole, retransmissions and FINs are acknowledged right away.
+*/
+
+// TCPDelayedAckTimeout is how long an ACK waits, the Linux default
+const TCPDelayedAckTimeout = 200 * time.Millisecond
+
+// delayAck acknowledges a segment that was received in order, now or
+// after the delayed ACK timeout
+func (tcb *TCB) delayAck(tcpBuff TCPBuffer) {
+	header := tcpBuff.Header
+	n := uint32(len(tcpBuff.SkBuff.Data))
+
+	if n > tcb.recvSegSize {
+		tcb.recvSegSize = n
+	}
+
+	tcb.ackPending += n
+
+	switch {
+	case header.IsFIN(),
+		tcb.ackNow && header.SeqNum+n == tcb.RecvNXT,
+		tcb.ackPending >= 2*tcb.recvSegSize:
+		tcb.SendAck()
+	case !tcb.delAckTimer.running():
+		tcb.startDelAckTimer()
+	}
+}
+
+// ackSent is called for each segment with an ACK. The ACK covers
+// everything received, so none is pending anymore.
+func (tcb *TCB) ackSent() {
+	tcb.ackPending = 0
+	tcb.ackNow = false
+	tcb.stopDelAckTimer()
+}
+
+func (tcb *TCB) startDelAckTimer() {
+	tcb.delAckTimer.start(&tcb.mu, TCPDelayedAckTimeout, tcb.delAckTimeout)
+}
+
+func (tcb *TCB) stopDelAckTimer() {
+	tcb.delAckTimer.stop()
+}
+
+// delAckTimeout sends the ACK that was delayed
+func (tcb *TCB) delAckTimeout() {
+	if err := tcb.SendAck(); err != nil {
+		tcb.Log.Printf("TCP: error sending delayed ACK: %v\n", err)
+	}
+}
@@ -0,0 +1,57 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_DelayedAck(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+	data := make([]byte, 100)
+
+	// A single segment is acknowledged after the timeout
+	start := time.Now()
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1, data))
+
+	assert.Equal(t, uint32(1101), nextSegment(t, sent).Header.AckNum)
+	assert.GreaterOrEqual(t, time.Since(start), TCPDelayedAckTimeout)
+
+	// Every second segment is acknowledged right away
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1101, iss+1, data))
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1201, iss+1, data))
+
+	start = time.Now()
+	assert.Equal(t, uint32(1301), nextSegment(t, sent).Header.AckNum)
+	assert.Less(t, time.Since(start), TCPDelayedAckTimeout)
+
+	// Data we send carries the delayed ACK
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1301, iss+1, data))
+
+	assert.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return conn.RecvNXT == 1401 && conn.ackPending == 100
+	}, time.Second, time.Millisecond)
+
+	_, err = conn.Write([]byte("reply"))
+	assert.NoError(t, err)
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, []byte("reply"), seg.SkBuff.Data)
+	assert.Equal(t, uint32(1401), seg.Header.AckNum)
+
+	conn.mu.Lock()
+	assert.False(t, conn.delAckTimer.running())
+	conn.mu.Unlock()
+}
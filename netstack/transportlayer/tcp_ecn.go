@@ -0,0 +1,100 @@
+package transportlayer
+
+import (
+	"github.com/mattcarp12/matnet/netstack"
+)
+
+// ==============================================================================
+// TCP Explicit Congestion Notification
+// ==============================================================================
+
+/*
+	With ECN, routers mark packets instead of dropping them when they see
+	congestion coming (RFC 3168). The two ends agree on it in the handshake:
+	the SYN has ECE and CWR set, and the SYN-ACK ECE. Packets with new data
+	are then sent ECN capable (ECT), while pure ACKs, retransmissions and
+	the handshake are not, and a router may set congestion experienced (CE)
+	on them.
+
+	The receiver of a CE mark sets ECE on its ACKs, until a segment with CWR
+	tells it the sender reduced its window. The sender reacts to ECE as to a
+	loss, at most once per window of data, but has nothing to retransmit.
+*/
+
+// ecnSyn tells whether a SYN asks for ECN, with both ECE and CWR set
+func ecnSyn(header *TCPHeader) bool {
+	return header.BitFlags&(TCP_ECE|TCP_CWR) == TCP_ECE|TCP_CWR
+}
+
+// ecnSynAck tells whether a SYN-ACK agrees to ECN, with only ECE set
+func ecnSynAck(header *TCPHeader) bool {
+	return header.BitFlags&(TCP_ECE|TCP_CWR) == TCP_ECE
+}
+
+// ecnFlags adds the ECN flags of an outgoing segment, and tells
+// whether its packet is ECN capable
+func (tcb *TCB) ecnFlags(flags uint8, seq uint32, data []byte) (uint8, bool) {
+	if !tcb.ecn || flags&TCP_RST != 0 {
+		return flags, false
+	}
+
+	switch {
+	case flags&TCP_SYN != 0 && flags&TCP_ACK == 0:
+		return flags | TCP_ECE | TCP_CWR, false
+	case flags&TCP_SYN != 0:
+		return flags | TCP_ECE, false
+	}
+
+	if tcb.ecnEcho && flags&TCP_ACK != 0 {
+		flags |= TCP_ECE
+	}
+
+	// Only new data is ECN capable, and the first of it after
+	// a reduction tells the peer with CWR
+	newData := len(data) > 0 && seq == tcb.SendNXT
+	if newData && tcb.ecnCWR {
+		flags |= TCP_CWR
+		tcb.ecnCWR = false
+	}
+
+	return flags, newData
+}
+
+// ecnReceived notes the CWR flag and the CE mark of a segment in
+// the window
+func (tcb *TCB) ecnReceived(tcpBuff TCPBuffer) {
+	if !tcb.ecn {
+		return
+	}
+
+	if tcpBuff.Header.BitFlags&TCP_CWR != 0 {
+		tcb.ecnEcho = false
+	}
+
+	if tcpBuff.SkBuff.GetECN() == netstack.ECNCE {
+		// The peer learns about it right away
+		if !tcb.ecnEcho {
+			tcb.ackNow = true
+		}
+
+		tcb.ecnEcho = true
+	}
+}
+
+// ecnAck reduces the window for an ACK with ECE, once per window of
+// data, and not during a fast recovery, which reduced it already
+func (tcb *TCB) ecnAck(header *TCPHeader) {
+	if !tcb.ecn || header.BitFlags&TCP_ECE == 0 {
+		return
+	}
+
+	if tcb.ccState.InRecovery || seqLEQ(header.AckNum, tcb.ecnRecover) || seqLEQ(tcb.SendUNA, tcb.recover) {
+		return
+	}
+
+	tcb.updateCongestionState()
+	tcb.cc.OnECN(&tcb.ccState)
+
+	tcb.ecnRecover = tcb.SendNXT
+	tcb.ecnCWR = true
+}
@@ -0,0 +1,123 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_ECN(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	// A SYN that asks for ECN gets a SYN-ACK with only ECE
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN|TCP_ECE|TCP_CWR, 1000, 0, nil))
+
+	synAck := nextSegment(t, sent)
+	assert.Equal(t, uint8(TCP_SYN|TCP_ACK|TCP_ECE), synAck.Header.BitFlags)
+	assert.Equal(t, uint8(netstack.ECNNotECT), synAck.SkBuff.GetECN())
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, synAck.Header.SeqNum+1, nil))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	assert.True(t, conn.Stats().ECN)
+
+	iss := conn.SendISN
+
+	// New data is ECN capable
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, uint8(netstack.ECNECT0), seg.SkBuff.GetECN())
+	assert.Equal(t, uint8(0), seg.Header.BitFlags&(TCP_ECE|TCP_CWR))
+
+	// The peer echoes a CE mark. The window is reduced as for a
+	// loss, but nothing is retransmitted.
+	before := conn.Stats()
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_ECE, 1001, iss+6, nil))
+
+	assert.Eventually(t, func() bool {
+		return conn.Stats().Ssthresh < before.Ssthresh
+	}, time.Second, time.Millisecond)
+
+	reduced := conn.Stats()
+	assert.Len(t, sent, 0)
+
+	// The next data tells the peer with CWR
+	_, err = conn.Write([]byte("world"))
+	assert.NoError(t, err)
+
+	seg = nextSegment(t, sent)
+	assert.Equal(t, uint8(TCP_CWR), seg.Header.BitFlags&(TCP_ECE|TCP_CWR))
+	assert.Equal(t, uint8(netstack.ECNECT0), seg.SkBuff.GetECN())
+
+	// Another ECE for data sent before the reduction is ignored
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_ECE, 1001, iss+6, nil))
+
+	// A segment with a CE mark is acknowledged right away with
+	// ECE, which is set until the peer sends CWR
+	skb := genRxSegment(40000, 80, TCP_ACK|TCP_PSH, 1001, iss+6, []byte("ping"))
+	skb.SetECN(netstack.ECNCE)
+	tcp.HandleRx(skb)
+
+	ack := nextSegment(t, sent)
+	assert.Equal(t, uint32(1005), ack.Header.AckNum)
+	assert.Equal(t, uint8(TCP_ECE), ack.Header.BitFlags&TCP_ECE)
+	assert.Equal(t, uint8(netstack.ECNNotECT), ack.SkBuff.GetECN())
+	assert.Equal(t, reduced.Ssthresh, conn.Stats().Ssthresh)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_PSH, 1005, iss+11, []byte("pong")))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, uint32(1009), ack.Header.AckNum)
+	assert.Equal(t, uint8(TCP_ECE), ack.Header.BitFlags&TCP_ECE)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_PSH|TCP_CWR, 1009, iss+11, []byte("done")))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, uint32(1013), ack.Header.AckNum)
+	assert.Equal(t, uint8(0), ack.Header.BitFlags&TCP_ECE)
+}
+
+func Test_TCP_ECNActiveOpen(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	local := netstack.SockAddr{IP: serverIP, Port: 5000}
+	remote := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 80}
+
+	// A SYN-ACK with ECE agrees to ECN
+	conn, err := tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+
+	syn := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_SYN|TCP_ECE|TCP_CWR), syn.BitFlags)
+
+	tcp.HandleRx(genRxSegment(80, 5000, TCP_SYN|TCP_ACK|TCP_ECE, 3000, syn.SeqNum+1, nil))
+	nextSegment(t, sent)
+	assert.True(t, conn.Stats().ECN)
+
+	// One without it doesn't
+	local.Port = 5001
+	conn, err = tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+
+	syn = nextSegment(t, sent).Header
+
+	tcp.HandleRx(genRxSegment(80, 5001, TCP_SYN|TCP_ACK, 3000, syn.SeqNum+1, nil))
+	nextSegment(t, sent)
+	assert.False(t, conn.Stats().ECN)
+
+	// With ECN turned off the SYN doesn't ask for it
+	tcp.ECN = false
+	local.Port = 5002
+	_, err = tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(TCP_SYN), nextSegment(t, sent).Header.BitFlags)
+}
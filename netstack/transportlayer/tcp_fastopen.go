@@ -0,0 +1,256 @@
+package transportlayer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/mattcarp12/matnet/netstack"
+)
+
+// ==============================================================================
+// TCP Fast Open
+// ==============================================================================
+
+/*
+	Fast Open lets a client send data in its SYN, which the server hands to
+	the user before the handshake completes, saving a round trip on short
+	connections (RFC 7413). The server only takes the data from clients that
+	show a cookie it gave them earlier, a keyed hash of their address, so an
+	attacker can't make it do work with spoofed SYNs.
+
+	A client without a cookie asks for one with an empty Fast Open option in
+	its SYN, and sends its data after the handshake as usual. The cookies are
+	cached by server address. When the server doesn't take the data of a SYN,
+	its SYN-ACK only acknowledges the SYN, and the client sends the data again
+	after the handshake.
+
+	A listener counts the connections it accepted with Fast Open that are
+	still in the handshake, and falls back to the usual handshake when there
+	are too many.
+*/
+
+const (
+	TCPOptionKindFastOpen TCPOptionKind = 34
+
+	// The size of the cookies we make, and the sizes we take (RFC 7413 4.1.1)
+	FastOpenCookieSize = 8
+	fastOpenCookieMin  = 4
+	fastOpenCookieMax  = 16
+
+	// How many servers the client keeps cookies for
+	fastOpenCacheSize = 1024
+)
+
+var ErrInvalidFastOpen = errors.New("invalid Fast Open queue length")
+
+// fastOpenEntry is a cookie a server gave us, with the MSS it
+// offered, which sizes the data of the next SYN
+type fastOpenEntry struct {
+	cookie []byte
+	mss    uint16
+}
+
+// fastOpenCache holds the cookies of servers, by IP address
+type fastOpenCache struct {
+	mu      sync.Mutex
+	entries map[string]fastOpenEntry
+}
+
+func (c *fastOpenCache) get(ip net.IP) (fastOpenEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[ip.String()]
+
+	return entry, ok
+}
+
+func (c *fastOpenCache) put(ip net.IP, entry fastOpenEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]fastOpenEntry)
+	}
+
+	// Make room by forgetting any other server
+	if _, ok := c.entries[ip.String()]; !ok && len(c.entries) >= fastOpenCacheSize {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+
+	c.entries[ip.String()] = entry
+}
+
+func (c *fastOpenCache) remove(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, ip.String())
+}
+
+// fastOpenCookie makes the cookie of a client
+func (tcp *TCPProtocol) fastOpenCookie(localIP, remoteIP net.IP) []byte {
+	sum := tcp.digest(hashLabelFastOpen, netstack.SockAddr{IP: localIP}, netstack.SockAddr{IP: remoteIP})
+
+	return sum[:FastOpenCookieSize]
+}
+
+// SetFastOpen lets a listener take the data in SYNs with a valid cookie.
+// Up to queue of these connections may be in the handshake at once,
+// 0 turns Fast Open off.
+func (tcb *TCB) SetFastOpen(queue int) error {
+	if queue < 0 {
+		return ErrInvalidFastOpen
+	}
+
+	if !tcb.IsListener() {
+		return ErrInvalidState
+	}
+
+	tcb.TCP.mu.Lock()
+	defer tcb.TCP.mu.Unlock()
+
+	tcb.fastOpenQueue = queue
+
+	return nil
+}
+
+// fastOpenSyn handles the Fast Open option of a SYN to a listener, for
+// the new child TCB. It returns true if the child took the data of the
+// SYN, and goes to the accept queue right away. Must be called with
+// tcp.mu held.
+func (tcp *TCPProtocol) fastOpenSyn(listener, tcb *TCB, header *TCPHeader, skb *netstack.SkBuff) bool {
+	option, ok := header.Options.Find(TCPOptionKindFastOpen)
+	if !ok || listener.fastOpenQueue == 0 {
+		return false
+	}
+
+	cookie := tcp.fastOpenCookie(skb.GetDstIP(), skb.GetSrcIP())
+
+	// A request for a cookie, or one we didn't make. The SYN-ACK
+	// gives the client a valid one for next time.
+	if subtle.ConstantTimeCompare(option.Data, cookie) != 1 {
+		tcb.fastOpenCookie = cookie
+		return false
+	}
+
+	if listener.fastOpenPending >= listener.fastOpenQueue {
+		tcp.Log.Printf("fastOpenSyn: too many pending connections on %v\n", listener.SrcAddr)
+		return false
+	}
+
+	// skb.Data still starts with the TCP header
+	data := skb.Data[header.SizeInBytes():]
+	if uint32(len(data)) > tcb.RecvWND {
+		data = data[:tcb.RecvWND]
+	}
+
+	n := uint32(len(data))
+	tcb.recvBuf = append([]byte(nil), data...)
+	tcb.RecvNXT += n
+	tcb.RecvWND -= n
+	tcb.recvQueued += n
+	tcb.bytesReceived += uint64(n)
+
+	// The user owns the connection from now on, but the
+	// listener counts it until the handshake completes
+	tcb.Listener = nil
+	tcb.fastOpenListener = listener
+	listener.fastOpenPending++
+
+	return true
+}
+
+// fastOpenDone stops the listener from counting a connection it
+// accepted with Fast Open as pending
+func (tcb *TCB) fastOpenDone() {
+	if tcb.fastOpenListener == nil {
+		return
+	}
+
+	tcb.TCP.mu.Lock()
+	tcb.fastOpenListener.fastOpenPending--
+	tcb.TCP.mu.Unlock()
+
+	tcb.fastOpenListener = nil
+}
+
+// fastOpenConnect sets up a connection in SYN_SENT to open with Fast
+// Open. It queues as much of data as the send buffer holds, and returns
+// the part that goes in the SYN, and how much was queued.
+func (tcb *TCB) fastOpenConnect(data []byte) ([]byte, int) {
+	n := len(data)
+	if n > TCPSendBufferSize {
+		n = TCPSendBufferSize
+	}
+
+	tcb.fastOpen = true
+	tcb.sendBuf = append([]byte(nil), data[:n]...)
+
+	entry, ok := tcb.TCP.fastOpenCache.get(tcb.DstAddr.IP)
+	if !ok {
+		// Ask for a cookie, the data waits for the handshake
+		tcb.fastOpenCookie = []byte{}
+		return nil, n
+	}
+
+	tcb.fastOpenCookie = entry.cookie
+
+	// The options take room from the MSS
+	size := int(entry.mss) - len(tcb.synOptions(false).Marshal())
+	if size > n {
+		size = n
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	tcb.SendNXT += uint32(size)
+
+	return tcb.sendBuf[:size], n
+}
+
+// fastOpenEstablished finishes a Fast Open for the SYN-ACK in header.
+// The data the server took leaves the send buffer, the rest is sent
+// again after the handshake. The server's cookie is cached for the
+// next connection.
+func (tcb *TCB) fastOpenEstablished(header *TCPHeader) {
+	acked := int(header.AckNum - tcb.SendISN - 1)
+	tcb.sendBuf = tcb.sendBuf[acked:]
+	tcb.bytesAcked += uint64(acked)
+
+	if header.AckNum != tcb.SendNXT {
+		tcb.SendNXT = header.AckNum
+		tcb.stopRetransmitTimer()
+		tcb.retxQueue = nil
+	}
+
+	cache := &tcb.TCP.fastOpenCache
+	option, ok := header.Options.Find(TCPOptionKindFastOpen)
+
+	switch {
+	case ok && len(option.Data) >= fastOpenCookieMin && len(option.Data) <= fastOpenCookieMax && len(option.Data)%2 == 0:
+		cache.put(tcb.DstAddr.IP, fastOpenEntry{cookie: option.Data, mss: tcb.SendMSS})
+	case !ok && acked == 0:
+		// The server doesn't do Fast Open anymore
+		cache.remove(tcb.DstAddr.IP)
+	}
+}
+
+// OpenConnectionData opens a connection like OpenConnection, with Fast
+// Open. If the server gave us a cookie before, the SYN carries it and
+// the start of data. It returns how much of data was queued.
+func (tcp *TCPProtocol) OpenConnectionData(
+	srcAddr, dstAddr netstack.SockAddr,
+	iface netstack.NetworkInterface,
+	ipControl *netstack.IPControl,
+	data []byte,
+) (*TCB, int, error) {
+	return tcp.openConnection(srcAddr, dstAddr, iface, ipControl, true, data)
+}
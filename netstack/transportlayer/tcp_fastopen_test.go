@@ -0,0 +1,166 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_FastOpenServer(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, listener.SetFastOpen(1))
+
+	// A client without a cookie asks for one, the data of its SYN waits
+	syn := TCPHeader{SrcPort: 40000, DstPort: 80, SeqNum: 1000, BitFlags: TCP_SYN, Window: 65535}
+	syn.SetOptions(TCPOptions{{Kind: TCPOptionKindFastOpen, Data: []byte{}}})
+	tcp.HandleRx(genRxHeader(syn, []byte("GET")))
+
+	synAck := nextSegment(t, sent).Header
+	assert.Equal(t, uint32(1001), synAck.AckNum)
+
+	option, ok := synAck.Options.Find(TCPOptionKindFastOpen)
+	assert.True(t, ok)
+	assert.Len(t, option.Data, FastOpenCookieSize)
+	assert.Len(t, listener.AcceptQueue, 0)
+
+	cookie := option.Data
+
+	// With the cookie the data is taken, and the connection is
+	// accepted before the handshake completes
+	syn.SrcPort = 40001
+	syn.SetOptions(TCPOptions{{Kind: TCPOptionKindFastOpen, Data: cookie}})
+	tcp.HandleRx(genRxHeader(syn, []byte("GET")))
+
+	synAck = nextSegment(t, sent).Header
+	assert.Equal(t, uint32(1004), synAck.AckNum)
+
+	_, ok = synAck.Options.Find(TCPOptionKindFastOpen)
+	assert.False(t, ok)
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, TCP_STATE_SYN_RCVD, state(conn))
+
+	data, err := conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("GET"), data)
+
+	// Only one connection may be pending, the next one falls back
+	// to the usual handshake
+	syn.SrcPort = 40002
+	tcp.HandleRx(genRxHeader(syn, []byte("GET")))
+	assert.Equal(t, uint32(1001), nextSegment(t, sent).Header.AckNum)
+
+	// The ACK completes the handshake
+	tcp.HandleRx(genRxSegment(40001, 80, TCP_ACK, 1004, synAck.SeqNum+1, nil))
+	assert.Eventually(t, func() bool {
+		return state(conn) == TCP_STATE_ESTABLISHED
+	}, time.Second, time.Millisecond)
+
+	tcp.mu.Lock()
+	assert.Equal(t, 0, listener.fastOpenPending)
+	tcp.mu.Unlock()
+
+	// A cookie the listener didn't make is replaced
+	syn.SrcPort = 40003
+	syn.SetOptions(TCPOptions{{Kind: TCPOptionKindFastOpen, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}})
+	tcp.HandleRx(genRxHeader(syn, []byte("GET")))
+
+	synAck = nextSegment(t, sent).Header
+	assert.Equal(t, uint32(1001), synAck.AckNum)
+
+	option, ok = synAck.Options.Find(TCPOptionKindFastOpen)
+	assert.True(t, ok)
+	assert.Equal(t, cookie, option.Data)
+}
+
+func Test_TCP_FastOpenClient(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	local := netstack.SockAddr{IP: serverIP, Port: 5000}
+	remote := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 80}
+	cookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	synAck := TCPHeader{SrcPort: 80, DstPort: 5000, SeqNum: 3000, BitFlags: TCP_SYN | TCP_ACK, Window: 65535}
+
+	// Without a cookie the SYN asks for one, and the data
+	// follows the handshake
+	_, n, err := tcp.OpenConnectionData(local, remote, &fakeIface{}, nil, []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	syn := nextSegment(t, sent)
+	option, ok := syn.Header.Options.Find(TCPOptionKindFastOpen)
+	assert.True(t, ok)
+	assert.Len(t, option.Data, 0)
+	assert.Len(t, syn.SkBuff.Data, 0)
+
+	synAck.AckNum = syn.Header.SeqNum + 1
+	synAck.SetOptions(TCPOptions{{Kind: TCPOptionKindMSS, MSS: 1460}, {Kind: TCPOptionKindFastOpen, Data: cookie}})
+	tcp.HandleRx(genRxHeader(synAck, nil))
+
+	assert.Equal(t, uint32(3001), nextSegment(t, sent).Header.AckNum)
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, syn.Header.SeqNum+1, seg.Header.SeqNum)
+	assert.Equal(t, []byte("hello"), seg.SkBuff.Data)
+
+	entry, ok := tcp.fastOpenCache.get(remote.IP)
+	assert.True(t, ok)
+	assert.Equal(t, cookie, entry.cookie)
+	assert.Equal(t, uint16(1460), entry.mss)
+
+	// With the cookie the SYN carries the data, which the server takes
+	local.Port = 5001
+	conn, _, err := tcp.OpenConnectionData(local, remote, &fakeIface{}, nil, []byte("hello"))
+	assert.NoError(t, err)
+
+	syn = nextSegment(t, sent)
+	option, _ = syn.Header.Options.Find(TCPOptionKindFastOpen)
+	assert.Equal(t, cookie, option.Data)
+	assert.Equal(t, []byte("hello"), syn.SkBuff.Data)
+
+	synAck.DstPort = 5001
+	synAck.AckNum = syn.Header.SeqNum + 6
+	synAck.SetOptions(TCPOptions{{Kind: TCPOptionKindMSS, MSS: 1460}})
+	tcp.HandleRx(genRxHeader(synAck, nil))
+
+	assert.Equal(t, uint32(3001), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_ESTABLISHED, state(conn))
+
+	conn.mu.Lock()
+	assert.Len(t, conn.sendBuf, 0)
+	assert.Equal(t, conn.SendNXT, conn.SendUNA)
+	conn.mu.Unlock()
+
+	_, ok = tcp.fastOpenCache.get(remote.IP)
+	assert.True(t, ok)
+
+	// A server that doesn't take the data only acknowledges the SYN. The
+	// data is sent again after the handshake, and the cookie forgotten.
+	local.Port = 5002
+	_, _, err = tcp.OpenConnectionData(local, remote, &fakeIface{}, nil, []byte("hello"))
+	assert.NoError(t, err)
+
+	syn = nextSegment(t, sent)
+	assert.Equal(t, []byte("hello"), syn.SkBuff.Data)
+
+	synAck.DstPort = 5002
+	synAck.AckNum = syn.Header.SeqNum + 1
+	tcp.HandleRx(genRxHeader(synAck, nil))
+
+	assert.Equal(t, uint32(3001), nextSegment(t, sent).Header.AckNum)
+
+	seg = nextSegment(t, sent)
+	assert.Equal(t, syn.Header.SeqNum+1, seg.Header.SeqNum)
+	assert.Equal(t, []byte("hello"), seg.SkBuff.Data)
+
+	_, ok = tcp.fastOpenCache.get(remote.IP)
+	assert.False(t, ok)
+}
@@ -0,0 +1,173 @@
+package transportlayer
+
+// ==============================================================================
+// TCP Flow Control
+// ==============================================================================
+
+/*
+	The receiver advertises the room left in its buffer, and the sender
+	keeps the data in flight within it. Both sides avoid the silly window
+	syndrome, where the window opens a few bytes at a time and is filled
+	by as many tiny segments (RFC 9293 3.8.6.2). When the window closes,
+	the persist timer probes it, so a lost window update doesn't stall
+	the connection forever (RFC 9293 3.8.6.1).
+*/
+
+// The most the persist timer backs off, on top of the RTO
+const maxPersistBackoff = 10
+
+// setSendWindow takes the send window from a segment
+func (tcb *TCB) setSendWindow(header *TCPHeader, wnd uint32) {
+	tcb.SendWND = wnd
+	tcb.SendWL1 = header.SeqNum
+	tcb.SendWL2 = header.AckNum
+
+	if wnd > tcb.maxSendWND {
+		tcb.maxSendWND = wnd
+	}
+}
+
+// sendRoom is how much new data the send window and the
+// congestion window allow
+func (tcb *TCB) sendRoom() int {
+	room := int(int32(tcb.SendUNA + tcb.SendWND - tcb.SendNXT))
+
+	// The congestion window limits the data in flight too
+	if cwndRoom := int(tcb.ccState.Cwnd) - int(tcb.flightSize()); cwndRoom < room {
+		room = cwndRoom
+	}
+
+	return room
+}
+
+// sendWorthwhile decides whether a segment of n bytes goes out now: a
+// full sized one, the rest of what the user wrote, or at least half of
+// the largest window the peer offered (RFC 9293 3.8.6.2.1). Anything
+// smaller waits for the window to open, or for the persist timer.
+//
+// With Nagle's algorithm, the rest of what the user wrote also waits
+// while data is in flight, so small writes are sent together once the
+// ACK arrives (RFC 1122 4.2.3.4). A corked connection only sends full
+// sized segments, until it is uncorked or closed.
+func (tcb *TCB) sendWorthwhile(n, size int, last bool) bool {
+	switch {
+	case n >= size || tcb.swsOverride || tcb.urgentPending():
+		return true
+	case tcb.cork && !tcb.finPending:
+		return false
+	case last:
+		return tcb.noDelay || tcb.SendNXT == tcb.SendUNA || tcb.finPending
+	default:
+		return uint32(n) >= tcb.maxSendWND/2
+	}
+}
+
+// SetNoDelay turns Nagle's algorithm off, and sends what it held back
+func (tcb *TCB) SetNoDelay(noDelay bool) error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.noDelay = noDelay
+
+	return tcb.flush()
+}
+
+// SetCork holds back partial segments while cork is set. Clearing
+// it sends them.
+func (tcb *TCB) SetCork(cork bool) error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.cork = cork
+
+	return tcb.flush()
+}
+
+// flush sends the data a changed option allows, on a connection
+// that can send
+func (tcb *TCB) flush() error {
+	switch tcb.State {
+	case TCP_STATE_ESTABLISHED, TCP_STATE_CLOSE_WAIT:
+		return tcb.output()
+	default:
+		return nil
+	}
+}
+
+// openRecvWindow moves the right edge of the receive window after the
+// user made room in the buffer. It only moves by at least the smaller
+// of half the buffer and the MSS (RFC 9293 3.8.6.2.2). It returns true
+// if the peer should be told: the window was too small for it to send,
+// or it doubled.
+func (tcb *TCB) openRecvWindow() bool {
+	free := TCPRecvBufferSize - tcb.recvQueued
+
+	threshold := uint32(TCPRecvBufferSize / 2)
+	if mss := uint32(tcb.RecvMSS); mss < threshold {
+		threshold = mss
+	}
+
+	if free-tcb.RecvWND < threshold {
+		return false
+	}
+
+	old := tcb.RecvWND
+	tcb.RecvWND = free
+
+	return old < threshold || free >= 2*old
+}
+
+// updatePersistTimer runs the persist timer while data waits for the
+// window to open and nothing is in flight, so no ACK would open it
+func (tcb *TCB) updatePersistTimer() {
+	unsent := len(tcb.sendBuf) - int(tcb.SendNXT-tcb.SendUNA)
+
+	// Corked data less than a segment waits for the user, not the window
+	if tcb.cork && !tcb.finPending && unsent < tcb.segmentDataSize() {
+		unsent = 0
+	}
+
+	waiting := unsent > 0
+
+	if !waiting || len(tcb.retxQueue) > 0 {
+		tcb.stopPersistTimer()
+		tcb.persistBackoff = 0
+
+		return
+	}
+
+	if !tcb.persistTimer.running() {
+		tcb.startPersistTimer()
+	}
+}
+
+func (tcb *TCB) startPersistTimer() {
+	tcb.persistTimer.start(&tcb.mu, tcb.clampRTO(tcb.RTO<<tcb.persistBackoff), tcb.persistTimeout)
+}
+
+func (tcb *TCB) stopPersistTimer() {
+	tcb.persistTimer.stop()
+}
+
+// persistTimeout sends what a window too small to be worthwhile allows
+// after all, or probes a closed window. The probe is an ACK with an old
+// sequence number, which the peer answers with its current window.
+func (tcb *TCB) persistTimeout() {
+	if tcb.persistBackoff < maxPersistBackoff {
+		tcb.persistBackoff++
+	}
+
+	if tcb.sendRoom() > 0 {
+		tcb.swsOverride = true
+		err := tcb.output()
+		tcb.swsOverride = false
+
+		if err != nil {
+			tcb.Log.Printf("TCP: error sending data: %v\n", err)
+		}
+	} else if err := tcb.sendSegment(TCP_ACK, tcb.SendUNA-1, nil); err != nil {
+		tcb.Log.Printf("TCP: error sending window probe: %v\n", err)
+	}
+
+	tcb.updatePersistTimer()
+}
@@ -0,0 +1,160 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_RecvWindow(t *testing.T) {
+	tcp := NewTCP()
+	tcb := tcp.newTCB("conn1")
+	tcb.RecvMSS = 1000
+
+	// The buffer is full, and the window closed
+	tcb.recvQueued = TCPRecvBufferSize
+	tcb.RecvWND = 0
+
+	// Reading less than an MSS leaves the window closed
+	tcb.recvQueued -= 999
+	assert.False(t, tcb.openRecvWindow())
+	assert.Equal(t, uint32(0), tcb.RecvWND)
+
+	// Another byte opens it, and the peer is told
+	tcb.recvQueued--
+	assert.True(t, tcb.openRecvWindow())
+	assert.Equal(t, uint32(1000), tcb.RecvWND)
+
+	// The peer hears about the window again once it doubles
+	tcb.recvQueued -= 1000
+	assert.True(t, tcb.openRecvWindow())
+	assert.Equal(t, uint32(2000), tcb.RecvWND)
+
+	tcb.recvQueued -= 1000
+	assert.False(t, tcb.openRecvWindow())
+	assert.Equal(t, uint32(3000), tcb.RecvWND)
+}
+
+func Test_TCP_PersistTimer(t *testing.T) {
+	tcp, sent := newTestTCP()
+	tcp.Retransmit.InitialRTO = 20 * time.Millisecond
+	tcp.Retransmit.MinRTO = 20 * time.Millisecond
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+	mss := TCPDefaultMSS
+
+	window := func(wnd uint16) {
+		header := TCPHeader{SrcPort: 40000, DstPort: 80, SeqNum: 1001, AckNum: iss + 1, HeaderLen: 5, BitFlags: TCP_ACK, Window: wnd}
+		tcp.HandleRx(genRxHeader(header, nil))
+
+		assert.Eventually(t, func() bool {
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+
+			return conn.SendWND == uint32(wnd)
+		}, time.Second, time.Millisecond)
+	}
+
+	// The peer closes its window, the data waits
+	window(0)
+
+	_, err = conn.Write(make([]byte, 2000))
+	assert.NoError(t, err)
+
+	// The persist timer probes the window with an old sequence number
+	for i := 0; i < 2; i++ {
+		probe := nextSegment(t, sent)
+		assert.Equal(t, iss, probe.Header.SeqNum)
+		assert.Equal(t, uint8(TCP_ACK), probe.Header.BitFlags)
+		assert.Empty(t, probe.SkBuff.Data)
+	}
+
+	// A window smaller than a segment and half the largest window
+	// is left alone, until the persist timer expires
+	window(300)
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, iss+1, seg.Header.SeqNum)
+	assert.Len(t, seg.SkBuff.Data, 300)
+
+	// A window update lets the rest go in full sized segments. The
+	// last, small one waits for their ACK.
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+301, nil))
+
+	for i := 0; i < 3; i++ {
+		assert.Len(t, nextSegment(t, sent).SkBuff.Data, mss)
+	}
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+301+3*uint32(mss), nil))
+	assert.Len(t, nextSegment(t, sent).SkBuff.Data, 1700-3*mss)
+
+	conn.mu.Lock()
+	assert.False(t, conn.persistTimer.running())
+	conn.mu.Unlock()
+}
+
+func Test_TCP_Nagle(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	write := func(n int) {
+		_, err := conn.Write(make([]byte, n))
+		assert.NoError(t, err)
+	}
+
+	// With nothing in flight, a small write goes out right away
+	write(10)
+	assert.Len(t, nextSegment(t, sent).SkBuff.Data, 10)
+
+	// The next ones wait for its ACK, and go out together
+	write(10)
+	write(10)
+	assert.Len(t, sent, 0)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+11, nil))
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, iss+11, seg.Header.SeqNum)
+	assert.Len(t, seg.SkBuff.Data, 20)
+
+	// Without Nagle, they don't wait
+	assert.NoError(t, conn.SetNoDelay(true))
+
+	write(10)
+	assert.Equal(t, iss+31, nextSegment(t, sent).Header.SeqNum)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+41, nil))
+
+	// A corked connection holds partial segments even with
+	// nothing in flight, until it is uncorked
+	assert.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return conn.SendUNA == iss+41
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, conn.SetCork(true))
+
+	write(10)
+	write(10)
+	assert.Len(t, sent, 0)
+
+	assert.NoError(t, conn.SetCork(false))
+
+	seg = nextSegment(t, sent)
+	assert.Equal(t, iss+41, seg.Header.SeqNum)
+	assert.Len(t, seg.SkBuff.Data, 20)
+}
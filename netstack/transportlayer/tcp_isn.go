@@ -0,0 +1,86 @@
+package transportlayer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+)
+
+// ==============================================================================
+// TCP Initial Sequence Numbers
+// ==============================================================================
+
+/*
+	The initial sequence number of a connection is a clock that ticks every
+	4 microseconds, plus a keyed hash of the connection's addresses (RFC 6528).
+	The clock keeps the sequence numbers of successive connections between the
+	same addresses from overlapping, and the hash keeps an attacker who doesn't
+	know the key from guessing the sequence numbers of other connections.
+*/
+
+// Labels that keep the hashes for different uses apart
+const (
+	hashLabelISN       = 1
+	hashLabelSynCookie = 2
+	hashLabelFastOpen  = 3
+)
+
+// ISN returns the initial sequence number of a connection
+func (tcp *TCPProtocol) ISN(localAddr, remoteAddr netstack.SockAddr) uint32 {
+	clock := uint32(time.Now().UnixNano() / int64(4*time.Microsecond))
+
+	return clock + tcp.hash(hashLabelISN, localAddr, remoteAddr)
+}
+
+// hash is a keyed hash of the connection's addresses and values
+func (tcp *TCPProtocol) hash(label byte, localAddr, remoteAddr netstack.SockAddr, values ...uint32) uint32 {
+	sum := tcp.digest(label, localAddr, remoteAddr, values...)
+
+	return binary.BigEndian.Uint32(sum[:])
+}
+
+// digest is the whole keyed hash, for uses that need more than 32 bits
+func (tcp *TCPProtocol) digest(label byte, localAddr, remoteAddr netstack.SockAddr, values ...uint32) [sha256.Size]byte {
+	buf := []byte{label}
+
+	for _, addr := range []netstack.SockAddr{localAddr, remoteAddr} {
+		buf = append(buf, addr.IP.To16()...)
+		buf = append(buf, byte(addr.Port>>8), byte(addr.Port))
+	}
+
+	for _, v := range values {
+		buf = append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	var sum [sha256.Size]byte
+
+	h := sha256.New()
+	h.Write(tcp.secret[:])
+	h.Write(buf)
+	h.Sum(sum[:0])
+
+	return sum
+}
+
+// newSecret returns a random key for the hashes
+func newSecret() [32]byte {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		panic(err)
+	}
+
+	return secret
+}
+
+// randomUint32 returns a random number nobody can predict
+func randomUint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,30 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_ISN(t *testing.T) {
+	tcp := NewTCP()
+
+	local := netstack.SockAddr{IP: serverIP, Port: 80}
+	remote := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 40000}
+	other := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 40001}
+
+	// The ISNs of a connection move forward with the clock
+	isn := tcp.ISN(local, remote)
+	time.Sleep(time.Millisecond)
+
+	next := tcp.ISN(local, remote)
+	assert.True(t, seqGT(next, isn))
+	assert.Less(t, next-isn, uint32(time.Second/(4*time.Microsecond)))
+
+	// Other connections, and other stacks, start elsewhere
+	assert.NotEqual(t, next-isn, tcp.ISN(local, other)-isn)
+	assert.NotEqual(t, next-isn, NewTCP().ISN(local, remote)-isn)
+}
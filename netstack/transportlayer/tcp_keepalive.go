@@ -0,0 +1,123 @@
+package transportlayer
+
+import (
+	"errors"
+	"time"
+)
+
+// ==============================================================================
+// TCP Keep-Alive
+// ==============================================================================
+
+/*
+	A connection with keep-alive enabled probes the peer after it was idle
+	for a while (RFC 1122 4.2.3.6). The probe is an ACK with an old sequence
+	number, which the peer answers with an ACK. Probes are repeated until
+	the peer answers, and after too many unanswered ones the connection is
+	aborted, so a peer that went away, or a NAT that forgot the connection,
+	is noticed. The connection is idle when nothing was received from the
+	peer; while data is in flight the retransmission and persist timers
+	look after it instead.
+*/
+
+// KeepAliveConfig holds the keep-alive settings of a connection
+type KeepAliveConfig struct {
+	Idle     time.Duration // Idle time before the first probe
+	Interval time.Duration // Time between unanswered probes
+	Count    int           // Unanswered probes before the connection is aborted
+}
+
+// DefaultKeepAliveConfig has the defaults of Linux
+var DefaultKeepAliveConfig = KeepAliveConfig{
+	Idle:     2 * time.Hour,
+	Interval: 75 * time.Second,
+	Count:    9,
+}
+
+var ErrInvalidKeepAlive = errors.New("invalid keep-alive setting")
+
+// SetKeepAlive turns keep-alive on or off. Zero fields of config
+// take the values of the TCPProtocol's KeepAlive settings.
+func (tcb *TCB) SetKeepAlive(enabled bool, config KeepAliveConfig) error {
+	if config.Idle < 0 || config.Interval < 0 || config.Count < 0 {
+		return ErrInvalidKeepAlive
+	}
+
+	defaults := tcb.TCP.KeepAlive
+
+	if config.Idle == 0 {
+		config.Idle = defaults.Idle
+	}
+
+	if config.Interval == 0 {
+		config.Interval = defaults.Interval
+	}
+
+	if config.Count == 0 {
+		config.Count = defaults.Count
+	}
+
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.keepAlive = enabled
+	tcb.keepAliveConfig = config
+
+	// Listeners have no peer to probe
+	if enabled && !tcb.IsListener() && tcb.State != TCP_STATE_CLOSED {
+		tcb.startKeepAliveTimer(config.Idle)
+	} else {
+		tcb.stopKeepAliveTimer()
+	}
+
+	return nil
+}
+
+// keepAliveReceived is called for each segment from the peer, which
+// shows it is still there
+func (tcb *TCB) keepAliveReceived() {
+	tcb.lastRecv = time.Now()
+	tcb.keepAliveProbes = 0
+}
+
+func (tcb *TCB) startKeepAliveTimer(d time.Duration) {
+	tcb.keepAliveTimer.start(&tcb.mu, d, tcb.keepAliveTimeout)
+}
+
+func (tcb *TCB) stopKeepAliveTimer() {
+	tcb.keepAliveTimer.stop()
+}
+
+// keepAliveTimeout probes an idle connection, or aborts it when too
+// many probes went unanswered
+func (tcb *TCB) keepAliveTimeout() {
+	config := tcb.keepAliveConfig
+	idle := time.Since(tcb.lastRecv)
+
+	switch {
+	case tcb.State != TCP_STATE_ESTABLISHED && tcb.State != TCP_STATE_CLOSE_WAIT,
+		len(tcb.retxQueue) > 0,
+		tcb.persistTimer.running():
+		// Not synchronized yet, closing, or the other timers are
+		// running. Check again later.
+		tcb.startKeepAliveTimer(config.Idle)
+	case tcb.keepAliveProbes == 0 && idle < config.Idle:
+		tcb.startKeepAliveTimer(config.Idle - idle)
+	case tcb.keepAliveProbes >= config.Count:
+		tcb.Log.Printf("TCP: %v: no answer to %d keep-alive probes\n", tcb.ID, tcb.keepAliveProbes)
+
+		if err := tcb.sendSegment(TCP_RST, tcb.SendNXT, nil); err != nil {
+			tcb.Log.Printf("TCP: error sending RST: %v\n", err)
+		}
+
+		tcb.closeWithError(ErrConnectionTimeout)
+		tcb.cond.Broadcast()
+	default:
+		if err := tcb.sendSegment(TCP_ACK, tcb.SendNXT-1, nil); err != nil {
+			tcb.Log.Printf("TCP: error sending keep-alive probe: %v\n", err)
+		}
+
+		tcb.keepAliveProbes++
+		tcb.startKeepAliveTimer(config.Interval)
+	}
+}
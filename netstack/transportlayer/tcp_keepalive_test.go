@@ -0,0 +1,57 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_KeepAlive(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	assert.ErrorIs(t, conn.SetKeepAlive(true, KeepAliveConfig{Idle: -1}), ErrInvalidKeepAlive)
+
+	idle := 100 * time.Millisecond
+	assert.NoError(t, conn.SetKeepAlive(true, KeepAliveConfig{Idle: idle, Interval: 20 * time.Millisecond, Count: 3}))
+
+	// The idle connection is probed with an old sequence number
+	start := time.Now()
+	probe := nextSegment(t, sent)
+
+	assert.GreaterOrEqual(t, time.Since(start), idle/2)
+	assert.Equal(t, iss, probe.Header.SeqNum)
+	assert.Equal(t, uint8(TCP_ACK), probe.Header.BitFlags)
+	assert.Empty(t, probe.SkBuff.Data)
+
+	// The peer answers, and the connection is idle again
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1, nil))
+
+	start = time.Now()
+	probe = nextSegment(t, sent)
+
+	assert.GreaterOrEqual(t, time.Since(start), idle/2)
+	assert.Equal(t, iss, probe.Header.SeqNum)
+
+	// Without answers, the connection is aborted after the last probe
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, iss, nextSegment(t, sent).Header.SeqNum)
+	}
+
+	rst := nextSegment(t, sent)
+	assert.True(t, rst.Header.IsRST())
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, ErrConnectionTimeout)
+
+	_, err = conn.Write([]byte("data"))
+	assert.ErrorIs(t, err, ErrConnectionTimeout)
+}
@@ -0,0 +1,246 @@
+package transportlayer
+
+import (
+	"sort"
+)
+
+// ==============================================================================
+// TCP Selective Acknowledgments
+// ==============================================================================
+
+/*
+	With SACK (RFC 2018) the receiver tells the sender which blocks of
+	data it holds beyond the cumulative ACK. The sender keeps track of
+	them on its retransmission queue, the scoreboard, and during loss
+	recovery only retransmits the segments that are missing (RFC 6675).
+	Both sides must have offered SACK in the handshake.
+*/
+
+// sackBlocks builds the SACK blocks for an ACK from the out of order
+// segments in the RxQueue (RFC 2018 4). The block with the segment that
+// arrived last goes first, so the sender learns about it even if there
+// is no room for all blocks.
+func (tcb *TCB) sackBlocks(max int) []SACKBlock {
+	segments := tcb.RxQueue.Items()
+	sort.Slice(segments, func(i, j int) bool {
+		return seqLT(segments[i].Header.SeqNum, segments[j].Header.SeqNum)
+	})
+
+	var blocks []SACKBlock
+
+	for _, seg := range segments {
+		left := seg.Header.SeqNum
+		right := left + uint32(len(seg.SkBuff.Data))
+
+		if right == left || seqLEQ(right, tcb.RecvNXT) {
+			continue
+		}
+
+		if n := len(blocks); n > 0 && seqLEQ(left, blocks[n-1].Right) {
+			if seqGT(right, blocks[n-1].Right) {
+				blocks[n-1].Right = right
+			}
+
+			continue
+		}
+
+		blocks = append(blocks, SACKBlock{Left: left, Right: right})
+	}
+
+	for i, block := range blocks {
+		if seqLEQ(block.Left, tcb.sackTrigger) && seqLT(tcb.sackTrigger, block.Right) {
+			copy(blocks[1:i+1], blocks[:i])
+			blocks[0] = block
+
+			break
+		}
+	}
+
+	if len(blocks) > max {
+		blocks = blocks[:max]
+	}
+
+	return blocks
+}
+
+// sackOption returns the SACK option for an ACK, if there is out of
+// order data to report. used is the room other options take up.
+func (tcb *TCB) sackOption(used int) (TCPOption, bool) {
+	if !tcb.SACKPermitted || tcb.RxQueue.Len() == 0 {
+		return TCPOption{}, false
+	}
+
+	max := (TCPOptionsMaxSize - used - 2) / tcpSACKBlockSize
+
+	blocks := tcb.sackBlocks(max)
+	if len(blocks) == 0 {
+		return TCPOption{}, false
+	}
+
+	return TCPOption{Kind: TCPOptionKindSACK, Blocks: blocks}, true
+}
+
+// updateScoreboard marks the segments on the retransmission queue that
+// the SACK blocks of an ACK cover. It returns true if it marked any.
+func (tcb *TCB) updateScoreboard(header *TCPHeader) bool {
+	if !tcb.SACKPermitted {
+		return false
+	}
+
+	option, ok := header.Options.Find(TCPOptionKindSACK)
+	if !ok {
+		return false
+	}
+
+	updated := false
+
+	for _, block := range option.Blocks {
+		// Ignore blocks for data that isn't in flight
+		if seqGEQ(block.Left, block.Right) || seqLEQ(block.Right, tcb.SendUNA) || seqGT(block.Right, tcb.SendNXT) {
+			continue
+		}
+
+		for i := range tcb.retxQueue {
+			seg := &tcb.retxQueue[i]
+			if !seg.sacked && seqGEQ(seg.seq, block.Left) && seqLEQ(seg.end(), block.Right) {
+				seg.sacked = true
+				updated = true
+			}
+		}
+	}
+
+	return updated
+}
+
+// clearScoreboard forgets what was SACKed. After a timeout the receiver
+// may have dropped the data it reported (RFC 2018 8).
+func (tcb *TCB) clearScoreboard() {
+	for i := range tcb.retxQueue {
+		tcb.retxQueue[i].sacked = false
+	}
+}
+
+// lostSegments tells for each segment on the retransmission queue whether
+// it is presumed lost: DupAckThreshold segments, or more than
+// DupAckThreshold-1 segments worth of data, after it were SACKed
+// (RFC 6675 4, IsLost).
+func (tcb *TCB) lostSegments() []bool {
+	lost := make([]bool, len(tcb.retxQueue))
+	mss := uint32(tcb.SendMSS)
+
+	sackedCount := 0
+	sackedBytes := uint32(0)
+
+	for i := len(tcb.retxQueue) - 1; i >= 0; i-- {
+		seg := tcb.retxQueue[i]
+		if seg.sacked {
+			sackedCount++
+			sackedBytes += seg.end() - seg.seq
+
+			continue
+		}
+
+		lost[i] = sackedCount >= DupAckThreshold || sackedBytes > (DupAckThreshold-1)*mss
+	}
+
+	return lost
+}
+
+// pipe estimates the data in flight during SACK recovery (RFC 6675 4).
+// Segments that weren't SACKed count unless they are lost, and their
+// retransmissions count as well.
+func (tcb *TCB) pipe() uint32 {
+	lost := tcb.lostSegments()
+	pipe := uint32(0)
+
+	for i, seg := range tcb.retxQueue {
+		if seg.sacked {
+			continue
+		}
+
+		size := seg.end() - seg.seq
+
+		if !lost[i] {
+			pipe += size
+		}
+
+		if seqLEQ(seg.end(), tcb.highRxt) {
+			pipe += size
+		}
+	}
+
+	return pipe
+}
+
+// flightSize is the data in flight the congestion window limits:
+// pipe during SACK recovery, everything unacknowledged otherwise
+func (tcb *TCB) flightSize() uint32 {
+	if tcb.ccState.InRecovery && tcb.SACKPermitted {
+		return tcb.pipe()
+	}
+
+	return tcb.SendNXT - tcb.SendUNA
+}
+
+// firstSegmentLost reports whether the scoreboard shows the oldest
+// segment in flight is lost
+func (tcb *TCB) firstSegmentLost() bool {
+	if !tcb.SACKPermitted || len(tcb.retxQueue) == 0 {
+		return false
+	}
+
+	return tcb.lostSegments()[0]
+}
+
+// canSend reports whether the congestion window has room for another
+// segment during SACK recovery
+func (tcb *TCB) canSend() bool {
+	return tcb.ccState.Cwnd >= tcb.pipe()+uint32(tcb.SendMSS)
+}
+
+// sackRecovery sends what the congestion window allows during loss
+// recovery with SACK (RFC 6675 4, NextSeg): the segments presumed lost
+// first, then new data, then the segments below the highest SACKed one
+// that weren't retransmitted yet.
+func (tcb *TCB) sackRecovery() {
+	for tcb.canSend() && tcb.retransmitNext(true) {
+	}
+
+	if err := tcb.output(); err != nil {
+		tcb.Log.Printf("TCP: error sending data: %v\n", err)
+	}
+
+	for tcb.canSend() && tcb.retransmitNext(false) {
+	}
+}
+
+// retransmitNext retransmits the first segment past highRxt that wasn't
+// SACKed and is lost, or with lostOnly false, has a SACKed segment after
+// it. It returns false if there is no such segment.
+func (tcb *TCB) retransmitNext(lostOnly bool) bool {
+	lost := tcb.lostSegments()
+
+	highestSacked := -1
+	for i, seg := range tcb.retxQueue {
+		if seg.sacked {
+			highestSacked = i
+		}
+	}
+
+	for i := range tcb.retxQueue {
+		seg := &tcb.retxQueue[i]
+		if seg.sacked || seqLEQ(seg.end(), tcb.highRxt) {
+			continue
+		}
+
+		if lostOnly && !lost[i] || !lostOnly && i > highestSacked {
+			continue
+		}
+
+		tcb.retransmitSegment(seg)
+
+		return true
+	}
+
+	return false
+}
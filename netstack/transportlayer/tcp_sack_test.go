@@ -0,0 +1,140 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+// sackOptions are the options on the SYN of a connection that permits
+// SACK and has an MSS of 1000
+var sackOptions = TCPOptions{
+	{Kind: TCPOptionKindMSS, MSS: 1000},
+	{Kind: TCPOptionKindSACKPermitted},
+}
+
+// genSACKAck generates an ACK from srcPort with the given SACK blocks
+func genSACKAck(srcPort uint16, ack uint32, blocks ...SACKBlock) *netstack.SkBuff {
+	header := TCPHeader{SrcPort: srcPort, DstPort: 80, SeqNum: 1001, AckNum: ack, BitFlags: TCP_ACK, Window: 0xffff}
+	header.SetOptions(TCPOptions{{Kind: TCPOptionKindSACK, Blocks: blocks}})
+
+	return genRxHeader(header, nil)
+}
+
+func Test_TCP_SACKBlocks(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000, sackOptions...)
+	assert.True(t, conn.SACKPermitted)
+	iss := conn.SendISN
+	data := make([]byte, 100)
+
+	sackBlocks := func(seg TCPBuffer) []SACKBlock {
+		option, _ := seg.Header.Options.Find(TCPOptionKindSACK)
+		return option.Blocks
+	}
+
+	// Each out of order segment is acknowledged right away, the block
+	// with the segment that arrived last first
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 2001, iss+1, data))
+
+	ack := nextSegment(t, sent)
+	assert.Equal(t, uint32(1001), ack.Header.AckNum)
+	assert.Equal(t, []SACKBlock{{2001, 2101}}, sackBlocks(ack))
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 3001, iss+1, data))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, uint32(1001), ack.Header.AckNum)
+	assert.Equal(t, []SACKBlock{{3001, 3101}, {2001, 2101}}, sackBlocks(ack))
+
+	// Adjacent segments are reported as one block
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 2101, iss+1, data))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, []SACKBlock{{2001, 2201}, {3001, 3101}}, sackBlocks(ack))
+
+	// Filling the first hole leaves the second to report
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1, make([]byte, 1000)))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, uint32(2201), ack.Header.AckNum)
+	assert.Equal(t, []SACKBlock{{3001, 3101}}, sackBlocks(ack))
+
+	// Without holes, ACKs have no SACK option
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 2201, iss+1, make([]byte, 800)))
+
+	ack = nextSegment(t, sent)
+	assert.Equal(t, uint32(3101), ack.Header.AckNum)
+	assert.Nil(t, ack.Header.Options)
+	assert.Len(t, sent, 0)
+}
+
+func Test_TCP_SACKRecovery(t *testing.T) {
+	tcp, sent := newTestTCP()
+	assert.NoError(t, tcp.SetCongestionControl(CongestionControlReno))
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000, sackOptions...)
+	assert.True(t, conn.SACKPermitted)
+	iss := conn.SendISN
+	mss := uint32(1000)
+
+	// Open the window for eight segments
+	conn.mu.Lock()
+	conn.ccState.Cwnd = 10 * mss
+	conn.mu.Unlock()
+
+	_, err = conn.Write(make([]byte, 8*mss))
+	assert.NoError(t, err)
+
+	segment := func(i uint32) uint32 {
+		return iss + 1 + i*mss
+	}
+
+	for i := uint32(0); i < 8; i++ {
+		assert.Equal(t, segment(i), nextSegment(t, sent).Header.SeqNum)
+	}
+
+	// Segments 1 and 4 are lost. The third duplicate ACK
+	// retransmits the first of them.
+	tcp.HandleRx(genSACKAck(40000, segment(1)))
+	tcp.HandleRx(genSACKAck(40000, segment(1), SACKBlock{segment(2), segment(3)}))
+	tcp.HandleRx(genSACKAck(40000, segment(1), SACKBlock{segment(2), segment(4)}))
+	tcp.HandleRx(genSACKAck(40000, segment(1), SACKBlock{segment(5), segment(6)}, SACKBlock{segment(2), segment(4)}))
+
+	assert.Equal(t, segment(1), nextSegment(t, sent).Header.SeqNum)
+
+	stats := conn.Stats()
+	assert.True(t, stats.InRecovery)
+	assert.Equal(t, uint32(3500), stats.Ssthresh)
+	assert.Equal(t, uint32(3500), stats.Cwnd)
+
+	// Once three segments after it are SACKed, segment 4 counts
+	// as lost too, and the window has room to retransmit it
+	tcp.HandleRx(genSACKAck(40000, segment(1), SACKBlock{segment(5), segment(7)}, SACKBlock{segment(2), segment(4)}))
+	tcp.HandleRx(genSACKAck(40000, segment(1), SACKBlock{segment(5), segment(8)}, SACKBlock{segment(2), segment(4)}))
+
+	assert.Equal(t, segment(4), nextSegment(t, sent).Header.SeqNum)
+
+	// The ACK of everything ends recovery. Only the lost
+	// segments were retransmitted.
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, segment(8), nil))
+
+	assert.Eventually(t, func() bool {
+		return !conn.Stats().InRecovery
+	}, time.Second, 10*time.Millisecond)
+
+	stats = conn.Stats()
+	assert.Equal(t, 2, stats.Retransmits)
+	assert.Equal(t, uint32(0), stats.InFlight)
+	assert.Len(t, sent, 0)
+}
@@ -0,0 +1,135 @@
+package transportlayer
+
+import (
+	"errors"
+	"time"
+)
+
+// ==============================================================================
+// TCP Shutdown, Linger and Abort
+// ==============================================================================
+
+/*
+	The user can close each direction of a connection on its own. Shutting
+	down the write side sends a FIN after the data written so far, while data
+	can still be received (a half-close, RFC 9293 3.6). Shutting down the
+	read side throws away what was received and not read yet, and everything
+	that arrives later. The peer isn't told, so it keeps sending.
+
+	On close, the user can wait until the peer acknowledged all data and the
+	FIN (linger), or abort the connection with a RST, which throws away the
+	data that wasn't sent yet.
+*/
+
+var ErrLingerTimeout = errors.New("linger timed out before the peer acknowledged all data")
+
+// ShutdownRead discards the data received, now and later. Reads
+// return io.EOF from now on.
+func (tcb *TCB) ShutdownRead() error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	if tcb.State == TCP_STATE_CLOSED || tcb.State == TCP_STATE_LISTEN {
+		return ErrInvalidState
+	}
+
+	tcb.readShutdown = true
+	tcb.recvQueued -= uint32(len(tcb.recvBuf))
+	tcb.recvBuf = nil
+	tcb.urgMarkValid = false
+
+	// The discarded data leaves room in the window
+	if tcb.State != TCP_STATE_SYN_SENT && tcb.openRecvWindow() {
+		tcb.SendAck()
+	}
+
+	tcb.cond.Broadcast()
+
+	return nil
+}
+
+// ShutdownWrite sends a FIN after the data written so far. The
+// connection keeps receiving until the peer sends its FIN.
+func (tcb *TCB) ShutdownWrite() error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	switch tcb.State {
+	case TCP_STATE_FIN_WAIT_1, TCP_STATE_FIN_WAIT_2, TCP_STATE_CLOSING, TCP_STATE_LAST_ACK, TCP_STATE_TIME_WAIT:
+		// The FIN is queued already
+		return nil
+	default:
+		return tcb.shutdownWrite()
+	}
+}
+
+// shutdownWrite queues the FIN of a connection that can still send
+func (tcb *TCB) shutdownWrite() error {
+	switch tcb.State {
+	case TCP_STATE_SYN_RCVD, TCP_STATE_ESTABLISHED:
+		tcb.State = TCP_STATE_FIN_WAIT_1
+	case TCP_STATE_CLOSE_WAIT:
+		tcb.State = TCP_STATE_LAST_ACK
+	default:
+		return ErrInvalidState
+	}
+
+	return tcb.TCP.SendFin(tcb)
+}
+
+// Linger waits until the peer acknowledged all data and the FIN, after
+// the connection was closed. It gives up with ErrLingerTimeout after
+// timeout, and the connection goes on closing in the background.
+func (tcb *TCB) Linger(timeout time.Duration) error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		tcb.mu.Lock()
+		expired = true
+		tcb.cond.Broadcast()
+		tcb.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		switch {
+		case tcb.err != nil:
+			return tcb.err
+		case tcb.finSent && tcb.SendUNA == tcb.SendNXT:
+			return nil
+		case !tcb.finPending:
+			// Closed without a FIN, there is nothing to wait for
+			return nil
+		case expired:
+			return ErrLingerTimeout
+		}
+
+		tcb.cond.Wait()
+	}
+}
+
+// Abort resets the connection, and throws away the data that wasn't
+// sent or read yet (RFC 9293 3.10.5)
+func (tcb *TCB) Abort() error {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	switch tcb.State {
+	case TCP_STATE_CLOSED:
+		return ErrConnectionNoExist
+	case TCP_STATE_LISTEN, TCP_STATE_SYN_SENT:
+		// The peer knows nothing about the connection yet
+		tcb.closeWithError(ErrConnectionReset)
+		tcb.cond.Broadcast()
+	case TCP_STATE_CLOSING, TCP_STATE_LAST_ACK, TCP_STATE_TIME_WAIT:
+		// The peer has closed already
+		tcb.close()
+		tcb.cond.Broadcast()
+	default:
+		tcb.reset()
+	}
+
+	return nil
+}
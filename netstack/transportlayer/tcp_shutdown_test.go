@@ -0,0 +1,156 @@
+package transportlayer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_HalfClose(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	// Shutting down the write side sends a FIN after the data
+	_, err = conn.Write([]byte("request"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.ShutdownWrite())
+	assert.NoError(t, conn.ShutdownWrite())
+
+	assert.Equal(t, []byte("request"), nextSegment(t, sent).SkBuff.Data)
+
+	fin := nextSegment(t, sent).Header
+	assert.True(t, fin.IsFIN())
+	assert.Equal(t, iss+8, fin.SeqNum)
+
+	_, err = conn.Write([]byte("more"))
+	assert.ErrorIs(t, err, ErrConnectionClosing)
+
+	// The peer can still send
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+9, []byte("reply")))
+
+	data, err := conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), data)
+	assert.Equal(t, TCP_STATE_FIN_WAIT_2, state(conn))
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1006, iss+9, nil))
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, TCP_STATE_TIME_WAIT, state(conn))
+}
+
+func Test_TCP_ShutdownRead(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+1, []byte("unread")))
+
+	assert.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return conn.RecvNXT == 1007
+	}, time.Second, time.Millisecond)
+
+	// The data is thrown away, now and later, and reads see the end
+	assert.NoError(t, conn.ShutdownRead())
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, io.EOF)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1007, iss+1, make([]byte, 100)))
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1107, iss+1, make([]byte, 100)))
+
+	assert.Equal(t, uint32(1207), nextSegment(t, sent).Header.AckNum)
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, io.EOF)
+
+	conn.mu.Lock()
+	assert.Equal(t, uint32(0), conn.recvQueued)
+	conn.mu.Unlock()
+
+	// Sending still works
+	_, err = conn.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), nextSegment(t, sent).SkBuff.Data)
+}
+
+func Test_TCP_Linger(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	_, err = conn.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, tcp.CloseConnection(conn.SrcAddr, conn.DstAddr))
+
+	nextSegment(t, sent)
+	nextSegment(t, sent)
+
+	// Without ACKs, lingering times out
+	assert.ErrorIs(t, conn.Linger(20*time.Millisecond), ErrLingerTimeout)
+
+	// Lingering ends when the peer has all data and the FIN
+	done := make(chan error)
+	go func() {
+		done <- conn.Linger(time.Second)
+	}()
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+5, nil))
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+6, nil))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("linger didn't return")
+	}
+
+	assert.Equal(t, TCP_STATE_FIN_WAIT_2, state(conn))
+}
+
+func Test_TCP_Abort(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	_, err = conn.Write([]byte("data"))
+	assert.NoError(t, err)
+	nextSegment(t, sent)
+
+	// Aborting resets the connection, and drops the data in flight
+	assert.NoError(t, conn.Abort())
+
+	rst := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_RST), rst.BitFlags)
+	assert.Equal(t, iss+5, rst.SeqNum)
+	assert.True(t, removed(tcp, conn)())
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, ErrConnectionReset)
+	assert.ErrorIs(t, conn.Abort(), ErrConnectionNoExist)
+}
@@ -0,0 +1,216 @@
+package transportlayer
+
+import (
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+)
+
+// ==============================================================================
+// TCP SYN Cookies
+// ==============================================================================
+
+/*
+	When the SYN queue of a listener is full, it answers SYNs without keeping
+	any state: the ISN of the SYN-ACK, the cookie, encodes what the listener
+	needs to know about the connection (RFC 4987 3.6). The ACK that completes
+	the handshake returns the cookie, and the connection is created from it.
+
+	The top 5 bits of the cookie are a counter that ticks every 64 seconds, the
+	next 3 the index of the peer's MSS in synCookieMSS, and the low 24 a keyed
+	hash of the addresses, the peer's ISN and the counter. If the peer offered
+	timestamps, its window scale and SACK options are kept in the low bits of
+	our timestamp in the SYN-ACK, which the ACK echoes. Otherwise the
+	connection goes without them.
+*/
+
+// The MSS values a cookie encodes, the peer's MSS is rounded down to one
+var synCookieMSS = [8]uint16{536, 1200, 1300, 1400, 1440, 1452, 1460, 8960}
+
+const (
+	synCookiePeriod = 64 * time.Second // How often the counter ticks
+	synCookieMaxAge = 2                // Ticks after which a cookie expires
+
+	// The options in the low bits of our timestamp
+	tsCookieWScale = 0x0f // The peer's window scale, all ones if it offered none
+	tsCookieSACK   = 0x10
+	tsCookieMask   = 0x3f
+)
+
+func synCookieCounter() uint32 {
+	return uint32(time.Now().UnixNano() / int64(synCookiePeriod))
+}
+
+// synCookie makes the cookie for a SYN
+func (tcp *TCPProtocol) synCookie(localAddr, remoteAddr netstack.SockAddr, peerISN uint32, mss uint16) uint32 {
+	index := uint32(0)
+
+	for i, v := range synCookieMSS {
+		if v <= mss {
+			index = uint32(i)
+		}
+	}
+
+	counter := synCookieCounter()
+	hash := tcp.hash(hashLabelSynCookie, localAddr, remoteAddr, peerISN, counter)
+
+	return counter<<27 | index<<24 | hash&0xffffff
+}
+
+// checkSynCookie checks a cookie the peer returned, and returns the MSS
+// it encodes. It is valid if it was made for the peer's ISN and
+// the addresses not long ago.
+func (tcp *TCPProtocol) checkSynCookie(localAddr, remoteAddr netstack.SockAddr, peerISN, cookie uint32) (uint16, bool) {
+	now := synCookieCounter()
+
+	for age := uint32(0); age <= synCookieMaxAge; age++ {
+		counter := now - age
+		if counter&0x1f != cookie>>27 {
+			continue
+		}
+
+		hash := tcp.hash(hashLabelSynCookie, localAddr, remoteAddr, peerISN, counter)
+		if hash&0xffffff == cookie&0xffffff {
+			return synCookieMSS[cookie>>24&0x7], true
+		}
+	}
+
+	return 0, false
+}
+
+// tsCookie returns our timestamp for a SYN-ACK with a cookie, with the
+// options of the SYN in its low bits. It is never ahead of the clock,
+// so the timestamps of the connection don't go back later.
+func tsCookie(now uint32, syn TCPOptions) uint32 {
+	options := uint32(tsCookieWScale)
+	if option, ok := syn.Find(TCPOptionKindWS); ok {
+		options = uint32(option.WScale)
+
+		if options > TCPMaxWindowScale {
+			options = TCPMaxWindowScale
+		}
+	}
+
+	if _, ok := syn.Find(TCPOptionKindSACKPermitted); ok {
+		options |= tsCookieSACK
+	}
+
+	ts := now&^tsCookieMask | options
+	if seqGT(ts, now) {
+		ts -= tsCookieMask + 1
+	}
+
+	return ts
+}
+
+// synCookieOptions rebuilds the options of the peer's SYN from the MSS
+// of the cookie and the timestamp the ACK echoes
+func synCookieOptions(mss uint16, ack *TCPHeader) TCPOptions {
+	options := TCPOptions{{Kind: TCPOptionKindMSS, MSS: mss}}
+
+	ts, ok := ack.Options.Find(TCPOptionKindTimestamps)
+	if !ok {
+		return options
+	}
+
+	if wscale := ts.TSEcr & tsCookieWScale; wscale != tsCookieWScale {
+		options = append(options, TCPOption{Kind: TCPOptionKindWS, WScale: uint8(wscale)})
+	}
+
+	if ts.TSEcr&tsCookieSACK != 0 {
+		options = append(options, TCPOption{Kind: TCPOptionKindSACKPermitted})
+	}
+
+	return append(options, TCPOption{Kind: TCPOptionKindTimestamps, TSVal: ts.TSVal})
+}
+
+// sendSynCookie answers a SYN with a SYN-ACK that has a cookie for its ISN
+func (tcp *TCPProtocol) sendSynCookie(
+	listener *TCB,
+	header *TCPHeader,
+	skb *netstack.SkBuff,
+	rxIface netstack.NetworkInterface,
+	settings childSettings,
+) {
+	mss := uint16(TCPDefaultMSS)
+	if option, ok := header.Options.Find(TCPOptionKindMSS); ok && option.MSS > 0 {
+		mss = option.MSS
+	}
+
+	cookie := tcp.synCookie(skb.GetDstAddr(), skb.GetSrcAddr(), header.SeqNum, mss)
+
+	// The TCB only sends the SYN-ACK, it is not kept. The connection
+	// will use the timestamp clock of the listener.
+	tcb := tcp.newChildTCB(listener, header, skb, rxIface, cookie, settings)
+	tcb.tsOffset = listener.tsOffset
+
+	// The cookie has no room for ECN
+	tcb.ecn = false
+
+	options := tcb.synOptions(true)
+	for i := range options {
+		if options[i].Kind == TCPOptionKindTimestamps {
+			options[i].TSVal = tsCookie(tcb.tsNow(), header.Options)
+		}
+	}
+
+	if err := tcb.sendSegmentOptions(TCP_SYN|TCP_ACK, cookie, nil, options); err != nil {
+		tcp.Log.Printf("sendSynCookie: error sending SYN-ACK: %v\n", err)
+	}
+}
+
+// acceptSynCookie creates the connection for an ACK that returns a valid
+// cookie. It returns false if the cookie isn't valid.
+func (tcp *TCPProtocol) acceptSynCookie(listener *TCB, header *TCPHeader, skb *netstack.SkBuff) bool {
+	if header.IsSYN() {
+		return false
+	}
+
+	localAddr := skb.GetDstAddr()
+	remoteAddr := skb.GetSrcAddr()
+	peerISN := header.SeqNum - 1
+	cookie := header.AckNum - 1
+
+	mss, ok := tcp.checkSynCookie(localAddr, remoteAddr, peerISN, cookie)
+	if !ok {
+		return false
+	}
+
+	rxIface, err := skb.GetRxIface()
+	if err != nil {
+		tcp.Log.Printf("acceptSynCookie: %v\n", err)
+		return false
+	}
+
+	settings := listener.childSettings()
+
+	syn := &TCPHeader{
+		SrcPort: header.SrcPort,
+		DstPort: header.DstPort,
+		SeqNum:  peerISN,
+		Window:  header.Window,
+		Options: synCookieOptions(mss, header),
+	}
+
+	tcb := tcp.newChildTCB(listener, syn, skb, rxIface, cookie, settings)
+	tcb.tsOffset = listener.tsOffset
+
+	tcp.mu.Lock()
+
+	if listener.State != TCP_STATE_LISTEN {
+		tcp.mu.Unlock()
+		return false
+	}
+
+	tcp.ConnTable[tcb.ID] = tcb
+
+	tcp.mu.Unlock()
+
+	go tcb.MainLoop()
+
+	// The TCB completes the handshake as if the SYN had been queued
+	skb.StripBytes(header.SizeInBytes())
+	tcb.RxChan <- TCPBuffer{Header: header, SkBuff: skb}
+
+	return true
+}
@@ -0,0 +1,89 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_SynCookies(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 1, nil)
+	assert.NoError(t, err)
+
+	// Fill the SYN queue
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil))
+	nextSegment(t, sent)
+
+	// The next SYNs are answered with a cookie, and leave no state behind
+	cookieSynAck := func(srcPort uint16, options TCPOptions) *TCPHeader {
+		syn := TCPHeader{SrcPort: srcPort, DstPort: 80, SeqNum: 2000, BitFlags: TCP_SYN, Window: 0xffff}
+		syn.SetOptions(options)
+		tcp.HandleRx(genRxHeader(syn, nil))
+
+		synAck := nextSegment(t, sent).Header
+		assert.Equal(t, uint8(TCP_SYN|TCP_ACK), synAck.BitFlags)
+		assert.Equal(t, uint32(2001), synAck.AckNum)
+		assert.Len(t, listener.SynQueue, 1)
+
+		return synAck
+	}
+
+	synAck := cookieSynAck(40001, TCPOptions{
+		{Kind: TCPOptionKindMSS, MSS: 1400},
+		{Kind: TCPOptionKindWS, WScale: 5},
+		{Kind: TCPOptionKindSACKPermitted},
+		{Kind: TCPOptionKindTimestamps, TSVal: 500},
+	})
+
+	// An ACK with the wrong cookie is reset
+	tcp.HandleRx(genRxSegment(40001, 80, TCP_ACK, 2001, synAck.SeqNum+2, nil))
+	assert.Equal(t, uint8(TCP_RST), nextSegment(t, sent).Header.BitFlags)
+
+	// The ACK with the cookie creates the connection, with the options
+	// of the SYN. It may carry data already.
+	ts, ok := synAck.Options.Find(TCPOptionKindTimestamps)
+	assert.True(t, ok)
+
+	ack := TCPHeader{SrcPort: 40001, DstPort: 80, SeqNum: 2001, AckNum: synAck.SeqNum + 1, BitFlags: TCP_ACK, Window: 100}
+	ack.SetOptions(TCPOptions{{Kind: TCPOptionKindTimestamps, TSVal: 501, TSEcr: ts.TSVal}})
+	tcp.HandleRx(genRxHeader(ack, []byte("hello")))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+
+	data, err := conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	conn.mu.Lock()
+	assert.Equal(t, TCP_STATE_ESTABLISHED, conn.State)
+	assert.Equal(t, uint16(1400), conn.SendMSS)
+	assert.Equal(t, uint8(5), conn.SendWScale)
+	assert.Equal(t, uint32(100<<5), conn.SendWND)
+	assert.True(t, conn.SACKPermitted)
+	assert.True(t, conn.TSEnabled)
+	conn.mu.Unlock()
+
+	// Without timestamps, the cookie only keeps the MSS, rounded down
+	synAck = cookieSynAck(40002, TCPOptions{
+		{Kind: TCPOptionKindMSS, MSS: 1450},
+		{Kind: TCPOptionKindWS, WScale: 5},
+		{Kind: TCPOptionKindSACKPermitted},
+	})
+
+	tcp.HandleRx(genRxSegment(40002, 80, TCP_ACK, 2001, synAck.SeqNum+1, nil))
+
+	conn, err = listener.Accept()
+	assert.NoError(t, err)
+
+	conn.mu.Lock()
+	assert.Equal(t, uint16(1440), conn.SendMSS)
+	assert.False(t, conn.windowScaling)
+	assert.False(t, conn.SACKPermitted)
+	assert.False(t, conn.TSEnabled)
+	conn.mu.Unlock()
+}
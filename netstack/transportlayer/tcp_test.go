@@ -1,7 +1,10 @@
 package transportlayer
 
 import (
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/mattcarp12/matnet/netstack"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +24,7 @@ func genTCPSkb(seqNum uint32) TCPBuffer {
 
 	return TCPBuffer{
 		SkBuff: skb,
-		Header: tcpHeader,
+		Header: &tcpHeader,
 	}
 }
 
@@ -35,7 +38,7 @@ func Test_TCP_RxQueue(t *testing.T) {
 
 	// Create a new TCB object
 	connID := "conn1"
-	tcb := tcp.NewTCB(connID)
+	tcb := tcp.newTCB(connID)
 
 	t.Logf("TCB: %+v\n", tcb)
 
@@ -54,12 +57,12 @@ func Test_TCP_RxQueue(t *testing.T) {
 	t.Logf("RxQueue: %+v\n", tcb.RxQueue)
 
 	// Check the skbs are in the correct order
-	var skb *netstack.SkBuff
+	var skb TCPBuffer
 
 	if len(tcb.RxChanSorted) > 0 {
 		skb = <-tcb.RxChanSorted
 		t.Logf("SKB: %+v\n", skb)
-		assert.Equal(t, skb1.SkBuff, skb)
+		assert.Equal(t, skb1.SkBuff, skb.SkBuff)
 	} else {
 		t.Errorf("RxChanSorted is empty")
 	}
@@ -67,7 +70,7 @@ func Test_TCP_RxQueue(t *testing.T) {
 	if len(tcb.RxChanSorted) > 0 {
 		skb = <-tcb.RxChanSorted
 		t.Logf("SKB: %+v\n", skb)
-		assert.Equal(t, skb2.SkBuff, skb)
+		assert.Equal(t, skb2.SkBuff, skb.SkBuff)
 	} else {
 		t.Errorf("RxChanSorted is empty")
 	}
@@ -75,8 +78,844 @@ func Test_TCP_RxQueue(t *testing.T) {
 	if len(tcb.RxChanSorted) > 0 {
 		skb = <-tcb.RxChanSorted
 		t.Logf("SKB: %+v\n", skb)
-		assert.Equal(t, skb3.SkBuff, skb)
+		assert.Equal(t, skb3.SkBuff, skb.SkBuff)
 	} else {
 		t.Errorf("RxChanSorted is empty")
 	}
 }
+
+// ===========================================================================
+// Test TCP Passive Open
+// ===========================================================================
+
+type fakeIface struct {
+	netstack.NetworkInterface
+}
+
+func (iface *fakeIface) GetMTU() uint16 {
+	return 1500
+}
+
+// newTestTCP makes a TCP protocol whose outgoing segments
+// go to the returned channel instead of the network layer
+func newTestTCP() (*TCPProtocol, chan TCPBuffer) {
+	tcp := NewTCP()
+
+	networkLayer := netstack.NewLayer()
+	transportLayer := netstack.NewLayer(tcp)
+	transportLayer.SetPrevLayer(networkLayer)
+	tcp.SetLayer(transportLayer)
+
+	sent := make(chan TCPBuffer, 16)
+
+	go func() {
+		for {
+			skb := <-networkLayer.TxChan()
+			skb.TxSuccess()
+
+			header := &TCPHeader{}
+			header.Unmarshal(skb.Data)
+			skb.StripBytes(header.SizeInBytes())
+
+			sent <- TCPBuffer{Header: header, SkBuff: skb}
+		}
+	}()
+
+	return tcp, sent
+}
+
+var serverIP = net.IPv4(10, 88, 45, 69).To4()
+
+// nextSegment returns the next segment TCP sent
+func nextSegment(t *testing.T, sent chan TCPBuffer) TCPBuffer {
+	t.Helper()
+
+	select {
+	case tcpBuff := <-sent:
+		return tcpBuff
+	case <-time.After(time.Second):
+		t.Fatal("no segment sent")
+	}
+
+	return TCPBuffer{}
+}
+
+// genRxSegment makes a segment from 10.88.45.1 to the server
+func genRxSegment(srcPort, dstPort uint16, flags uint8, seq, ack uint32, data []byte) *netstack.SkBuff {
+	header := TCPHeader{
+		SrcPort:   srcPort,
+		DstPort:   dstPort,
+		SeqNum:    seq,
+		AckNum:    ack,
+		HeaderLen: 5,
+		BitFlags:  flags,
+		Window:    0xffff,
+	}
+
+	return genRxHeader(header, data)
+}
+
+// genRxHeader makes a segment with the header from 10.88.45.1 to the server
+func genRxHeader(header TCPHeader, data []byte) *netstack.SkBuff {
+	skb := netstack.NewSkBuff(data)
+	skb.SetSrcIP(net.IPv4(10, 88, 45, 1).To4())
+	skb.SetDstIP(serverIP)
+	skb.SetRxIface(&fakeIface{})
+
+	setTCPChecksum(skb, &header)
+	skb.PrependBytes(header.Marshal())
+
+	return skb
+}
+
+func Test_TCP_PassiveOpen(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 1, nil)
+	assert.NoError(t, err)
+
+	_, err = tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 1, nil)
+	assert.ErrorIs(t, err, ErrAddrInUse)
+
+	// The handshake
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil))
+	synAck := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_SYN|TCP_ACK), synAck.BitFlags)
+	assert.Equal(t, uint32(1001), synAck.AckNum)
+	assert.Len(t, listener.SynQueue, 1)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, synAck.SeqNum+1, nil))
+
+	select {
+	case conn := <-listener.AcceptQueue:
+		assert.Equal(t, TCP_STATE_ESTABLISHED, conn.State)
+		assert.Equal(t, uint16(40000), conn.DstAddr.Port)
+		assert.Equal(t, serverIP, conn.SrcAddr.IP)
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+
+	assert.Len(t, listener.SynQueue, 0)
+
+	// With the SYN queue full and without SYN cookies, SYNs are dropped
+	tcp.SynCookies = false
+
+	tcp.HandleRx(genRxSegment(40001, 80, TCP_SYN, 2000, 0, nil))
+	assert.Equal(t, uint8(TCP_SYN|TCP_ACK), nextSegment(t, sent).Header.BitFlags)
+
+	tcp.HandleRx(genRxSegment(40002, 80, TCP_SYN, 3000, 0, nil))
+	assert.Len(t, sent, 0)
+
+	// Segments for other ports are reset
+	tcp.HandleRx(genRxSegment(40003, 81, TCP_SYN, 4000, 0, nil))
+
+	rst := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_RST|TCP_ACK), rst.BitFlags)
+	assert.Equal(t, uint32(4001), rst.AckNum)
+
+	// Closing the listener resets the connection in the handshake
+	assert.NoError(t, tcp.CloseListener(listener))
+	assert.Equal(t, uint8(TCP_RST), nextSegment(t, sent).Header.BitFlags)
+
+	_, err = listener.Accept()
+	assert.ErrorIs(t, err, ErrListenerClosed)
+	assert.Len(t, tcp.ConnTable, 1)
+}
+
+// ===========================================================================
+// Test TCP Data Transfer
+// ===========================================================================
+
+// establish runs the handshake for a connection from srcPort to the
+// listener, with the options on the SYN, and returns the accepted TCB.
+// The client's ISN is 1000.
+func establish(t *testing.T, tcp *TCPProtocol, sent chan TCPBuffer, listener *TCB, srcPort uint16, options ...TCPOption) *TCB {
+	syn := TCPHeader{SrcPort: srcPort, DstPort: 80, SeqNum: 1000, BitFlags: TCP_SYN, Window: 0xffff}
+	syn.SetOptions(options)
+	tcp.HandleRx(genRxHeader(syn, nil))
+	synAck := nextSegment(t, sent).Header
+
+	tcp.HandleRx(genRxSegment(srcPort, 80, TCP_ACK, 1001, synAck.SeqNum+1, nil))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+
+	return conn
+}
+
+func Test_TCP_IPControl(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	ipControl := &netstack.IPControl{TTL: 9, Options: []byte{1, 1, 1, 1}}
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, ipControl)
+	assert.NoError(t, err)
+
+	// The listener keeps its own copy
+	ipControl.TTL = 8
+	ipControl.Options[0] = 0
+
+	// A connection takes the settings of its listener when it is
+	// created, later changes to the listener don't reach it
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil))
+	synAck := nextSegment(t, sent)
+	assert.Equal(t, uint8(9), synAck.SkBuff.GetTTL())
+	assert.Equal(t, []byte{1, 1, 1, 1}, synAck.SkBuff.GetIPOptions())
+
+	listener.SetIPControl(netstack.IPControl{TTL: 7})
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, synAck.Header.SeqNum+1, nil))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(9), nextSegment(t, sent).SkBuff.GetTTL())
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, synAck.Header.SeqNum+6, nil))
+
+	conn.SetIPControl(netstack.IPControl{TTL: 5})
+
+	_, err = conn.Write([]byte("world"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(5), nextSegment(t, sent).SkBuff.GetTTL())
+}
+
+func Test_TCP_DataTransfer(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	// Out of order data is held back until the gap is filled, and
+	// acknowledged right away. Filling the gap acknowledges it all.
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1006, iss+1, []byte("World")))
+	assert.Equal(t, uint32(1001), nextSegment(t, sent).Header.AckNum)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_PSH, 1001, iss+1, []byte("Hello")))
+	assert.Equal(t, uint32(1011), nextSegment(t, sent).Header.AckNum)
+
+	data, err := conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("HelloWorld"), data)
+
+	// A retransmission overlapping what we have only delivers the new part
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1006, iss+1, []byte("World!")))
+	assert.Equal(t, uint32(1012), nextSegment(t, sent).Header.AckNum)
+
+	data, err = conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("!"), data)
+
+	// Writes are cut into segments of at most the MSS. The small
+	// one at the end waits for the ACK of the first (Nagle).
+	payload := make([]byte, TCPDefaultMSS+100)
+	n, err := conn.Write(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, len(payload), n)
+
+	seg := nextSegment(t, sent)
+	assert.Equal(t, iss+1, seg.Header.SeqNum)
+	assert.Len(t, seg.SkBuff.Data, TCPDefaultMSS)
+	assert.False(t, seg.Header.IsPSH())
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1012, iss+1+TCPDefaultMSS, nil))
+
+	seg = nextSegment(t, sent)
+	assert.Equal(t, iss+1+TCPDefaultMSS, seg.Header.SeqNum)
+	assert.Len(t, seg.SkBuff.Data, 100)
+	assert.True(t, seg.Header.IsPSH())
+
+	// The peer acknowledges the data and closes
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1012, iss+1+uint32(len(payload)), nil))
+	assert.Equal(t, uint32(1013), nextSegment(t, sent).Header.AckNum)
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, io.EOF)
+
+	conn.mu.Lock()
+	assert.Equal(t, TCP_STATE_CLOSE_WAIT, conn.State)
+	assert.Empty(t, conn.sendBuf)
+	conn.mu.Unlock()
+}
+
+// ===========================================================================
+// Test TCP Retransmission
+// ===========================================================================
+
+func Test_TCP_RTO(t *testing.T) {
+	tcp := NewTCP()
+	tcb := tcp.newTCB("conn1")
+
+	// The first sample sets the variation to half of it
+	tcb.sampleRTT(2 * time.Second)
+	assert.Equal(t, 2*time.Second, tcb.SRTT)
+	assert.Equal(t, time.Second, tcb.RTTVAR)
+	assert.Equal(t, 6*time.Second, tcb.RTO)
+
+	tcb.sampleRTT(time.Second)
+	assert.Equal(t, 1875*time.Millisecond, tcb.SRTT)
+	assert.Equal(t, time.Second, tcb.RTTVAR)
+	assert.Equal(t, 5875*time.Millisecond, tcb.RTO)
+
+	// The RTO stays within its bounds
+	tcb.sampleRTT(time.Hour)
+	assert.Equal(t, DefaultRetransmitConfig.MaxRTO, tcb.RTO)
+
+	tcb = tcp.newTCB("conn2")
+	tcb.sampleRTT(time.Millisecond)
+	assert.Equal(t, DefaultRetransmitConfig.MinRTO, tcb.RTO)
+}
+
+func Test_TCP_Retransmit(t *testing.T) {
+	tcp, sent := newTestTCP()
+	tcp.Retransmit = RetransmitConfig{
+		InitialRTO:    20 * time.Millisecond,
+		MinRTO:        20 * time.Millisecond,
+		MaxRTO:        time.Second,
+		MaxSynRetries: 2,
+		MaxRetries:    2,
+	}
+
+	// A SYN without an answer is sent again with the timer backed off,
+	// until the connection times out
+	srcAddr := netstack.SockAddr{IP: serverIP, Port: 40000}
+	dstAddr := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 80}
+
+	tcb, err := tcp.OpenConnection(srcAddr, dstAddr, nil, nil)
+	assert.NoError(t, err)
+
+	syn := nextSegment(t, sent).Header
+	assert.True(t, syn.IsSYN())
+
+	for i := 0; i < 2; i++ {
+		retransmitted := nextSegment(t, sent).Header
+		assert.True(t, retransmitted.IsSYN())
+		assert.Equal(t, syn.SeqNum, retransmitted.SeqNum)
+	}
+
+	_, err = tcb.Read()
+	assert.ErrorIs(t, err, ErrConnectionTimeout)
+	assert.Equal(t, 80*time.Millisecond, tcb.RTO)
+	assert.Len(t, tcp.ConnTable, 0)
+
+	// Lost data is sent again, and the ACK of the retransmission
+	// stops the timer without giving an RTT sample
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40001)
+
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err)
+
+	seg := nextSegment(t, sent)
+	retransmitted := nextSegment(t, sent)
+	assert.Equal(t, seg.Header.SeqNum, retransmitted.Header.SeqNum)
+	assert.Equal(t, []byte("Hello"), retransmitted.SkBuff.Data)
+
+	conn.mu.Lock()
+	srtt := conn.SRTT
+	conn.mu.Unlock()
+
+	tcp.HandleRx(genRxSegment(40001, 80, TCP_ACK, 1001, seg.Header.SeqNum+5, nil))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, sent, 0)
+
+	conn.mu.Lock()
+	assert.Empty(t, conn.retxQueue)
+	assert.Equal(t, srtt, conn.SRTT)
+	conn.mu.Unlock()
+}
+
+// ===========================================================================
+// Test TCP Options
+// ===========================================================================
+
+func Test_TCP_Options(t *testing.T) {
+	options := TCPOptions{
+		{Kind: TCPOptionKindMSS, MSS: 1460},
+		{Kind: TCPOptionKindWS, WScale: 7},
+		{Kind: TCPOptionKindSACKPermitted},
+		{Kind: TCPOptionKindTimestamps, TSVal: 1, TSEcr: 2},
+		{Kind: TCPOptionKindSACK, Blocks: []SACKBlock{{Left: 100, Right: 200}, {Left: 300, Right: 400}}},
+		{Kind: 30, Data: []byte{0xab, 0xcd}},
+	}
+
+	// 4 + 3 + 2 + 10 + 18 + 4 bytes, padded to 44
+	b := options.Marshal()
+	assert.Len(t, b, 44)
+
+	var decoded TCPOptions
+	assert.NoError(t, decoded.Unmarshal(b))
+	assert.Equal(t, options, decoded)
+
+	// NOPs are skipped, and nothing after the end of the list is read
+	decoded = nil
+	assert.NoError(t, decoded.Unmarshal([]byte{1, 1, 3, 3, 2, 0, 2, 4, 5, 180}))
+	assert.Equal(t, TCPOptions{{Kind: TCPOptionKindWS, WScale: 2}}, decoded)
+
+	// Bad lengths are errors instead of loops or panics
+	for _, bad := range [][]byte{
+		{30, 0},
+		{2},
+		{2, 4, 5},
+		{2, 3, 5},
+		{5, 6, 0, 0, 0, 0},
+	} {
+		decoded = nil
+		assert.ErrorIs(t, decoded.Unmarshal(bad), ErrInvalidTCPOptions, "%v", bad)
+	}
+
+	// The header length follows the options
+	header := TCPHeader{SrcPort: 80, DstPort: 40000}
+	header.SetOptions(options[:4])
+	assert.Equal(t, uint8(10), header.HeaderLen)
+
+	var decodedHeader TCPHeader
+	assert.NoError(t, decodedHeader.Unmarshal(header.Marshal()))
+	assert.Equal(t, options[:4], decodedHeader.Options)
+
+	b = header.Marshal()
+	b[12] = 15 << 4
+	assert.ErrorIs(t, decodedHeader.Unmarshal(b), ErrInvalidTCPHeader)
+}
+
+func Test_TCP_OptionNegotiation(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	// Without options in the SYN, the SYN-ACK only has the MSS of the interface
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil))
+
+	synAck := nextSegment(t, sent).Header
+	assert.Equal(t, TCPOptions{{Kind: TCPOptionKindMSS, MSS: 1460}}, synAck.Options)
+
+	// A SYN with all options gets them all back
+	syn := TCPHeader{SrcPort: 40001, DstPort: 80, SeqNum: 1000, BitFlags: TCP_SYN, Window: 0xffff}
+	syn.SetOptions(TCPOptions{
+		{Kind: TCPOptionKindMSS, MSS: 1200},
+		{Kind: TCPOptionKindWS, WScale: 7},
+		{Kind: TCPOptionKindSACKPermitted},
+		{Kind: TCPOptionKindTimestamps, TSVal: 100},
+	})
+	tcp.HandleRx(genRxHeader(syn, nil))
+
+	synAck = nextSegment(t, sent).Header
+	assert.Equal(t, uint16(0xffff), synAck.Window)
+
+	_, ok := synAck.Options.Find(TCPOptionKindSACKPermitted)
+	assert.True(t, ok)
+
+	ws, _ := synAck.Options.Find(TCPOptionKindWS)
+	assert.Equal(t, uint8(TCPWindowScale), ws.WScale)
+
+	ts, _ := synAck.Options.Find(TCPOptionKindTimestamps)
+	assert.Equal(t, uint32(100), ts.TSEcr)
+
+	ack := TCPHeader{SrcPort: 40001, DstPort: 80, SeqNum: 1001, AckNum: synAck.SeqNum + 1, BitFlags: TCP_ACK, Window: 1000}
+	ack.SetOptions(TCPOptions{{Kind: TCPOptionKindTimestamps, TSVal: 101, TSEcr: ts.TSVal}})
+	tcp.HandleRx(genRxHeader(ack, nil))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+
+	conn.mu.Lock()
+	assert.Equal(t, uint16(1200), conn.SendMSS)
+	assert.Equal(t, uint32(1000<<7), conn.SendWND)
+	assert.True(t, conn.TSEnabled)
+	assert.True(t, conn.SACKPermitted)
+	assert.Equal(t, uint32(101), conn.TSRecent)
+	conn.mu.Unlock()
+
+	// Data segments carry timestamps, which take room from the MSS,
+	// and a scaled window
+	_, err = conn.Write(make([]byte, 2000))
+	assert.NoError(t, err)
+
+	seg := nextSegment(t, sent)
+	assert.Len(t, seg.SkBuff.Data, 1200-12)
+	assert.Equal(t, uint16(TCPRecvBufferSize>>TCPWindowScale), seg.Header.Window)
+
+	ts, _ = seg.Header.Options.Find(TCPOptionKindTimestamps)
+	assert.Equal(t, uint32(101), ts.TSEcr)
+
+	// A segment with an older timestamp is an old duplicate
+	old := TCPHeader{SrcPort: 40001, DstPort: 80, SeqNum: 1001, AckNum: synAck.SeqNum + 1, BitFlags: TCP_ACK, Window: 1000}
+	old.SetOptions(TCPOptions{{Kind: TCPOptionKindTimestamps, TSVal: 50}})
+	tcp.HandleRx(genRxHeader(old, []byte("old")))
+
+	assert.Equal(t, uint32(1001), nextSegment(t, sent).Header.AckNum)
+
+	conn.mu.Lock()
+	assert.Empty(t, conn.recvBuf)
+	conn.mu.Unlock()
+}
+
+// ===========================================================================
+// Test TCP Sequence Numbers
+// ===========================================================================
+
+func Test_TCP_SeqCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b uint32
+		lt   bool
+	}{
+		{"ordered", 1000, 2000, true},
+		{"reversed", 2000, 1000, false},
+		{"before the wrap", 0xfffffff0, 0xffffffff, true},
+		{"across the wrap", 0xfffffff0, 0x10, true},
+		{"across the wrap reversed", 0x10, 0xfffffff0, false},
+		{"at the wrap", 0xffffffff, 0, true},
+		{"half the space apart", 0, 0x7fffffff, true},
+		{"over half the space apart", 0, 0x80000001, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.lt, seqLT(test.a, test.b))
+			assert.Equal(t, !test.lt, seqGEQ(test.a, test.b))
+			assert.Equal(t, test.lt, seqGT(test.b, test.a))
+			assert.Equal(t, !test.lt, seqLEQ(test.b, test.a))
+		})
+	}
+
+	assert.True(t, seqLEQ(0xffffffff, 0xffffffff))
+	assert.False(t, seqLT(0xffffffff, 0xffffffff))
+
+	// Relative to the ISN, the whole space is ordered
+	assert.True(t, IsLessThan(0xfffffff0, 0xfffffff0, 0x7ffffff0))
+	assert.True(t, IsLessThan(0xfffffff0, 0xffffffff, 0))
+	assert.False(t, IsLessThan(0xfffffff0, 0x10, 0xfffffff5))
+}
+
+func Test_TCP_SeqWraparound(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	// The client's sequence numbers wrap after its first 16 bytes
+	isn := uint32(0xffffffef)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, isn, 0, nil))
+	synAck := nextSegment(t, sent).Header
+	assert.Equal(t, uint32(0xfffffff0), synAck.AckNum)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, isn+1, synAck.SeqNum+1, nil))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+
+	// Segments on both sides of the wrap are put back in order
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, isn+33, synAck.SeqNum+1, []byte("cccccccccccccccc")))
+	assert.Equal(t, uint32(0xfffffff0), nextSegment(t, sent).Header.AckNum)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, isn+17, synAck.SeqNum+1, []byte("bbbbbbbbbbbbbbbb")))
+	assert.Equal(t, uint32(0xfffffff0), nextSegment(t, sent).Header.AckNum)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, isn+1, synAck.SeqNum+1, []byte("aaaaaaaaaaaaaaaa")))
+
+	assert.Equal(t, isn+49, nextSegment(t, sent).Header.AckNum)
+
+	data, err := conn.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbcccccccccccccccc"), data)
+
+	// A retransmission from before the wrap is old data
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, isn+1, synAck.SeqNum+1, []byte("aaaaaaaaaaaaaaaa")))
+	assert.Equal(t, isn+49, nextSegment(t, sent).Header.AckNum)
+
+	conn.mu.Lock()
+	assert.Empty(t, conn.recvBuf)
+	assert.Equal(t, uint32(32), conn.RecvNXT)
+	conn.mu.Unlock()
+}
+
+// ===========================================================================
+// Test TCP Connection Termination
+// ===========================================================================
+
+// state returns the state of the connection
+func state(tcb *TCB) TCPState {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	return tcb.State
+}
+
+// removed tells whether the connection was deleted from the table
+func removed(tcp *TCPProtocol, tcb *TCB) func() bool {
+	return func() bool {
+		tcp.mu.Lock()
+		defer tcp.mu.Unlock()
+
+		_, ok := tcp.ConnTable[tcb.ID]
+
+		return !ok
+	}
+}
+
+func Test_TCP_ActiveClose(t *testing.T) {
+	tcp, sent := newTestTCP()
+	tcp.MSL = 50 * time.Millisecond
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	assert.NoError(t, tcp.CloseConnection(conn.SrcAddr, conn.DstAddr))
+
+	fin := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_FIN|TCP_ACK), fin.BitFlags)
+	assert.Equal(t, TCP_STATE_FIN_WAIT_1, state(conn))
+
+	// The ACK of our FIN
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+2, nil))
+	assert.Eventually(t, func() bool {
+		return state(conn) == TCP_STATE_FIN_WAIT_2
+	}, time.Second, time.Millisecond)
+
+	// The peer's FIN
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1001, iss+2, nil))
+	assert.Equal(t, uint32(1002), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_TIME_WAIT, state(conn))
+
+	// A retransmitted FIN is acknowledged again
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1001, iss+2, nil))
+	assert.Equal(t, uint32(1002), nextSegment(t, sent).Header.AckNum)
+	assert.False(t, removed(tcp, conn)())
+
+	// After 2*MSL the TCB is gone
+	assert.Eventually(t, removed(tcp, conn), time.Second, time.Millisecond)
+	assert.Equal(t, TCP_STATE_CLOSED, state(conn))
+}
+
+func Test_TCP_PassiveClose(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1001, iss+1, nil))
+	assert.Equal(t, uint32(1002), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_CLOSE_WAIT, state(conn))
+
+	// The user's close sends our FIN
+	assert.NoError(t, tcp.CloseConnection(conn.SrcAddr, conn.DstAddr))
+	assert.Equal(t, uint8(TCP_FIN|TCP_ACK), nextSegment(t, sent).Header.BitFlags)
+	assert.Equal(t, TCP_STATE_LAST_ACK, state(conn))
+
+	// Its ACK ends the connection without TIME_WAIT
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1002, iss+2, nil))
+	assert.Eventually(t, removed(tcp, conn), time.Second, time.Millisecond)
+	assert.Equal(t, TCP_STATE_CLOSED, state(conn))
+}
+
+func Test_TCP_SimultaneousClose(t *testing.T) {
+	tcp, sent := newTestTCP()
+	tcp.MSL = 50 * time.Millisecond
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	assert.NoError(t, tcp.CloseConnection(conn.SrcAddr, conn.DstAddr))
+	nextSegment(t, sent)
+
+	// The peer's FIN crosses ours
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_FIN, 1001, iss+1, nil))
+	assert.Equal(t, uint32(1002), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_CLOSING, state(conn))
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1002, iss+2, nil))
+	assert.Eventually(t, func() bool {
+		return state(conn) == TCP_STATE_TIME_WAIT
+	}, time.Second, time.Millisecond)
+
+	assert.Eventually(t, removed(tcp, conn), time.Second, time.Millisecond)
+}
+
+func Test_TCP_SimultaneousOpen(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	local := netstack.SockAddr{IP: serverIP, Port: 5000}
+	remote := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 40000}
+
+	conn, err := tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+
+	// The SYN asks for ECN
+	syn := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_SYN|TCP_ECE|TCP_CWR), syn.BitFlags)
+
+	// The peer's SYN crosses ours, and we go without ECN
+	tcp.HandleRx(genRxSegment(40000, 5000, TCP_SYN, 1000, 0, nil))
+
+	synAck := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_SYN|TCP_ACK), synAck.BitFlags)
+	assert.Equal(t, syn.SeqNum, synAck.SeqNum)
+	assert.Equal(t, uint32(1001), synAck.AckNum)
+	assert.Equal(t, TCP_STATE_SYN_RCVD, state(conn))
+
+	// Its SYN-ACK acknowledges our SYN
+	tcp.HandleRx(genRxSegment(40000, 5000, TCP_SYN|TCP_ACK, 1000, syn.SeqNum+1, nil))
+	assert.Eventually(t, func() bool {
+		return state(conn) == TCP_STATE_ESTABLISHED
+	}, time.Second, time.Millisecond)
+}
+
+func Test_TCP_Reset(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	// A RST in the window, but not at RecvNXT, gets a challenge ACK
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_RST, 1500, 0, nil))
+
+	ack := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_ACK), ack.BitFlags)
+	assert.Equal(t, uint32(1001), ack.AckNum)
+	assert.Equal(t, TCP_STATE_ESTABLISHED, state(conn))
+
+	// So does a SYN
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 5000, 0, nil))
+	assert.Equal(t, uint32(1001), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_ESTABLISHED, state(conn))
+
+	// A RST out of the window is dropped
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_RST, 1000, 0, nil))
+
+	// A RST at RecvNXT resets the connection
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_RST|TCP_ACK, 1001, iss+1, nil))
+	assert.Eventually(t, removed(tcp, conn), time.Second, time.Millisecond)
+
+	_, err = conn.Read()
+	assert.ErrorIs(t, err, ErrConnectionReset)
+	assert.Len(t, sent, 0)
+}
+
+func Test_TCP_ResetSynSent(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	local := netstack.SockAddr{IP: serverIP, Port: 5000}
+	remote := netstack.SockAddr{IP: net.IPv4(10, 88, 45, 1).To4(), Port: 80}
+
+	conn, err := tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+
+	iss := nextSegment(t, sent).Header.SeqNum
+
+	// A RST without an ACK, or with one that doesn't acknowledge
+	// our SYN, is dropped
+	tcp.HandleRx(genRxSegment(80, 5000, TCP_RST, 3000, 0, nil))
+	tcp.HandleRx(genRxSegment(80, 5000, TCP_RST|TCP_ACK, 3000, iss+5, nil))
+
+	// So the handshake still completes
+	tcp.HandleRx(genRxSegment(80, 5000, TCP_SYN|TCP_ACK, 3000, iss+1, nil))
+	assert.Equal(t, uint32(3001), nextSegment(t, sent).Header.AckNum)
+	assert.Equal(t, TCP_STATE_ESTABLISHED, state(conn))
+	assert.Len(t, sent, 0)
+
+	// One that acknowledges the SYN resets the connection
+	local.Port = 5001
+	conn, err = tcp.OpenConnection(local, remote, &fakeIface{}, nil)
+	assert.NoError(t, err)
+
+	iss = nextSegment(t, sent).Header.SeqNum
+
+	tcp.HandleRx(genRxSegment(80, 5001, TCP_RST|TCP_ACK, 0, iss+1, nil))
+	assert.Eventually(t, removed(tcp, conn), time.Second, time.Millisecond)
+	assert.Len(t, sent, 0)
+}
+
+func Test_TCP_Stats(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	nextSegment(t, sent)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1001, iss+6, []byte("world")))
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK, 1106, iss+6, []byte("later")))
+	nextSegment(t, sent)
+
+	assert.Eventually(t, func() bool {
+		return conn.Stats().SegmentsReceived == 3
+	}, time.Second, time.Millisecond)
+
+	stats := conn.Stats()
+	assert.Equal(t, TCP_STATE_ESTABLISHED, stats.State)
+	assert.Equal(t, "ESTABLISHED", stats.State.String())
+	assert.Equal(t, uint16(40000), stats.DstAddr.Port)
+	assert.Equal(t, uint64(5), stats.BytesSent)
+	assert.Equal(t, uint64(5), stats.BytesAcked)
+	assert.Equal(t, uint64(5), stats.BytesReceived)
+	assert.Equal(t, uint64(3), stats.SegmentsSent)
+	assert.Equal(t, 1, stats.OutOfOrder)
+
+	// The listing has the listener and the connection
+	conns := tcp.Connections()
+	assert.Len(t, conns, 2)
+	assert.Equal(t, TCP_STATE_LISTEN, conns[0].State)
+	assert.Equal(t, TCP_STATE_ESTABLISHED, conns[1].State)
+}
+
+func Test_TCP_RxMalformed(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	_, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 1, nil)
+	assert.NoError(t, err)
+
+	// A corrupted SYN is dropped without an answer
+	skb := genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil)
+	skb.Data[4] ^= 0x01
+	tcp.HandleRx(skb)
+
+	// A data offset past the end of the segment
+	skb = genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil)
+	skb.Data[12] = 0xf0
+	tcp.HandleRx(skb)
+
+	// Too short for a header
+	skb = genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil)
+	skb.Data = skb.Data[:12]
+	tcp.HandleRx(skb)
+
+	select {
+	case seg := <-sent:
+		t.Fatalf("unexpected segment %+v", seg.Header)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, RxDrops{BadHeader: 2, BadChecksum: 1}, tcp.RxDrops())
+
+	// An intact one is answered
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_SYN, 1000, 0, nil))
+	assert.Equal(t, uint8(TCP_SYN|TCP_ACK), nextSegment(t, sent).Header.BitFlags)
+}
@@ -0,0 +1,58 @@
+package transportlayer
+
+import (
+	"sync"
+	"time"
+)
+
+// ==============================================================================
+// TCP Timers
+// ==============================================================================
+
+/*
+	The timers of a TCB run their function with the TCB locked. A timer
+	that fires while the TCB is locked waits for the lock, and may find
+	that it was stopped or restarted in the meantime, which Stop can't
+	prevent. So each start and stop bumps a generation counter, and a
+	timer whose generation is no longer current does nothing.
+*/
+
+// tcbTimer is a timer of a TCB. It is guarded by the TCB's lock.
+type tcbTimer struct {
+	timer *time.Timer
+	gen   int
+}
+
+// start runs fn with mu held after d, replacing the timer if it runs.
+// The timer doesn't run anymore when fn is called.
+func (t *tcbTimer) start(mu *sync.Mutex, d time.Duration, fn func()) {
+	t.stop()
+
+	gen := t.gen
+	t.timer = time.AfterFunc(d, func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if gen != t.gen {
+			return
+		}
+
+		t.timer = nil
+		fn()
+	})
+}
+
+// stop stops the timer, including one that fired and waits for the lock
+func (t *tcbTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	t.gen++
+}
+
+// running tells whether the timer is started and hasn't fired yet
+func (t *tcbTimer) running() bool {
+	return t.timer != nil
+}
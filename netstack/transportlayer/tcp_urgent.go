@@ -0,0 +1,193 @@
+package transportlayer
+
+import (
+	"errors"
+)
+
+// ==============================================================================
+// TCP Urgent Data
+// ==============================================================================
+
+/*
+	The urgent pointer marks a point in the stream the receiver should get
+	to quickly, like the interrupt of a telnet session (RFC 9293 3.8.5). We
+	follow the BSD reading of it that every stack uses (RFC 6093): the
+	pointer in a segment is the offset from its sequence number to the byte
+	after the last urgent byte. SendUP and RecvUP hold it as a sequence
+	number.
+
+	A write with MSG_OOB makes its last byte urgent. Every segment sent
+	before SendUP has URG set, including ACKs and window probes, so the
+	peer hears about it even when the data can't be sent yet.
+
+	The receiver keeps a mark where the urgent byte is in the stream. Reads
+	stop at the mark, so the user can find it. Unless the socket has
+	SO_OOBINLINE set, the urgent byte is taken out of the stream and read
+	on its own with MSG_OOB. A later urgent byte replaces one that wasn't
+	read.
+*/
+
+var (
+	ErrNoUrgentData = errors.New("no urgent data")
+	ErrOOBInline    = errors.New("urgent data is read inline")
+)
+
+// urgentFlags sets URG on a segment sent before SendUP, and returns
+// the urgent pointer for it
+func (tcb *TCB) urgentFlags(flags uint8, seq uint32) (uint8, uint16) {
+	if !tcb.urgentSend || flags&TCP_ACK == 0 || flags&(TCP_SYN|TCP_RST) != 0 {
+		return flags, 0
+	}
+
+	// The peer has all of it
+	if seqGEQ(tcb.SendUNA, tcb.SendUP) {
+		tcb.urgentSend = false
+		return flags, 0
+	}
+
+	if !seqGT(tcb.SendUP, seq) {
+		return flags, 0
+	}
+
+	// A pointer too far ahead for the field points as far as it
+	// can, the next segments get closer
+	offset := tcb.SendUP - seq
+	if offset > 0xffff {
+		offset = 0xffff
+	}
+
+	return flags | TCP_URG, uint16(offset)
+}
+
+// urgentPending tells whether urgent data is waiting to be sent,
+// which is sent right away
+func (tcb *TCB) urgentPending() bool {
+	return tcb.urgentSend && seqGT(tcb.SendUP, tcb.SendNXT)
+}
+
+// urgentReceived moves RecvUP forward for a segment in the window with
+// URG set. seq is the sequence number of the segment before it was
+// trimmed to the window.
+func (tcb *TCB) urgentReceived(header *TCPHeader, seq uint32) {
+	if header.BitFlags&TCP_URG == 0 || header.UrgentPtr == 0 || tcb.finReceived {
+		return
+	}
+
+	up := seq + uint32(header.UrgentPtr)
+
+	// Retransmissions and later segments of the same urgent
+	// data carry the same pointer
+	if tcb.urgentRecv && !seqGT(up, tcb.RecvUP) {
+		return
+	}
+
+	// The urgent byte was received already
+	if seqLEQ(up, tcb.RecvNXT) {
+		return
+	}
+
+	tcb.RecvUP = up
+	tcb.urgentRecv = true
+	tcb.urgentWait = true
+}
+
+// urgentData marks the urgent byte in the data of an in-order segment
+// that is about to go in the receive buffer, and takes it out of the
+// stream unless it is read inline. It returns the data to buffer.
+func (tcb *TCB) urgentData(seq uint32, data []byte) []byte {
+	if !tcb.urgentWait {
+		return data
+	}
+
+	if seqLT(tcb.RecvUP-1, seq) || int(tcb.RecvUP-1-seq) >= len(data) {
+		return data
+	}
+
+	i := int(tcb.RecvUP - 1 - seq)
+
+	tcb.urgentWait = false
+
+	if tcb.readShutdown {
+		return data
+	}
+
+	tcb.urgMark = len(tcb.recvBuf) + i
+	tcb.urgMarkValid = true
+
+	if tcb.oobInline {
+		return data
+	}
+
+	tcb.oobByte = data[i]
+	tcb.oobValid = true
+
+	// The byte doesn't wait in the receive buffer
+	tcb.recvQueued--
+
+	return append(data[:i:i], data[i+1:]...)
+}
+
+// urgentRead moves the mark for n bytes the user read
+func (tcb *TCB) urgentRead(n int) {
+	if !tcb.urgMarkValid {
+		return
+	}
+
+	// Reading at the mark reads past it
+	if tcb.urgMark == 0 {
+		tcb.urgMarkValid = false
+		return
+	}
+
+	tcb.urgMark -= n
+}
+
+// readSize is how much of the receive buffer a read returns, the
+// data up to the mark if there is one ahead
+func (tcb *TCB) readSize() int {
+	if tcb.urgMarkValid && tcb.urgMark > 0 && tcb.urgMark < len(tcb.recvBuf) {
+		return tcb.urgMark
+	}
+
+	return len(tcb.recvBuf)
+}
+
+// WriteUrgent writes b like Write, and makes its last byte urgent
+func (tcb *TCB) WriteUrgent(b []byte) (int, error) {
+	return tcb.write(b, true)
+}
+
+// ReadOOB returns the urgent byte taken out of the stream. It doesn't
+// wait, ErrNoUrgentData means there is none, or it hasn't arrived yet.
+func (tcb *TCB) ReadOOB() (byte, error) {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	switch {
+	case tcb.oobInline:
+		return 0, ErrOOBInline
+	case !tcb.oobValid:
+		return 0, ErrNoUrgentData
+	}
+
+	tcb.oobValid = false
+
+	return tcb.oobByte, nil
+}
+
+// AtMark tells whether the next byte to read is where the urgent
+// data was, like SIOCATMARK
+func (tcb *TCB) AtMark() bool {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	return tcb.urgMarkValid && tcb.urgMark == 0
+}
+
+// SetOOBInline leaves urgent bytes received from now on in the stream
+func (tcb *TCB) SetOOBInline(inline bool) {
+	tcb.mu.Lock()
+	defer tcb.mu.Unlock()
+
+	tcb.oobInline = inline
+}
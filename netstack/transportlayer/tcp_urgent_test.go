@@ -0,0 +1,137 @@
+package transportlayer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCP_UrgentSend(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	_, err = conn.Write([]byte("ls"))
+	assert.NoError(t, err)
+
+	seg := nextSegment(t, sent).Header
+	assert.Equal(t, uint8(0), seg.BitFlags&TCP_URG)
+
+	// Urgent data isn't held back by Nagle's algorithm, and the
+	// pointer is past its last byte
+	_, err = conn.WriteUrgent([]byte("ab"))
+	assert.NoError(t, err)
+
+	seg = nextSegment(t, sent).Header
+	assert.Equal(t, iss+3, seg.SeqNum)
+	assert.Equal(t, uint8(TCP_URG), seg.BitFlags&TCP_URG)
+	assert.Equal(t, uint16(2), seg.UrgentPtr)
+
+	// A retransmission of it is urgent too
+	conn.mu.Lock()
+	assert.NoError(t, conn.sendSegment(TCP_ACK, iss+1, conn.sendBuf[:4]))
+	conn.mu.Unlock()
+
+	seg = nextSegment(t, sent).Header
+	assert.Equal(t, uint8(TCP_URG), seg.BitFlags&TCP_URG)
+	assert.Equal(t, uint16(4), seg.UrgentPtr)
+
+	// Once the peer has it, nothing is urgent anymore
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_PSH, 1001, iss+5, []byte("ok")))
+
+	seg = nextSegment(t, sent).Header
+	assert.Equal(t, uint32(1003), seg.AckNum)
+	assert.Equal(t, uint8(0), seg.BitFlags&TCP_URG)
+	assert.Equal(t, uint16(0), seg.UrgentPtr)
+}
+
+func Test_TCP_UrgentReceive(t *testing.T) {
+	tcp, sent := newTestTCP()
+
+	listener, err := tcp.Listen(netstack.SockAddr{IP: net.IPv4zero, Port: 80}, 0, nil)
+	assert.NoError(t, err)
+
+	conn := establish(t, tcp, sent, listener, 40000)
+	iss := conn.SendISN
+
+	urgent := func(seq uint32, ptr uint16, data string) {
+		header := TCPHeader{
+			SrcPort:   40000,
+			DstPort:   80,
+			SeqNum:    seq,
+			AckNum:    iss + 1,
+			HeaderLen: 5,
+			BitFlags:  TCP_ACK | TCP_PSH | TCP_URG,
+			Window:    65535,
+			UrgentPtr: ptr,
+		}
+		tcp.HandleRx(genRxHeader(header, []byte(data)))
+	}
+
+	read := func(expected string) {
+		data, err := conn.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	// The urgent byte is taken out of the stream, and reads stop
+	// where it was
+	urgent(1001, 3, "abc")
+
+	read("ab")
+	assert.True(t, conn.AtMark())
+
+	b, err := conn.ReadOOB()
+	assert.NoError(t, err)
+	assert.Equal(t, byte('c'), b)
+
+	_, err = conn.ReadOOB()
+	assert.ErrorIs(t, err, ErrNoUrgentData)
+
+	tcp.HandleRx(genRxSegment(40000, 80, TCP_ACK|TCP_PSH, 1004, iss+1, []byte("de")))
+
+	read("de")
+	assert.False(t, conn.AtMark())
+
+	// A pointer past the segment marks a byte that comes later
+	urgent(1006, 4, "12")
+
+	read("12")
+
+	_, err = conn.ReadOOB()
+	assert.ErrorIs(t, err, ErrNoUrgentData)
+
+	urgent(1008, 2, "34")
+
+	read("3")
+
+	b, err = conn.ReadOOB()
+	assert.NoError(t, err)
+	assert.Equal(t, byte('4'), b)
+
+	// Inline, the urgent byte stays in the stream, and the
+	// mark is on it
+	conn.SetOOBInline(true)
+
+	urgent(1010, 2, "xyz")
+
+	read("x")
+	assert.True(t, conn.AtMark())
+
+	read("yz")
+	assert.False(t, conn.AtMark())
+
+	_, err = conn.ReadOOB()
+	assert.ErrorIs(t, err, ErrOOBInline)
+
+	// The urgent byte didn't take room in the window for good
+	conn.mu.Lock()
+	assert.Equal(t, uint32(0), conn.recvQueued)
+	conn.mu.Unlock()
+}
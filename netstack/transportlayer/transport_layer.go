@@ -2,6 +2,8 @@ package transportlayer
 
 import (
 	"errors"
+	"net"
+	"sync/atomic"
 
 	"github.com/mattcarp12/matnet/netstack"
 )
@@ -57,3 +59,56 @@ func setSkbType(skb *netstack.SkBuff) error {
 func ConnectionID(localAddr netstack.SockAddr, remoteAddr netstack.SockAddr) string {
 	return localAddr.String() + "-" + remoteAddr.String()
 }
+
+// ==============================================================================
+// Receive Checks
+// ==============================================================================
+
+/*
+	TCP and UDP check a received packet before looking at it any further: the
+	header must fit in the packet, its lengths must agree with the packet's,
+	and the checksum over the packet and a pseudo header of the addresses must
+	be right (RFC 9293 3.1, RFC 768). A packet that fails is dropped without
+	an answer, since any of its fields could be wrong, and counted.
+*/
+
+// RxDrops counts the received packets a protocol dropped as malformed
+type RxDrops struct {
+	BadHeader   uint64 // Too short, or with lengths that don't fit the packet
+	BadChecksum uint64
+}
+
+func (d *RxDrops) load() RxDrops {
+	return RxDrops{
+		BadHeader:   atomic.LoadUint64(&d.BadHeader),
+		BadChecksum: atomic.LoadUint64(&d.BadChecksum),
+	}
+}
+
+// pseudoHeaderIPs returns the addresses of the skb for the pseudo
+// header, in their 4 byte form for IPv4
+func pseudoHeaderIPs(skb *netstack.SkBuff) (net.IP, net.IP) {
+	src, dst := skb.GetSrcIP(), skb.GetDstIP()
+
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		return src4, dst4
+	}
+
+	return src, dst
+}
+
+// checksumValid checks the checksum of a received packet b, the
+// header and the data, for the protocol
+func checksumValid(skb *netstack.SkBuff, protocol uint8, b []byte) bool {
+	srcIP, dstIP := pseudoHeaderIPs(skb)
+
+	// TODO: Handle IPv6
+	ph := TCPPseudoHeader{
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+		Protocol: protocol,
+		Length:   uint16(len(b)),
+	}
+
+	return netstack.Checksum(append(ph.Marshal(), b...)) == 0
+}
@@ -2,7 +2,9 @@ package transportlayer
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
+	"sync/atomic"
 
 	"github.com/mattcarp12/matnet/netstack"
 )
@@ -11,6 +13,14 @@ import (
 // UDP Header
 // =============================================================================
 
+// UDPHeaderSize is the size of the UDP header in bytes
+const UDPHeaderSize = 8
+
+// The protocol number of UDP in the IP header and the pseudo header
+const udpProtocolNumber = 17
+
+var ErrInvalidUDPHeader = errors.New("invalid UDP header")
+
 type UDPHeader struct {
 	SrcPort  uint16
 	DstPort  uint16
@@ -28,11 +38,22 @@ func (h *UDPHeader) Marshal() []byte {
 	return b
 }
 
+// Unmarshal parses the header at the start of the packet b. The
+// length must cover the header, and not go past the end of b.
 func (h *UDPHeader) Unmarshal(b []byte) error {
+	if len(b) < UDPHeaderSize {
+		return ErrInvalidUDPHeader
+	}
+
 	h.SrcPort = binary.BigEndian.Uint16(b[0:2])
 	h.DstPort = binary.BigEndian.Uint16(b[2:4])
 	h.Length = binary.BigEndian.Uint16(b[4:6])
 	h.Checksum = binary.BigEndian.Uint16(b[6:8])
+
+	if int(h.Length) < UDPHeaderSize || int(h.Length) > len(b) {
+		return ErrInvalidUDPHeader
+	}
+
 	return nil
 }
 
@@ -74,6 +95,9 @@ func (ph *UDPPsuedoHeader) Marshal() []byte {
 
 type UDPProtocol struct {
 	netstack.IProtocol
+
+	// Received datagrams dropped as malformed
+	rxDrops RxDrops
 }
 
 func NewUDP() *UDPProtocol {
@@ -91,7 +115,19 @@ func (udp *UDPProtocol) HandleRx(skb *netstack.SkBuff) {
 
 	// Unmarshal the UDP header, handle errors
 	if err := h.Unmarshal(skb.Data); err != nil {
-		skb.Error(err)
+		udp.Log.Printf("HandleRx: %v\n", err)
+		atomic.AddUint64(&udp.rxDrops.BadHeader, 1)
+
+		return
+	}
+
+	// Anything after the datagram isn't part of it
+	skb.Data = skb.Data[:h.Length]
+
+	if !udpChecksumValid(skb, h) {
+		udp.Log.Printf("HandleRx: invalid checksum\n")
+		atomic.AddUint64(&udp.rxDrops.BadChecksum, 1)
+
 		return
 	}
 
@@ -102,12 +138,17 @@ func (udp *UDPProtocol) HandleRx(skb *netstack.SkBuff) {
 	// TODO: Handle fragmentation, possibly reassemble
 
 	// Strip the UDP header from the skb
-	skb.StripBytes(8)
+	skb.StripBytes(UDPHeaderSize)
 
 	// Send to socket layer
 	udp.RxUp(skb)
 }
 
+// RxDrops returns the counts of received datagrams dropped as malformed
+func (udp *UDPProtocol) RxDrops() RxDrops {
+	return udp.rxDrops.load()
+}
+
 func (udp *UDPProtocol) HandleTx(skb *netstack.SkBuff) {
 	udp.Log.Printf("HandleTx -- UDP packet")
 
@@ -139,7 +180,7 @@ func (udp *UDPProtocol) makeUDPHeader(skb *netstack.SkBuff) *UDPHeader {
 	h.SrcPort = skb.GetSrcPort()
 
 	// Set length
-	h.Length = uint16(len(skb.Data) + 8)
+	h.Length = uint16(len(skb.Data) + UDPHeaderSize)
 
 	// Set checksum
 	setUDPChecksum(skb, h)
@@ -153,11 +194,12 @@ func setUDPChecksum(skb *netstack.SkBuff, h *UDPHeader) {
 
 	// Make pseudo header
 	// TODO: Handle IPv6
+	srcIP, dstIP := pseudoHeaderIPs(skb)
 	p := &UDPPsuedoHeader{
-		SrcIP:  skb.GetSrcIP().To4(),
-		DstIP:  skb.GetDstIP().To4(),
+		SrcIP:  srcIP,
+		DstIP:  dstIP,
 		Zero:   0,
-		Proto:  17,
+		Proto:  udpProtocolNumber,
 		Length: h.Length,
 	}
 
@@ -165,6 +207,21 @@ func setUDPChecksum(skb *netstack.SkBuff, h *UDPHeader) {
 	b := append(h.Marshal(), skb.Data...)
 	b = append(p.Marshal(), b...)
 
-	// Calculate checksum
+	// Calculate checksum. A zero checksum means there is none,
+	// so it is sent as all ones, its other form.
 	h.Checksum = netstack.Checksum(b)
+	if h.Checksum == 0 {
+		h.Checksum = 0xffff
+	}
+}
+
+// udpChecksumValid checks the checksum of a received datagram. Over
+// IPv4 the sender may leave it zero, for none, while IPv6 requires one.
+func udpChecksumValid(skb *netstack.SkBuff, h *UDPHeader) bool {
+	if h.Checksum == 0 {
+		srcIP, dstIP := pseudoHeaderIPs(skb)
+		return len(srcIP) == net.IPv4len && len(dstIP) == net.IPv4len
+	}
+
+	return checksumValid(skb, udpProtocolNumber, skb.Data)
 }
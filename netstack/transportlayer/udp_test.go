@@ -0,0 +1,121 @@
+package transportlayer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mattcarp12/matnet/netstack"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestUDP returns a UDP protocol, and the channel of the
+// datagrams it passes up to the socket layer
+func newTestUDP() (*UDPProtocol, chan *netstack.SkBuff) {
+	udp := NewUDP()
+
+	transportLayer := netstack.NewLayer(udp)
+	socketLayer := netstack.NewLayer()
+	transportLayer.SetNextLayer(socketLayer)
+	udp.SetLayer(transportLayer)
+
+	return udp, socketLayer.RxChan()
+}
+
+// genRxDatagram makes a datagram from 10.88.45.1 to the server
+func genRxDatagram(srcPort, dstPort uint16, data []byte) *netstack.SkBuff {
+	skb := netstack.NewSkBuff(data)
+	skb.SetSrcIP(net.IPv4(10, 88, 45, 1).To4())
+	skb.SetDstIP(serverIP)
+	skb.SetSrcPort(srcPort)
+	skb.SetDstPort(dstPort)
+
+	h := (&UDPProtocol{}).makeUDPHeader(skb)
+	skb.PrependBytes(h.Marshal())
+
+	return skb
+}
+
+// receive passes the skb to the UDP protocol, and returns what it
+// passed up, or nil if it dropped the skb
+func receive(udp *UDPProtocol, up chan *netstack.SkBuff, skb *netstack.SkBuff) *netstack.SkBuff {
+	go udp.HandleRx(skb)
+
+	select {
+	case skb := <-up:
+		return skb
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func Test_UDP_Header_Invalid(t *testing.T) {
+	b := (&UDPHeader{SrcPort: 1, DstPort: 2, Length: 8}).Marshal()
+
+	assert.NoError(t, (&UDPHeader{}).Unmarshal(b))
+	assert.ErrorIs(t, (&UDPHeader{}).Unmarshal(b[:7]), ErrInvalidUDPHeader)
+
+	// The length must cover the header and fit in the packet
+	binary.BigEndian.PutUint16(b[4:6], 7)
+	assert.ErrorIs(t, (&UDPHeader{}).Unmarshal(b), ErrInvalidUDPHeader)
+
+	binary.BigEndian.PutUint16(b[4:6], 9)
+	assert.ErrorIs(t, (&UDPHeader{}).Unmarshal(b), ErrInvalidUDPHeader)
+}
+
+func Test_UDP_RxChecksum(t *testing.T) {
+	udp, up := newTestUDP()
+
+	skb := receive(udp, up, genRxDatagram(5000, 53, []byte("hello")))
+	if assert.NotNil(t, skb) {
+		assert.Equal(t, []byte("hello"), skb.Data)
+		assert.Equal(t, uint16(53), skb.GetDstPort())
+	}
+
+	// Padding after the datagram is cut off
+	skb = genRxDatagram(5000, 53, []byte("hello"))
+	skb.Data = append(skb.Data, 0, 0, 0)
+
+	skb = receive(udp, up, skb)
+	if assert.NotNil(t, skb) {
+		assert.Equal(t, []byte("hello"), skb.Data)
+	}
+
+	// A corrupted datagram is dropped
+	skb = genRxDatagram(5000, 53, []byte("hello"))
+	skb.Data[9] ^= 0x01
+	assert.Nil(t, receive(udp, up, skb))
+
+	// A zero checksum means there is none
+	skb = genRxDatagram(5000, 53, []byte("hello"))
+	skb.Data[9] ^= 0x01
+	skb.Data[6], skb.Data[7] = 0, 0
+	assert.NotNil(t, receive(udp, up, skb))
+
+	// A length longer than the datagram
+	skb = genRxDatagram(5000, 53, []byte("hello"))
+	skb.Data[5] += 1
+	assert.Nil(t, receive(udp, up, skb))
+
+	assert.Equal(t, RxDrops{BadHeader: 1, BadChecksum: 1}, udp.RxDrops())
+}
+
+func Test_UDP_TxZeroChecksum(t *testing.T) {
+	skb := netstack.NewSkBuff(nil)
+	skb.SetSrcIP(net.IPv4(10, 88, 45, 1).To4())
+	skb.SetDstIP(serverIP)
+
+	// Find ports for which the checksum sums to zero, which must be
+	// sent as all ones
+	h := &UDPHeader{SrcPort: 1, Length: UDPHeaderSize}
+	h.DstPort = 0
+	setUDPChecksum(skb, h)
+	h.DstPort = h.Checksum
+	setUDPChecksum(skb, h)
+
+	assert.Equal(t, uint16(0xffff), h.Checksum)
+
+	skb.PrependBytes(h.Marshal())
+	assert.True(t, udpChecksumValid(skb, h))
+}
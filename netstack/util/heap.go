@@ -71,6 +71,11 @@ func (h *Heap[T]) Peek() T {
 	return h.data[0]
 }
 
+// Items returns the elements of the heap, in no particular order
+func (h *Heap[T]) Items() []T {
+	return append([]T(nil), h.data...)
+}
+
 func (h *Heap[T]) Len() int {
 	return len(h.data)
 }
\ No newline at end of file
@@ -107,3 +107,51 @@ func TestUDPRead(t *testing.T) {
 
 	// Check msg received by udp client
 }
+
+func TestUDPReadFrom(t *testing.T) {
+	// A port of its own, TestUDPRead keeps UDPPort bound
+	port := UDPPort + 1
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{
+		IP:   net.ParseIP(netstack.DefaultIPAddr),
+		Port: port,
+	})
+	assert.NoError(t, err)
+
+	defer client.Close()
+
+	sock, err := s.Socket(s.SOCK_DGRAM)
+	assert.NoError(t, err)
+
+	err = s.Bind(sock, s.SockAddr{Port: uint16(port)})
+	assert.NoError(t, err)
+
+	// Each datagram is read on its own, a long one is cut off
+	_, err = client.Write([]byte("Hello"))
+	assert.NoError(t, err)
+
+	_, err = client.Write([]byte("Hello World\n"))
+	assert.NoError(t, err)
+
+	dgram, err := s.ReadFrom(sock, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(dgram.Data))
+	assert.False(t, dgram.Truncated)
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	assert.Equal(t, uint16(clientAddr.Port), dgram.From.Port)
+	assert.NotEmpty(t, dgram.Iface)
+
+	dgram, err = s.ReadFrom(sock, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(dgram.Data))
+	assert.True(t, dgram.Truncated)
+
+	// The sender address is good for a reply
+	err = s.WriteTo(sock, []byte("Hi\n"), 0, s.SockAddr(dgram.From))
+	assert.NoError(t, err)
+
+	if resp := readUDP(client); resp != "Hi\n" {
+		t.Errorf("Expected reply 'Hi', got '%s'", resp)
+	}
+}